@@ -487,10 +487,16 @@ Common env values
   value: {{ .Release.Namespace }}
 - name: ELASTI_RESOLVER_DEPLOYMENT_NAME
   value: {{ include "elasti.fullname" . }}-resolver
+- name: ELASTI_RESOLVER_SERVICE_ACCOUNT_NAME
+  value: {{ include "elasti.fullname" . }}-resolver
 - name: ELASTI_RESOLVER_SERVICE_NAME
   value: {{ include "elasti.fullname" . }}-resolver-service
 - name: ELASTI_RESOLVER_PORT
   value: {{ .Values.elastiResolver.service.port | quote }}
 - name: ELASTI_RESOLVER_PROXY_PORT
   value: {{ .Values.elastiResolver.reverseProxyService.port | quote }}
+- name: ELASTI_RESOLVER_TLS_PASSTHROUGH_PORT
+  value: {{ .Values.elastiResolver.tls.passthroughPort | quote }}
+- name: ELASTI_RESOLVER_TLS_TERMINATION_PORT
+  value: {{ .Values.elastiResolver.tls.terminationPort | quote }}
 {{- end }}
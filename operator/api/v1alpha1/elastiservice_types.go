@@ -19,11 +19,25 @@ package v1alpha1
 import (
 	"encoding/json"
 
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 const (
 	ElastiServiceFinalizer = "elasti.truefoundry.com/finalizer"
+
+	// ConditionServiceSupported tells if the service of the ElastiService can be proxied by the resolver
+	ConditionServiceSupported = "ServiceSupported"
+	// ReasonServiceSupported is the reason when the service is supported
+	ReasonServiceSupported = "Supported"
+	// ReasonUnsupportedServiceType is the reason when the type of the service can't be proxied, like ExternalName
+	ReasonUnsupportedServiceType = "UnsupportedServiceType"
+	// ReasonUnsupportedServiceSpec is the reason when the service has no selector, no ports, ports which are not TCP,
+	// or when the TCP or TLS ports of the ElastiService are not ports of the service
+	ReasonUnsupportedServiceSpec = "UnsupportedServiceSpec"
+	// ReasonResolverPortConflict is the reason when a resolverPort of the TCP ports is a port the resolver already uses,
+	// or is used by an older ElastiService
+	ReasonResolverPortConflict = "ResolverPortConflict"
 )
 
 // EnabledPeriod defines when the scale-to-zero policy is active.
@@ -63,6 +77,188 @@ type ElastiServiceSpec struct {
 	// When omitted, scale-to-zero is always enabled (default behavior).
 	// When specified, scale-down only occurs during the cron schedule window.
 	EnabledPeriod *EnabledPeriod `json:"enabledPeriod,omitempty"`
+	// TCPPorts are the ports of the service which the resolver proxies as raw TCP, instead of HTTP,
+	// like the ports of databases or Redis. Every other port of the service is proxied as HTTP.
+	// +listType=map
+	// +listMapKey=port
+	// +optional
+	TCPPorts []TCPPort `json:"tcpPorts,omitempty"`
+	// TLSPorts are the ports of the service which serve TLS, like HTTPS on port 443.
+	// The resolver finds the service of these connections from the SNI of the client, so a service can have
+	// at most one port per mode.
+	// +listType=map
+	// +listMapKey=port
+	// +optional
+	TLSPorts []TLSPort `json:"tlsPorts,omitempty"`
+	// Resolver configures how the resolver handles the requests of the service, while it is in proxy mode
+	// +optional
+	Resolver *ResolverSpec `json:"resolver,omitempty"`
+}
+
+// ResolverSpec configures how the resolver handles the requests of a service
+type ResolverSpec struct {
+	// RequestBody configures how the resolver keeps request bodies, so queued requests can be replayed
+	// +optional
+	RequestBody *RequestBodySpec `json:"requestBody,omitempty"`
+	// WarmUp configures what the resolver answers while the target is scaled up from zero
+	// +optional
+	WarmUp *WarmUpSpec `json:"warmUp,omitempty"`
+	// Queue limits the requests of the service which wait for the target, on top of the global limits of the resolver
+	// +optional
+	Queue *QueueSpec `json:"queue,omitempty"`
+	// Priority sets the priority of the queued requests of the service, so requests like health checks are served first,
+	// and a full queue sheds the requests with the lowest priority first
+	// +optional
+	Priority *PrioritySpec `json:"priority,omitempty"`
+	// Hosts are the other hosts of the requests for the service, like the hosts of an ingress, which the resolver
+	// maps to the service. The Kubernetes DNS names of the service are always mapped.
+	// +listType=map
+	// +listMapKey=host
+	// +optional
+	Hosts []HostSpec `json:"hosts,omitempty"`
+}
+
+// HostSpec is a host of the requests for a service
+type HostSpec struct {
+	// Host is the host without its port, like api.example.com, or a wildcard like *.example.com
+	// +kubebuilder:validation:MinLength=1
+	Host string `json:"host"`
+	// Port is the port of the service the requests are sent to, it defaults to the port of the request
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=65535
+	// +optional
+	Port int32 `json:"port,omitempty"`
+}
+
+// PrioritySpec sets the priority of the queued requests of a service. The X-Elasti-Priority header of a request
+// takes precedence over the rules, up to MaxHeaderPriority, and the rule with the longest matching path prefix wins.
+type PrioritySpec struct {
+	// Default is the priority of the requests which match no rule
+	// +kubebuilder:validation:Enum=low;normal;high;critical
+	// +kubebuilder:default=normal
+	// +optional
+	Default string `json:"default,omitempty"`
+	// MaxHeaderPriority is the highest priority clients can set with the X-Elasti-Priority header.
+	// The header is ignored when it is not set, so clients can't jump the queue of the service.
+	// +kubebuilder:validation:Enum=low;normal;high;critical
+	// +optional
+	MaxHeaderPriority string `json:"maxHeaderPriority,omitempty"`
+	// Rules set the priority of the requests by their path
+	// +optional
+	Rules []PriorityRule `json:"rules,omitempty"`
+}
+
+// PriorityRule sets the priority of the requests whose path starts with PathPrefix
+type PriorityRule struct {
+	// +kubebuilder:validation:MinLength=1
+	PathPrefix string `json:"pathPrefix"`
+	// +kubebuilder:validation:Enum=low;normal;high;critical
+	Priority string `json:"priority"`
+}
+
+// QueueSpec limits the requests of a service which wait for the target
+type QueueSpec struct {
+	// Depth is the number of requests which wait for a concurrency slot, before new ones are rejected.
+	// It defaults to the SERVICE_QUEUE_SIZE of the resolver.
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	Depth *int32 `json:"depth,omitempty"`
+	// MaxConcurrency is the number of requests which check the target, or are proxied to it, at the same time.
+	// It defaults to the SERVICE_MAX_QUEUE_CONCURRENCY of the resolver.
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	MaxConcurrency *int32 `json:"maxConcurrency,omitempty"`
+}
+
+const (
+	// OversizedBodyReject rejects requests with bodies larger than the limit, with 413 Request Entity Too Large
+	OversizedBodyReject = "reject"
+	// OversizedBodyStream sends bodies larger than the limit once, without keeping them, so the request can't be replayed
+	OversizedBodyStream = "stream"
+)
+
+// RequestBodySpec configures how the resolver keeps request bodies
+type RequestBodySpec struct {
+	// MaxBufferedSize is the largest body the resolver keeps to replay the request, like "10Mi".
+	// It defaults to the MAX_BUFFERED_BODY_SIZE of the resolver.
+	// +optional
+	MaxBufferedSize *resource.Quantity `json:"maxBufferedSize,omitempty"`
+	// OversizedPolicy is what the resolver does with bodies larger than MaxBufferedSize, either "reject" or "stream".
+	// It defaults to the OVERSIZED_BODY_POLICY of the resolver.
+	// +kubebuilder:validation:Enum=reject;stream
+	// +optional
+	OversizedPolicy string `json:"oversizedPolicy,omitempty"`
+}
+
+const (
+	// WarmUpHold holds the requests until the target is ready
+	WarmUpHold = "hold"
+	// WarmUpPage answers browsers with a page which refreshes until the target is ready, and other clients like WarmUpUnavailable
+	WarmUpPage = "page"
+	// WarmUpUnavailable answers with 503 Service Unavailable, with a Retry-After from the cold start time of the target
+	WarmUpUnavailable = "unavailable"
+)
+
+// WarmUpSpec configures what the resolver answers while the target is scaled up from zero
+type WarmUpSpec struct {
+	// Mode is either "hold", "page" or "unavailable". Clients can still be held in the other modes,
+	// by sending the X-Elasti-Hold: true header. It defaults to the WARM_UP_MODE of the resolver.
+	// +kubebuilder:validation:Enum=hold;page;unavailable
+	// +optional
+	Mode string `json:"mode,omitempty"`
+	// Template is the HTML template of the page, from a ConfigMap in the namespace of the ElastiService.
+	// It is a Go html/template, with the .Namespace, .Service and .RetryAfter of the request.
+	// +optional
+	Template *ConfigMapKeyRef `json:"template,omitempty"`
+}
+
+// ConfigMapKeyRef selects a key of a ConfigMap
+type ConfigMapKeyRef struct {
+	Name string `json:"name"`
+	Key  string `json:"key"`
+}
+
+// TCPPort selects a port of the service for the TCP mode of the resolver
+type TCPPort struct {
+	// Port of the service, as in spec.ports[].port of the service
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=65535
+	Port int32 `json:"port"`
+	// ResolverPort is the port the resolver listens on for the connections to this port.
+	// It must be unique across all ElastiServices, and must not be one of the ports the resolver already uses.
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=65535
+	ResolverPort int32 `json:"resolverPort"`
+}
+
+const (
+	// TLSModePassthrough splices the TLS connection to the private service, without decrypting it
+	TLSModePassthrough = "passthrough"
+	// TLSModeTerminate decrypts the TLS connection, and proxies its requests to the private service over HTTPS
+	TLSModeTerminate = "terminate"
+)
+
+// TLSPort selects a port of the service which serves TLS, and how the resolver handles it
+type TLSPort struct {
+	// Port of the service, as in spec.ports[].port of the service
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=65535
+	Port int32 `json:"port"`
+	// Mode is how the resolver handles the TLS connections to this port.
+	// "passthrough" reads the SNI of the ClientHello, and splices the connection to the private service once it is ready.
+	// "terminate" decrypts the connection with the certificate of SecretName, and proxies the requests to the private service over HTTPS,
+	// so they are queued and retried like any HTTP request.
+	// +kubebuilder:validation:Enum=passthrough;terminate
+	// +kubebuilder:default=passthrough
+	Mode string `json:"mode,omitempty"`
+	// SecretName of the kubernetes.io/tls Secret with the certificate of the service, in the namespace of the ElastiService.
+	// It is required for the "terminate" mode.
+	// +optional
+	SecretName string `json:"secretName,omitempty"`
+	// InsecureSkipVerify skips the verification of the certificate of the private service, when the resolver proxies
+	// the requests of the "terminate" mode over HTTPS, like for self-signed certificates
+	// +optional
+	InsecureSkipVerify bool `json:"insecureSkipVerify,omitempty"`
 }
 
 func (es *ElastiServiceSpec) GetScaleTargetRef() ScaleTargetRef {
@@ -101,6 +297,11 @@ type ElastiServiceStatus struct {
 	// "proxy" mode is when the ScaleTargetRef is scaled to 0 replicas.
 	// "serve" mode is when the ScaleTargetRef is scaled to at least 1 replica.
 	Mode string `json:"mode,omitempty"`
+	// Conditions of the ElastiService, like whether its service is supported
+	// +listType=map
+	// +listMapKey=type
+	// +optional
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
 }
 
 //+kubebuilder:object:root=true
@@ -28,6 +28,7 @@ import (
 	"github.com/getsentry/sentry-go"
 	"github.com/truefoundry/elasti/pkg/config"
 	"github.com/truefoundry/elasti/pkg/scaling"
+	"github.com/truefoundry/elasti/pkg/tracing"
 
 	"truefoundry/elasti/operator/internal/elastiserver"
 
@@ -94,6 +95,15 @@ func mainWithError() error {
 
 	var watchNamespace string
 	flag.StringVar(&watchNamespace, "watch-namespace", metav1.NamespaceAll, "Namespace to watch for resources")
+	var resolverSyncWorkers int
+	flag.IntVar(&resolverSyncWorkers, "resolver-sync-workers", controller.DefaultResolverSyncWorkers,
+		"Number of services updated in parallel when the resolver endpoints change")
+	var resolverUnavailableGracePeriod time.Duration
+	flag.DurationVar(&resolverUnavailableGracePeriod, "resolver-unavailable-grace-period", controller.DefaultResolverUnavailableGracePeriod,
+		"Duration the resolver can have no ready endpoints, before services in proxy mode are moved to serve mode")
+	var consistencyCheckInterval time.Duration
+	flag.DurationVar(&consistencyCheckInterval, "consistency-check-interval", controller.DefaultConsistencyCheckInterval,
+		"Interval at which the resources of every ElastiService are checked against the expected state for its mode")
 
 	zapLogger, err := tfLogger.NewLogger("dev", sentryEnabled)
 	if err != nil {
@@ -122,6 +132,20 @@ func mainWithError() error {
 
 	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
 
+	// Spans are sent to the OTLP endpoint of the OTEL_EXPORTER_OTLP_ENDPOINT env, if it is set
+	shutdownTracing, err := tracing.Setup(context.Background(), "elasti-operator")
+	if err != nil {
+		setupLog.Error(err, "unable to set up tracing")
+		return fmt.Errorf("main: %w", err)
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		if err := shutdownTracing(ctx); err != nil {
+			setupLog.Error(err, "unable to flush spans")
+		}
+	}()
+
 	// if the enable-http2 flag is false (the default), http/2 should be disabled
 	// due to its vulnerabilities. More specifically, disabling http/2 will
 	// prevent from being vulnerable to the HTTP/2 Stream Cancellation and
@@ -173,11 +197,15 @@ func mainWithError() error {
 
 	// Set up the ElastiService controller
 	reconciler := &controller.ElastiServiceReconciler{
-		Client:          mgr.GetClient(),
-		Scheme:          mgr.GetScheme(),
-		Logger:          zapLogger,
-		InformerManager: informerManager,
-		ScaleHandler:    scaleHandler,
+		Client:                         mgr.GetClient(),
+		Scheme:                         mgr.GetScheme(),
+		Logger:                         zapLogger,
+		InformerManager:                informerManager,
+		ScaleHandler:                   scaleHandler,
+		ResolverSyncWorkers:            resolverSyncWorkers,
+		ResolverUnavailableGracePeriod: resolverUnavailableGracePeriod,
+		ConsistencyCheckInterval:       consistencyCheckInterval,
+		APIReader:                      mgr.GetAPIReader(),
 	}
 
 	if err = reconciler.SetupWithManager(mgr, watchNamespace); err != nil {
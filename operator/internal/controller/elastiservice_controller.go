@@ -17,12 +17,16 @@ import (
 	"k8s.io/apimachinery/pkg/api/errors"
 	kRuntime "k8s.io/apimachinery/pkg/runtime"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
 	"sigs.k8s.io/controller-runtime/pkg/predicate"
 
 	"truefoundry/elasti/operator/api/v1alpha1"
 
 	"go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
@@ -37,6 +41,15 @@ type (
 		ScaleHandler       *scaling.ScaleHandler
 		InformerStartLocks sync.Map
 		ReconcileLocks     sync.Map
+		// ResolverSyncWorkers is the number of services updated in parallel when the resolver endpoints change
+		ResolverSyncWorkers int
+		// ResolverUnavailableGracePeriod is how long the resolver can be unavailable before services are moved to serve mode
+		ResolverUnavailableGracePeriod time.Duration
+		resolverFallback               resolverFallback
+		// ConsistencyCheckInterval is how often the resources of every ElastiService are checked for drift
+		ConsistencyCheckInterval time.Duration
+		// APIReader reads directly from the API server, bypassing the cache
+		APIReader client.Reader
 	}
 )
 
@@ -97,6 +110,21 @@ func (r *ElastiServiceReconciler) Reconcile(ctx context.Context, req ctrl.Reques
 	}
 	r.Logger.Info("Finalizer added to CRD", zap.String("es", req.String()))
 
+	// Services we can't proxy are not watched or moved to proxy mode, and are validated again on the next requeue
+	if supported, err := r.checkPublicServiceSupported(ctx, es); err != nil {
+		r.Logger.Error("Failed to validate public service", zap.String("es", req.String()), zap.Error(err))
+		return res, err
+	} else if !supported {
+		r.Logger.Warn("Public service is not supported", zap.String("es", req.String()), zap.String("service", es.Spec.Service))
+		return ctrl.Result{RequeueAfter: r.consistencyCheckInterval()}, nil
+	}
+
+	// The resolver can only read the Secrets and ConfigMaps the ElastiService refers to
+	if err := r.syncResolverAccess(ctx, es); err != nil {
+		r.Logger.Error("Failed to sync resolver access", zap.String("es", req.String()), zap.Error(err))
+		return res, err
+	}
+
 	// Add watch for public service, so when the public service is modified, we can update the private service
 	if err := r.watchScaleTargetRef(ctx, es, req); err != nil {
 		r.Logger.Error("Failed to add watch for ScaleTargetRef", zap.String("es", req.String()), zap.Any("scaleTargetRef", es.Spec.ScaleTargetRef), zap.Error(err))
@@ -113,22 +141,31 @@ func (r *ElastiServiceReconciler) Reconcile(ctx context.Context, req ctrl.Reques
 		Status:  es.Status,
 	})
 	r.Logger.Info("CRD added to service directory", zap.String("es", req.String()), zap.String("service", es.Spec.Service))
+
+	// Re-create or remove the private service and EndpointSlice to resolver, if they drifted from the current mode
+	if err := r.checkConsistency(ctx, req.NamespacedName); err != nil {
+		r.Logger.Error("Failed to check consistency", zap.String("es", req.String()), zap.Error(err))
+		return res, err
+	}
 	return res, nil
 }
 
 func (r *ElastiServiceReconciler) SetupWithManager(mgr ctrl.Manager, watchNamespace string) error {
+	inWatchNamespace := predicate.NewPredicateFuncs(func(obj client.Object) bool {
+		return watchNamespace == metav1.NamespaceAll || obj.GetNamespace() == watchNamespace
+	})
+	// We only reconcile on deletion of the owned resources, so they are re-created right away.
+	// Any other drift is caught by the consistency checker, to avoid a reconcile on every EndpointSlice update.
+	ownedDeleted := predicate.Funcs{
+		CreateFunc:  func(event.CreateEvent) bool { return false },
+		UpdateFunc:  func(event.UpdateEvent) bool { return false },
+		DeleteFunc:  func(event.DeleteEvent) bool { return true },
+		GenericFunc: func(event.GenericEvent) bool { return false },
+	}
 	err := ctrl.NewControllerManagedBy(mgr).
-		For(&v1alpha1.ElastiService{}).
-		WithEventFilter(predicate.NewPredicateFuncs(func(obj client.Object) bool {
-			es, ok := obj.(*v1alpha1.ElastiService)
-			if !ok {
-				return false
-			}
-			if watchNamespace == metav1.NamespaceAll || es.Namespace == watchNamespace {
-				return true
-			}
-			return false
-		})).
+		For(&v1alpha1.ElastiService{}, builder.WithPredicates(inWatchNamespace)).
+		Owns(&corev1.Service{}, builder.WithPredicates(inWatchNamespace, ownedDeleted)).
+		Owns(&discoveryv1.EndpointSlice{}, builder.WithPredicates(inWatchNamespace, ownedDeleted)).
 		Complete(r)
 	if err != nil {
 		return fmt.Errorf("SetupWithManager: %w", err)
@@ -148,7 +185,13 @@ func (r *ElastiServiceReconciler) Initialize(ctx context.Context, watchNamespace
 	if err := r.InformerManager.InitializeResolverInformer(r.getResolverChangeHandler(ctx)); err != nil {
 		return fmt.Errorf("failed to initialize resolver informer: %w", err)
 	}
+	// The informer only calls the handler for existing EndpointSlices, so we also check the
+	// resolver once here, to catch the case where the resolver has no EndpointSlices at all.
+	if err := r.syncResolverEndpoints(ctx); err != nil {
+		r.Logger.Warn("Failed to sync resolver endpoints on initialization", zap.Error(err))
+	}
 	r.ScaleHandler.StartScaleDownWatcher(ctx)
+	r.StartConsistencyChecker(ctx, watchNamespace)
 	return nil
 }
 
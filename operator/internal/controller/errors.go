@@ -3,3 +3,9 @@ package controller
 import "errors"
 
 var ErrNoResolverPodFound = errors.New("no Resolver pod found")
+
+// ErrUnsupportedService is returned when the public service can't be proxied by the resolver
+var ErrUnsupportedService = errors.New("unsupported service")
+
+// ErrResolverSyncFailed is returned when the EndpointSlice to resolver of some services couldn't be updated
+var ErrResolverSyncFailed = errors.New("failed to sync resolver endpoints")
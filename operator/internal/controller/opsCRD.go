@@ -12,6 +12,9 @@ import (
 	"github.com/truefoundry/elasti/pkg/k8shelper"
 	"github.com/truefoundry/elasti/pkg/values"
 	"go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/types"
@@ -61,6 +64,59 @@ func (r *ElastiServiceReconciler) updateCRDStatus(ctx context.Context, crdNamesp
 	return nil
 }
 
+// updateServiceSupportedCondition sets the ServiceSupported condition of the ElastiService from the result of validateService.
+// An event is recorded when the service becomes unsupported.
+func (r *ElastiServiceReconciler) updateServiceSupportedCondition(ctx context.Context, crdNamespacedName types.NamespacedName, reason string, validationErr error) error {
+	es := &v1alpha1.ElastiService{}
+	if err := r.Client.Get(ctx, crdNamespacedName, es); err != nil {
+		return fmt.Errorf("failed to get elastiService for condition update: %w", err)
+	}
+	original := es.DeepCopy()
+
+	condition := metav1.Condition{
+		Type:               v1alpha1.ConditionServiceSupported,
+		Status:             metav1.ConditionTrue,
+		Reason:             reason,
+		Message:            "Service can be proxied by the resolver",
+		ObservedGeneration: es.Generation,
+	}
+	if validationErr != nil {
+		condition.Status = metav1.ConditionFalse
+		condition.Message = validationErr.Error()
+	}
+	if !meta.SetStatusCondition(&es.Status.Conditions, condition) {
+		return nil
+	}
+	if err := r.Status().Patch(ctx, es, client.MergeFrom(original)); err != nil {
+		return fmt.Errorf("failed to patch condition: %w", err)
+	}
+
+	if validationErr != nil && r.ScaleHandler != nil && r.ScaleHandler.EventRecorder != nil {
+		r.ScaleHandler.EventRecorder.Event(es, corev1.EventTypeWarning, reason, validationErr.Error())
+	}
+	return nil
+}
+
+// checkPublicServiceSupported validates the public service, and reports the result in the ServiceSupported condition.
+// A missing public service is not reported, as it might be created after the ElastiService.
+func (r *ElastiServiceReconciler) checkPublicServiceSupported(ctx context.Context, es *v1alpha1.ElastiService) (bool, error) {
+	publicSVC := &corev1.Service{}
+	if err := r.Get(ctx, types.NamespacedName{Name: es.Spec.Service, Namespace: es.Namespace}, publicSVC); err != nil {
+		if errors.IsNotFound(err) {
+			return true, nil
+		}
+		return false, fmt.Errorf("failed to get public service: %w", err)
+	}
+	reason, validationErr, err := r.validateService(ctx, publicSVC, es)
+	if err != nil {
+		return false, err
+	}
+	if err := r.updateServiceSupportedCondition(ctx, types.NamespacedName{Name: es.Name, Namespace: es.Namespace}, reason, validationErr); err != nil {
+		return false, err
+	}
+	return validationErr == nil, nil
+}
+
 func (r *ElastiServiceReconciler) addCRDFinalizer(ctx context.Context, es *v1alpha1.ElastiService) error {
 	// If the CRD does not contain the finalizer, we add the finalizer
 	if !controllerutil.ContainsFinalizer(es, v1alpha1.ElastiServiceFinalizer) {
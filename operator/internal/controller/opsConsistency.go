@@ -0,0 +1,189 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"truefoundry/elasti/operator/api/v1alpha1"
+	"truefoundry/elasti/operator/internal/prom"
+
+	"github.com/truefoundry/elasti/pkg/utils"
+	"github.com/truefoundry/elasti/pkg/values"
+	"go.uber.org/zap"
+	v1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/discovery/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// DefaultConsistencyCheckInterval is how often we compare the resources of every ElastiService with the expected state
+	DefaultConsistencyCheckInterval = 5 * time.Minute
+
+	driftResourcePrivateService = "private-service"
+	driftResourceEndpointSlice  = "endpointslice-to-resolver"
+)
+
+// StartConsistencyChecker periodically checks the resources of every ElastiService against the expected state for its mode.
+// Deletion of the owned resources is caught right away by the controller, this catches every other kind of drift.
+func (r *ElastiServiceReconciler) StartConsistencyChecker(ctx context.Context, watchNamespace string) {
+	ticker := time.NewTicker(r.consistencyCheckInterval())
+
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				ticker.Stop()
+				return
+			case <-ticker.C:
+				if err := r.checkConsistencyForAll(ctx, watchNamespace); err != nil {
+					r.Logger.Error("failed to run the consistency check", zap.Error(err))
+				}
+			}
+		}
+	}()
+}
+
+func (r *ElastiServiceReconciler) consistencyCheckInterval() time.Duration {
+	if r.ConsistencyCheckInterval <= 0 {
+		return DefaultConsistencyCheckInterval
+	}
+	return r.ConsistencyCheckInterval
+}
+
+func (r *ElastiServiceReconciler) checkConsistencyForAll(ctx context.Context, watchNamespace string) error {
+	crdList := &v1alpha1.ElastiServiceList{}
+	if err := r.List(ctx, crdList, client.InNamespace(watchNamespace)); err != nil {
+		return fmt.Errorf("failed to list ElastiServices: %w", err)
+	}
+	for _, es := range crdList.Items {
+		crdNamespacedName := types.NamespacedName{Name: es.Name, Namespace: es.Namespace}
+		if err := r.checkConsistency(ctx, crdNamespacedName); err != nil {
+			r.Logger.Error("Failed to check consistency", zap.String("es", crdNamespacedName.String()), zap.Error(err))
+		}
+	}
+	return nil
+}
+
+// checkConsistency compares the private service and the EndpointSlice to resolver with the expected state
+// for the current mode of the ElastiService, and re-creates or removes them on drift.
+func (r *ElastiServiceReconciler) checkConsistency(ctx context.Context, crdNamespacedName types.NamespacedName) error {
+	// We take the switch mode lock, so we don't act on a mode which is being switched
+	mutex := r.getMutexForSwitchMode(crdNamespacedName.String())
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	// The mode is read from the API server, since the cache might not have the latest status from switchMode yet
+	es := &v1alpha1.ElastiService{}
+	if err := r.apiReader().Get(ctx, crdNamespacedName, es); err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to get ElastiService: %w", err)
+	}
+	if !es.ObjectMeta.DeletionTimestamp.IsZero() {
+		return nil
+	}
+
+	switch es.Status.Mode {
+	case values.ProxyMode:
+		return r.checkProxyModeConsistency(ctx, es)
+	case values.ServeMode:
+		return r.checkServeModeConsistency(ctx, es)
+	default:
+		return nil
+	}
+}
+
+// checkProxyModeConsistency makes sure the private service and the EndpointSlice to resolver exist, and are in sync
+func (r *ElastiServiceReconciler) checkProxyModeConsistency(ctx context.Context, es *v1alpha1.ElastiService) (err error) {
+	publicSVC := &v1.Service{}
+	if err := r.Get(ctx, types.NamespacedName{Name: es.Spec.Service, Namespace: es.Namespace}, publicSVC); err != nil {
+		return fmt.Errorf("failed to get public service: %w", err)
+	}
+	if _, validationErr, err := r.validateService(ctx, publicSVC, es); err != nil {
+		return err
+	} else if validationErr != nil {
+		return validationErr
+	}
+
+	privateSVCNamespacedName := types.NamespacedName{Name: utils.GetPrivateServiceName(es.Spec.Service), Namespace: es.Namespace}
+	if found, err := r.exists(ctx, privateSVCNamespacedName, &v1.Service{}); err != nil {
+		return err
+	} else if !found {
+		r.Logger.Warn("Private service missing in proxy mode, re-creating it", zap.String("es", es.Namespace+"/"+es.Name), zap.String("private-service", privateSVCNamespacedName.String()))
+		_, err := r.checkAndCreatePrivateService(ctx, publicSVC, es)
+		r.recordDrift(es, driftResourcePrivateService, err)
+		if err != nil {
+			return fmt.Errorf("failed to re-create private service: %w", err)
+		}
+	} else if err := r.updatePrivateService(ctx, publicSVC, es); err != nil {
+		return fmt.Errorf("failed to sync private service: %w", err)
+	}
+
+	sliceNamespacedName := types.NamespacedName{Name: utils.GetEndpointSliceToResolverName(es.Spec.Service), Namespace: es.Namespace}
+	found, err := r.exists(ctx, sliceNamespacedName, &networkingv1.EndpointSlice{})
+	if err != nil {
+		return err
+	}
+	// Apply is a no-op if the EndpointSlice is already up to date, so it also reverts any change made to it
+	err = r.createOrUpdateEndpointsliceToResolver(ctx, publicSVC, es)
+	if errors.Is(err, ErrNoResolverPodFound) {
+		// The resolver fallback takes care of the services while the resolver is unavailable
+		r.Logger.Warn("No resolver pod found, skipping EndpointSlice to resolver check", zap.String("es", es.Namespace+"/"+es.Name))
+		return nil
+	}
+	if !found {
+		r.Logger.Warn("EndpointSlice to resolver missing in proxy mode, re-created it", zap.String("es", es.Namespace+"/"+es.Name), zap.String("endpointslice", sliceNamespacedName.String()))
+		r.recordDrift(es, driftResourceEndpointSlice, err)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to apply EndpointSlice to resolver: %w", err)
+	}
+	return nil
+}
+
+// checkServeModeConsistency makes sure the EndpointSlice to resolver doesn't exist, so the traffic goes to the target
+func (r *ElastiServiceReconciler) checkServeModeConsistency(ctx context.Context, es *v1alpha1.ElastiService) error {
+	sliceNamespacedName := types.NamespacedName{Name: utils.GetEndpointSliceToResolverName(es.Spec.Service), Namespace: es.Namespace}
+	found, err := r.exists(ctx, sliceNamespacedName, &networkingv1.EndpointSlice{})
+	if err != nil {
+		return err
+	} else if !found {
+		return nil
+	}
+
+	r.Logger.Warn("EndpointSlice to resolver found in serve mode, deleting it", zap.String("es", es.Namespace+"/"+es.Name), zap.String("endpointslice", sliceNamespacedName.String()))
+	err = r.deleteEndpointsliceToResolver(ctx, types.NamespacedName{Name: es.Spec.Service, Namespace: es.Namespace})
+	r.recordDrift(es, driftResourceEndpointSlice, err)
+	if err != nil {
+		return fmt.Errorf("failed to delete EndpointSlice to resolver: %w", err)
+	}
+	return nil
+}
+
+// exists returns true if the object exists
+func (r *ElastiServiceReconciler) exists(ctx context.Context, namespacedName types.NamespacedName, obj client.Object) (bool, error) {
+	if err := r.Get(ctx, namespacedName, obj); err != nil {
+		if apierrors.IsNotFound(err) {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to get %s: %w", namespacedName.String(), err)
+	}
+	return true, nil
+}
+
+func (r *ElastiServiceReconciler) recordDrift(es *v1alpha1.ElastiService, resource string, err error) {
+	prom.DriftCounter.WithLabelValues(es.Namespace+"/"+es.Name, es.Status.Mode, resource, errorReason(err)).Inc()
+}
+
+// apiReader returns a reader which reads from the API server directly, falling back to the cached client
+func (r *ElastiServiceReconciler) apiReader() client.Reader {
+	if r.APIReader != nil {
+		return r.APIReader
+	}
+	return r.Client
+}
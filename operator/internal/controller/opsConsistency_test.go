@@ -0,0 +1,107 @@
+package controller
+
+import (
+	"context"
+	"testing"
+
+	"truefoundry/elasti/operator/internal/prom"
+
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/truefoundry/elasti/pkg/utils"
+	"github.com/truefoundry/elasti/pkg/values"
+	v1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/discovery/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+var (
+	privateServiceName  = types.NamespacedName{Name: utils.GetPrivateServiceName("target"), Namespace: testNamespace}
+	sliceToResolverName = types.NamespacedName{Name: utils.GetEndpointSliceToResolverName("target"), Namespace: testNamespace}
+)
+
+func TestCheckProxyModeConsistency(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+	es := newTestElastiService(values.ProxyMode)
+	r := newTestReconciler(t, es, newTestService(), newTestResolverSlice(true))
+	privateServiceDrift := prom.DriftCounter.WithLabelValues("default/target-es", values.ProxyMode, driftResourcePrivateService, values.Success)
+	sliceDrift := prom.DriftCounter.WithLabelValues("default/target-es", values.ProxyMode, driftResourceEndpointSlice, values.Success)
+	privateServiceDrifts, sliceDrifts := testutil.ToFloat64(privateServiceDrift), testutil.ToFloat64(sliceDrift)
+
+	// The missing private service and EndpointSlice to resolver are re-created
+	g.Expect(r.checkProxyModeConsistency(ctx, es)).To(Succeed())
+	privateSVC := &v1.Service{}
+	g.Expect(r.Get(ctx, privateServiceName, privateSVC)).To(Succeed())
+	g.Expect(privateSVC.Spec.Selector).To(Equal(map[string]string{"app": "target"}))
+	g.Expect(privateSVC.Labels).To(HaveKeyWithValue(values.PrivateServiceLabel, "true"))
+	sliceToResolver := &networkingv1.EndpointSlice{}
+	g.Expect(r.Get(ctx, sliceToResolverName, sliceToResolver)).To(Succeed())
+	g.Expect(sliceToResolver.Endpoints).To(HaveLen(1))
+	g.Expect(sliceToResolver.Endpoints[0].Addresses).To(Equal([]string{"10.0.0.1"}))
+	g.Expect(testutil.ToFloat64(privateServiceDrift)).To(Equal(privateServiceDrifts + 1))
+	g.Expect(testutil.ToFloat64(sliceDrift)).To(Equal(sliceDrifts + 1))
+
+	// Changes to the EndpointSlice to resolver are reverted, without counting a drift, since it still exists
+	sliceToResolver.Endpoints[0].Addresses = []string{"10.0.0.99"}
+	g.Expect(r.Update(ctx, sliceToResolver)).To(Succeed())
+	g.Expect(r.checkProxyModeConsistency(ctx, es)).To(Succeed())
+	g.Expect(r.Get(ctx, sliceToResolverName, sliceToResolver)).To(Succeed())
+	g.Expect(sliceToResolver.Endpoints[0].Addresses).To(Equal([]string{"10.0.0.1"}))
+	g.Expect(testutil.ToFloat64(sliceDrift)).To(Equal(sliceDrifts + 1))
+}
+
+func TestCheckProxyModeConsistencyWithoutResolver(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+	es := newTestElastiService(values.ProxyMode)
+	r := newTestReconciler(t, es, newTestService())
+
+	// The private service is still re-created, the resolver fallback takes care of the EndpointSlice
+	g.Expect(r.checkProxyModeConsistency(ctx, es)).To(Succeed())
+	g.Expect(r.Get(ctx, privateServiceName, &v1.Service{})).To(Succeed())
+	err := r.Get(ctx, sliceToResolverName, &networkingv1.EndpointSlice{})
+	g.Expect(apierrors.IsNotFound(err)).To(BeTrue())
+}
+
+func TestCheckProxyModeConsistencyUnsupportedService(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+	es := newTestElastiService(values.ProxyMode)
+	service := newTestService()
+	service.Spec.Selector = nil
+	r := newTestReconciler(t, es, service, newTestResolverSlice(true))
+
+	g.Expect(r.checkProxyModeConsistency(ctx, es)).To(MatchError(ErrUnsupportedService))
+	err := r.Get(ctx, privateServiceName, &v1.Service{})
+	g.Expect(apierrors.IsNotFound(err)).To(BeTrue())
+}
+
+func TestCheckServeModeConsistency(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+	es := newTestElastiService(values.ServeMode)
+	sliceToResolver := &networkingv1.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      sliceToResolverName.Name,
+			Namespace: testNamespace,
+			Labels:    map[string]string{networkingv1.LabelServiceName: "target", values.ResolverSliceLabel: "true"},
+		},
+		AddressType: networkingv1.AddressTypeIPv4,
+	}
+	r := newTestReconciler(t, es, newTestService(), sliceToResolver)
+	sliceDrift := prom.DriftCounter.WithLabelValues("default/target-es", values.ServeMode, driftResourceEndpointSlice, values.Success)
+	sliceDrifts := testutil.ToFloat64(sliceDrift)
+
+	// The EndpointSlice to resolver left in serve mode is deleted, so the traffic goes to the target
+	g.Expect(r.checkServeModeConsistency(ctx, es)).To(Succeed())
+	err := r.Get(ctx, sliceToResolverName, &networkingv1.EndpointSlice{})
+	g.Expect(apierrors.IsNotFound(err)).To(BeTrue())
+	g.Expect(testutil.ToFloat64(sliceDrift)).To(Equal(sliceDrifts + 1))
+
+	// Nothing is done once it is gone
+	g.Expect(r.checkServeModeConsistency(ctx, es)).To(Succeed())
+	g.Expect(testutil.ToFloat64(sliceDrift)).To(Equal(sliceDrifts + 1))
+}
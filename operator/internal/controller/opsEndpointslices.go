@@ -3,37 +3,131 @@ package controller
 import (
 	"context"
 	"fmt"
+	"sort"
 
 	"github.com/truefoundry/elasti/pkg/config"
 	"github.com/truefoundry/elasti/pkg/utils"
+	"github.com/truefoundry/elasti/pkg/values"
 	"go.uber.org/zap"
 	v1 "k8s.io/api/core/v1"
 	networkingv1 "k8s.io/api/discovery/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/utils/ptr"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	"truefoundry/elasti/operator/api/v1alpha1"
 )
 
-func (r *ElastiServiceReconciler) getIPsForResolver(ctx context.Context) ([]string, error) {
+// getResolverEndpoints returns the endpoints of the resolver, along with their ready, serving and terminating conditions.
+// These are mirrored in every EndpointSlice we point to the resolver, so clients see the same readiness as the resolver service.
+func (r *ElastiServiceReconciler) getResolverEndpoints(ctx context.Context) ([]networkingv1.Endpoint, error) {
 	resolverSlices := &networkingv1.EndpointSliceList{}
 	if err := r.List(ctx, resolverSlices, client.MatchingLabels{
-		"kubernetes.io/service-name": config.GetResolverConfig().ServiceName,
+		networkingv1.LabelServiceName: config.GetResolverConfig().ServiceName,
 	}); err != nil {
 		r.Logger.Error("Failed to get Resolver endpoint slices", zap.Error(err))
-		return nil, fmt.Errorf("getIPsForResolver: %w", err)
+		return nil, fmt.Errorf("getResolverEndpoints: %w", err)
+	}
+	resolverEndpoints := buildResolverEndpoints(resolverSlices.Items)
+	if len(resolverEndpoints) == 0 {
+		return nil, ErrNoResolverPodFound
 	}
-	var resolverPodIPs []string
-	for _, endpointSlice := range resolverSlices.Items {
+	return resolverEndpoints, nil
+}
+
+// buildResolverEndpoints flattens the resolver slices into a sorted list of endpoints, one per address.
+// The list is sorted so comparing it with an existing slice doesn't report a change when only the order differs.
+func buildResolverEndpoints(resolverSlices []networkingv1.EndpointSlice) []networkingv1.Endpoint {
+	seen := map[string]bool{}
+	var resolverEndpoints []networkingv1.Endpoint
+	for _, endpointSlice := range resolverSlices {
+		// The slice to resolver is IPv4 only, so we skip any other address type
+		if endpointSlice.AddressType != networkingv1.AddressTypeIPv4 {
+			continue
+		}
 		for _, endpoint := range endpointSlice.Endpoints {
-			resolverPodIPs = append(resolverPodIPs, endpoint.Addresses...)
+			for _, address := range endpoint.Addresses {
+				if seen[address] {
+					continue
+				}
+				seen[address] = true
+				resolverEndpoints = append(resolverEndpoints, networkingv1.Endpoint{
+					Addresses:  []string{address},
+					Conditions: *endpoint.Conditions.DeepCopy(),
+				})
+			}
 		}
 	}
-	if len(resolverPodIPs) == 0 {
-		return nil, ErrNoResolverPodFound
+	sort.Slice(resolverEndpoints, func(i, j int) bool {
+		return resolverEndpoints[i].Addresses[0] < resolverEndpoints[j].Addresses[0]
+	})
+	return resolverEndpoints
+}
+
+// podHostnames returns the hostnames of the pods which get their own DNS record behind a headless service, like web-0.web.ns.svc.
+// Only StatefulSet pods have stable hostnames, so we return the ones of the pods created on scale up, for minTargetReplicas.
+func podHostnames(service *v1.Service, es *v1alpha1.ElastiService) []string {
+	if !isHeadless(service) || es.Spec.ScaleTargetRef.Kind != "StatefulSet" {
+		return nil
+	}
+	replicas := max(es.Spec.MinTargetReplicas, 1)
+	hostnames := make([]string, 0, replicas)
+	for ordinal := range replicas {
+		hostnames = append(hostnames, fmt.Sprintf("%s-%d", es.Spec.ScaleTargetRef.Name, ordinal))
+	}
+	return hostnames
+}
+
+// withPodHostnames repeats the resolver endpoints for every pod hostname, so the per-pod DNS records
+// of a headless service also point to the resolver, while the pods are scaled down.
+func withPodHostnames(resolverEndpoints []networkingv1.Endpoint, hostnames []string) []networkingv1.Endpoint {
+	if len(hostnames) == 0 {
+		return resolverEndpoints
+	}
+	endpoints := make([]networkingv1.Endpoint, 0, len(hostnames)*len(resolverEndpoints))
+	for _, hostname := range hostnames {
+		for _, resolverEndpoint := range resolverEndpoints {
+			endpoint := *resolverEndpoint.DeepCopy()
+			endpoint.Hostname = ptr.To(hostname)
+			endpoints = append(endpoints, endpoint)
+		}
+	}
+	return endpoints
+}
+
+// resolverEndpointPorts points every port of the service to the resolver. The TCP ports of the ElastiService
+// go to the port the resolver listens on for them, the TLS ports go to the TLS passthrough or termination port
+// of the resolver, and every other port goes to the reverse proxy.
+func resolverEndpointPorts(service *v1.Service, es *v1alpha1.ElastiService) []networkingv1.EndpointPort {
+	resolverConfig := config.GetResolverConfig()
+	resolverPorts := make(map[int32]int32, len(es.Spec.TCPPorts)+len(es.Spec.TLSPorts))
+	for _, tcpPort := range es.Spec.TCPPorts {
+		resolverPorts[tcpPort.Port] = tcpPort.ResolverPort
+	}
+	for _, tlsPort := range es.Spec.TLSPorts {
+		if tlsPortMode(tlsPort) == v1alpha1.TLSModeTerminate {
+			resolverPorts[tlsPort.Port] = resolverConfig.TLSTerminationPort
+		} else {
+			resolverPorts[tlsPort.Port] = resolverConfig.TLSPassthroughPort
+		}
 	}
-	return resolverPodIPs, nil
+	endpointPorts := make([]networkingv1.EndpointPort, 0, len(service.Spec.Ports))
+	for _, servicePort := range service.Spec.Ports {
+		resolverPort, ok := resolverPorts[servicePort.Port]
+		if !ok {
+			resolverPort = resolverConfig.ReverseProxyPort
+		}
+		endpointPorts = append(endpointPorts, networkingv1.EndpointPort{
+			Name:     ptr.To(servicePort.Name),
+			Protocol: ptr.To(v1.ProtocolTCP),
+			Port:     ptr.To(resolverPort),
+		})
+	}
+	return endpointPorts
 }
 
 func (r *ElastiServiceReconciler) deleteEndpointsliceToResolver(ctx context.Context, serviceNamespacedName types.NamespacedName) error {
@@ -52,13 +146,18 @@ func (r *ElastiServiceReconciler) deleteEndpointsliceToResolver(ctx context.Cont
 	return nil
 }
 
-func (r *ElastiServiceReconciler) createOrUpdateEndpointsliceToResolver(ctx context.Context, service *v1.Service) error {
-	resolverPodIPs, err := r.getIPsForResolver(ctx)
+func (r *ElastiServiceReconciler) createOrUpdateEndpointsliceToResolver(ctx context.Context, service *v1.Service, es *v1alpha1.ElastiService) error {
+	resolverEndpoints, err := r.getResolverEndpoints(ctx)
 	if err != nil {
-		r.Logger.Error("Failed to get IPs for Resolver", zap.String("service", service.Name), zap.Error(err))
+		r.Logger.Error("Failed to get endpoints for Resolver", zap.String("service", service.Name), zap.Error(err))
 		return err
 	}
+	return r.applyEndpointsliceToResolver(ctx, service, es, resolverEndpoints)
+}
 
+// applyEndpointsliceToResolver creates or patches the EndpointSlice of the service, so it points to the given resolver endpoints.
+// The EndpointSlice is owned by the ElastiService, so it is garbage collected with it, and its deletion triggers a reconcile.
+func (r *ElastiServiceReconciler) applyEndpointsliceToResolver(ctx context.Context, service *v1.Service, es *v1alpha1.ElastiService, resolverEndpoints []networkingv1.Endpoint) error {
 	// NOTE: Suggestion is to give it a random name in end, to avoid any conflicts, which is rare, but possible.
 	// In case of random name, we need to store the name in CRD. Right now, we provide a deterministic hashed name.
 	newEndpointsliceToResolverName := utils.GetEndpointSliceToResolverName(service.Name)
@@ -71,7 +170,7 @@ func (r *ElastiServiceReconciler) createOrUpdateEndpointsliceToResolver(ctx cont
 	sliceToResolver := &networkingv1.EndpointSlice{}
 	if err := r.Get(ctx, EndpointsliceNamespacedName, sliceToResolver); err != nil && !errors.IsNotFound(err) {
 		r.Logger.Debug("Error getting a endpoint slice to Resolver", zap.String("endpointslice", EndpointsliceNamespacedName.String()), zap.Error(err))
-		return fmt.Errorf("createOrUpdateEndpointsliceToResolver: %w", err)
+		return fmt.Errorf("applyEndpointsliceToResolver: %w", err)
 	} else if errors.IsNotFound(err) {
 		// TODO: This can be handled better
 		// This is a similar case as seen in resolver informer
@@ -83,44 +182,58 @@ func (r *ElastiServiceReconciler) createOrUpdateEndpointsliceToResolver(ctx cont
 		r.Logger.Debug("EndpointSlice Found", zap.String("endpointslice", EndpointsliceNamespacedName.String()))
 	}
 
-	newEndpointSlice := &networkingv1.EndpointSlice{
-		ObjectMeta: metav1.ObjectMeta{
-			Name:      newEndpointsliceToResolverName,
-			Namespace: service.Namespace,
-			Labels: map[string]string{
-				"kubernetes.io/service-name": service.Name,
-			},
-		},
-		AddressType: networkingv1.AddressTypeIPv4,
-		Ports: []networkingv1.EndpointPort{
-			{
-				Name:     ptr.To(service.Spec.Ports[0].Name),
-				Protocol: ptr.To(v1.ProtocolTCP),
-				// Make this dynamic too
-				Port: ptr.To(config.GetResolverConfig().ReverseProxyPort),
-			},
-		},
+	if len(service.Spec.Ports) == 0 {
+		return fmt.Errorf("applyEndpointsliceToResolver: %w: service has no ports", ErrUnsupportedService)
 	}
+	endpoints := withPodHostnames(resolverEndpoints, podHostnames(service, es))
 
-	// sliceToResolver.DeepCopy()
-
-	for _, ip := range resolverPodIPs {
-		newEndpointSlice.Endpoints = append(newEndpointSlice.Endpoints, networkingv1.Endpoint{
-			Addresses: []string{ip},
-		})
-	}
+	endpointPorts := resolverEndpointPorts(service, es)
 
 	if isResolverSliceFound {
-		if err := r.Update(ctx, newEndpointSlice); err != nil {
-			r.Logger.Error("failed to update sliceToResolver", zap.String("endpointslice", EndpointsliceNamespacedName.String()), zap.Error(err))
-			return fmt.Errorf("createOrUpdateEndpointsliceToResolver: %w", err)
+		// We only patch the fields which changed, so the API server and the watchers of this slice
+		// don't process a full update every time the resolver changes.
+		original := sliceToResolver.DeepCopy()
+		if sliceToResolver.Labels == nil {
+			sliceToResolver.Labels = map[string]string{}
+		}
+		sliceToResolver.Labels[networkingv1.LabelServiceName] = service.Name
+		sliceToResolver.Labels[values.ResolverSliceLabel] = "true"
+		sliceToResolver.Ports = endpointPorts
+		sliceToResolver.Endpoints = endpoints
+		// EndpointSlices created by older versions are not owned by the ElastiService, so we add the reference here
+		if err := controllerutil.SetControllerReference(es, sliceToResolver, r.Scheme); err != nil {
+			r.Logger.Warn("Failed to set ElastiService as owner of EndpointSlice", zap.String("endpointslice", EndpointsliceNamespacedName.String()), zap.Error(err))
+		}
+		if equality.Semantic.DeepEqual(original, sliceToResolver) {
+			r.Logger.Debug("EndpointSlice already up to date", zap.String("endpointslice", EndpointsliceNamespacedName.String()))
+			return nil
+		}
+		if err := r.Patch(ctx, sliceToResolver, client.MergeFrom(original)); err != nil {
+			r.Logger.Error("failed to patch sliceToResolver", zap.String("endpointslice", EndpointsliceNamespacedName.String()), zap.Error(err))
+			return fmt.Errorf("applyEndpointsliceToResolver: %w", err)
 		}
 		r.Logger.Info("EndpointSlice updated successfully", zap.String("endpointslice", EndpointsliceNamespacedName.String()))
 	} else {
-		// TODOS: Make sure the private service is owned by the ElastiService
+		newEndpointSlice := &networkingv1.EndpointSlice{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      newEndpointsliceToResolverName,
+				Namespace: service.Namespace,
+				Labels: map[string]string{
+					networkingv1.LabelServiceName: service.Name,
+					values.ResolverSliceLabel:     "true",
+				},
+			},
+			AddressType: networkingv1.AddressTypeIPv4,
+			Ports:       endpointPorts,
+			Endpoints:   endpoints,
+		}
+		// Make sure the EndpointSlice is owned by the ElastiService
+		if err := controllerutil.SetControllerReference(es, newEndpointSlice, r.Scheme); err != nil {
+			return fmt.Errorf("applyEndpointsliceToResolver: %w", err)
+		}
 		if err := r.Create(ctx, newEndpointSlice); err != nil {
 			r.Logger.Error("failed to create sliceToResolver", zap.String("endpointslice", EndpointsliceNamespacedName.String()), zap.Error(err))
-			return fmt.Errorf("createOrUpdateEndpointsliceToResolver: %w", err)
+			return fmt.Errorf("applyEndpointsliceToResolver: %w", err)
 		}
 		r.Logger.Info("EndpointSlice created successfully", zap.String("endpointslice", EndpointsliceNamespacedName.String()))
 	}
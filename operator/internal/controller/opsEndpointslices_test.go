@@ -0,0 +1,129 @@
+package controller
+
+import (
+	"testing"
+
+	"truefoundry/elasti/operator/api/v1alpha1"
+
+	. "github.com/onsi/gomega"
+	"github.com/truefoundry/elasti/pkg/config"
+	"github.com/truefoundry/elasti/pkg/values"
+	v1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/discovery/v1"
+	"k8s.io/utils/ptr"
+)
+
+func TestBuildResolverEndpoints(t *testing.T) {
+	g := NewWithT(t)
+
+	resolverSlices := []networkingv1.EndpointSlice{
+		{
+			AddressType: networkingv1.AddressTypeIPv4,
+			Endpoints: []networkingv1.Endpoint{
+				{
+					Addresses:  []string{"10.0.0.2"},
+					Conditions: networkingv1.EndpointConditions{Ready: ptr.To(false), Serving: ptr.To(true), Terminating: ptr.To(true)},
+				},
+				{
+					Addresses:  []string{"10.0.0.1", "10.0.0.3"},
+					Conditions: networkingv1.EndpointConditions{Ready: ptr.To(true)},
+				},
+			},
+		},
+		{
+			// The same address can be in more than one slice while the slices are being updated
+			AddressType: networkingv1.AddressTypeIPv4,
+			Endpoints: []networkingv1.Endpoint{
+				{Addresses: []string{"10.0.0.1"}},
+			},
+		},
+		{
+			AddressType: networkingv1.AddressTypeIPv6,
+			Endpoints: []networkingv1.Endpoint{
+				{Addresses: []string{"fd00::1"}},
+			},
+		},
+	}
+
+	g.Expect(buildResolverEndpoints(resolverSlices)).To(Equal([]networkingv1.Endpoint{
+		{Addresses: []string{"10.0.0.1"}, Conditions: networkingv1.EndpointConditions{Ready: ptr.To(true)}},
+		{Addresses: []string{"10.0.0.2"}, Conditions: networkingv1.EndpointConditions{Ready: ptr.To(false), Serving: ptr.To(true), Terminating: ptr.To(true)}},
+		{Addresses: []string{"10.0.0.3"}, Conditions: networkingv1.EndpointConditions{Ready: ptr.To(true)}},
+	}))
+	g.Expect(buildResolverEndpoints(nil)).To(BeEmpty())
+}
+
+func TestBuildResolverEndpointsCopiesConditions(t *testing.T) {
+	g := NewWithT(t)
+
+	resolverSlices := []networkingv1.EndpointSlice{{
+		AddressType: networkingv1.AddressTypeIPv4,
+		Endpoints: []networkingv1.Endpoint{{
+			Addresses:  []string{"10.0.0.1"},
+			Conditions: networkingv1.EndpointConditions{Ready: ptr.To(true)},
+		}},
+	}}
+	endpoints := buildResolverEndpoints(resolverSlices)
+	*resolverSlices[0].Endpoints[0].Conditions.Ready = false
+
+	g.Expect(*endpoints[0].Conditions.Ready).To(BeTrue())
+}
+
+func TestResolverEndpointPorts(t *testing.T) {
+	g := NewWithT(t)
+	setResolverEnv(t)
+	t.Setenv(config.EnvResolverTLSTerminationPort, "9443")
+	service := newTestService()
+	service.Spec.Ports = []v1.ServicePort{
+		{Name: "http", Port: 80},
+		{Name: "postgres", Port: 5432},
+		{Name: "https", Port: 443},
+		{Name: "admin", Port: 8443},
+	}
+	es := newTestElastiService(values.ProxyMode)
+	es.Spec.TCPPorts = []v1alpha1.TCPPort{{Port: 5432, ResolverPort: 15432}}
+	es.Spec.TLSPorts = []v1alpha1.TLSPort{{Port: 443}, {Port: 8443, Mode: v1alpha1.TLSModeTerminate, SecretName: "admin-tls"}}
+
+	g.Expect(resolverEndpointPorts(service, es)).To(Equal([]networkingv1.EndpointPort{
+		{Name: ptr.To("http"), Protocol: ptr.To(v1.ProtocolTCP), Port: ptr.To(int32(8012))},
+		{Name: ptr.To("postgres"), Protocol: ptr.To(v1.ProtocolTCP), Port: ptr.To(int32(15432))},
+		{Name: ptr.To("https"), Protocol: ptr.To(v1.ProtocolTCP), Port: ptr.To(config.DefaultResolverTLSPassthroughPort)},
+		{Name: ptr.To("admin"), Protocol: ptr.To(v1.ProtocolTCP), Port: ptr.To(int32(9443))},
+	}))
+}
+
+func TestPodHostnames(t *testing.T) {
+	g := NewWithT(t)
+	headless := newTestService()
+	headless.Spec.ClusterIP = v1.ClusterIPNone
+	statefulSet := newTestElastiService(values.ProxyMode)
+	statefulSet.Spec.ScaleTargetRef.Kind = "StatefulSet"
+	statefulSet.Spec.ScaleTargetRef.Name = "web"
+	statefulSet.Spec.MinTargetReplicas = 2
+
+	g.Expect(podHostnames(headless, statefulSet)).To(Equal([]string{"web-0", "web-1"}))
+	// Only the pods of StatefulSets behind a headless service have their own DNS records
+	g.Expect(podHostnames(newTestService(), statefulSet)).To(BeEmpty())
+	g.Expect(podHostnames(headless, newTestElastiService(values.ProxyMode))).To(BeEmpty())
+	// The first pod is created on scale up, even with no minTargetReplicas
+	statefulSet.Spec.MinTargetReplicas = 0
+	g.Expect(podHostnames(headless, statefulSet)).To(Equal([]string{"web-0"}))
+}
+
+func TestWithPodHostnames(t *testing.T) {
+	g := NewWithT(t)
+	resolverEndpoints := []networkingv1.Endpoint{
+		{Addresses: []string{"10.0.0.1"}, Conditions: networkingv1.EndpointConditions{Ready: ptr.To(true)}},
+		{Addresses: []string{"10.0.0.2"}, Conditions: networkingv1.EndpointConditions{Ready: ptr.To(false)}},
+	}
+
+	g.Expect(withPodHostnames(resolverEndpoints, nil)).To(Equal(resolverEndpoints))
+	g.Expect(withPodHostnames(resolverEndpoints, []string{"web-0", "web-1"})).To(Equal([]networkingv1.Endpoint{
+		{Addresses: []string{"10.0.0.1"}, Hostname: ptr.To("web-0"), Conditions: networkingv1.EndpointConditions{Ready: ptr.To(true)}},
+		{Addresses: []string{"10.0.0.2"}, Hostname: ptr.To("web-0"), Conditions: networkingv1.EndpointConditions{Ready: ptr.To(false)}},
+		{Addresses: []string{"10.0.0.1"}, Hostname: ptr.To("web-1"), Conditions: networkingv1.EndpointConditions{Ready: ptr.To(true)}},
+		{Addresses: []string{"10.0.0.2"}, Hostname: ptr.To("web-1"), Conditions: networkingv1.EndpointConditions{Ready: ptr.To(false)}},
+	}))
+	// The resolver endpoints are not changed
+	g.Expect(resolverEndpoints[0].Hostname).To(BeNil())
+}
@@ -59,15 +59,12 @@ func (r *ElastiServiceReconciler) getResolverChangeHandler(ctx context.Context)
 			}
 		},
 		DeleteFunc: func(_ interface{}) {
-			// TODO: Handle deletion of resolver deployment
-			// We can do two things here
-			// 1. We can move to the serve mode
-			// 2. We can add a finalizer to the deployent to avoid deletion
-			//
-			//
-			// Another situation is, if the resolver has some issues, and is restarting.
-			// In that case, we can wait for the resolver to come back up, and in the meanwhile, we can move to the serve mode
-			r.Logger.Warn("Resolver deployment deleted", zap.String("deployment_name", config.GetResolverConfig().DeploymentName))
+			// A resolver EndpointSlice was removed, so the set of resolver endpoints changed.
+			// If no resolver endpoints are left, the services in proxy mode are moved to serve mode.
+			r.Logger.Warn("Resolver EndpointSlice deleted", zap.String("service_name", config.GetResolverConfig().ServiceName))
+			if err := r.syncResolverEndpoints(ctx); err != nil {
+				r.Logger.Error("Failed to handle resolver changes", zap.Error(err))
+			}
 		},
 	}
 }
@@ -83,7 +80,7 @@ func (r *ElastiServiceReconciler) getPublicServiceChangeHandler(ctx context.Cont
 	return cache.ResourceEventHandlerFuncs{
 		AddFunc: func(obj interface{}) {
 			errStr := values.Success
-			err := r.handlePublicServiceChanges(ctx, obj, es.Spec.Service, req.Namespace)
+			err := r.handlePublicServiceChanges(ctx, obj, es)
 			if err != nil {
 				errStr = err.Error()
 				r.Logger.Error("Failed to handle public service changes", zap.Error(err))
@@ -94,7 +91,7 @@ func (r *ElastiServiceReconciler) getPublicServiceChangeHandler(ctx context.Cont
 		},
 		UpdateFunc: func(_, newObj interface{}) {
 			errStr := values.Success
-			err := r.handlePublicServiceChanges(ctx, newObj, es.Spec.Service, req.Namespace)
+			err := r.handlePublicServiceChanges(ctx, newObj, es)
 			if err != nil {
 				errStr = err.Error()
 				r.Logger.Error("Failed to handle public service changes", zap.Error(err))
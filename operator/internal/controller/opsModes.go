@@ -65,13 +65,19 @@ func (r *ElastiServiceReconciler) enableProxyMode(ctx context.Context, req ctrl.
 	if err := r.Get(ctx, targetNamespacedName, targetSVC); err != nil {
 		return fmt.Errorf("failed to get target service: %w", err)
 	}
+	// Services we can't proxy stay in serve mode, the reason is reported in the ServiceSupported condition
+	if _, validationErr, err := r.validateService(ctx, targetSVC, es); err != nil {
+		return fmt.Errorf("failed to validate target service: %w", err)
+	} else if validationErr != nil {
+		return fmt.Errorf("failed to validate target service: %w", validationErr)
+	}
 	PVTName, err := r.checkAndCreatePrivateService(ctx, targetSVC, es)
 	if err != nil {
 		return fmt.Errorf("failed to check and create private service: %w", err)
 	}
 	r.Logger.Info("1. Checked and created private service", zap.String("public service", targetSVC.Name), zap.String("private service", PVTName))
 
-	if err = r.createOrUpdateEndpointsliceToResolver(ctx, targetSVC); err != nil {
+	if err = r.createOrUpdateEndpointsliceToResolver(ctx, targetSVC, es); err != nil {
 		return fmt.Errorf("failed to create or update endpointslice to resolver: %w ", err)
 	}
 	r.Logger.Info("2. Created or updated endpointslice to resolver", zap.String("service", targetSVC.Name))
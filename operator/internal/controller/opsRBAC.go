@@ -0,0 +1,135 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"slices"
+
+	"truefoundry/elasti/operator/api/v1alpha1"
+
+	"github.com/truefoundry/elasti/pkg/config"
+	"github.com/truefoundry/elasti/pkg/utils"
+	"go.uber.org/zap"
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+// resolverAccessRules returns the rules which let the resolver get the TLS Secrets and the warm-up template ConfigMap
+// of the ElastiService, and nothing else
+func resolverAccessRules(es *v1alpha1.ElastiService) []rbacv1.PolicyRule {
+	var secrets []string
+	for _, tlsPort := range es.Spec.TLSPorts {
+		if tlsPortMode(tlsPort) == v1alpha1.TLSModeTerminate && tlsPort.SecretName != "" {
+			secrets = append(secrets, tlsPort.SecretName)
+		}
+	}
+	var configMaps []string
+	if resolver := es.Spec.Resolver; resolver != nil && resolver.WarmUp != nil && resolver.WarmUp.Template != nil && resolver.WarmUp.Template.Name != "" {
+		configMaps = append(configMaps, resolver.WarmUp.Template.Name)
+	}
+
+	var rules []rbacv1.PolicyRule
+	if len(secrets) > 0 {
+		slices.Sort(secrets)
+		rules = append(rules, rbacv1.PolicyRule{
+			APIGroups:     []string{""},
+			Resources:     []string{"secrets"},
+			Verbs:         []string{"get"},
+			ResourceNames: slices.Compact(secrets),
+		})
+	}
+	if len(configMaps) > 0 {
+		rules = append(rules, rbacv1.PolicyRule{
+			APIGroups:     []string{""},
+			Resources:     []string{"configmaps"},
+			Verbs:         []string{"get"},
+			ResourceNames: configMaps,
+		})
+	}
+	return rules
+}
+
+// syncResolverAccess gives the resolver access to the Secrets and ConfigMaps the ElastiService refers to, with a Role
+// and a RoleBinding in the namespace of the ElastiService. Both are owned by the ElastiService, so they are garbage
+// collected with it, and are deleted when the ElastiService no longer refers to any Secret or ConfigMap.
+func (r *ElastiServiceReconciler) syncResolverAccess(ctx context.Context, es *v1alpha1.ElastiService) error {
+	namespacedName := types.NamespacedName{Name: utils.GetResolverAccessName(es.Name), Namespace: es.Namespace}
+	rules := resolverAccessRules(es)
+	if len(rules) == 0 {
+		return r.deleteResolverAccess(ctx, namespacedName)
+	}
+
+	role := &rbacv1.Role{}
+	if err := r.apiReader().Get(ctx, namespacedName, role); err != nil && !errors.IsNotFound(err) {
+		return fmt.Errorf("failed to get resolver access Role: %w", err)
+	} else if errors.IsNotFound(err) {
+		role = &rbacv1.Role{
+			ObjectMeta: metav1.ObjectMeta{Name: namespacedName.Name, Namespace: namespacedName.Namespace},
+			Rules:      rules,
+		}
+		if err := controllerutil.SetControllerReference(es, role, r.Scheme); err != nil {
+			return fmt.Errorf("failed to set controller reference on resolver access Role: %w", err)
+		}
+		if err := r.Create(ctx, role); err != nil {
+			return fmt.Errorf("failed to create resolver access Role: %w", err)
+		}
+		r.Logger.Info("Resolver access Role created", zap.String("role", namespacedName.String()))
+	} else if !equality.Semantic.DeepEqual(role.Rules, rules) {
+		role.Rules = rules
+		if err := r.Update(ctx, role); err != nil {
+			return fmt.Errorf("failed to update resolver access Role: %w", err)
+		}
+		r.Logger.Info("Resolver access Role updated", zap.String("role", namespacedName.String()))
+	}
+
+	resolverConfig := config.GetResolverConfig()
+	subjects := []rbacv1.Subject{{
+		Kind:      rbacv1.ServiceAccountKind,
+		Name:      resolverConfig.ServiceAccountName,
+		Namespace: resolverConfig.Namespace,
+	}}
+	roleBinding := &rbacv1.RoleBinding{}
+	if err := r.apiReader().Get(ctx, namespacedName, roleBinding); err != nil && !errors.IsNotFound(err) {
+		return fmt.Errorf("failed to get resolver access RoleBinding: %w", err)
+	} else if errors.IsNotFound(err) {
+		roleBinding = &rbacv1.RoleBinding{
+			ObjectMeta: metav1.ObjectMeta{Name: namespacedName.Name, Namespace: namespacedName.Namespace},
+			RoleRef: rbacv1.RoleRef{
+				APIGroup: rbacv1.GroupName,
+				Kind:     "Role",
+				Name:     namespacedName.Name,
+			},
+			Subjects: subjects,
+		}
+		if err := controllerutil.SetControllerReference(es, roleBinding, r.Scheme); err != nil {
+			return fmt.Errorf("failed to set controller reference on resolver access RoleBinding: %w", err)
+		}
+		if err := r.Create(ctx, roleBinding); err != nil {
+			return fmt.Errorf("failed to create resolver access RoleBinding: %w", err)
+		}
+		r.Logger.Info("Resolver access RoleBinding created", zap.String("rolebinding", namespacedName.String()))
+	} else if !equality.Semantic.DeepEqual(roleBinding.Subjects, subjects) {
+		roleBinding.Subjects = subjects
+		if err := r.Update(ctx, roleBinding); err != nil {
+			return fmt.Errorf("failed to update resolver access RoleBinding: %w", err)
+		}
+		r.Logger.Info("Resolver access RoleBinding updated", zap.String("rolebinding", namespacedName.String()))
+	}
+	return nil
+}
+
+// deleteResolverAccess deletes the Role and RoleBinding of the resolver, if they exist
+func (r *ElastiServiceReconciler) deleteResolverAccess(ctx context.Context, namespacedName types.NamespacedName) error {
+	objectMeta := metav1.ObjectMeta{Name: namespacedName.Name, Namespace: namespacedName.Namespace}
+	for _, obj := range []client.Object{&rbacv1.RoleBinding{ObjectMeta: objectMeta}, &rbacv1.Role{ObjectMeta: objectMeta}} {
+		if err := r.Delete(ctx, obj); err != nil && !errors.IsNotFound(err) {
+			return fmt.Errorf("failed to delete resolver access %T: %w", obj, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package controller
+
+import (
+	"context"
+	"testing"
+
+	"truefoundry/elasti/operator/api/v1alpha1"
+
+	. "github.com/onsi/gomega"
+	"github.com/truefoundry/elasti/pkg/utils"
+	"github.com/truefoundry/elasti/pkg/values"
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestResolverAccessRules(t *testing.T) {
+	g := NewWithT(t)
+	es := newTestElastiService(values.ProxyMode)
+	g.Expect(resolverAccessRules(es)).To(BeEmpty())
+
+	es.Spec.TLSPorts = []v1alpha1.TLSPort{
+		{Port: 443},
+		{Port: 8443, Mode: v1alpha1.TLSModeTerminate, SecretName: "target-tls"},
+	}
+	es.Spec.Resolver = &v1alpha1.ResolverSpec{
+		WarmUp: &v1alpha1.WarmUpSpec{Template: &v1alpha1.ConfigMapKeyRef{Name: "warm-up", Key: "page.html"}},
+	}
+	g.Expect(resolverAccessRules(es)).To(Equal([]rbacv1.PolicyRule{
+		{APIGroups: []string{""}, Resources: []string{"secrets"}, Verbs: []string{"get"}, ResourceNames: []string{"target-tls"}},
+		{APIGroups: []string{""}, Resources: []string{"configmaps"}, Verbs: []string{"get"}, ResourceNames: []string{"warm-up"}},
+	}))
+}
+
+func TestSyncResolverAccess(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+	es := newTestElastiService(values.ProxyMode)
+	es.Spec.TLSPorts = []v1alpha1.TLSPort{{Port: 443, Mode: v1alpha1.TLSModeTerminate, SecretName: "target-tls"}}
+	r := newTestReconciler(t, es)
+	namespacedName := types.NamespacedName{Name: utils.GetResolverAccessName(es.Name), Namespace: testNamespace}
+
+	// The resolver can only get the Secret of the ElastiService
+	g.Expect(r.syncResolverAccess(ctx, es)).To(Succeed())
+	role := &rbacv1.Role{}
+	g.Expect(r.Get(ctx, namespacedName, role)).To(Succeed())
+	g.Expect(role.Rules).To(Equal(resolverAccessRules(es)))
+	g.Expect(role.OwnerReferences).To(HaveLen(1))
+	g.Expect(role.OwnerReferences[0].UID).To(Equal(es.UID))
+	roleBinding := &rbacv1.RoleBinding{}
+	g.Expect(r.Get(ctx, namespacedName, roleBinding)).To(Succeed())
+	g.Expect(roleBinding.RoleRef.Name).To(Equal(namespacedName.Name))
+	g.Expect(roleBinding.Subjects).To(Equal([]rbacv1.Subject{{Kind: rbacv1.ServiceAccountKind, Name: "elasti-resolver", Namespace: "elasti"}}))
+
+	// The Role follows the Secrets of the ElastiService
+	es.Spec.TLSPorts[0].SecretName = "renewed-tls"
+	g.Expect(r.syncResolverAccess(ctx, es)).To(Succeed())
+	g.Expect(r.Get(ctx, namespacedName, role)).To(Succeed())
+	g.Expect(role.Rules[0].ResourceNames).To(Equal([]string{"renewed-tls"}))
+
+	// Both are deleted once the ElastiService refers to no Secret or ConfigMap
+	es.Spec.TLSPorts = nil
+	g.Expect(r.syncResolverAccess(ctx, es)).To(Succeed())
+	g.Expect(errors.IsNotFound(r.Get(ctx, namespacedName, role))).To(BeTrue())
+	g.Expect(errors.IsNotFound(r.Get(ctx, namespacedName, roleBinding))).To(BeTrue())
+	g.Expect(r.syncResolverAccess(ctx, es)).To(Succeed())
+}
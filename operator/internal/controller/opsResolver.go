@@ -0,0 +1,367 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"truefoundry/elasti/operator/internal/crddirectory"
+	"truefoundry/elasti/operator/internal/prom"
+
+	"github.com/truefoundry/elasti/pkg/config"
+	"github.com/truefoundry/elasti/pkg/k8shelper"
+	"github.com/truefoundry/elasti/pkg/values"
+	"go.uber.org/zap"
+	v1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/discovery/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/util/retry"
+)
+
+// DefaultResolverSyncWorkers is the number of services for which we update the EndpointSlice to resolver in parallel
+const DefaultResolverSyncWorkers = 10
+
+// resolverSyncBackoff is the backoff used when updating the EndpointSlice to resolver of a single service fails
+var resolverSyncBackoff = wait.Backoff{
+	Duration: 100 * time.Millisecond,
+	Factor:   2,
+	Jitter:   0.1,
+	Steps:    5,
+}
+
+// handleResolverChanges is called when one of the resolver EndpointSlices changes
+func (r *ElastiServiceReconciler) handleResolverChanges(ctx context.Context, obj interface{}) error {
+	resolverSlice := &networkingv1.EndpointSlice{}
+	err := k8shelper.UnstructuredToResource(obj, resolverSlice)
+	if err != nil {
+		return fmt.Errorf("failed to convert unstructured to endpointslice: %w", err)
+	}
+	if resolverSlice.Labels[networkingv1.LabelServiceName] != config.GetResolverConfig().ServiceName {
+		return nil
+	}
+	return r.syncResolverEndpoints(ctx)
+}
+
+// syncResolverEndpoints computes the resolver endpoints once, and updates the EndpointSlice to resolver
+// for every service in proxy mode, using a bounded pool of workers.
+func (r *ElastiServiceReconciler) syncResolverEndpoints(ctx context.Context) (err error) {
+	startTime := time.Now()
+	defer func() {
+		prom.ResolverSyncHistogram.WithLabelValues(errorReason(err)).Observe(time.Since(startTime).Seconds())
+	}()
+
+	resolverEndpoints, err := r.getResolverEndpoints(ctx)
+	if err != nil && !errors.Is(err, ErrNoResolverPodFound) {
+		return fmt.Errorf("failed to get resolver endpoints: %w", err)
+	}
+
+	if !hasReadyEndpoint(resolverEndpoints) {
+		r.handleResolverUnavailable(ctx)
+	} else {
+		r.handleResolverAvailable(ctx)
+	}
+	// With no resolver endpoints at all, there is nothing to point the services to.
+	// The services are moved to serve mode by the resolver fallback instead.
+	if len(resolverEndpoints) == 0 {
+		return ErrNoResolverPodFound
+	}
+
+	total, failed := r.forEachServiceInProxyMode(func(service types.NamespacedName, crdDetails *crddirectory.CRDDetails) error {
+		return r.syncEndpointsliceToResolver(ctx, service, crdDetails.CRDName, resolverEndpoints)
+	})
+
+	r.Logger.Info("Synced resolver endpoints to services in proxy mode",
+		zap.Int("endpoints", len(resolverEndpoints)),
+		zap.Int64("services", total),
+		zap.Int64("failed", failed),
+		zap.Duration("duration", time.Since(startTime)))
+	if failed > 0 {
+		return fmt.Errorf("%w: failed to update EndpointSlice to resolver for %d of %d services", ErrResolverSyncFailed, failed, total)
+	}
+	return nil
+}
+
+// forEachServiceInProxyMode calls fn for every service in proxy mode, using a bounded pool of workers.
+// It returns the number of services fn was called for, and the number of calls which failed.
+func (r *ElastiServiceReconciler) forEachServiceInProxyMode(fn func(service types.NamespacedName, crdDetails *crddirectory.CRDDetails) error) (int64, int64) {
+	workers := r.ResolverSyncWorkers
+	if workers <= 0 {
+		workers = DefaultResolverSyncWorkers
+	}
+
+	type serviceInProxyMode struct {
+		service    types.NamespacedName
+		crdDetails *crddirectory.CRDDetails
+	}
+
+	var total, failed atomic.Int64
+	services := make(chan serviceInProxyMode)
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for s := range services {
+				total.Add(1)
+				if err := fn(s.service, s.crdDetails); err != nil {
+					failed.Add(1)
+					r.Logger.Error("Failed to handle resolver changes for service", zap.String("service", s.service.String()), zap.Error(err))
+				}
+			}
+		}()
+	}
+
+	crddirectory.CRDDirectory.Services.Range(func(key, value interface{}) bool {
+		crdDetails := value.(*crddirectory.CRDDetails)
+		if crdDetails.Status.Mode != values.ProxyMode {
+			return true
+		}
+
+		// Extract namespace and service name from the key
+		keyStr := key.(string)
+		parts := strings.Split(keyStr, "/")
+		if len(parts) != 2 {
+			r.Logger.Error("Invalid key format", zap.String("key", keyStr))
+			return true
+		}
+		services <- serviceInProxyMode{
+			service: types.NamespacedName{
+				Namespace: parts[0],
+				Name:      parts[1],
+			},
+			crdDetails: crdDetails,
+		}
+		return true
+	})
+	close(services)
+	wg.Wait()
+
+	return total.Load(), failed.Load()
+}
+
+// syncEndpointsliceToResolver updates the EndpointSlice to resolver for a single service, retrying with backoff on failure
+func (r *ElastiServiceReconciler) syncEndpointsliceToResolver(ctx context.Context, service types.NamespacedName, crdName string, resolverEndpoints []networkingv1.Endpoint) (err error) {
+	attempts := 0
+	defer func() {
+		if attempts > 1 {
+			prom.ResolverSyncRetryCounter.WithLabelValues(service.Name, service.Namespace).Add(float64(attempts - 1))
+		}
+		prom.ResolverSyncServiceCounter.WithLabelValues(service.Name, service.Namespace, errorReason(err)).Inc()
+	}()
+
+	return retry.OnError(resolverSyncBackoff, func(err error) bool {
+		// If the service or the ElastiService is gone, there is nothing to update, and retrying won't help
+		return !apierrors.IsNotFound(err) && ctx.Err() == nil
+	}, func() error {
+		attempts++
+		es, err := r.getCRD(ctx, types.NamespacedName{Name: crdName, Namespace: service.Namespace})
+		if err != nil {
+			return err
+		}
+		targetService := &v1.Service{}
+		if err := r.Get(ctx, service, targetService); err != nil {
+			return fmt.Errorf("failed to get service: %w", err)
+		}
+		return r.applyEndpointsliceToResolver(ctx, targetService, es, resolverEndpoints)
+	})
+}
+
+// DefaultResolverUnavailableGracePeriod is how long the resolver can have no ready endpoints,
+// before we move the services in proxy mode to serve mode. This avoids scaling up every service
+// when the resolver is only restarting.
+const DefaultResolverUnavailableGracePeriod = 30 * time.Second
+
+// resolverFallback tracks the services we scaled up because the resolver was unavailable.
+// The lock is only held to read and update the state, never while scaling the services or recording events,
+// since it is taken by the resolver informer handlers.
+type resolverFallback struct {
+	mu sync.Mutex
+	// timer fires after the grace period, if the resolver is still unavailable
+	timer *time.Timer
+	// active is true while the services are kept in serve mode because of the resolver
+	active bool
+	// generation is incremented every time the fallback is enabled, so a slow fallback doesn't
+	// add services to a later one, or to none once the resolver recovered
+	generation uint64
+	// services are the services scaled up by the fallback, mapped to the name of their ElastiService
+	services map[types.NamespacedName]string
+	// scaleUp scales up the target of a service, it defaults to scaleUpForResolverFallback
+	scaleUp func(ctx context.Context, namespace string, crdDetails *crddirectory.CRDDetails) error
+}
+
+// hasReadyEndpoint returns true if any of the endpoints is ready, nil ready condition is interpreted as ready
+func hasReadyEndpoint(endpoints []networkingv1.Endpoint) bool {
+	for _, endpoint := range endpoints {
+		if endpoint.Conditions.Ready == nil || *endpoint.Conditions.Ready {
+			return true
+		}
+	}
+	return false
+}
+
+// handleResolverUnavailable starts the grace period after which services in proxy mode are moved to serve mode.
+// Without a resolver, the traffic for these services is blackholed.
+func (r *ElastiServiceReconciler) handleResolverUnavailable(ctx context.Context) {
+	r.resolverFallback.mu.Lock()
+	defer r.resolverFallback.mu.Unlock()
+	if r.resolverFallback.active || r.resolverFallback.timer != nil {
+		return
+	}
+
+	gracePeriod := r.ResolverUnavailableGracePeriod
+	if gracePeriod <= 0 {
+		gracePeriod = DefaultResolverUnavailableGracePeriod
+	}
+	r.Logger.Warn("No ready resolver endpoints, services in proxy mode will be moved to serve mode if it doesn't recover",
+		zap.String("service_name", config.GetResolverConfig().ServiceName),
+		zap.Duration("gracePeriod", gracePeriod))
+	r.resolverFallback.timer = time.AfterFunc(gracePeriod, func() {
+		r.enableResolverFallback(ctx)
+	})
+}
+
+// handleResolverAvailable cancels a pending fallback, or ends an active one
+func (r *ElastiServiceReconciler) handleResolverAvailable(ctx context.Context) {
+	r.resolverFallback.mu.Lock()
+	if r.resolverFallback.timer != nil {
+		r.resolverFallback.timer.Stop()
+		r.resolverFallback.timer = nil
+		r.Logger.Info("Resolver recovered within the grace period")
+	}
+	if !r.resolverFallback.active {
+		r.resolverFallback.mu.Unlock()
+		return
+	}
+	r.resolverFallback.active = false
+	services := r.resolverFallback.services
+	r.resolverFallback.services = nil
+	r.resolverFallback.mu.Unlock()
+
+	// The targets are left running. Once the scale down watcher finds them idle, they are scaled to zero,
+	// and they move back to proxy mode through the usual ScaleTargetRef informer.
+	for service, crdName := range services {
+		if r.ScaleHandler != nil {
+			r.ScaleHandler.ResumeScaleDown(service.Namespace, service.Name)
+		}
+		r.recordResolverEvent(ctx, types.NamespacedName{Name: crdName, Namespace: service.Namespace}, v1.EventTypeNormal, "ResolverRecovered",
+			"Resolver is available again, proxy mode will be restored once the target is scaled down")
+	}
+	r.Logger.Info("Resolver recovered, scale down resumed", zap.Int("services", len(services)))
+}
+
+// enableResolverFallback scales up the target of every service in proxy mode, if the resolver is still unavailable
+func (r *ElastiServiceReconciler) enableResolverFallback(ctx context.Context) {
+	r.resolverFallback.mu.Lock()
+	r.resolverFallback.timer = nil
+	r.resolverFallback.mu.Unlock()
+
+	resolverEndpoints, err := r.getResolverEndpoints(ctx)
+	if err != nil && !errors.Is(err, ErrNoResolverPodFound) {
+		r.Logger.Error("Failed to check resolver endpoints for fallback", zap.Error(err))
+		return
+	}
+	if hasReadyEndpoint(resolverEndpoints) {
+		return
+	}
+
+	r.resolverFallback.mu.Lock()
+	if r.resolverFallback.active || r.resolverFallback.timer != nil {
+		// The fallback is already enabled, or the resolver recovered and went away again since the timer fired
+		r.resolverFallback.mu.Unlock()
+		return
+	}
+	r.resolverFallback.active = true
+	r.resolverFallback.generation++
+	generation := r.resolverFallback.generation
+	r.resolverFallback.services = map[types.NamespacedName]string{}
+	scaleUp := r.resolverFallback.scaleUp
+	r.resolverFallback.mu.Unlock()
+	if scaleUp == nil {
+		scaleUp = r.scaleUpForResolverFallback
+	}
+
+	r.Logger.Warn("Resolver is unavailable, moving services in proxy mode to serve mode")
+	total, failed := r.forEachServiceInProxyMode(func(service types.NamespacedName, crdDetails *crddirectory.CRDDetails) error {
+		crdNamespacedName := types.NamespacedName{Name: crdDetails.CRDName, Namespace: service.Namespace}
+		if r.ScaleHandler != nil {
+			// Prevent the scale down watcher from moving the service back to proxy mode, while there is no resolver
+			r.ScaleHandler.PauseScaleDown(service.Namespace, service.Name)
+		}
+		if err := scaleUp(ctx, service.Namespace, crdDetails); err != nil {
+			if r.ScaleHandler != nil {
+				r.ScaleHandler.ResumeScaleDown(service.Namespace, service.Name)
+			}
+			r.recordResolverEvent(ctx, crdNamespacedName, v1.EventTypeWarning, "ResolverFallbackFailed",
+				fmt.Sprintf("Resolver is unavailable, failed to scale up the target: %v", err))
+			return err
+		}
+
+		r.resolverFallback.mu.Lock()
+		current := r.resolverFallback.active && r.resolverFallback.generation == generation
+		if current {
+			r.resolverFallback.services[service] = crdDetails.CRDName
+		}
+		r.resolverFallback.mu.Unlock()
+		if !current {
+			// The resolver recovered while the service was scaled up, so its scale down is not paused anymore
+			if r.ScaleHandler != nil {
+				r.ScaleHandler.ResumeScaleDown(service.Namespace, service.Name)
+			}
+			return nil
+		}
+		r.recordResolverEvent(ctx, crdNamespacedName, v1.EventTypeWarning, "ResolverUnavailable",
+			"Resolver is unavailable, target scaled up to switch to serve mode")
+		return nil
+	})
+	prom.ResolverFallbackCounter.WithLabelValues(values.Success).Add(float64(total - failed))
+	if failed > 0 {
+		prom.ResolverFallbackCounter.WithLabelValues("failed").Add(float64(failed))
+	}
+	r.Logger.Warn("Moved services in proxy mode to serve mode, as resolver is unavailable",
+		zap.Int64("services", total),
+		zap.Int64("failed", failed))
+}
+
+// scaleUpForResolverFallback scales the target of the service to its minimum replicas.
+// Once the target is ready, the ScaleTargetRef informer switches the service to serve mode.
+func (r *ElastiServiceReconciler) scaleUpForResolverFallback(ctx context.Context, namespace string, crdDetails *crddirectory.CRDDetails) error {
+	if r.ScaleHandler == nil {
+		return fmt.Errorf("scale handler not configured")
+	}
+	// Unpause the Keda ScaledObject if it's paused
+	if crdDetails.Spec.Autoscaler != nil && strings.ToLower(crdDetails.Spec.Autoscaler.Type) == "keda" {
+		if err := r.ScaleHandler.UpdateKedaScaledObjectPausedState(ctx, crdDetails.Spec.Autoscaler.Name, namespace, false); err != nil {
+			return fmt.Errorf("failed to update Keda ScaledObject: %w", err)
+		}
+	}
+
+	scaleTargetRef := crdDetails.Spec.GetScaleTargetRef()
+	targetGVK, err := k8shelper.APIVersionStrToGVK(scaleTargetRef.APIVersion, scaleTargetRef.Kind)
+	if err != nil {
+		return fmt.Errorf("failed to parse API version: %w", err)
+	}
+	replicas := max(crdDetails.Spec.MinTargetReplicas, 1)
+	if _, err := r.ScaleHandler.Scale(ctx, namespace, targetGVK, scaleTargetRef.Name, replicas); err != nil {
+		return fmt.Errorf("failed to scale target: %w", err)
+	}
+	return nil
+}
+
+// recordResolverEvent records an event on the ElastiService, about the resolver availability
+func (r *ElastiServiceReconciler) recordResolverEvent(ctx context.Context, crdNamespacedName types.NamespacedName, eventType, reason, message string) {
+	if r.ScaleHandler == nil || r.ScaleHandler.EventRecorder == nil {
+		return
+	}
+	es, err := r.getCRD(ctx, crdNamespacedName)
+	if err != nil {
+		r.Logger.Warn("Failed to get ElastiService to record event", zap.String("es", crdNamespacedName.String()), zap.Error(err))
+		return
+	}
+	r.ScaleHandler.EventRecorder.Event(es, eventType, reason, message)
+}
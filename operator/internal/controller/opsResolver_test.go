@@ -0,0 +1,229 @@
+package controller
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"truefoundry/elasti/operator/api/v1alpha1"
+	"truefoundry/elasti/operator/internal/crddirectory"
+
+	. "github.com/onsi/gomega"
+	"github.com/truefoundry/elasti/pkg/config"
+	"github.com/truefoundry/elasti/pkg/utils"
+	"github.com/truefoundry/elasti/pkg/values"
+	"go.uber.org/zap"
+	v1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/utils/ptr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+const (
+	testNamespace       = "default"
+	testResolverService = "elasti-resolver-service"
+)
+
+// setResolverEnv sets the env of the resolver config, with the default ports
+func setResolverEnv(t *testing.T) {
+	t.Setenv(config.EnvResolverNamespace, "elasti")
+	t.Setenv(config.EnvResolverDeploymentName, "elasti-resolver")
+	t.Setenv(config.EnvResolverServiceName, testResolverService)
+	t.Setenv(config.EnvResolverPort, "8013")
+	t.Setenv(config.EnvResolverProxyPort, "8012")
+}
+
+// newTestReconciler returns a reconciler backed by a fake client with the given objects, and sets the resolver config env
+func newTestReconciler(t *testing.T, objs ...client.Object) *ElastiServiceReconciler {
+	setResolverEnv(t)
+	scheme := runtime.NewScheme()
+	NewWithT(t).Expect(clientgoscheme.AddToScheme(scheme)).To(Succeed())
+	NewWithT(t).Expect(v1alpha1.AddToScheme(scheme)).To(Succeed())
+	return &ElastiServiceReconciler{
+		Client: fake.NewClientBuilder().
+			WithScheme(scheme).
+			WithObjects(objs...).
+			WithStatusSubresource(&v1alpha1.ElastiService{}).
+			Build(),
+		Scheme: scheme,
+		Logger: zap.NewNop(),
+	}
+}
+
+// newTestElastiService returns an ElastiService in the given mode, for the "target" service and deployment
+func newTestElastiService(mode string) *v1alpha1.ElastiService {
+	return &v1alpha1.ElastiService{
+		ObjectMeta: metav1.ObjectMeta{Name: "target-es", Namespace: testNamespace, UID: "es-uid"},
+		Spec: v1alpha1.ElastiServiceSpec{
+			Service: "target",
+			ScaleTargetRef: v1alpha1.ScaleTargetRef{
+				APIVersion: "apps/v1",
+				Kind:       "Deployment",
+				Name:       "target",
+			},
+			MinTargetReplicas: 1,
+		},
+		Status: v1alpha1.ElastiServiceStatus{Mode: mode},
+	}
+}
+
+// newTestService returns the public "target" service
+func newTestService() *v1.Service {
+	return &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "target", Namespace: testNamespace},
+		Spec: v1.ServiceSpec{
+			ClusterIP: "10.96.0.10",
+			Selector:  map[string]string{"app": "target"},
+			Ports:     []v1.ServicePort{{Name: "http", Port: 80, Protocol: v1.ProtocolTCP}},
+		},
+	}
+}
+
+// newTestResolverSlice returns an EndpointSlice of the resolver service, with one endpoint
+func newTestResolverSlice(ready bool) *networkingv1.EndpointSlice {
+	return &networkingv1.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      testResolverService + "-abc",
+			Namespace: "elasti",
+			Labels:    map[string]string{networkingv1.LabelServiceName: testResolverService},
+		},
+		AddressType: networkingv1.AddressTypeIPv4,
+		Endpoints: []networkingv1.Endpoint{{
+			Addresses:  []string{"10.0.0.1"},
+			Conditions: networkingv1.EndpointConditions{Ready: ptr.To(ready)},
+		}},
+	}
+}
+
+// addToDirectory adds the ElastiService to the CRD directory, until the test ends
+func addToDirectory(t *testing.T, es *v1alpha1.ElastiService) {
+	crddirectory.InitDirectory(zap.NewNop())
+	key := es.Namespace + "/" + es.Spec.Service
+	crddirectory.AddCRD(key, &crddirectory.CRDDetails{CRDName: es.Name, Spec: es.Spec, Status: es.Status})
+	t.Cleanup(func() { crddirectory.RemoveCRD(key) })
+}
+
+func TestHasReadyEndpoint(t *testing.T) {
+	tests := []struct {
+		name      string
+		endpoints []networkingv1.Endpoint
+		want      bool
+	}{
+		{name: "no endpoints", want: false},
+		{
+			name:      "nil ready condition is ready",
+			endpoints: []networkingv1.Endpoint{{Addresses: []string{"10.0.0.1"}}},
+			want:      true,
+		},
+		{
+			name: "only terminating endpoints",
+			endpoints: []networkingv1.Endpoint{
+				{Addresses: []string{"10.0.0.1"}, Conditions: networkingv1.EndpointConditions{Ready: ptr.To(false), Serving: ptr.To(true), Terminating: ptr.To(true)}},
+			},
+			want: false,
+		},
+		{
+			name: "one ready endpoint",
+			endpoints: []networkingv1.Endpoint{
+				{Addresses: []string{"10.0.0.1"}, Conditions: networkingv1.EndpointConditions{Ready: ptr.To(false)}},
+				{Addresses: []string{"10.0.0.2"}, Conditions: networkingv1.EndpointConditions{Ready: ptr.To(true)}},
+			},
+			want: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			NewWithT(t).Expect(hasReadyEndpoint(tt.endpoints)).To(Equal(tt.want))
+		})
+	}
+}
+
+// scaleUpRecorder records the services scaled up by the resolver fallback
+type scaleUpRecorder struct {
+	mu       sync.Mutex
+	services []string
+}
+
+func (s *scaleUpRecorder) scaleUp(_ context.Context, namespace string, crdDetails *crddirectory.CRDDetails) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.services = append(s.services, namespace+"/"+crdDetails.Spec.Service)
+	return nil
+}
+
+func (s *scaleUpRecorder) scaled() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.services...)
+}
+
+func TestResolverFallback(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+	es := newTestElastiService(values.ProxyMode)
+	addToDirectory(t, es)
+	r := newTestReconciler(t, es, newTestService(), newTestResolverSlice(false))
+	r.ResolverUnavailableGracePeriod = 50 * time.Millisecond
+	recorder := &scaleUpRecorder{}
+	r.resolverFallback.scaleUp = recorder.scaleUp
+
+	// The resolver has no ready endpoint, so the services are scaled up once the grace period is over
+	g.Expect(r.syncResolverEndpoints(ctx)).To(Succeed())
+	g.Consistently(recorder.scaled, 30*time.Millisecond, 5*time.Millisecond).Should(BeEmpty())
+	g.Eventually(recorder.scaled, time.Second, 5*time.Millisecond).Should(Equal([]string{"default/target"}))
+	g.Eventually(func() map[types.NamespacedName]string {
+		r.resolverFallback.mu.Lock()
+		defer r.resolverFallback.mu.Unlock()
+		return r.resolverFallback.services
+	}, time.Second, 5*time.Millisecond).Should(Equal(map[types.NamespacedName]string{
+		{Namespace: testNamespace, Name: "target"}: "target-es",
+	}))
+
+	// The services are only scaled up once, while the resolver stays unavailable
+	g.Expect(r.syncResolverEndpoints(ctx)).To(Succeed())
+	g.Consistently(recorder.scaled, 100*time.Millisecond, 5*time.Millisecond).Should(HaveLen(1))
+
+	// Once the resolver recovers, the fallback ends, and the services in proxy mode point to the resolver again
+	resolverSlice := &networkingv1.EndpointSlice{}
+	g.Expect(r.Get(ctx, client.ObjectKeyFromObject(newTestResolverSlice(true)), resolverSlice)).To(Succeed())
+	resolverSlice.Endpoints[0].Conditions.Ready = ptr.To(true)
+	g.Expect(r.Update(ctx, resolverSlice)).To(Succeed())
+	g.Expect(r.syncResolverEndpoints(ctx)).To(Succeed())
+	r.resolverFallback.mu.Lock()
+	g.Expect(r.resolverFallback.active).To(BeFalse())
+	g.Expect(r.resolverFallback.timer).To(BeNil())
+	g.Expect(r.resolverFallback.services).To(BeEmpty())
+	r.resolverFallback.mu.Unlock()
+
+	sliceToResolver := &networkingv1.EndpointSlice{}
+	g.Expect(r.Get(ctx, types.NamespacedName{Name: utils.GetEndpointSliceToResolverName("target"), Namespace: testNamespace}, sliceToResolver)).To(Succeed())
+	g.Expect(sliceToResolver.Endpoints).To(HaveLen(1))
+	g.Expect(sliceToResolver.Endpoints[0].Addresses).To(Equal([]string{"10.0.0.1"}))
+}
+
+func TestResolverRecoversWithinGracePeriod(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+	es := newTestElastiService(values.ProxyMode)
+	addToDirectory(t, es)
+	r := newTestReconciler(t, es, newTestService())
+	r.ResolverUnavailableGracePeriod = 50 * time.Millisecond
+	recorder := &scaleUpRecorder{}
+	r.resolverFallback.scaleUp = recorder.scaleUp
+
+	g.Expect(r.syncResolverEndpoints(ctx)).To(MatchError(ErrNoResolverPodFound))
+	g.Expect(r.Create(ctx, newTestResolverSlice(true))).To(Succeed())
+	g.Expect(r.syncResolverEndpoints(ctx)).To(Succeed())
+
+	g.Consistently(recorder.scaled, 150*time.Millisecond, 5*time.Millisecond).Should(BeEmpty())
+	r.resolverFallback.mu.Lock()
+	defer r.resolverFallback.mu.Unlock()
+	g.Expect(r.resolverFallback.active).To(BeFalse())
+	g.Expect(r.resolverFallback.timer).To(BeNil())
+}
@@ -3,15 +3,24 @@ package controller
 import (
 	"context"
 	"fmt"
+	"maps"
+	"slices"
+	"strings"
 
 	"truefoundry/elasti/operator/api/v1alpha1"
 
+	"github.com/truefoundry/elasti/pkg/config"
 	"github.com/truefoundry/elasti/pkg/k8shelper"
 	"github.com/truefoundry/elasti/pkg/utils"
+	"github.com/truefoundry/elasti/pkg/values"
 	"go.uber.org/zap"
 	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
 	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
 )
 
@@ -45,16 +54,13 @@ func (r *ElastiServiceReconciler) checkAndCreatePrivateService(ctx context.Conte
 		return privateServiceName, nil
 	}
 
-	privateSVC = publicSVC.DeepCopy()
-	privateSVC.SetName(privateServiceName)
-	// We must remove the cluster IP and node port, as it already exists for the public service
-	privateSVC.Spec.ClusterIP = ""
-	privateSVC.Spec.ClusterIPs = nil
-	for port := range privateSVC.Spec.Ports {
-		privateSVC.Spec.Ports[port].NodePort = 0
+	privateSVC = &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      privateServiceName,
+			Namespace: publicSVC.Namespace,
+		},
 	}
-	// We also need to remove the resourceVersion
-	privateSVC.ResourceVersion = ""
+	syncPrivateService(publicSVC, privateSVC)
 
 	// Make sure the private service is owned by the ElastiService
 	if err := controllerutil.SetControllerReference(es, privateSVC, r.Scheme); err != nil {
@@ -69,7 +75,7 @@ func (r *ElastiServiceReconciler) checkAndCreatePrivateService(ctx context.Conte
 }
 
 // handlePublicServiceChanges handles the changes in the public service, and sync those changes in the private service
-func (r *ElastiServiceReconciler) handlePublicServiceChanges(ctx context.Context, obj interface{}, serviceName, _ string) error {
+func (r *ElastiServiceReconciler) handlePublicServiceChanges(ctx context.Context, obj interface{}, es *v1alpha1.ElastiService) error {
 	publicSVC := &v1.Service{}
 	err := k8shelper.UnstructuredToResource(obj, publicSVC)
 	if err != nil {
@@ -77,10 +83,27 @@ func (r *ElastiServiceReconciler) handlePublicServiceChanges(ctx context.Context
 	}
 
 	// Check if the service is same as mentioned in CRD
-	if publicSVC.Name != serviceName {
+	if publicSVC.Name != es.Spec.Service {
 		return fmt.Errorf("public service is not same as mentioned in CRD; informer misconfigured")
 	}
-	// Get Private Service
+
+	// The service might have been changed to a type we can't proxy, so we validate it again
+	reason, validationErr, err := r.validateService(ctx, publicSVC, es)
+	if err != nil {
+		return err
+	}
+	crdNamespacedName := types.NamespacedName{Name: es.Name, Namespace: es.Namespace}
+	if err := r.updateServiceSupportedCondition(ctx, crdNamespacedName, reason, validationErr); err != nil {
+		r.Logger.Warn("Failed to update ServiceSupported condition", zap.String("es", crdNamespacedName.String()), zap.Error(err))
+	}
+	if validationErr != nil {
+		return validationErr
+	}
+	return r.updatePrivateService(ctx, publicSVC, es)
+}
+
+// updatePrivateService patches the private service with the changes in the public service
+func (r *ElastiServiceReconciler) updatePrivateService(ctx context.Context, publicSVC *v1.Service, es *v1alpha1.ElastiService) error {
 	PVTName := utils.GetPrivateServiceName(publicSVC.Name)
 	privateServiceNamespacedName := types.NamespacedName{Name: PVTName, Namespace: publicSVC.Namespace}
 	privateSVC := &v1.Service{}
@@ -90,18 +113,264 @@ func (r *ElastiServiceReconciler) handlePublicServiceChanges(ctx context.Context
 		return fmt.Errorf("private service not found: %w", err)
 	}
 
-	// Sync the changes in private service
-	privateSVC.Spec.Selector = publicSVC.Spec.Selector
-	privateSVC.Spec.Ports = make([]v1.ServicePort, len(publicSVC.Spec.Ports))
-	copy(privateSVC.Spec.Ports, publicSVC.Spec.Ports)
-	for port := range privateSVC.Spec.Ports {
-		privateSVC.Spec.Ports[port].NodePort = 0
+	// The cluster IP can't be changed, so the private service is re-created when the public service
+	// is changed to or from a headless service
+	if isHeadless(publicSVC) != isHeadless(privateSVC) {
+		r.Logger.Info("Public service switched between headless and ClusterIP, re-creating private service", zap.String("private-service", privateServiceNamespacedName.String()))
+		if err := r.Delete(ctx, privateSVC); err != nil && !errors.IsNotFound(err) {
+			return fmt.Errorf("failed to delete private service: %w", err)
+		}
+		if _, err := r.checkAndCreatePrivateService(ctx, publicSVC, es); err != nil {
+			return fmt.Errorf("failed to re-create private service: %w", err)
+		}
+		return nil
 	}
 
-	// Update the private service
-	if err := r.Update(ctx, privateSVC); err != nil {
-		return fmt.Errorf("failed to update private service: %w", err)
+	// Sync the changes in private service, and only patch the fields which changed
+	original := privateSVC.DeepCopy()
+	syncPrivateService(publicSVC, privateSVC)
+	if equality.Semantic.DeepEqual(original, privateSVC) {
+		return nil
+	}
+	if err := r.Patch(ctx, privateSVC, client.MergeFrom(original)); err != nil {
+		return fmt.Errorf("failed to patch private service: %w", err)
 	}
 
 	return nil
 }
+
+var (
+	// Labels which are not copied to the private service, as ArgoCD and Helm track the resources they manage with them
+	privateServiceExcludedLabels = []string{
+		"app.kubernetes.io/instance",
+		"app.kubernetes.io/managed-by",
+		"helm.sh/chart",
+	}
+	// Annotations which are not copied to the private service, as they make kubectl think it applied it
+	privateServiceExcludedAnnotations = []string{
+		v1.LastAppliedConfigAnnotation,
+	}
+	// Prefixes of the labels and annotations which are not copied to the private service,
+	// as ArgoCD, Helm and Flux would prune it, or report it as out of sync
+	privateServiceExcludedPrefixes = []string{
+		"argocd.argoproj.io/",
+		"meta.helm.sh/",
+		"kustomize.toolkit.fluxcd.io/",
+		"helm.toolkit.fluxcd.io/",
+	}
+)
+
+// copyForPrivateService returns a copy of the labels or annotations of the public service, without the excluded keys
+func copyForPrivateService(from map[string]string, excluded []string) map[string]string {
+	to := maps.Clone(from)
+	maps.DeleteFunc(to, func(key, _ string) bool {
+		return slices.Contains(excluded, key) || slices.ContainsFunc(privateServiceExcludedPrefixes, func(prefix string) bool {
+			return strings.HasPrefix(key, prefix)
+		})
+	})
+	return to
+}
+
+// syncPrivateService copies the labels, annotations and spec of the public service to the private service.
+//
+// The following fields are excluded on purpose:
+//   - spec.clusterIP and spec.clusterIPs, as they are allocated by the API server for each service.
+//     Only a headless public service gets a headless private service, so DNS keeps returning the IPs of the pods.
+//   - spec.ports[].nodePort, as the node ports are already taken by the public service
+//   - spec.type, externalIPs, externalName, externalTrafficPolicy, healthCheckNodePort and the loadBalancer* fields,
+//     as the private service is only reached from inside the cluster, so it is always a ClusterIP service
+//   - spec.ipFamilies once the private service is created, as the API server rejects most changes to it
+//   - the tracking labels and annotations of kubectl, ArgoCD, Helm and Flux
+func syncPrivateService(publicSVC, privateSVC *v1.Service) {
+	privateSVC.Labels = copyForPrivateService(publicSVC.Labels, privateServiceExcludedLabels)
+	if privateSVC.Labels == nil {
+		privateSVC.Labels = map[string]string{}
+	}
+	// The label is copied to the EndpointSlices of the private service, which the resolver watches for readiness
+	privateSVC.Labels[values.PrivateServiceLabel] = "true"
+	privateSVC.Annotations = copyForPrivateService(publicSVC.Annotations, privateServiceExcludedAnnotations)
+
+	spec := &privateSVC.Spec
+	spec.Selector = maps.Clone(publicSVC.Spec.Selector)
+	spec.Ports = make([]v1.ServicePort, len(publicSVC.Spec.Ports))
+	copy(spec.Ports, publicSVC.Spec.Ports)
+	for port := range spec.Ports {
+		spec.Ports[port].NodePort = 0
+	}
+	spec.SessionAffinity = publicSVC.Spec.SessionAffinity
+	spec.SessionAffinityConfig = publicSVC.Spec.SessionAffinityConfig.DeepCopy()
+	spec.PublishNotReadyAddresses = publicSVC.Spec.PublishNotReadyAddresses
+	if privateSVC.ResourceVersion == "" {
+		spec.IPFamilies = slices.Clone(publicSVC.Spec.IPFamilies)
+	}
+	spec.IPFamilyPolicy = publicSVC.Spec.IPFamilyPolicy
+	spec.InternalTrafficPolicy = publicSVC.Spec.InternalTrafficPolicy
+	spec.TrafficDistribution = publicSVC.Spec.TrafficDistribution
+
+	if isHeadless(publicSVC) {
+		spec.ClusterIP = v1.ClusterIPNone
+		spec.ClusterIPs = []string{v1.ClusterIPNone}
+	}
+
+	spec.Type = v1.ServiceTypeClusterIP
+	spec.ExternalIPs = nil
+	spec.ExternalName = ""
+	spec.ExternalTrafficPolicy = ""
+	spec.HealthCheckNodePort = 0
+	spec.LoadBalancerIP = ""
+	spec.LoadBalancerSourceRanges = nil
+	spec.LoadBalancerClass = nil
+	spec.AllocateLoadBalancerNodePorts = nil
+}
+
+// tlsPortMode returns the mode of the TLS port, which defaults to passthrough when the CRD default was not applied
+func tlsPortMode(tlsPort v1alpha1.TLSPort) string {
+	if tlsPort.Mode == "" {
+		return v1alpha1.TLSModePassthrough
+	}
+	return tlsPort.Mode
+}
+
+// isHeadless returns true if the service has no cluster IP, so DNS returns the IPs of its pods directly
+func isHeadless(svc *v1.Service) bool {
+	return svc.Spec.ClusterIP == v1.ClusterIPNone
+}
+
+// validatePublicService checks if the public service can be proxied by the resolver.
+// It returns the reason for the ServiceSupported condition, and an error wrapping ErrUnsupportedService if it can't.
+func validatePublicService(svc *v1.Service, es *v1alpha1.ElastiService) (string, error) {
+	if svc.Spec.Type == v1.ServiceTypeExternalName {
+		return v1alpha1.ReasonUnsupportedServiceType,
+			fmt.Errorf("%w: ExternalName services point to a DNS name, and have no pods to scale", ErrUnsupportedService)
+	}
+	if len(svc.Spec.Selector) == 0 {
+		return v1alpha1.ReasonUnsupportedServiceSpec,
+			fmt.Errorf("%w: services without a selector have no pods the private service can point to", ErrUnsupportedService)
+	}
+	if len(svc.Spec.Ports) == 0 {
+		return v1alpha1.ReasonUnsupportedServiceSpec,
+			fmt.Errorf("%w: services without ports can't be pointed to the resolver", ErrUnsupportedService)
+	}
+	for _, port := range svc.Spec.Ports {
+		if port.Protocol != "" && port.Protocol != v1.ProtocolTCP {
+			return v1alpha1.ReasonUnsupportedServiceSpec,
+				fmt.Errorf("%w: port %q uses %s, only TCP ports can be proxied by the resolver", ErrUnsupportedService, port.Name, port.Protocol)
+		}
+	}
+	isServicePort := func(p int32) bool {
+		return slices.ContainsFunc(svc.Spec.Ports, func(port v1.ServicePort) bool { return port.Port == p })
+	}
+	for _, tcpPort := range es.Spec.TCPPorts {
+		if !isServicePort(tcpPort.Port) {
+			return v1alpha1.ReasonUnsupportedServiceSpec,
+				fmt.Errorf("%w: TCP port %d is not a port of the service", ErrUnsupportedService, tcpPort.Port)
+		}
+	}
+	tlsModes := map[string]bool{}
+	for _, tlsPort := range es.Spec.TLSPorts {
+		if !isServicePort(tlsPort.Port) {
+			return v1alpha1.ReasonUnsupportedServiceSpec,
+				fmt.Errorf("%w: TLS port %d is not a port of the service", ErrUnsupportedService, tlsPort.Port)
+		}
+		if slices.ContainsFunc(es.Spec.TCPPorts, func(tcpPort v1alpha1.TCPPort) bool { return tcpPort.Port == tlsPort.Port }) {
+			return v1alpha1.ReasonUnsupportedServiceSpec,
+				fmt.Errorf("%w: port %d is both a TCP and a TLS port", ErrUnsupportedService, tlsPort.Port)
+		}
+		mode := tlsPortMode(tlsPort)
+		if tlsModes[mode] {
+			return v1alpha1.ReasonUnsupportedServiceSpec,
+				fmt.Errorf("%w: more than one TLS port uses the %s mode, the resolver can't tell them apart by SNI", ErrUnsupportedService, mode)
+		}
+		tlsModes[mode] = true
+		if mode == v1alpha1.TLSModeTerminate && tlsPort.SecretName == "" {
+			return v1alpha1.ReasonUnsupportedServiceSpec,
+				fmt.Errorf("%w: TLS port %d uses the terminate mode without a secretName", ErrUnsupportedService, tlsPort.Port)
+		}
+	}
+	// DNS returns the IPs of the resolver pods for a headless service in proxy mode, and there is no kube-proxy
+	// to translate the port, so clients reach the resolver on the port of the service
+	if isHeadless(svc) {
+		for i, endpointPort := range resolverEndpointPorts(svc, es) {
+			if *endpointPort.Port != svc.Spec.Ports[i].Port {
+				return v1alpha1.ReasonUnsupportedServiceSpec,
+					fmt.Errorf("%w: port %d of a headless service is not a port the resolver listens on for it (%d), clients would connect to the resolver pods on a closed port",
+						ErrUnsupportedService, svc.Spec.Ports[i].Port, *endpointPort.Port)
+			}
+		}
+	}
+	return v1alpha1.ReasonServiceSupported, nil
+}
+
+// validateService validates the public service, and the resolver ports of the TCP ports of the ElastiService.
+// It returns the reason for the ServiceSupported condition, and the validation error, or an error if the
+// ElastiServices could not be listed.
+func (r *ElastiServiceReconciler) validateService(ctx context.Context, svc *v1.Service, es *v1alpha1.ElastiService) (string, error, error) {
+	if reason, validationErr := validatePublicService(svc, es); validationErr != nil {
+		return reason, validationErr, nil
+	}
+	if len(es.Spec.TCPPorts) == 0 {
+		return v1alpha1.ReasonServiceSupported, nil, nil
+	}
+	esList := &v1alpha1.ElastiServiceList{}
+	if err := r.List(ctx, esList); err != nil {
+		return "", nil, fmt.Errorf("failed to list ElastiServices: %w", err)
+	}
+	reason, validationErr := validateResolverPorts(es, esList.Items)
+	return reason, validationErr, nil
+}
+
+// validateResolverPorts checks the resolver ports of the TCP ports of the ElastiService are not ports the resolver
+// already uses, and are not used by another ElastiService. When two ElastiServices use the same resolver port, the
+// older one keeps it, so a new ElastiService never takes the port of one which is already proxied.
+func validateResolverPorts(es *v1alpha1.ElastiService, elastiServices []v1alpha1.ElastiService) (string, error) {
+	resolverConfig := config.GetResolverConfig()
+	reserved := map[int32]string{
+		resolverConfig.Port:               "internal port",
+		resolverConfig.ReverseProxyPort:   "reverse proxy port",
+		resolverConfig.TLSPassthroughPort: "TLS passthrough port",
+		resolverConfig.TLSTerminationPort: "TLS termination port",
+	}
+	resolverPorts := map[int32]bool{}
+	for _, tcpPort := range es.Spec.TCPPorts {
+		if name, ok := reserved[tcpPort.ResolverPort]; ok {
+			return v1alpha1.ReasonResolverPortConflict,
+				fmt.Errorf("%w: resolverPort %d of TCP port %d is the %s of the resolver", ErrUnsupportedService, tcpPort.ResolverPort, tcpPort.Port, name)
+		}
+		if resolverPorts[tcpPort.ResolverPort] {
+			return v1alpha1.ReasonResolverPortConflict,
+				fmt.Errorf("%w: resolverPort %d is used by more than one TCP port", ErrUnsupportedService, tcpPort.ResolverPort)
+		}
+		resolverPorts[tcpPort.ResolverPort] = true
+	}
+	for i := range elastiServices {
+		other := &elastiServices[i]
+		// The ports of the ElastiServices which lost a conflict are not used by the resolver, so they don't hold them
+		if !isOlder(other, es) || !other.DeletionTimestamp.IsZero() || hasResolverPortConflict(other) {
+			continue
+		}
+		for _, tcpPort := range other.Spec.TCPPorts {
+			if resolverPorts[tcpPort.ResolverPort] {
+				return v1alpha1.ReasonResolverPortConflict,
+					fmt.Errorf("%w: resolverPort %d is already used by ElastiService %s/%s", ErrUnsupportedService, tcpPort.ResolverPort, other.Namespace, other.Name)
+			}
+		}
+	}
+	return v1alpha1.ReasonServiceSupported, nil
+}
+
+// isOlder returns true if a was created before b, using the namespace and name to order ElastiServices created in the same second
+func isOlder(a, b *v1alpha1.ElastiService) bool {
+	if !a.CreationTimestamp.Equal(&b.CreationTimestamp) {
+		return a.CreationTimestamp.Before(&b.CreationTimestamp)
+	}
+	if a.Namespace != b.Namespace {
+		return a.Namespace < b.Namespace
+	}
+	return a.Name < b.Name
+}
+
+// hasResolverPortConflict returns true if the ServiceSupported condition of the ElastiService reports a resolver port conflict
+func hasResolverPortConflict(es *v1alpha1.ElastiService) bool {
+	condition := meta.FindStatusCondition(es.Status.Conditions, v1alpha1.ConditionServiceSupported)
+	return condition != nil && condition.Status == metav1.ConditionFalse && condition.Reason == v1alpha1.ReasonResolverPortConflict
+}
@@ -0,0 +1,347 @@
+package controller
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"truefoundry/elasti/operator/api/v1alpha1"
+
+	. "github.com/onsi/gomega"
+	"github.com/truefoundry/elasti/pkg/values"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/utils/ptr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func TestSyncPrivateService(t *testing.T) {
+	g := NewWithT(t)
+	publicSVC := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "target",
+			Namespace: testNamespace,
+			Labels: map[string]string{
+				"app":                                "target",
+				"app.kubernetes.io/instance":         "target-release",
+				"app.kubernetes.io/managed-by":       "Helm",
+				"helm.sh/chart":                      "target-1.0.0",
+				"kustomize.toolkit.fluxcd.io/name":   "apps",
+				"helm.toolkit.fluxcd.io/namespace":   "flux-system",
+				"elasti.truefoundry.com/unrelated":   "kept",
+				"app.kubernetes.io/name":             "target",
+				"argocd.argoproj.io/instance":        "target",
+				"kustomize.toolkit.fluxcd.io/prune":  "disabled",
+				"example.com/argocd.argoproj.io-ish": "kept",
+			},
+			Annotations: map[string]string{
+				"team":                           "search",
+				v1.LastAppliedConfigAnnotation:   "{}",
+				"argocd.argoproj.io/tracking-id": "target:/Service:default/target",
+				"meta.helm.sh/release-name":      "target-release",
+				"meta.helm.sh/release-namespace": testNamespace,
+			},
+		},
+		Spec: v1.ServiceSpec{
+			Type:                  v1.ServiceTypeLoadBalancer,
+			ClusterIP:             "10.96.0.10",
+			ClusterIPs:            []string{"10.96.0.10"},
+			Selector:              map[string]string{"app": "target"},
+			Ports:                 []v1.ServicePort{{Name: "http", Port: 80, NodePort: 30080, Protocol: v1.ProtocolTCP}},
+			SessionAffinity:       v1.ServiceAffinityClientIP,
+			ExternalTrafficPolicy: v1.ServiceExternalTrafficPolicyLocal,
+			HealthCheckNodePort:   30100,
+			LoadBalancerClass:     ptr.To("example.com/lb"),
+			IPFamilies:            []v1.IPFamily{v1.IPv4Protocol},
+			IPFamilyPolicy:        ptr.To(v1.IPFamilyPolicySingleStack),
+		},
+	}
+
+	privateSVC := &v1.Service{}
+	syncPrivateService(publicSVC, privateSVC)
+
+	g.Expect(privateSVC.Labels).To(Equal(map[string]string{
+		"app":                                "target",
+		"app.kubernetes.io/name":             "target",
+		"elasti.truefoundry.com/unrelated":   "kept",
+		"example.com/argocd.argoproj.io-ish": "kept",
+		values.PrivateServiceLabel:           "true",
+	}))
+	g.Expect(privateSVC.Annotations).To(Equal(map[string]string{"team": "search"}))
+	g.Expect(privateSVC.Spec).To(Equal(v1.ServiceSpec{
+		Type:            v1.ServiceTypeClusterIP,
+		Selector:        map[string]string{"app": "target"},
+		Ports:           []v1.ServicePort{{Name: "http", Port: 80, Protocol: v1.ProtocolTCP}},
+		SessionAffinity: v1.ServiceAffinityClientIP,
+		IPFamilies:      []v1.IPFamily{v1.IPv4Protocol},
+		IPFamilyPolicy:  ptr.To(v1.IPFamilyPolicySingleStack),
+	}))
+	// The node port of the public service is left alone
+	g.Expect(publicSVC.Spec.Ports[0].NodePort).To(Equal(int32(30080)))
+}
+
+func TestSyncPrivateServiceUpdate(t *testing.T) {
+	g := NewWithT(t)
+	publicSVC := newTestService()
+	publicSVC.Spec.IPFamilies = []v1.IPFamily{v1.IPv6Protocol, v1.IPv4Protocol}
+	privateSVC := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: privateServiceName.Name, Namespace: testNamespace, ResourceVersion: "1"},
+		Spec: v1.ServiceSpec{
+			ClusterIP:  "10.96.0.20",
+			ClusterIPs: []string{"10.96.0.20"},
+			IPFamilies: []v1.IPFamily{v1.IPv4Protocol},
+		},
+	}
+
+	syncPrivateService(publicSVC, privateSVC)
+
+	// The cluster IP and the IP families of the existing private service are kept, as they can't be changed
+	g.Expect(privateSVC.Spec.ClusterIP).To(Equal("10.96.0.20"))
+	g.Expect(privateSVC.Spec.ClusterIPs).To(Equal([]string{"10.96.0.20"}))
+	g.Expect(privateSVC.Spec.IPFamilies).To(Equal([]v1.IPFamily{v1.IPv4Protocol}))
+}
+
+func TestSyncPrivateServiceHeadless(t *testing.T) {
+	g := NewWithT(t)
+	publicSVC := newTestService()
+	publicSVC.Spec.ClusterIP = v1.ClusterIPNone
+	publicSVC.Spec.PublishNotReadyAddresses = true
+	privateSVC := &v1.Service{}
+
+	syncPrivateService(publicSVC, privateSVC)
+
+	g.Expect(privateSVC.Spec.ClusterIP).To(Equal(v1.ClusterIPNone))
+	g.Expect(privateSVC.Spec.ClusterIPs).To(Equal([]string{v1.ClusterIPNone}))
+	g.Expect(privateSVC.Spec.PublishNotReadyAddresses).To(BeTrue())
+}
+
+func TestValidatePublicService(t *testing.T) {
+	setResolverEnv(t)
+	tests := []struct {
+		name    string
+		service func(svc *v1.Service)
+		es      func(es *v1alpha1.ElastiService)
+		reason  string
+	}{
+		{name: "ClusterIP service", reason: v1alpha1.ReasonServiceSupported},
+		{
+			name:    "headless service on a port the resolver doesn't listen on",
+			service: func(svc *v1.Service) { svc.Spec.ClusterIP = v1.ClusterIPNone },
+			reason:  v1alpha1.ReasonUnsupportedServiceSpec,
+		},
+		{
+			name: "headless service on the ports the resolver listens on",
+			service: func(svc *v1.Service) {
+				svc.Spec.ClusterIP = v1.ClusterIPNone
+				svc.Spec.Ports = []v1.ServicePort{{Name: "http", Port: 8012}, {Name: "postgres", Port: 5432}}
+			},
+			es: func(es *v1alpha1.ElastiService) {
+				es.Spec.TCPPorts = []v1alpha1.TCPPort{{Port: 5432, ResolverPort: 5432}}
+			},
+			reason: v1alpha1.ReasonServiceSupported,
+		},
+		{
+			name: "headless service with a TCP port mapped to another resolver port",
+			service: func(svc *v1.Service) {
+				svc.Spec.ClusterIP = v1.ClusterIPNone
+				svc.Spec.Ports = []v1.ServicePort{{Name: "postgres", Port: 5432}}
+			},
+			es: func(es *v1alpha1.ElastiService) {
+				es.Spec.TCPPorts = []v1alpha1.TCPPort{{Port: 5432, ResolverPort: 9000}}
+			},
+			reason: v1alpha1.ReasonUnsupportedServiceSpec,
+		},
+		{
+			name: "ExternalName service",
+			service: func(svc *v1.Service) {
+				svc.Spec.Type = v1.ServiceTypeExternalName
+				svc.Spec.ExternalName = "example.com"
+			},
+			reason: v1alpha1.ReasonUnsupportedServiceType,
+		},
+		{
+			name:    "service without a selector",
+			service: func(svc *v1.Service) { svc.Spec.Selector = nil },
+			reason:  v1alpha1.ReasonUnsupportedServiceSpec,
+		},
+		{
+			name:    "service without ports",
+			service: func(svc *v1.Service) { svc.Spec.Ports = nil },
+			reason:  v1alpha1.ReasonUnsupportedServiceSpec,
+		},
+		{
+			name:    "UDP port",
+			service: func(svc *v1.Service) { svc.Spec.Ports[0].Protocol = v1.ProtocolUDP },
+			reason:  v1alpha1.ReasonUnsupportedServiceSpec,
+		},
+		{
+			name: "TCP port which is not a port of the service",
+			es: func(es *v1alpha1.ElastiService) {
+				es.Spec.TCPPorts = []v1alpha1.TCPPort{{Port: 5432, ResolverPort: 9000}}
+			},
+			reason: v1alpha1.ReasonUnsupportedServiceSpec,
+		},
+		{
+			name: "port which is both a TCP and a TLS port",
+			es: func(es *v1alpha1.ElastiService) {
+				es.Spec.TCPPorts = []v1alpha1.TCPPort{{Port: 80, ResolverPort: 9000}}
+				es.Spec.TLSPorts = []v1alpha1.TLSPort{{Port: 80}}
+			},
+			reason: v1alpha1.ReasonUnsupportedServiceSpec,
+		},
+		{
+			name: "two TLS ports in the same mode",
+			service: func(svc *v1.Service) {
+				svc.Spec.Ports = append(svc.Spec.Ports, v1.ServicePort{Name: "https", Port: 443}, v1.ServicePort{Name: "https-alt", Port: 8443})
+			},
+			es:     func(es *v1alpha1.ElastiService) { es.Spec.TLSPorts = []v1alpha1.TLSPort{{Port: 443}, {Port: 8443}} },
+			reason: v1alpha1.ReasonUnsupportedServiceSpec,
+		},
+		{
+			name: "TLS termination without a secret",
+			service: func(svc *v1.Service) {
+				svc.Spec.Ports = append(svc.Spec.Ports, v1.ServicePort{Name: "https", Port: 443})
+			},
+			es: func(es *v1alpha1.ElastiService) {
+				es.Spec.TLSPorts = []v1alpha1.TLSPort{{Port: 443, Mode: v1alpha1.TLSModeTerminate}}
+			},
+			reason: v1alpha1.ReasonUnsupportedServiceSpec,
+		},
+		{
+			name: "TLS passthrough and termination ports",
+			service: func(svc *v1.Service) {
+				svc.Spec.Ports = append(svc.Spec.Ports, v1.ServicePort{Name: "https", Port: 443})
+			},
+			es: func(es *v1alpha1.ElastiService) {
+				es.Spec.TLSPorts = []v1alpha1.TLSPort{{Port: 80}, {Port: 443, Mode: v1alpha1.TLSModeTerminate, SecretName: "target-tls"}}
+			},
+			reason: v1alpha1.ReasonServiceSupported,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+			svc := newTestService()
+			if tt.service != nil {
+				tt.service(svc)
+			}
+			es := newTestElastiService(values.ProxyMode)
+			if tt.es != nil {
+				tt.es(es)
+			}
+
+			reason, err := validatePublicService(svc, es)
+			g.Expect(reason).To(Equal(tt.reason))
+			if tt.reason == v1alpha1.ReasonServiceSupported {
+				g.Expect(err).NotTo(HaveOccurred())
+			} else {
+				g.Expect(err).To(MatchError(ErrUnsupportedService))
+			}
+		})
+	}
+}
+
+func TestValidateResolverPorts(t *testing.T) {
+	created := metav1.NewTime(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	newElastiService := func(name string, createdAt metav1.Time, resolverPorts ...int32) v1alpha1.ElastiService {
+		es := newTestElastiService(values.ServeMode)
+		es.Name = name
+		es.CreationTimestamp = createdAt
+		for i, resolverPort := range resolverPorts {
+			es.Spec.TCPPorts = append(es.Spec.TCPPorts, v1alpha1.TCPPort{Port: int32(5432 + i), ResolverPort: resolverPort})
+		}
+		return *es
+	}
+	conflicting := newElastiService("conflicting", metav1.NewTime(created.Add(-2*time.Hour)), 15432)
+	conflicting.Status.Conditions = []metav1.Condition{{
+		Type:   v1alpha1.ConditionServiceSupported,
+		Status: metav1.ConditionFalse,
+		Reason: v1alpha1.ReasonResolverPortConflict,
+	}}
+	deleted := newElastiService("deleted", metav1.NewTime(created.Add(-2*time.Hour)), 15432)
+	deleted.DeletionTimestamp = &created
+
+	tests := []struct {
+		name   string
+		es     v1alpha1.ElastiService
+		others []v1alpha1.ElastiService
+		reason string
+	}{
+		{name: "unique resolver port", es: newElastiService("target-es", created, 15432), reason: v1alpha1.ReasonServiceSupported},
+		{name: "reverse proxy port", es: newElastiService("target-es", created, 8012), reason: v1alpha1.ReasonResolverPortConflict},
+		{name: "internal port", es: newElastiService("target-es", created, 8013), reason: v1alpha1.ReasonResolverPortConflict},
+		{name: "TLS passthrough port", es: newElastiService("target-es", created, 8014), reason: v1alpha1.ReasonResolverPortConflict},
+		{name: "same resolver port twice", es: newElastiService("target-es", created, 15432, 15432), reason: v1alpha1.ReasonResolverPortConflict},
+		{
+			name:   "resolver port of an older ElastiService",
+			es:     newElastiService("target-es", created, 15432),
+			others: []v1alpha1.ElastiService{newElastiService("older", metav1.NewTime(created.Add(-time.Hour)), 15432)},
+			reason: v1alpha1.ReasonResolverPortConflict,
+		},
+		{
+			name:   "resolver port of a newer ElastiService",
+			es:     newElastiService("target-es", created, 15432),
+			others: []v1alpha1.ElastiService{newElastiService("newer", metav1.NewTime(created.Add(time.Hour)), 15432)},
+			reason: v1alpha1.ReasonServiceSupported,
+		},
+		{
+			name:   "created in the same second, ordered by name",
+			es:     newElastiService("target-es", created, 15432),
+			others: []v1alpha1.ElastiService{newElastiService("a-es", created, 15432)},
+			reason: v1alpha1.ReasonResolverPortConflict,
+		},
+		{
+			name:   "older ElastiServices which lost a conflict or are deleted don't hold their ports",
+			es:     newElastiService("target-es", created, 15432),
+			others: []v1alpha1.ElastiService{conflicting, deleted},
+			reason: v1alpha1.ReasonServiceSupported,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+			setResolverEnv(t)
+
+			// The ElastiService is also in the list, and must not conflict with itself
+			reason, err := validateResolverPorts(&tt.es, append(tt.others, tt.es))
+			g.Expect(reason).To(Equal(tt.reason))
+			if tt.reason == v1alpha1.ReasonServiceSupported {
+				g.Expect(err).NotTo(HaveOccurred())
+			} else {
+				g.Expect(err).To(MatchError(ErrUnsupportedService))
+			}
+		})
+	}
+}
+
+func TestCheckPublicServiceSupportedResolverPortConflict(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+	older := newTestElastiService(values.ServeMode)
+	older.Name = "older-es"
+	older.UID = "older-uid"
+	older.CreationTimestamp = metav1.NewTime(time.Now().Add(-time.Hour).Truncate(time.Second))
+	older.Spec.TCPPorts = []v1alpha1.TCPPort{{Port: 80, ResolverPort: 15432}}
+	es := newTestElastiService(values.ServeMode)
+	es.CreationTimestamp = metav1.NewTime(time.Now().Truncate(time.Second))
+	es.Spec.TCPPorts = []v1alpha1.TCPPort{{Port: 80, ResolverPort: 15432}}
+	r := newTestReconciler(t, older, es, newTestService())
+
+	supported, err := r.checkPublicServiceSupported(ctx, es)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(supported).To(BeFalse())
+
+	updated := &v1alpha1.ElastiService{}
+	g.Expect(r.Get(ctx, client.ObjectKeyFromObject(es), updated)).To(Succeed())
+	condition := meta.FindStatusCondition(updated.Status.Conditions, v1alpha1.ConditionServiceSupported)
+	g.Expect(condition).NotTo(BeNil())
+	g.Expect(condition.Status).To(Equal(metav1.ConditionFalse))
+	g.Expect(condition.Reason).To(Equal(v1alpha1.ReasonResolverPortConflict))
+	g.Expect(condition.Message).To(ContainSubstring("already used by ElastiService default/older-es"))
+
+	// The older ElastiService keeps the port
+	supported, err = r.checkPublicServiceSupported(ctx, older)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(supported).To(BeTrue())
+}
@@ -0,0 +1,35 @@
+package controller
+
+import (
+	"context"
+	"errors"
+
+	"truefoundry/elasti/operator/internal/prom"
+
+	"github.com/truefoundry/elasti/pkg/values"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+// errorReason returns the reason of an error, for the error labels of the resolver sync and drift metrics
+func errorReason(err error) string {
+	switch {
+	case err == nil:
+		return values.Success
+	case errors.Is(err, ErrNoResolverPodFound):
+		return prom.ReasonNoResolverEndpoints
+	case errors.Is(err, ErrResolverSyncFailed):
+		return prom.ReasonSyncFailed
+	case errors.Is(err, ErrUnsupportedService):
+		return prom.ReasonUnsupportedService
+	case errors.Is(err, context.DeadlineExceeded), apierrors.IsTimeout(err), apierrors.IsServerTimeout(err):
+		return prom.ReasonTimeout
+	case errors.Is(err, context.Canceled):
+		return prom.ReasonCanceled
+	case apierrors.IsNotFound(err):
+		return prom.ReasonNotFound
+	case apierrors.IsConflict(err), apierrors.IsAlreadyExists(err):
+		return prom.ReasonConflict
+	default:
+		return prom.ReasonAPIError
+	}
+}
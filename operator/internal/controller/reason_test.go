@@ -0,0 +1,37 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"truefoundry/elasti/operator/internal/prom"
+
+	. "github.com/onsi/gomega"
+	"github.com/truefoundry/elasti/pkg/values"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+func TestErrorReason(t *testing.T) {
+	resource := schema.GroupResource{Resource: "endpointslices"}
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{err: nil, want: values.Success},
+		{err: fmt.Errorf("getResolverEndpoints: %w", ErrNoResolverPodFound), want: prom.ReasonNoResolverEndpoints},
+		{err: fmt.Errorf("%w: 2 of 3 services", ErrResolverSyncFailed), want: prom.ReasonSyncFailed},
+		{err: fmt.Errorf("applyEndpointsliceToResolver: %w: service has no ports", ErrUnsupportedService), want: prom.ReasonUnsupportedService},
+		{err: fmt.Errorf("failed to get service: %w", apierrors.NewNotFound(resource, "target")), want: prom.ReasonNotFound},
+		{err: apierrors.NewConflict(resource, "target", errors.New("object was modified")), want: prom.ReasonConflict},
+		{err: apierrors.NewTimeoutError("slow", 1), want: prom.ReasonTimeout},
+		{err: fmt.Errorf("failed to get service: %w", context.DeadlineExceeded), want: prom.ReasonTimeout},
+		{err: context.Canceled, want: prom.ReasonCanceled},
+		{err: apierrors.NewForbidden(resource, "target", errors.New("denied")), want: prom.ReasonAPIError},
+	}
+	for _, tt := range tests {
+		NewWithT(t).Expect(errorReason(tt.err)).To(Equal(tt.want), "%v", tt.err)
+	}
+}
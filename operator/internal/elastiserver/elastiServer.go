@@ -15,6 +15,9 @@ import (
 	sentryhttp "github.com/getsentry/sentry-go/http"
 	"github.com/truefoundry/elasti/pkg/k8shelper"
 	"github.com/truefoundry/elasti/pkg/scaling"
+	"github.com/truefoundry/elasti/pkg/tracing"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/trace"
 	"k8s.io/apimachinery/pkg/types"
 
 	"truefoundry/elasti/operator/internal/crddirectory"
@@ -25,6 +28,8 @@ import (
 	"go.uber.org/zap"
 )
 
+var tracer = otel.Tracer("truefoundry/elasti/operator/internal/elastiserver")
+
 type (
 	Response struct {
 		Message string `json:"message"`
@@ -96,6 +101,10 @@ func (s *Server) Start(port string) error {
 }
 
 func (s *Server) resolverReqHandler(w http.ResponseWriter, req *http.Request) {
+	// The scale-up continues the trace of the request which reached the resolver
+	ctx, span := tracer.Start(tracing.Extract(req.Context(), req.Header), "operator.incoming_request",
+		trace.WithSpanKind(trace.SpanKindServer))
+	defer span.End()
 	defer func() {
 		if err := req.Body.Close(); err != nil {
 			s.logger.Error("Failed to close request body", zap.Error(err))
@@ -109,11 +118,13 @@ func (s *Server) resolverReqHandler(w http.ResponseWriter, req *http.Request) {
 	var body messages.RequestCount
 	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
 		s.logger.Error("Failed to decode request body", zap.Error(err))
+		tracing.RecordError(span, err)
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
 
 	s.logger.Info("Received request from Resolver", zap.Any("body", body))
+	span.SetAttributes(tracing.NamespaceKey.String(body.Namespace), tracing.ServiceKey.String(body.Svc))
 
 	response := Response{
 		Message: "Request received successfully!",
@@ -133,7 +144,8 @@ func (s *Server) resolverReqHandler(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	if err = s.scaleTargetForService(req.Context(), body.Svc, body.Namespace); err != nil {
+	if err = s.scaleTargetForService(ctx, body.Svc, body.Namespace); err != nil {
+		tracing.RecordError(span, err)
 		s.logger.Error("Failed to scale target",
 			zap.Error(err),
 			zap.String("service", body.Svc),
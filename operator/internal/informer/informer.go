@@ -14,6 +14,7 @@ import (
 	"github.com/truefoundry/elasti/pkg/config"
 	"github.com/truefoundry/elasti/pkg/values"
 	"go.uber.org/zap"
+	discoveryv1 "k8s.io/api/discovery/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	kRuntime "k8s.io/apimachinery/pkg/runtime"
@@ -80,25 +81,22 @@ func NewInformerManager(logger *zap.Logger, kConfig *rest.Config) *Manager {
 	}
 }
 
+// InitializeResolverInformer starts a watch on the EndpointSlices of the resolver service.
+// We watch the EndpointSlices instead of the deployment, since they reflect the readiness of every resolver pod.
 func (m *Manager) InitializeResolverInformer(handlers cache.ResourceEventHandlerFuncs) error {
-	deploymentGVR := schema.GroupVersionResource{
-		Group:    "apps",
-		Version:  "v1",
-		Resource: "deployments",
-	}
-
 	resolverConfig := config.GetResolverConfig()
+	labelSelector := discoveryv1.LabelServiceName + "=" + resolverConfig.ServiceName
 
 	m.resolver.Informer = cache.NewSharedInformer(
 		&cache.ListWatch{
 			ListFunc: func(_ metav1.ListOptions) (kRuntime.Object, error) {
-				return m.dynamicClient.Resource(deploymentGVR).Namespace(resolverConfig.Namespace).List(context.Background(), metav1.ListOptions{
-					FieldSelector: "metadata.name=" + resolverConfig.DeploymentName,
+				return m.dynamicClient.Resource(values.EndpointSliceGVR).Namespace(resolverConfig.Namespace).List(context.Background(), metav1.ListOptions{
+					LabelSelector: labelSelector,
 				})
 			},
 			WatchFunc: func(_ metav1.ListOptions) (watch.Interface, error) {
-				return m.dynamicClient.Resource(deploymentGVR).Namespace(resolverConfig.Namespace).Watch(context.Background(), metav1.ListOptions{
-					FieldSelector: "metadata.name=" + resolverConfig.DeploymentName,
+				return m.dynamicClient.Resource(values.EndpointSliceGVR).Namespace(resolverConfig.Namespace).Watch(context.Background(), metav1.ListOptions{
+					LabelSelector: labelSelector,
 				})
 			},
 		},
@@ -5,6 +5,19 @@ import (
 	"github.com/prometheus/client_golang/prometheus/promauto"
 )
 
+// Reasons are the values of the error labels of the resolver sync and drift metrics.
+// They are a fixed set, so errors don't add series for every message.
+const (
+	ReasonNoResolverEndpoints = "no_resolver_endpoints"
+	ReasonSyncFailed          = "sync_failed"
+	ReasonUnsupportedService  = "unsupported_service"
+	ReasonNotFound            = "not_found"
+	ReasonConflict            = "conflict"
+	ReasonTimeout             = "timeout"
+	ReasonCanceled            = "canceled"
+	ReasonAPIError            = "api_error"
+)
+
 var (
 	CRDReconcileHistogram = promauto.NewHistogramVec(
 		prometheus.HistogramOpts{
@@ -70,4 +83,45 @@ var (
 		},
 		[]string{"service_name", "namespace", "target", "error"},
 	)
+
+	ResolverSyncHistogram = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "elasti_operator_resolver_sync",
+			Help:    "Histogram of time (seconds) taken to sync resolver endpoints to all services in proxy mode",
+			Buckets: []float64{0.1, 0.5, 1, 2, 5, 10, 30, 60},
+		},
+		[]string{"error"},
+	)
+
+	ResolverSyncServiceCounter = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "elasti_operator_resolver_sync_service_counter",
+			Help: "Counter for EndpointSlice to resolver updates per service",
+		},
+		[]string{"service_name", "namespace", "error"},
+	)
+
+	ResolverSyncRetryCounter = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "elasti_operator_resolver_sync_retry_counter",
+			Help: "Counter for retries while updating EndpointSlice to resolver per service",
+		},
+		[]string{"service_name", "namespace"},
+	)
+
+	ResolverFallbackCounter = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "elasti_operator_resolver_fallback_counter",
+			Help: "Counter for services moved to serve mode because the resolver was unavailable",
+		},
+		[]string{"error"},
+	)
+
+	DriftCounter = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "elasti_operator_drift_counter",
+			Help: "Counter for resources re-created or removed because they drifted from the expected state",
+		},
+		[]string{"crd_name", "mode", "resource", "error"},
+	)
 )
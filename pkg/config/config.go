@@ -7,16 +7,19 @@ import (
 )
 
 const (
-	EnvResolverNamespace       = "ELASTI_RESOLVER_NAMESPACE"
-	EnvResolverDeploymentName  = "ELASTI_RESOLVER_DEPLOYMENT_NAME"
-	EnvResolverServiceName     = "ELASTI_RESOLVER_SERVICE_NAME"
-	EnvResolverPort            = "ELASTI_RESOLVER_PORT"
-	EnvResolverProxyPort       = "ELASTI_RESOLVER_PROXY_PORT"
-	EnvOperatorNamespace       = "ELASTI_OPERATOR_NAMESPACE"
-	EnvOperatorDeploymentName  = "ELASTI_OPERATOR_DEPLOYMENT_NAME"
-	EnvOperatorServiceName     = "ELASTI_OPERATOR_SERVICE_NAME"
-	EnvOperatorPort            = "ELASTI_OPERATOR_PORT"
-	EnvKubernetesClusterDomain = "KUBERNETES_CLUSTER_DOMAIN"
+	EnvResolverNamespace          = "ELASTI_RESOLVER_NAMESPACE"
+	EnvResolverDeploymentName     = "ELASTI_RESOLVER_DEPLOYMENT_NAME"
+	EnvResolverServiceName        = "ELASTI_RESOLVER_SERVICE_NAME"
+	EnvResolverPort               = "ELASTI_RESOLVER_PORT"
+	EnvResolverProxyPort          = "ELASTI_RESOLVER_PROXY_PORT"
+	EnvResolverTLSPassthroughPort = "ELASTI_RESOLVER_TLS_PASSTHROUGH_PORT"
+	EnvResolverTLSTerminationPort = "ELASTI_RESOLVER_TLS_TERMINATION_PORT"
+	EnvResolverServiceAccountName = "ELASTI_RESOLVER_SERVICE_ACCOUNT_NAME"
+	EnvOperatorNamespace          = "ELASTI_OPERATOR_NAMESPACE"
+	EnvOperatorDeploymentName     = "ELASTI_OPERATOR_DEPLOYMENT_NAME"
+	EnvOperatorServiceName        = "ELASTI_OPERATOR_SERVICE_NAME"
+	EnvOperatorPort               = "ELASTI_OPERATOR_PORT"
+	EnvKubernetesClusterDomain    = "KUBERNETES_CLUSTER_DOMAIN"
 )
 
 // Config holds component namespace/name/service and listen port sourced from env.
@@ -27,11 +30,24 @@ type Config struct {
 	Port           int32
 }
 
-// ResolverConfig embeds Config and adds ReverseProxyPort for the resolver.
+const (
+	DefaultResolverTLSPassthroughPort int32 = 8014
+	DefaultResolverTLSTerminationPort int32 = 8015
+)
+
+// ResolverConfig embeds Config and adds the ports the resolver proxies on.
 type ResolverConfig struct {
 	Config
 
 	ReverseProxyPort int32
+	// TLSPassthroughPort is where the resolver reads the SNI of TLS connections, and splices them to the service
+	TLSPassthroughPort int32
+	// TLSTerminationPort is where the resolver terminates TLS, and proxies the requests like the reverse proxy.
+	// Both TLS ports are optional in the env, for setups which predate them.
+	TLSTerminationPort int32
+	// ServiceAccountName is the service account of the resolver pods, which the operator gives access to the Secrets
+	// and ConfigMaps of the ElastiServices. It defaults to the name of the deployment, like in the Helm chart.
+	ServiceAccountName string
 }
 
 // GetKubernetesClusterDomain reads kubernetes cluster domain or panics if it is missing
@@ -41,15 +57,19 @@ func GetKubernetesClusterDomain() string {
 
 // GetResolverConfig reads resolver env vars or panics if any are missing or invalid.
 func GetResolverConfig() ResolverConfig {
+	deploymentName := getEnvStringOrPanic(EnvResolverDeploymentName)
 	return ResolverConfig{
 		Config: Config{
 			Namespace:      getEnvStringOrPanic(EnvResolverNamespace),
-			DeploymentName: getEnvStringOrPanic(EnvResolverDeploymentName),
+			DeploymentName: deploymentName,
 			ServiceName:    getEnvStringOrPanic(EnvResolverServiceName),
 			Port:           getEnvPortOrPanic(EnvResolverPort),
 		},
 
-		ReverseProxyPort: getEnvPortOrPanic(EnvResolverProxyPort),
+		ReverseProxyPort:   getEnvPortOrPanic(EnvResolverProxyPort),
+		TLSPassthroughPort: getEnvPortOrDefault(EnvResolverTLSPassthroughPort, DefaultResolverTLSPassthroughPort),
+		TLSTerminationPort: getEnvPortOrDefault(EnvResolverTLSTerminationPort, DefaultResolverTLSTerminationPort),
+		ServiceAccountName: getEnvStringOrDefault(EnvResolverServiceAccountName, deploymentName),
 	}
 }
 
@@ -73,6 +93,22 @@ func getEnvStringOrPanic(envName string) string {
 	return envValue
 }
 
+// getEnvStringOrDefault returns the env value, or the default if unset.
+func getEnvStringOrDefault(envName, defaultValue string) string {
+	if envValue := os.Getenv(envName); envValue != "" {
+		return envValue
+	}
+	return defaultValue
+}
+
+// getEnvPortOrDefault parses env value as tcp port, returns the default if unset, or panics if invalid.
+func getEnvPortOrDefault(envName string, defaultPort int32) int32 {
+	if os.Getenv(envName) == "" {
+		return defaultPort
+	}
+	return getEnvPortOrPanic(envName)
+}
+
 // getEnvPortOrPanic parses env value as tcp port or panics if value is unset of invalid.
 func getEnvPortOrPanic(envName string) int32 {
 	envValue := getEnvStringOrPanic(envName)
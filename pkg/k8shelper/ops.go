@@ -1,23 +1,38 @@
 package k8shelper
 
 import (
+	"cmp"
 	"context"
+	"crypto/tls"
 	"fmt"
+	"slices"
+	"sync/atomic"
 
 	"github.com/truefoundry/elasti/pkg/logger"
+	"github.com/truefoundry/elasti/pkg/values"
 	"go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
 	discoveryv1 "k8s.io/api/discovery/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/fields"
 	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
 )
 
 // Ops help you do various operations in your kubernetes cluster
 type Ops struct {
-	kClient        *kubernetes.Clientset
-	kDynamicClient *dynamic.DynamicClient
+	kClient        kubernetes.Interface
+	kDynamicClient dynamic.Interface
 	logger         *zap.Logger
+	// privateServiceSlices is the indexer of the EndpointSlices of the private services, once WatchServiceReadiness synced it
+	privateServiceSlices atomic.Pointer[cache.Indexer]
+	// services is the store of the Services, with only their ClusterIPs, once WatchServiceClusterIPs synced it
+	services atomic.Pointer[cache.Store]
 }
 
 // NewOps create a new instance for the k8s Operations
@@ -30,6 +45,11 @@ func NewOps(logger *zap.Logger, config *rest.Config) *Ops {
 	if err != nil {
 		logger.Fatal("Error connecting with kubernetes", zap.Error(err))
 	}
+	return NewOpsWithClients(logger, kClient, kDynamicClient)
+}
+
+// NewOpsWithClients create a new instance for the k8s Operations, with the given clients, like the fake ones in tests
+func NewOpsWithClients(logger *zap.Logger, kClient kubernetes.Interface, kDynamicClient dynamic.Interface) *Ops {
 	return &Ops{
 		logger:         logger.Named("k8sOps"),
 		kClient:        kClient,
@@ -60,3 +80,378 @@ func (k *Ops) CheckIfServiceEndpointSliceActive(ns, svc string) (bool, error) {
 
 	return false, nil
 }
+
+// GetReadyEndpointAddressForPod returns the address of a pod in the endpoints of a service, if the pod is ready.
+// The pod is matched by the target ref of the endpoint, or by its hostname, so it works for the per-pod DNS names of StatefulSets.
+// The EndpointSlices come from the informer of WatchServiceReadiness, once it is synced, and from the API server for the services
+// it doesn't know about, like the private services created by older operators.
+func (k *Ops) GetReadyEndpointAddressForPod(ns, svc, pod string) (string, error) {
+	if indexer := k.privateServiceSlices.Load(); indexer != nil {
+		items, err := (*indexer).ByIndex(endpointSliceServiceIndex, ns+"/"+svc)
+		if err != nil {
+			return "", fmt.Errorf("GetReadyEndpointAddressForPod - ByIndex: %w", err)
+		}
+		if len(items) > 0 {
+			endpointSlices := make([]*discoveryv1.EndpointSlice, 0, len(items))
+			for _, item := range items {
+				if slice, ok := item.(*discoveryv1.EndpointSlice); ok {
+					endpointSlices = append(endpointSlices, slice)
+				}
+			}
+			return readyEndpointAddressForPod(endpointSlices, pod)
+		}
+	}
+
+	endpointSliceList, err := k.kClient.DiscoveryV1().EndpointSlices(ns).List(context.TODO(), metav1.ListOptions{
+		LabelSelector: discoveryv1.LabelServiceName + "=" + svc,
+	})
+	if err != nil {
+		return "", fmt.Errorf("GetReadyEndpointAddressForPod - GET: %w", err)
+	}
+	endpointSlices := make([]*discoveryv1.EndpointSlice, 0, len(endpointSliceList.Items))
+	for i := range endpointSliceList.Items {
+		endpointSlices = append(endpointSlices, &endpointSliceList.Items[i])
+	}
+	return readyEndpointAddressForPod(endpointSlices, pod)
+}
+
+// readyEndpointAddressForPod returns the address of the pod in the EndpointSlices, if the pod is ready
+func readyEndpointAddressForPod(endpointSlices []*discoveryv1.EndpointSlice, pod string) (string, error) {
+	for _, slice := range endpointSlices {
+		for _, endpoint := range slice.Endpoints {
+			isPod := (endpoint.TargetRef != nil && endpoint.TargetRef.Kind == "Pod" && endpoint.TargetRef.Name == pod) ||
+				(endpoint.Hostname != nil && *endpoint.Hostname == pod)
+			if !isPod || len(endpoint.Addresses) == 0 {
+				continue
+			}
+			if endpoint.Conditions.Ready == nil || *endpoint.Conditions.Ready {
+				return endpoint.Addresses[0], nil
+			}
+		}
+	}
+
+	return "", ErrNoActivePodFound
+}
+
+// GetTLSCertificate returns the certificate of a kubernetes.io/tls Secret
+func (k *Ops) GetTLSCertificate(ns, name string) (*tls.Certificate, error) {
+	secret, err := k.kClient.CoreV1().Secrets(ns).Get(context.TODO(), name, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("GetTLSCertificate - GET: %w", err)
+	}
+	cert, err := tls.X509KeyPair(secret.Data[corev1.TLSCertKey], secret.Data[corev1.TLSPrivateKeyKey])
+	if err != nil {
+		return nil, fmt.Errorf("GetTLSCertificate - parse: %w", err)
+	}
+	return &cert, nil
+}
+
+// GetConfigMapValue returns the value of a key of the ConfigMap
+func (k *Ops) GetConfigMapValue(ns, name, key string) (string, error) {
+	configMap, err := k.kClient.CoreV1().ConfigMaps(ns).Get(context.TODO(), name, metav1.GetOptions{})
+	if err != nil {
+		return "", fmt.Errorf("GetConfigMapValue - GET: %w", err)
+	}
+	value, ok := configMap.Data[key]
+	if !ok {
+		return "", fmt.Errorf("GetConfigMapValue - key %s not found in ConfigMap %s/%s", key, ns, name)
+	}
+	return value, nil
+}
+
+// WatchElastiServices calls onChange with all the ElastiServices in the cluster, sorted by namespace and name, once they
+// are all listed, and then every time some of them are added, updated or deleted. Changes which happen while onChange
+// runs are coalesced into a single call. onChange is never called concurrently. It blocks until the context is done.
+func (k *Ops) WatchElastiServices(ctx context.Context, onChange func([]*unstructured.Unstructured)) error {
+	factory := dynamicinformer.NewDynamicSharedInformerFactory(k.kDynamicClient, 0)
+	informer := factory.ForResource(values.ElastiServiceGVR).Informer()
+	// changed holds at most one pending change, so a burst of events only lists the ElastiServices once
+	changed := make(chan struct{}, 1)
+	notify := func() {
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+	}
+	if _, err := informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(any) { notify() },
+		UpdateFunc: func(any, any) { notify() },
+		DeleteFunc: func(any) { notify() },
+	}); err != nil {
+		return fmt.Errorf("WatchElastiServices - AddEventHandler: %w", err)
+	}
+
+	factory.Start(ctx.Done())
+	defer factory.Shutdown()
+	if !cache.WaitForCacheSync(ctx.Done(), informer.HasSynced) {
+		return fmt.Errorf("WatchElastiServices: failed to sync informer: %w", ctx.Err())
+	}
+	// The first call has the full list, so onChange never sees the partial list of the initial events
+	for {
+		// A change which happens from here on lists the ElastiServices again
+		select {
+		case <-changed:
+		default:
+		}
+		items := informer.GetStore().List()
+		elastiServices := make([]*unstructured.Unstructured, 0, len(items))
+		for _, item := range items {
+			if es, ok := item.(*unstructured.Unstructured); ok {
+				elastiServices = append(elastiServices, es)
+			}
+		}
+		slices.SortFunc(elastiServices, func(a, b *unstructured.Unstructured) int {
+			return cmp.Or(cmp.Compare(a.GetNamespace(), b.GetNamespace()), cmp.Compare(a.GetName(), b.GetName()))
+		})
+		onChange(elastiServices)
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-changed:
+		}
+	}
+}
+
+// WatchServiceReadiness calls onChange with the readiness of a private service every time one of its EndpointSlices is added,
+// updated or deleted. Private services are the services with the PrivateServiceLabel.
+// onChange is never called concurrently. It blocks until the context is done.
+func (k *Ops) WatchServiceReadiness(ctx context.Context, onChange func(ns, svc string, ready bool)) error {
+	factory := informers.NewSharedInformerFactoryWithOptions(k.kClient, 0, informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+		options.LabelSelector = values.PrivateServiceLabel + "=true"
+	}))
+	informer := factory.Discovery().V1().EndpointSlices().Informer()
+	if err := informer.AddIndexers(cache.Indexers{endpointSliceServiceIndex: endpointSliceService}); err != nil {
+		return fmt.Errorf("WatchServiceReadiness - AddIndexers: %w", err)
+	}
+	notify := func(obj any) {
+		if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+			obj = tombstone.Obj
+		}
+		slice, ok := obj.(*discoveryv1.EndpointSlice)
+		if !ok {
+			return
+		}
+		svc := slice.Labels[discoveryv1.LabelServiceName]
+		if svc == "" {
+			return
+		}
+		slices, err := informer.GetIndexer().ByIndex(endpointSliceServiceIndex, slice.Namespace+"/"+svc)
+		if err != nil {
+			k.logger.Error("Failed to get EndpointSlices of service", zap.String("service", svc), zap.Error(err))
+			return
+		}
+		ready := false
+		for _, item := range slices {
+			if s, ok := item.(*discoveryv1.EndpointSlice); ok && hasReadyEndpoint(s) {
+				ready = true
+				break
+			}
+		}
+		onChange(slice.Namespace, svc, ready)
+	}
+	if _, err := informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    notify,
+		UpdateFunc: func(_, obj any) { notify(obj) },
+		DeleteFunc: notify,
+	}); err != nil {
+		return fmt.Errorf("WatchServiceReadiness - AddEventHandler: %w", err)
+	}
+
+	factory.Start(ctx.Done())
+	defer factory.Shutdown()
+	if !cache.WaitForCacheSync(ctx.Done(), informer.HasSynced) {
+		return fmt.Errorf("WatchServiceReadiness: failed to sync informer: %w", ctx.Err())
+	}
+	// The pod addresses are read from the informer too, while it runs
+	indexer := informer.GetIndexer()
+	k.privateServiceSlices.Store(&indexer)
+	defer k.privateServiceSlices.Store(nil)
+	<-ctx.Done()
+	return nil
+}
+
+// WatchServiceClusterIPs calls onChange with the ClusterIPs of a service every time it is added, updated or deleted.
+// Deleted and headless services have no ClusterIPs. Only the name and the ClusterIPs of the Services are cached, and
+// GetServiceClusterIPs reads them while it runs. onChange is never called concurrently. It blocks until the context is done.
+func (k *Ops) WatchServiceClusterIPs(ctx context.Context, onChange func(ns, svc string, clusterIPs []string)) error {
+	factory := informers.NewSharedInformerFactory(k.kClient, 0)
+	informer := factory.Core().V1().Services().Informer()
+	if err := informer.SetTransform(trimService); err != nil {
+		return fmt.Errorf("WatchServiceClusterIPs - SetTransform: %w", err)
+	}
+	notify := func(obj any, deleted bool) {
+		if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+			obj = tombstone.Obj
+		}
+		service, ok := obj.(*corev1.Service)
+		if !ok {
+			return
+		}
+		var clusterIPs []string
+		if !deleted {
+			clusterIPs = serviceClusterIPs(service)
+		}
+		onChange(service.Namespace, service.Name, clusterIPs)
+	}
+	if _, err := informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(obj any) { notify(obj, false) },
+		UpdateFunc: func(_, obj any) { notify(obj, false) },
+		DeleteFunc: func(obj any) { notify(obj, true) },
+	}); err != nil {
+		return fmt.Errorf("WatchServiceClusterIPs - AddEventHandler: %w", err)
+	}
+
+	factory.Start(ctx.Done())
+	defer factory.Shutdown()
+	if !cache.WaitForCacheSync(ctx.Done(), informer.HasSynced) {
+		return fmt.Errorf("WatchServiceClusterIPs: failed to sync informer: %w", ctx.Err())
+	}
+	store := informer.GetStore()
+	k.services.Store(&store)
+	defer k.services.Store(nil)
+	<-ctx.Done()
+	return nil
+}
+
+// GetServiceClusterIPs returns the ClusterIPs of the service, from the informer of WatchServiceClusterIPs.
+// It returns none until the informer is synced.
+func (k *Ops) GetServiceClusterIPs(ns, svc string) []string {
+	store := k.services.Load()
+	if store == nil {
+		return nil
+	}
+	item, exists, err := (*store).GetByKey(ns + "/" + svc)
+	if err != nil || !exists {
+		return nil
+	}
+	service, ok := item.(*corev1.Service)
+	if !ok {
+		return nil
+	}
+	return serviceClusterIPs(service)
+}
+
+// trimService drops everything but the name and the ClusterIPs of the Services, so the informer doesn't keep their
+// labels, annotations and ports
+func trimService(obj any) (any, error) {
+	service, ok := obj.(*corev1.Service)
+	if !ok {
+		return obj, nil
+	}
+	return &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            service.Name,
+			Namespace:       service.Namespace,
+			UID:             service.UID,
+			ResourceVersion: service.ResourceVersion,
+		},
+		Spec: corev1.ServiceSpec{ClusterIPs: service.Spec.ClusterIPs},
+	}, nil
+}
+
+// serviceClusterIPs returns the ClusterIPs of the service, which headless services don't have
+func serviceClusterIPs(service *corev1.Service) []string {
+	var clusterIPs []string
+	for _, ip := range service.Spec.ClusterIPs {
+		if ip != "" && ip != corev1.ClusterIPNone {
+			clusterIPs = append(clusterIPs, ip)
+		}
+	}
+	return clusterIPs
+}
+
+// WatchResolverSlices calls onChange every time the EndpointSlice which points a service to the resolver is added, updated
+// or deleted, with whether it exists. These are the EndpointSlices with the ResolverSliceLabel.
+// onChange is never called concurrently. It blocks until the context is done.
+func (k *Ops) WatchResolverSlices(ctx context.Context, onChange func(ns, svc string, exists bool)) error {
+	factory := informers.NewSharedInformerFactoryWithOptions(k.kClient, 0, informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+		options.LabelSelector = values.ResolverSliceLabel + "=true"
+	}))
+	informer := factory.Discovery().V1().EndpointSlices().Informer()
+	notify := func(obj any, exists bool) {
+		if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+			obj = tombstone.Obj
+		}
+		slice, ok := obj.(*discoveryv1.EndpointSlice)
+		if !ok || slice.Labels[discoveryv1.LabelServiceName] == "" {
+			return
+		}
+		onChange(slice.Namespace, slice.Labels[discoveryv1.LabelServiceName], exists)
+	}
+	if _, err := informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(obj any) { notify(obj, true) },
+		UpdateFunc: func(_, obj any) { notify(obj, true) },
+		DeleteFunc: func(obj any) { notify(obj, false) },
+	}); err != nil {
+		return fmt.Errorf("WatchResolverSlices - AddEventHandler: %w", err)
+	}
+
+	factory.Start(ctx.Done())
+	defer factory.Shutdown()
+	if !cache.WaitForCacheSync(ctx.Done(), informer.HasSynced) {
+		return fmt.Errorf("WatchResolverSlices: failed to sync informer: %w", ctx.Err())
+	}
+	<-ctx.Done()
+	return nil
+}
+
+// WatchConfigMap calls onChange with the data of the ConfigMap every time it is added or updated, and with exists false
+// once it is deleted. onChange is never called concurrently. It blocks until the context is done.
+func (k *Ops) WatchConfigMap(ctx context.Context, ns, name string, onChange func(data map[string]string, exists bool)) error {
+	factory := informers.NewSharedInformerFactoryWithOptions(k.kClient, 0, informers.WithNamespace(ns),
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.FieldSelector = fields.OneTermEqualSelector(metav1.ObjectNameField, name).String()
+		}))
+	informer := factory.Core().V1().ConfigMaps().Informer()
+	notify := func(obj any, exists bool) {
+		if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+			obj = tombstone.Obj
+		}
+		configMap, ok := obj.(*corev1.ConfigMap)
+		if !ok || configMap.Name != name {
+			return
+		}
+		if !exists {
+			onChange(nil, false)
+			return
+		}
+		onChange(configMap.Data, true)
+	}
+	if _, err := informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(obj any) { notify(obj, true) },
+		UpdateFunc: func(_, obj any) { notify(obj, true) },
+		DeleteFunc: func(obj any) { notify(obj, false) },
+	}); err != nil {
+		return fmt.Errorf("WatchConfigMap - AddEventHandler: %w", err)
+	}
+
+	factory.Start(ctx.Done())
+	defer factory.Shutdown()
+	if !cache.WaitForCacheSync(ctx.Done(), informer.HasSynced) {
+		return fmt.Errorf("WatchConfigMap: failed to sync informer: %w", ctx.Err())
+	}
+	<-ctx.Done()
+	return nil
+}
+
+const endpointSliceServiceIndex = "service"
+
+// endpointSliceService indexes EndpointSlices by the namespace and name of their service
+func endpointSliceService(obj any) ([]string, error) {
+	slice, ok := obj.(*discoveryv1.EndpointSlice)
+	if !ok || slice.Labels[discoveryv1.LabelServiceName] == "" {
+		return nil, nil
+	}
+	return []string{slice.Namespace + "/" + slice.Labels[discoveryv1.LabelServiceName]}, nil
+}
+
+// hasReadyEndpoint returns true if an endpoint of the EndpointSlice is ready, a nil ready condition is ready
+func hasReadyEndpoint(slice *discoveryv1.EndpointSlice) bool {
+	for _, endpoint := range slice.Endpoints {
+		if endpoint.Conditions.Ready == nil || *endpoint.Conditions.Ready {
+			return true
+		}
+	}
+	return false
+}
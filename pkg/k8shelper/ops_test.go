@@ -0,0 +1,309 @@
+package k8shelper
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+	"github.com/truefoundry/elasti/pkg/values"
+	"go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/utils/ptr"
+)
+
+// newTestOps returns Ops backed by a fake clientset with the given objects
+func newTestOps(objs ...runtime.Object) (*Ops, *fake.Clientset) {
+	kClient := fake.NewClientset(objs...)
+	return NewOpsWithClients(zap.NewNop(), kClient, dynamicfake.NewSimpleDynamicClient(runtime.NewScheme())), kClient
+}
+
+// newTestSlice returns an EndpointSlice of the service, with an endpoint for each of the pods
+func newTestSlice(name, svc string, labels map[string]string, pods map[string]bool) *discoveryv1.EndpointSlice {
+	slice := &discoveryv1.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "default",
+			Labels:    map[string]string{discoveryv1.LabelServiceName: svc},
+		},
+		AddressType: discoveryv1.AddressTypeIPv4,
+	}
+	for key, value := range labels {
+		slice.Labels[key] = value
+	}
+	i := 0
+	for pod, ready := range pods {
+		i++
+		slice.Endpoints = append(slice.Endpoints, discoveryv1.Endpoint{
+			Addresses:  []string{fmt.Sprintf("10.0.0.%d", i)},
+			Hostname:   ptr.To(pod),
+			TargetRef:  &corev1.ObjectReference{Kind: "Pod", Name: pod},
+			Conditions: discoveryv1.EndpointConditions{Ready: ptr.To(ready)},
+		})
+	}
+	return slice
+}
+
+// listActions returns the number of EndpointSlice lists sent to the fake API server
+func listActions(kClient *fake.Clientset) int {
+	count := 0
+	for _, action := range kClient.Actions() {
+		if action.GetVerb() == "list" && action.GetResource().Resource == "endpointslices" {
+			count++
+		}
+	}
+	return count
+}
+
+// readinessChange is a call of the onChange of WatchServiceReadiness
+type readinessChange struct {
+	svc   string
+	ready bool
+}
+
+func TestGetReadyEndpointAddressForPod(t *testing.T) {
+	g := NewWithT(t)
+	ops, _ := newTestOps(newTestSlice("web-private-abc", "web-private", nil, map[string]bool{"web-0": true, "web-1": false}))
+
+	g.Expect(ops.GetReadyEndpointAddressForPod("default", "web-private", "web-0")).To(HavePrefix("10.0.0."))
+	_, err := ops.GetReadyEndpointAddressForPod("default", "web-private", "web-1")
+	g.Expect(err).To(MatchError(ErrNoActivePodFound))
+	_, err = ops.GetReadyEndpointAddressForPod("default", "web-private", "web-2")
+	g.Expect(err).To(MatchError(ErrNoActivePodFound))
+}
+
+func TestWatchServiceReadiness(t *testing.T) {
+	g := NewWithT(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	privateLabel := map[string]string{values.PrivateServiceLabel: "true"}
+	ops, kClient := newTestOps(
+		newTestSlice("web-private-abc", "web-private", privateLabel, map[string]bool{"web-0": false}),
+		// Private services created by older operators don't have the label
+		newTestSlice("legacy-private-abc", "legacy-private", nil, map[string]bool{"legacy-0": true}),
+	)
+
+	var mu sync.Mutex
+	var changes []readinessChange
+	done := make(chan error)
+	go func() {
+		done <- ops.WatchServiceReadiness(ctx, func(_, svc string, ready bool) {
+			mu.Lock()
+			defer mu.Unlock()
+			changes = append(changes, readinessChange{svc: svc, ready: ready})
+		})
+	}()
+	getChanges := func() []readinessChange {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]readinessChange(nil), changes...)
+	}
+	g.Eventually(getChanges, time.Second, 5*time.Millisecond).Should(Equal([]readinessChange{{svc: "web-private", ready: false}}))
+	g.Eventually(ops.privateServiceSlices.Load, time.Second, 5*time.Millisecond).ShouldNot(BeNil())
+
+	// The pods of the watched services are found in the informer, without listing the EndpointSlices
+	lists := listActions(kClient)
+	_, err := ops.GetReadyEndpointAddressForPod("default", "web-private", "web-0")
+	g.Expect(err).To(MatchError(ErrNoActivePodFound))
+	g.Expect(listActions(kClient)).To(Equal(lists))
+	slice := newTestSlice("web-private-abc", "web-private", privateLabel, map[string]bool{"web-0": true})
+	_, err = kClient.DiscoveryV1().EndpointSlices("default").Update(ctx, slice, metav1.UpdateOptions{})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Eventually(getChanges, time.Second, 5*time.Millisecond).Should(ContainElement(readinessChange{svc: "web-private", ready: true}))
+	g.Expect(ops.GetReadyEndpointAddressForPod("default", "web-private", "web-0")).To(HavePrefix("10.0.0."))
+	g.Expect(listActions(kClient)).To(Equal(lists))
+
+	// The other services are still found on the API server
+	g.Expect(ops.GetReadyEndpointAddressForPod("default", "legacy-private", "legacy-0")).To(HavePrefix("10.0.0."))
+	g.Expect(listActions(kClient)).To(Equal(lists + 1))
+
+	// Once the watch is stopped, the API server is used again
+	cancel()
+	g.Eventually(done, time.Second).Should(Receive(BeNil()))
+	g.Expect(ops.privateServiceSlices.Load()).To(BeNil())
+}
+
+func TestWatchServiceClusterIPs(t *testing.T) {
+	g := NewWithT(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ops, kClient := newTestOps(&corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default"},
+		Spec:       corev1.ServiceSpec{ClusterIP: "10.96.0.10", ClusterIPs: []string{"10.96.0.10", "fd00::10"}},
+	})
+
+	var mu sync.Mutex
+	clusterIPs := map[string][]string{}
+	go func() {
+		_ = ops.WatchServiceClusterIPs(ctx, func(ns, svc string, ips []string) {
+			mu.Lock()
+			defer mu.Unlock()
+			clusterIPs[ns+"/"+svc] = ips
+		})
+	}()
+	getClusterIPs := func() map[string][]string {
+		mu.Lock()
+		defer mu.Unlock()
+		return maps.Clone(clusterIPs)
+	}
+	g.Eventually(getClusterIPs, time.Second, 5*time.Millisecond).Should(HaveKeyWithValue("default/web", []string{"10.96.0.10", "fd00::10"}))
+	g.Eventually(func() []string { return ops.GetServiceClusterIPs("default", "web") }, time.Second, 5*time.Millisecond).
+		Should(Equal([]string{"10.96.0.10", "fd00::10"}))
+	g.Expect(ops.GetServiceClusterIPs("default", "unknown")).To(BeEmpty())
+
+	_, err := kClient.CoreV1().Services("default").Create(ctx, &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "headless", Namespace: "default"},
+		Spec:       corev1.ServiceSpec{ClusterIP: corev1.ClusterIPNone, ClusterIPs: []string{corev1.ClusterIPNone}},
+	}, metav1.CreateOptions{})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Eventually(getClusterIPs, time.Second, 5*time.Millisecond).Should(HaveKeyWithValue("default/headless", BeEmpty()))
+
+	g.Expect(kClient.CoreV1().Services("default").Delete(ctx, "web", metav1.DeleteOptions{})).To(Succeed())
+	g.Eventually(getClusterIPs, time.Second, 5*time.Millisecond).Should(HaveKeyWithValue("default/web", BeEmpty()))
+	g.Expect(ops.GetServiceClusterIPs("default", "web")).To(BeEmpty())
+}
+
+func TestWatchResolverSlices(t *testing.T) {
+	g := NewWithT(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	resolverLabel := map[string]string{values.ResolverSliceLabel: "true"}
+	ops, kClient := newTestOps(
+		newTestSlice("to-resolver-web", "web", resolverLabel, nil),
+		newTestSlice("web-abc", "web", nil, nil),
+	)
+
+	var mu sync.Mutex
+	exists := map[string]bool{}
+	go func() {
+		_ = ops.WatchResolverSlices(ctx, func(ns, svc string, found bool) {
+			mu.Lock()
+			defer mu.Unlock()
+			exists[ns+"/"+svc] = found
+		})
+	}()
+	getExists := func() map[string]bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return maps.Clone(exists)
+	}
+	g.Eventually(getExists, time.Second, 5*time.Millisecond).Should(Equal(map[string]bool{"default/web": true}))
+
+	g.Expect(kClient.DiscoveryV1().EndpointSlices("default").Delete(ctx, "to-resolver-web", metav1.DeleteOptions{})).To(Succeed())
+	g.Eventually(getExists, time.Second, 5*time.Millisecond).Should(Equal(map[string]bool{"default/web": false}))
+}
+
+func TestWatchConfigMap(t *testing.T) {
+	g := NewWithT(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ops, kClient := newTestOps(
+		&corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "rules", Namespace: "elasti"}, Data: map[string]string{"rules.yaml": "v1"}},
+		&corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "other", Namespace: "elasti"}, Data: map[string]string{"rules.yaml": "other"}},
+	)
+
+	var mu sync.Mutex
+	var data map[string]string
+	exists := false
+	go func() {
+		_ = ops.WatchConfigMap(ctx, "elasti", "rules", func(d map[string]string, found bool) {
+			mu.Lock()
+			defer mu.Unlock()
+			data, exists = d, found
+		})
+	}()
+	getData := func() map[string]string {
+		mu.Lock()
+		defer mu.Unlock()
+		if !exists {
+			return nil
+		}
+		return maps.Clone(data)
+	}
+	g.Eventually(getData, time.Second, 5*time.Millisecond).Should(HaveKeyWithValue("rules.yaml", "v1"))
+
+	_, err := kClient.CoreV1().ConfigMaps("elasti").Update(ctx, &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "rules", Namespace: "elasti"},
+		Data:       map[string]string{"rules.yaml": "v2"},
+	}, metav1.UpdateOptions{})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Eventually(getData, time.Second, 5*time.Millisecond).Should(HaveKeyWithValue("rules.yaml", "v2"))
+
+	// Other ConfigMaps are not watched
+	g.Expect(kClient.CoreV1().ConfigMaps("elasti").Delete(ctx, "other", metav1.DeleteOptions{})).To(Succeed())
+	g.Consistently(getData, 50*time.Millisecond, 5*time.Millisecond).Should(HaveKeyWithValue("rules.yaml", "v2"))
+
+	g.Expect(kClient.CoreV1().ConfigMaps("elasti").Delete(ctx, "rules", metav1.DeleteOptions{})).To(Succeed())
+	g.Eventually(getData, time.Second, 5*time.Millisecond).Should(BeNil())
+}
+
+// newTestElastiService returns an ElastiService of the service in the default namespace
+func newTestElastiService(name string) *unstructured.Unstructured {
+	es := &unstructured.Unstructured{Object: map[string]any{"spec": map[string]any{"service": name}}}
+	es.SetAPIVersion(values.ElastiServiceGVR.GroupVersion().String())
+	es.SetKind("ElastiService")
+	es.SetNamespace("default")
+	es.SetName(name)
+	return es
+}
+
+func TestWatchElastiServices(t *testing.T) {
+	g := NewWithT(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	dynamicClient := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{values.ElastiServiceGVR: "ElastiServiceList"},
+		newTestElastiService("web"), newTestElastiService("api"), newTestElastiService("batch"))
+	ops := NewOpsWithClients(zap.NewNop(), fake.NewClientset(), dynamicClient)
+
+	var mu sync.Mutex
+	var calls [][]string
+	go func() {
+		_ = ops.WatchElastiServices(ctx, func(elastiServices []*unstructured.Unstructured) {
+			names := make([]string, 0, len(elastiServices))
+			for _, es := range elastiServices {
+				names = append(names, es.GetName())
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			calls = append(calls, names)
+		})
+	}()
+	getCalls := func() [][]string {
+		mu.Lock()
+		defer mu.Unlock()
+		return slices.Clone(calls)
+	}
+
+	// The first call has all the ElastiServices, sorted, instead of one call for each of them
+	g.Eventually(getCalls, time.Second, 5*time.Millisecond).ShouldNot(BeEmpty())
+	g.Consistently(getCalls, 50*time.Millisecond, 5*time.Millisecond).Should(Equal([][]string{{"api", "batch", "web"}}))
+
+	// A burst of changes is coalesced
+	for _, name := range []string{"a", "b", "c", "d"} {
+		_, err := dynamicClient.Resource(values.ElastiServiceGVR).Namespace("default").Create(ctx, newTestElastiService(name), metav1.CreateOptions{})
+		g.Expect(err).NotTo(HaveOccurred())
+	}
+	g.Eventually(func() []string {
+		calls := getCalls()
+		return calls[len(calls)-1]
+	}, time.Second, 5*time.Millisecond).Should(Equal([]string{"a", "api", "b", "batch", "c", "d", "web"}))
+	g.Expect(len(getCalls())).To(BeNumerically("<=", 5))
+
+	g.Expect(dynamicClient.Resource(values.ElastiServiceGVR).Namespace("default").Delete(ctx, "web", metav1.DeleteOptions{})).To(Succeed())
+	g.Eventually(func() []string {
+		calls := getCalls()
+		return calls[len(calls)-1]
+	}, time.Second, 5*time.Millisecond).ShouldNot(ContainElement("web"))
+}
@@ -9,4 +9,6 @@ type Host struct {
 	SourceHost     string
 	TargetHost     string
 	TrafficAllowed bool
+	// TargetPod is set for the per-pod DNS names of a headless service, like web-0.web.ns.svc, and is the pod the request is for
+	TargetPod string
 }
@@ -15,7 +15,11 @@ import (
 	"github.com/truefoundry/elasti/pkg/cronutil"
 	"github.com/truefoundry/elasti/pkg/k8shelper"
 	"github.com/truefoundry/elasti/pkg/scaling/scalers"
+	"github.com/truefoundry/elasti/pkg/tracing"
 	"github.com/truefoundry/elasti/pkg/values"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 	autoscalingv1 "k8s.io/api/autoscaling/v1"
 	v1 "k8s.io/api/core/v1"
@@ -37,6 +41,17 @@ const (
 	kedaPausedReplicasAnnotation = "autoscaling.keda.sh/paused-replicas"
 )
 
+var tracer = otel.Tracer("github.com/truefoundry/elasti/pkg/scaling")
+
+// Attributes of the spans of the scales
+const (
+	targetKindKey      = attribute.Key("elasti.target_kind")
+	targetNameKey      = attribute.Key("elasti.target_name")
+	desiredReplicasKey = attribute.Key("elasti.desired_replicas")
+	currentReplicasKey = attribute.Key("elasti.current_replicas")
+	scaledKey          = attribute.Key("elasti.scaled")
+)
+
 type ScaleDirection string
 
 const (
@@ -57,6 +72,10 @@ type ScaleHandler struct {
 
 	logger         *zap.Logger
 	watchNamespace string
+
+	// scaleDownPaused holds the namespace/service of the services whose targets are not safe to scale to zero,
+	// like the ones kept in serve mode while the resolver is unavailable
+	scaleDownPaused sync.Map
 }
 
 // getMutexForScale returns a mutex for scaling based on the input key
@@ -152,6 +171,10 @@ func (h *ScaleHandler) checkAndScale(ctx context.Context) error {
 
 		switch scaleDirection {
 		case ScaleDown:
+			if h.IsScaleDownPaused(es.Namespace, es.Spec.Service) {
+				h.logger.Debug("Skipping scale down as it is paused", zap.String("service", es.Spec.Service), zap.String("namespace", es.Namespace))
+				continue
+			}
 			err := h.handleScaleToZero(ctx, es)
 			if err != nil {
 				h.logger.Error("failed to scale target to zero", zap.String("service", es.Spec.Service), zap.String("namespace", es.Namespace), zap.Error(err))
@@ -169,6 +192,24 @@ func (h *ScaleHandler) checkAndScale(ctx context.Context) error {
 	return nil
 }
 
+// PauseScaleDown stops the scale down watcher from scaling the target of the service to zero, until ResumeScaleDown is called
+func (h *ScaleHandler) PauseScaleDown(namespace, service string) {
+	h.scaleDownPaused.Store(namespace+"/"+service, true)
+	h.logger.Info("Scale down paused", zap.String("namespace", namespace), zap.String("service", service))
+}
+
+// ResumeScaleDown lets the scale down watcher scale the target of the service to zero again
+func (h *ScaleHandler) ResumeScaleDown(namespace, service string) {
+	h.scaleDownPaused.Delete(namespace + "/" + service)
+	h.logger.Info("Scale down resumed", zap.String("namespace", namespace), zap.String("service", service))
+}
+
+// IsScaleDownPaused returns true if the scale down of the target of the service is paused
+func (h *ScaleHandler) IsScaleDownPaused(namespace, service string) bool {
+	_, paused := h.scaleDownPaused.Load(namespace + "/" + service)
+	return paused
+}
+
 func (h *ScaleHandler) calculateScaleDirection(ctx context.Context, cooldownPeriod time.Duration, es *v1alpha1.ElastiService) (ScaleDirection, error) {
 	if len(es.Spec.Triggers) == 0 {
 		h.logger.Info("No triggers found, skipping scale to zero", zap.String("namespace", es.Namespace), zap.String("service", es.Spec.Service))
@@ -336,11 +377,27 @@ func (h *ScaleHandler) Scale(ctx context.Context,
 	namespace string,
 	targetGVK schema.GroupVersionKind,
 	targetName string,
-	desiredReplicas int32) (bool, error) {
+	desiredReplicas int32) (scaled bool, rErr error) {
+	// The span includes the wait for the lock of the target, which is held by other scales of the target
+	ctx, span := tracer.Start(ctx, "scaler.scale", trace.WithAttributes(
+		tracing.NamespaceKey.String(namespace),
+		targetKindKey.String(targetGVK.Kind),
+		targetNameKey.String(targetName),
+		desiredReplicasKey.Int(int(desiredReplicas)),
+	))
+	defer func() {
+		span.SetAttributes(scaledKey.Bool(scaled))
+		if rErr != nil {
+			tracing.RecordError(span, rErr)
+		}
+		span.End()
+	}()
+
 	// Get mutex for the target
 	mutex := h.getMutexForScale(namespace + "/" + targetGVK.Kind + "/" + targetName)
 	mutex.Lock()
 	defer mutex.Unlock()
+	span.AddEvent("scale lock taken")
 	h.logger.Debug("Scaling", zap.String("kind", targetGVK.Kind), zap.String("namespace", namespace), zap.String("name", targetName), zap.Int32("desired replicas", desiredReplicas))
 
 	// Get the scale object
@@ -373,6 +430,8 @@ func (h *ScaleHandler) Scale(ctx context.Context,
 		return false, fmt.Errorf("failed to get scale for %s/%s (%s): %w", targetGVK.Kind, targetName, namespace, err)
 	}
 
+	span.SetAttributes(currentReplicasKey.Int(int(currentScale.Status.Replicas)))
+
 	// Check if already at desired replicas
 	if currentScale.Status.Replicas == desiredReplicas {
 		h.logger.Info("No scale required. Target already at desired replicas",
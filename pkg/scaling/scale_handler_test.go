@@ -214,3 +214,17 @@ var _ = Describe("StartScaleDownWatcher Polling Interval", func() {
 		})
 	})
 })
+
+var _ = Describe("PauseScaleDown", func() {
+	It("should only pause the scale down of the given service", func() {
+		h := &ScaleHandler{logger: zap.NewNop()}
+
+		h.PauseScaleDown("namespace", "paused")
+		Expect(h.IsScaleDownPaused("namespace", "paused")).To(BeTrue())
+		Expect(h.IsScaleDownPaused("namespace", "other")).To(BeFalse())
+		Expect(h.IsScaleDownPaused("other-namespace", "paused")).To(BeFalse())
+
+		h.ResumeScaleDown("namespace", "paused")
+		Expect(h.IsScaleDownPaused("namespace", "paused")).To(BeFalse())
+	})
+})
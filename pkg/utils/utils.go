@@ -9,6 +9,7 @@ const (
 	prefix                = "elasti-"
 	privateServicePostfix = "-pvt"
 	endpointSlicePostfix  = "-endpointslice-to-resolver"
+	resolverAccessPostfix = "-resolver-access"
 )
 
 // GetPrivateServiceName returns a private service name for a given public service name
@@ -30,3 +31,12 @@ func GetEndpointSliceToResolverName(serviceName string) string {
 	hashed := hex.EncodeToString(hash.Sum(nil))
 	return prefix + serviceName + endpointSlicePostfix + "-" + hashed[:10]
 }
+
+// GetResolverAccessName returns the name of the Role and RoleBinding which give the resolver access to the
+// Secrets and ConfigMaps of an ElastiService
+func GetResolverAccessName(elastiServiceName string) string {
+	hash := sha256.New()
+	hash.Write([]byte(elastiServiceName))
+	hashed := hex.EncodeToString(hash.Sum(nil))
+	return prefix + elastiServiceName + resolverAccessPostfix + "-" + hashed[:10]
+}
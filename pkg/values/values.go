@@ -16,6 +16,14 @@ const (
 	Success = "success"
 
 	DefaultCooldownPeriod = time.Second * 900
+
+	// PrivateServiceLabel is set on the private services, and copied to their EndpointSlices,
+	// so the resolver only watches the EndpointSlices of private services
+	PrivateServiceLabel = "elasti.truefoundry.com/private-service"
+
+	// ResolverSliceLabel is set on the EndpointSlices which point a service to the resolver, so the resolver
+	// knows which services are switched to it, and which ones are switched back to their target
+	ResolverSliceLabel = "elasti.truefoundry.com/endpointslice-to-resolver"
 )
 
 var (
@@ -25,6 +33,12 @@ var (
 		Resource: "services",
 	}
 
+	EndpointSliceGVR = schema.GroupVersionResource{
+		Group:    "discovery.k8s.io",
+		Version:  "v1",
+		Resource: "endpointslices",
+	}
+
 	ElastiServiceGVR = schema.GroupVersionResource{
 		Group:    "elasti.truefoundry.com",
 		Version:  "v1alpha1",
@@ -1,8 +1,11 @@
 package main
 
 import (
+	"cmp"
+	"context"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"time"
 
@@ -16,14 +19,21 @@ import (
 	"github.com/truefoundry/elasti/resolver/internal/handler"
 	"github.com/truefoundry/elasti/resolver/internal/hostmanager"
 	"github.com/truefoundry/elasti/resolver/internal/operator"
+	"github.com/truefoundry/elasti/resolver/internal/prom"
+	"github.com/truefoundry/elasti/resolver/internal/serviceconfig"
+	"github.com/truefoundry/elasti/resolver/internal/tcpproxy"
 	"github.com/truefoundry/elasti/resolver/internal/throttler"
+	"github.com/truefoundry/elasti/resolver/internal/tlsproxy"
 
 	"github.com/kelseyhightower/envconfig"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	elasti_config "github.com/truefoundry/elasti/pkg/config"
 	"github.com/truefoundry/elasti/pkg/k8shelper"
 	"github.com/truefoundry/elasti/pkg/logger"
+	"github.com/truefoundry/elasti/pkg/tracing"
 	"go.uber.org/zap"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/client-go/rest"
 )
 
@@ -32,8 +42,7 @@ type config struct {
 	MaxIdleProxyConnsPerHost int `split_words:"true" default:"100"`
 	// ReqTimeout is the timeout for each request
 	ReqTimeout int `split_words:"true" default:"600"`
-	// TrafficReEnableDuration is the duration for which the traffic is disabled for a host
-	// This is also duration for which we don't recheck readiness of the service
+	// TrafficReEnableDuration is the duration for which we don't recheck readiness of the service
 	TrafficReEnableDuration int `split_words:"true" default:"30"`
 	// OperatorRetryDuration is the duration for which we don't inform the operator
 	// about the traffic on the same host
@@ -46,6 +55,10 @@ type config struct {
 	MaxQueueConcurrency int `split_words:"true" default:"10"`
 	// InitialCapacity is the initial capacity of the semaphore
 	InitialCapacity int `split_words:"true" default:"100"`
+	// ServiceQueueSize and ServiceMaxQueueConcurrency are the limits of every service, for services which don't set
+	// spec.resolver.queue, on top of the global limits. They default to the global limits.
+	ServiceQueueSize           int `split_words:"true" default:"0"`
+	ServiceMaxQueueConcurrency int `split_words:"true" default:"0"`
 	// HeaderForHost is the header to look for to get the host
 	HeaderForHost string `split_words:"true" default:"Host"`
 	// Sentry config
@@ -53,6 +66,43 @@ type config struct {
 	SentryEnv string `envconfig:"SENTRY_ENVIRONMENT" default:""`
 	// H2C
 	EnableH2C bool `envconfig:"ENABLE_H2C" default:"false"`
+	// EnableGRPC returns gRPC statuses for the errors of gRPC requests, it also enables H2C, since gRPC needs HTTP/2
+	EnableGRPC bool `envconfig:"ENABLE_GRPC" default:"false"`
+	// MaxBufferedBodySize is the largest request body, in bytes, which is kept to replay the request,
+	// for services which don't set spec.resolver.requestBody.maxBufferedSize
+	MaxBufferedBodySize int64 `split_words:"true" default:"10485760"`
+	// OversizedBodyPolicy is what is done with larger bodies, either reject or stream
+	OversizedBodyPolicy string `split_words:"true" default:"stream"`
+	// BodyMemoryLimit is the largest request body kept in memory, larger ones are spilled to BodySpillDir
+	BodyMemoryLimit int64  `split_words:"true" default:"65536"`
+	BodySpillDir    string `split_words:"true" default:""`
+	// BodyMemoryBudget and BodyDiskBudget are the bytes all the kept request bodies can use in memory and in BodySpillDir,
+	// requests are rejected with 503 once they are used up. 0 is unlimited.
+	BodyMemoryBudget int64 `split_words:"true" default:"67108864"`
+	BodyDiskBudget   int64 `split_words:"true" default:"1073741824"`
+	// WarmUpMode is what is answered while a target is scaled up, for services which don't set spec.resolver.warmUp.mode,
+	// either hold, page or unavailable
+	WarmUpMode string `split_words:"true" default:"hold"`
+	// DefaultPriority is the priority of queued requests, for services which don't set spec.resolver.priority.default,
+	// either low, normal, high or critical
+	DefaultPriority string `split_words:"true" default:"normal"`
+	// ProxyRetryAttempts is how many times a request is sent again when the connection to the target is refused or reset,
+	// within ProxyRetryWindow seconds after the target scaled up. Only idempotent requests, and the ones with a buffered
+	// body, are retried. 0 disables the retries.
+	ProxyRetryAttempts int `split_words:"true" default:"3"`
+	ProxyRetryWindow   int `split_words:"true" default:"10"`
+	// HostRulesConfigMap is the ConfigMap, in the namespace of the resolver, whose rules.yaml key has the rules
+	// which map hosts to services. It is watched, so changes apply right away, and its rules are dropped once it is deleted.
+	HostRulesConfigMap string `split_words:"true" default:""`
+	// HostCacheSize is the number of hosts which are cached, the least recently used one is evicted once it is full.
+	// HostCacheTTL is how long, in seconds, a host is cached before it is mapped again.
+	HostCacheSize int `split_words:"true" default:"10000"`
+	HostCacheTTL  int `split_words:"true" default:"600"`
+	// RequestMetricLabels are the labels of the incoming requests histogram, out of prom.RequestLabels
+	RequestMetricLabels []string `split_words:"true" default:"source,target,namespace,method,route,status,reason"`
+	// MetricRouteTemplates are the route templates the paths of the requests are normalised to, like /users/{id}.
+	// Paths which match none are "other", and the route is empty if none is set.
+	MetricRouteTemplates []string `split_words:"true" default:""`
 }
 
 func main() {
@@ -82,6 +132,27 @@ func main() {
 		defer sentry.Flush(2 * time.Second)
 	}
 
+	// Spans are sent to the OTLP endpoint of the OTEL_EXPORTER_OTLP_ENDPOINT env, if it is set
+	shutdownTracing, err := tracing.Setup(context.Background(), "elasti-resolver")
+	if err != nil {
+		logger.Fatal("Failed to set up tracing", zap.Error(err))
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		if err := shutdownTracing(ctx); err != nil {
+			logger.Error("Failed to flush spans", zap.Error(err))
+		}
+	}()
+
+	if err := prom.SetRequestLabels(env.RequestMetricLabels); err != nil {
+		logger.Fatal("Invalid request metric labels", zap.Error(err))
+	}
+	routes, err := handler.ParseRouteTemplates(env.MetricRouteTemplates)
+	if err != nil {
+		logger.Fatal("Invalid metric route templates", zap.Error(err))
+	}
+
 	config, err := rest.InClusterConfig()
 	if err != nil {
 		logger.Fatal("Error fetching cluster config", zap.Error(err))
@@ -90,7 +161,30 @@ func main() {
 	// Get components required for the handler
 	k8sUtil := k8shelper.NewOps(logger, config)
 	newOperatorRPC := operator.NewOperatorClient(logger, time.Duration(env.OperatorRetryDuration)*time.Second)
-	newHostManager := hostmanager.NewHostManager(logger, time.Duration(env.TrafficReEnableDuration)*time.Second, env.HeaderForHost)
+	newHostManager := hostmanager.NewHostManager(&hostmanager.Params{
+		Logger:        logger,
+		HeaderForHost: env.HeaderForHost,
+		CacheSize:     env.HostCacheSize,
+		CacheTTL:      time.Duration(env.HostCacheTTL) * time.Second,
+		ClusterIPs:    k8sUtil.GetServiceClusterIPs,
+	})
+	serviceConfig := serviceconfig.NewStore(logger, serviceconfig.Config{
+		RequestBody: serviceconfig.RequestBody{
+			MaxBufferedSize: env.MaxBufferedBodySize,
+			OversizedPolicy: env.OversizedBodyPolicy,
+		},
+		WarmUp: serviceconfig.WarmUp{
+			Mode: env.WarmUpMode,
+		},
+		Queue: serviceconfig.Queue{
+			Depth: cmp.Or(env.ServiceQueueSize, env.QueueSize),
+			// The global concurrency starts at the initial capacity, which may be above the max concurrency
+			MaxConcurrency: cmp.Or(env.ServiceMaxQueueConcurrency, max(env.MaxQueueConcurrency, env.InitialCapacity)),
+		},
+		Priority: serviceconfig.Priority{
+			Default: env.DefaultPriority,
+		},
+	})
 	newTransport := throttler.NewProxyAutoTransport(env.MaxIdleProxyConns, env.MaxIdleProxyConnsPerHost)
 	newThrottler := throttler.NewThrottler(&throttler.Params{
 		QueueRetryDuration:      time.Duration(env.QueueRetryDuration) * time.Second,
@@ -100,8 +194,16 @@ func main() {
 		InitialCapacity:         env.InitialCapacity,
 		TrafficReEnableDuration: time.Duration(env.TrafficReEnableDuration) * time.Second,
 		Logger:                  logger,
+		ServiceConfig:           serviceConfig,
 	})
 
+	// Queued requests are woken up as soon as an EndpointSlice of their private service turns ready
+	go func() {
+		if err := k8sUtil.WatchServiceReadiness(context.Background(), newThrottler.SetServiceReadiness); err != nil {
+			logger.Error("Failed to watch EndpointSlices, queued requests are only checked every queue retry duration", zap.Error(err))
+		}
+	}()
+
 	// Create an instance of sentryhttp
 	sentryHandler := sentryhttp.New(sentryhttp.Options{})
 
@@ -113,6 +215,17 @@ func main() {
 		HostManager: newHostManager,
 		Throttler:   newThrottler,
 		Transport:   newTransport,
+		EnableGRPC:  env.EnableGRPC,
+
+		ServiceConfig:    serviceConfig,
+		BodyMemoryLimit:  env.BodyMemoryLimit,
+		BodySpillDir:     env.BodySpillDir,
+		BodyMemoryBudget: env.BodyMemoryBudget,
+		BodyDiskBudget:   env.BodyDiskBudget,
+		K8sUtil:          k8sUtil,
+		RetryAttempts:    env.ProxyRetryAttempts,
+		RetryWindow:      time.Duration(env.ProxyRetryWindow) * time.Second,
+		Routes:           routes,
 	})
 
 	// Handle all the incoming requests
@@ -126,7 +239,7 @@ func main() {
 		ReadHeaderTimeout: 5 * time.Second,
 	}
 
-	if env.EnableH2C {
+	if env.EnableH2C || env.EnableGRPC {
 		h2s := &http2.Server{}
 		reverseProxyServer.Handler = h2c.NewHandler(reverseProxyServerMux, h2s)
 	}
@@ -138,11 +251,89 @@ func main() {
 		}
 	}()
 
+	// Listen on the TCP ports of the ElastiServices, and follow their changes, with the config of their services
+	tcpProxy := tcpproxy.NewProxy(&tcpproxy.Params{
+		Logger:      logger,
+		ReqTimeout:  time.Duration(env.ReqTimeout) * time.Second,
+		OperatorRPC: newOperatorRPC,
+		Throttler:   newThrottler,
+	})
+	tlsProxy := tlsproxy.NewProxy(&tlsproxy.Params{
+		Logger:      logger,
+		TCPProxy:    tcpProxy,
+		K8sUtil:     k8sUtil,
+		HostManager: newHostManager,
+	})
+	go func() {
+		if err := k8sUtil.WatchElastiServices(context.Background(), func(elastiServices []*unstructured.Unstructured) {
+			tcpProxy.Apply(tcpproxy.PortsFromElastiServices(elastiServices))
+			tlsProxy.Apply(tlsproxy.PortsFromElastiServices(elastiServices))
+			serviceConfig.Apply(elastiServices)
+			newThrottler.PruneServiceBreakers()
+			newHostManager.SetServices(hostmanager.ServicesFromElastiServices(elastiServices))
+			if err := newHostManager.SetRules(hostmanager.RuleSourceElastiServices, hostmanager.RulesFromElastiServices(elastiServices)); err != nil {
+				logger.Error("Invalid hosts in ElastiServices, the previous ones are used", zap.Error(err))
+			}
+		}); err != nil {
+			logger.Error("Failed to watch ElastiServices, TCP and TLS ports are not proxied, and hosts of every service are accepted", zap.Error(err))
+		}
+	}()
+
+	// The traffic of a service is switched to its target once the operator removes its EndpointSlice to the resolver
+	go func() {
+		if err := k8sUtil.WatchResolverSlices(context.Background(), newHostManager.SetResolverSlice); err != nil {
+			logger.Error("Failed to watch EndpointSlices to the resolver, the traffic of every service is allowed", zap.Error(err))
+		}
+	}()
+
+	// Requests sent to the ClusterIP of a managed service are mapped to it
+	go func() {
+		if err := k8sUtil.WatchServiceClusterIPs(context.Background(), newHostManager.SetServiceClusterIPs); err != nil {
+			logger.Error("Failed to watch Services, requests sent to ClusterIPs are rejected", zap.Error(err))
+		}
+	}()
+
+	if env.HostRulesConfigMap != "" {
+		go watchHostRules(logger, k8sUtil, newHostManager, env.HostRulesConfigMap)
+	}
+
+	// TLS connections are spliced to the service they are for, found from their SNI
+	tlsPassthroughPort := fmt.Sprintf(":%d", elasti_config.GetResolverConfig().TLSPassthroughPort)
+	tlsPassthroughListener, err := net.Listen("tcp", tlsPassthroughPort)
+	if err != nil {
+		logger.Fatal("Failed to listen for TLS passthrough: ", zap.Error(err))
+	}
+	logger.Info("TLS Passthrough Server starting at ", zap.String("port", tlsPassthroughPort))
+	go func() {
+		if err := tlsProxy.ServePassthrough(tlsPassthroughListener); err != nil {
+			logger.Fatal("ServePassthrough Failed: ", zap.Error(err))
+		}
+	}()
+
+	// TLS is terminated with the certificate of the service, and the requests are proxied like the ones of the reverse proxy
+	tlsTerminationPort := fmt.Sprintf(":%d", elasti_config.GetResolverConfig().TLSTerminationPort)
+	tlsTerminationServer := &http.Server{
+		Addr:              tlsTerminationPort,
+		Handler:           tlsProxy.WithUpstreamTLS(reverseProxyServerMux),
+		TLSConfig:         tlsProxy.TLSConfig(),
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+	logger.Info("TLS Termination Server starting at ", zap.String("port", tlsTerminationPort))
+	go func() {
+		if err := tlsTerminationServer.ListenAndServeTLS("", ""); err != nil {
+			logger.Fatal("ListenAndServeTLS Failed: ", zap.Error(err))
+		}
+	}()
+
 	// Handle all the incoming internal request like from prometheus that are not related to the reverse proxy
 	internalPort := fmt.Sprintf(":%d", elasti_config.GetResolverConfig().Port)
 	internalServeMux := http.NewServeMux()
-	internalServeMux.Handle("/metrics", promhttp.Handler())
+	// OpenMetrics is enabled, so the exemplars of the incoming requests histogram are exposed
+	internalServeMux.Handle("/metrics", promhttp.InstrumentMetricHandler(prometheus.DefaultRegisterer,
+		promhttp.HandlerFor(prometheus.DefaultGatherer, promhttp.HandlerOpts{EnableOpenMetrics: true})))
 	internalServeMux.Handle("/queue-status", sentryHandler.HandleFunc(requestHandler.GetQueueStatus))
+	internalServeMux.Handle("/queues", sentryHandler.HandleFunc(requestHandler.GetQueues))
+	internalServeMux.Handle("/queues/metrics", requestHandler.QueuesMetricsHandler())
 	internalServeMux.HandleFunc("/healthz", func(w http.ResponseWriter, _ *http.Request) {
 		w.WriteHeader(http.StatusOK)
 		_, err := w.Write([]byte("ok"))
@@ -169,3 +360,32 @@ func main() {
 		logger.Fatal("ListenAndServe Failed: ", zap.Error(err))
 	}
 }
+
+// watchHostRules sets the rules of the host rules ConfigMap on the host manager every time it changes, and drops them once
+// it is deleted. Invalid rules are logged, and the previous ones are used.
+func watchHostRules(logger *zap.Logger, k8sUtil *k8shelper.Ops, hostManager *hostmanager.HostManager, configMap string) {
+	namespace := elasti_config.GetResolverConfig().Namespace
+	if err := k8sUtil.WatchConfigMap(context.Background(), namespace, configMap, func(data map[string]string, exists bool) {
+		if !exists {
+			logger.Warn("Host rules ConfigMap deleted, its rules are dropped", zap.String("configMap", configMap))
+			if err := hostManager.SetRules(hostmanager.RuleSourceConfigMap, nil); err != nil {
+				logger.Error("Failed to drop host rules", zap.String("configMap", configMap), zap.Error(err))
+			}
+			return
+		}
+		value, ok := data["rules.yaml"]
+		if !ok {
+			logger.Error("Host rules ConfigMap has no rules.yaml key, the previous rules are used", zap.String("configMap", configMap))
+			return
+		}
+		rules, err := hostmanager.ParseRules([]byte(value))
+		if err == nil {
+			err = hostManager.SetRules(hostmanager.RuleSourceConfigMap, rules)
+		}
+		if err != nil {
+			logger.Error("Failed to load host rules, the previous ones are used", zap.String("configMap", configMap), zap.Error(err))
+		}
+	}); err != nil {
+		logger.Error("Failed to watch host rules ConfigMap, its rules are not used", zap.String("configMap", configMap), zap.Error(err))
+	}
+}
@@ -0,0 +1,239 @@
+package handler
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync/atomic"
+
+	"github.com/truefoundry/elasti/resolver/internal/prom"
+)
+
+var (
+	// ErrBodyTooLarge is returned for bodies larger than the limit of the service, when they are rejected
+	ErrBodyTooLarge = errors.New("request body is larger than the buffer limit")
+	// ErrBodyNotReplayable is returned when a body which was streamed is sent again
+	ErrBodyNotReplayable = errors.New("request body was streamed and can't be replayed")
+	// ErrInvalidBody is returned for bodies which can't be read
+	ErrInvalidBody = errors.New("error buffering request body")
+	// ErrBodyBudgetExhausted is returned when the bodies which are kept use all the memory or disk budget of the resolver
+	ErrBodyBudgetExhausted = errors.New("request body budget exhausted")
+)
+
+// bodyBudget bounds the bytes of all the request bodies which are kept at the same time, in memory and on disk,
+// so many large requests can't run the resolver out of memory or fill its disk. A limit of 0 is unlimited.
+type bodyBudget struct {
+	memoryLimit int64
+	diskLimit   int64
+	memory      atomic.Int64
+	disk        atomic.Int64
+}
+
+// newBodyBudget returns a budget with the limits, in bytes
+func newBodyBudget(memoryLimit, diskLimit int64) *bodyBudget {
+	return &bodyBudget{memoryLimit: memoryLimit, diskLimit: diskLimit}
+}
+
+// reserve adds n bytes to used, unless it goes over the limit
+func reserve(used *atomic.Int64, limit, n int64) bool {
+	for {
+		current := used.Load()
+		if limit > 0 && current+n > limit {
+			return false
+		}
+		if used.CompareAndSwap(current, current+n) {
+			return true
+		}
+	}
+}
+
+func (b *bodyBudget) reserveMemory(n int64) bool {
+	if b == nil {
+		return true
+	}
+	if !reserve(&b.memory, b.memoryLimit, n) {
+		return false
+	}
+	prom.BufferedBodyBytesGauge.WithLabelValues("memory").Add(float64(n))
+	return true
+}
+
+func (b *bodyBudget) reserveDisk(n int64) bool {
+	if b == nil {
+		return true
+	}
+	if !reserve(&b.disk, b.diskLimit, n) {
+		return false
+	}
+	prom.BufferedBodyBytesGauge.WithLabelValues("disk").Add(float64(n))
+	return true
+}
+
+// release gives back the bytes reserved in memory and on disk
+func (b *bodyBudget) release(memory, disk int64) {
+	if b == nil {
+		return
+	}
+	if memory > 0 {
+		b.memory.Add(-memory)
+		prom.BufferedBodyBytesGauge.WithLabelValues("memory").Sub(float64(memory))
+	}
+	if disk > 0 {
+		b.disk.Add(-disk)
+		prom.BufferedBodyBytesGauge.WithLabelValues("disk").Sub(float64(disk))
+	}
+}
+
+// budgetedReader reserves the bytes it reads, and fails with ErrBodyBudgetExhausted once the budget is used up
+type budgetedReader struct {
+	io.Reader
+	reserve  func(int64) bool
+	reserved int64
+}
+
+func (r *budgetedReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if n > 0 {
+		if !r.reserve(int64(n)) {
+			return 0, ErrBodyBudgetExhausted
+		}
+		r.reserved += int64(n)
+	}
+	return n, err
+}
+
+// requestBody keeps the body of a request, so it can be sent again when the request is replayed.
+// Bodies up to the memory limit are kept in memory, larger ones are spilled to a temporary file.
+// Bodies larger than the buffer limit are only streamed once, with the part which was read before.
+type requestBody struct {
+	memory []byte
+	file   *os.File
+	size   int64
+	// budget has the bytes of the body reserved in memory and on disk, until it is closed
+	budget         *bodyBudget
+	memoryReserved int64
+	diskReserved   int64
+	// rest is the unread part of a body larger than the buffer limit, it is only set if the body is streamed
+	rest     io.ReadCloser
+	streamed bool
+}
+
+// bufferRequestBody reads the body of the request into a requestBody. It returns ErrBodyTooLarge for a body larger than maxSize,
+// after it read maxSize bytes of it. The caller either rejects the request, or streams the body once.
+// The bytes which are kept are reserved in the budget, and ErrBodyBudgetExhausted is returned once it is used up.
+func bufferRequestBody(req *http.Request, memoryLimit, maxSize int64, spillDir string, budget *bodyBudget) (*requestBody, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return &requestBody{}, nil
+	}
+	// Bodies which are known to be too large are not read, so they can be streamed right away
+	if req.ContentLength > maxSize {
+		return &requestBody{rest: req.Body}, ErrBodyTooLarge
+	}
+
+	memoryReader := &budgetedReader{Reader: io.LimitReader(req.Body, min(memoryLimit, maxSize)+1), reserve: budget.reserveMemory}
+	memory, err := io.ReadAll(memoryReader)
+	body := &requestBody{budget: budget, memoryReserved: memoryReader.reserved}
+	if err != nil {
+		_ = body.Close()
+		return nil, fmt.Errorf("error reading request body: %w", err)
+	}
+	body.memory, body.size = memory, int64(len(memory))
+	if body.size <= min(memoryLimit, maxSize) {
+		_ = req.Body.Close()
+		return body, nil
+	}
+	if memoryLimit >= maxSize {
+		body.rest = req.Body
+		return body, ErrBodyTooLarge
+	}
+
+	file, err := os.CreateTemp(spillDir, "elasti-body-")
+	if err != nil {
+		_ = body.Close()
+		return nil, fmt.Errorf("error creating file for request body: %w", err)
+	}
+	body.file = file
+	diskReader := &budgetedReader{
+		Reader:  io.MultiReader(bytes.NewReader(memory), io.LimitReader(req.Body, maxSize-int64(len(memory))+1)),
+		reserve: budget.reserveDisk,
+	}
+	written, err := io.Copy(file, diskReader)
+	// The part which was read in memory is in the file now
+	budget.release(body.memoryReserved, 0)
+	body.memory, body.memoryReserved = nil, 0
+	body.size, body.diskReserved = written, diskReader.reserved
+	if err != nil {
+		_ = body.Close()
+		return nil, fmt.Errorf("error spilling request body: %w", err)
+	}
+	if written > maxSize {
+		body.rest = req.Body
+		return body, ErrBodyTooLarge
+	}
+	_ = req.Body.Close()
+	return body, nil
+}
+
+// replayable returns true if the body can be sent more than once
+func (b *requestBody) replayable() bool {
+	return b.rest == nil
+}
+
+// reader returns a reader for the next attempt to send the body
+func (b *requestBody) reader() (io.ReadCloser, error) {
+	var buffered io.Reader
+	if b.file != nil {
+		buffered = io.NewSectionReader(b.file, 0, b.size)
+	} else {
+		buffered = bytes.NewReader(b.memory)
+	}
+	if b.replayable() {
+		return io.NopCloser(buffered), nil
+	}
+	if b.streamed {
+		return nil, ErrBodyNotReplayable
+	}
+	b.streamed = true
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(buffered, b.rest), b.rest}, nil
+}
+
+// setOn sets the body on the request, for the next attempt to send it. GetBody is set for bodies which can be replayed,
+// so the transport can send the request again.
+func (b *requestBody) setOn(req *http.Request) error {
+	if b.size == 0 && b.rest == nil {
+		req.Body = http.NoBody
+		req.ContentLength = 0
+		req.GetBody = func() (io.ReadCloser, error) { return http.NoBody, nil }
+		return nil
+	}
+	body, err := b.reader()
+	if err != nil {
+		return err
+	}
+	req.Body = body
+	if b.replayable() {
+		req.ContentLength = b.size
+		req.GetBody = b.reader
+	}
+	return nil
+}
+
+// Close releases the budget of the body, and removes the file of a spilled body
+func (b *requestBody) Close() error {
+	b.budget.release(b.memoryReserved, b.diskReserved)
+	b.memoryReserved, b.diskReserved = 0, 0
+	if b.file == nil {
+		return nil
+	}
+	_ = b.file.Close()
+	if err := os.Remove(b.file.Name()); err != nil {
+		return fmt.Errorf("error removing request body file: %w", err)
+	}
+	return nil
+}
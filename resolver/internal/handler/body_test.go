@@ -0,0 +1,124 @@
+package handler
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// sendBody sets the body on the request and reads it, like an attempt to proxy the request
+func sendBody(t *testing.T, body *requestBody, req *http.Request) (string, error) {
+	if err := body.setOn(req); err != nil {
+		return "", err
+	}
+	data, err := io.ReadAll(req.Body)
+	require.NoError(t, err)
+	return string(data), nil
+}
+
+func TestBufferRequestBody(t *testing.T) {
+	tests := []struct {
+		name        string
+		body        string
+		memoryLimit int64
+		maxSize     int64
+		expectedErr error
+		spilled     bool
+		replayable  bool
+	}{
+		{name: "Empty body", body: "", memoryLimit: 8, maxSize: 16, replayable: true},
+		{name: "Kept in memory", body: "in memory", memoryLimit: 16, maxSize: 32, replayable: true},
+		{name: "Spilled to a file", body: "spilled to a file", memoryLimit: 4, maxSize: 32, spilled: true, replayable: true},
+		{name: "Larger than the memory limit and max size", body: "too large for memory", memoryLimit: 16, maxSize: 16, expectedErr: ErrBodyTooLarge},
+		{name: "Larger than the max size", body: "too large to be kept", memoryLimit: 4, maxSize: 8, expectedErr: ErrBodyTooLarge, spilled: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The content length is not known, like a chunked request, so the body has to be read to find its size
+			req, err := http.NewRequest(http.MethodPost, "http://target", io.NopCloser(strings.NewReader(tt.body)))
+			require.NoError(t, err)
+			body, err := bufferRequestBody(req, tt.memoryLimit, tt.maxSize, t.TempDir(), nil)
+			if tt.expectedErr != nil {
+				assert.ErrorIs(t, err, tt.expectedErr)
+			} else {
+				require.NoError(t, err)
+			}
+			defer body.Close()
+			assert.Equal(t, tt.spilled, body.file != nil)
+			assert.Equal(t, tt.replayable, body.replayable())
+
+			// Every attempt gets the whole body, but a streamed one is only sent once
+			sent, err := sendBody(t, body, req)
+			require.NoError(t, err)
+			assert.Equal(t, tt.body, sent)
+			sent, err = sendBody(t, body, req)
+			if !tt.replayable {
+				assert.ErrorIs(t, err, ErrBodyNotReplayable)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.body, sent)
+			assert.Equal(t, int64(len(tt.body)), req.ContentLength)
+		})
+	}
+}
+
+func TestBufferRequestBodyContentLength(t *testing.T) {
+	// A body which is known to be too large is not read, so it can be streamed right away
+	req, err := http.NewRequest(http.MethodPost, "http://target", strings.NewReader("too large to be kept"))
+	require.NoError(t, err)
+	body, err := bufferRequestBody(req, 4, 8, t.TempDir(), nil)
+	assert.ErrorIs(t, err, ErrBodyTooLarge)
+	assert.Zero(t, body.size)
+	assert.Nil(t, body.file)
+}
+
+func TestRequestBodyClose(t *testing.T) {
+	req, err := http.NewRequest(http.MethodPost, "http://target", io.NopCloser(strings.NewReader("spilled to a file")))
+	require.NoError(t, err)
+	body, err := bufferRequestBody(req, 4, 32, t.TempDir(), nil)
+	require.NoError(t, err)
+	require.NotNil(t, body.file)
+
+	// The file of the body is removed once the request is done
+	require.NoError(t, body.Close())
+	_, err = os.Stat(body.file.Name())
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestBufferRequestBodyBudget(t *testing.T) {
+	newRequest := func(body string) *http.Request {
+		req, err := http.NewRequest(http.MethodPost, "http://target", io.NopCloser(strings.NewReader(body)))
+		require.NoError(t, err)
+		return req
+	}
+	budget := newBodyBudget(16, 32)
+
+	// The bytes of a body are reserved until it is closed
+	inMemory, err := bufferRequestBody(newRequest("in memory"), 16, 64, t.TempDir(), budget)
+	require.NoError(t, err)
+	assert.Equal(t, int64(9), budget.memory.Load())
+	_, err = bufferRequestBody(newRequest("over the budget"), 16, 64, t.TempDir(), budget)
+	assert.ErrorIs(t, err, ErrBodyBudgetExhausted)
+	assert.Equal(t, int64(9), budget.memory.Load())
+	require.NoError(t, inMemory.Close())
+	assert.Zero(t, budget.memory.Load())
+
+	// A spilled body only uses the disk budget, once it is in the file
+	spilled, err := bufferRequestBody(newRequest("spilled to a file"), 4, 64, t.TempDir(), budget)
+	require.NoError(t, err)
+	require.NotNil(t, spilled.file)
+	assert.Zero(t, budget.memory.Load())
+	assert.Equal(t, int64(17), budget.disk.Load())
+	_, err = bufferRequestBody(newRequest("also spilled to a file"), 4, 64, t.TempDir(), budget)
+	assert.ErrorIs(t, err, ErrBodyBudgetExhausted)
+	require.NoError(t, spilled.Close())
+	assert.Zero(t, budget.memory.Load())
+	assert.Zero(t, budget.disk.Load())
+}
@@ -0,0 +1,81 @@
+package handler
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// gRPC status codes returned by the resolver, see https://grpc.github.io/grpc/core/md_doc_statuscodes.html
+const (
+	grpcCodeDeadlineExceeded = 4
+	grpcCodeNotFound         = 5
+	grpcCodeInternal         = 13
+	grpcCodeUnavailable      = 14
+)
+
+// isGRPCRequest returns true for gRPC requests. gRPC-Web requests are excluded, as they are not sent over HTTP/2.
+func isGRPCRequest(req *http.Request) bool {
+	contentType := req.Header.Get("Content-Type")
+	return contentType == "application/grpc" || strings.HasPrefix(contentType, "application/grpc+")
+}
+
+// writeGRPCError writes the status in a way gRPC clients can parse. If the response has not started yet,
+// it is sent as a Trailers-Only response, otherwise the status is sent in the trailers.
+func writeGRPCError(w http.ResponseWriter, code int, message string) {
+	if rw, ok := w.(*responseWriter); ok && rw.statusCode != 0 {
+		w.Header().Set(http.TrailerPrefix+"Grpc-Status", strconv.Itoa(code))
+		w.Header().Set(http.TrailerPrefix+"Grpc-Message", encodeGRPCMessage(message))
+		return
+	}
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Grpc-Status", strconv.Itoa(code))
+	w.Header().Set("Grpc-Message", encodeGRPCMessage(message))
+	w.WriteHeader(http.StatusOK)
+}
+
+// encodeGRPCMessage percent-encodes the message, as required for the grpc-message header
+func encodeGRPCMessage(message string) string {
+	var sb strings.Builder
+	for i := 0; i < len(message); i++ {
+		c := message[i]
+		if c >= ' ' && c <= '~' && c != '%' {
+			sb.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&sb, "%%%02X", c)
+	}
+	return sb.String()
+}
+
+// grpcTimeoutUnits maps the units of the grpc-timeout header to durations
+var grpcTimeoutUnits = map[byte]time.Duration{
+	'H': time.Hour,
+	'M': time.Minute,
+	'S': time.Second,
+	'm': time.Millisecond,
+	'u': time.Microsecond,
+	'n': time.Nanosecond,
+}
+
+// parseGRPCTimeout parses the grpc-timeout header, like "100m" for 100 milliseconds
+func parseGRPCTimeout(value string) (time.Duration, bool) {
+	if len(value) < 2 || len(value) > 9 {
+		return 0, false
+	}
+	unit, ok := grpcTimeoutUnits[value[len(value)-1]]
+	if !ok {
+		return 0, false
+	}
+	amount, err := strconv.ParseInt(value[:len(value)-1], 10, 64)
+	if err != nil || amount < 0 {
+		return 0, false
+	}
+	if amount > math.MaxInt64/int64(unit) {
+		return time.Duration(math.MaxInt64), true
+	}
+	return time.Duration(amount) * unit, true
+}
@@ -0,0 +1,138 @@
+package handler
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// newGRPCTarget starts a gRPC server with the health service, where "cold" is a known service
+func newGRPCTarget(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	healthServer := health.NewServer()
+	healthServer.SetServingStatus("cold", healthpb.HealthCheckResponse_SERVING)
+	server := grpc.NewServer()
+	healthpb.RegisterHealthServer(server, healthServer)
+	go func() {
+		_ = server.Serve(listener)
+	}()
+	t.Cleanup(server.Stop)
+	return "http://" + listener.Addr().String()
+}
+
+func newHealthClient(t *testing.T, resolverURL string) healthpb.HealthClient {
+	conn, err := grpc.NewClient(strings.TrimPrefix(resolverURL, "http://"), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+	return healthpb.NewHealthClient(conn)
+}
+
+func TestProxyGRPC(t *testing.T) {
+	// The target is cold for the first checks, so the call is queued before it is proxied
+	resolver, operator := newTestResolver(t, testResolverParams{targetURL: newGRPCTarget(t), coldChecks: 3, enableGRPC: true})
+	client := newHealthClient(t, resolver.URL)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var trailer metadata.MD
+	res, err := client.Check(ctx, &healthpb.HealthCheckRequest{Service: "cold"}, grpc.Trailer(&trailer))
+	require.NoError(t, err)
+	assert.Equal(t, healthpb.HealthCheckResponse_SERVING, res.GetStatus())
+	assert.Positive(t, operator.Requests.Load())
+
+	// The status of the target is forwarded in the trailers
+	_, err = client.Check(ctx, &healthpb.HealthCheckRequest{Service: "unknown"})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func TestGRPCErrors(t *testing.T) {
+	tests := []struct {
+		name         string
+		params       testResolverParams
+		expectedCode codes.Code
+	}{
+		{
+			name: "Queue timeout",
+			params: testResolverParams{
+				coldChecks: 1 << 30,
+				reqTimeout: 200 * time.Millisecond,
+			},
+			expectedCode: codes.DeadlineExceeded,
+		},
+		{
+			name: "Traffic switched",
+			params: testResolverParams{
+				trafficDisabled: true,
+			},
+			expectedCode: codes.Unavailable,
+		},
+		{
+			name:         "Target unreachable",
+			params:       testResolverParams{},
+			expectedCode: codes.Unavailable,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Nothing listens on the closed listener, so the target is unreachable unless it is a test for another error
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			require.NoError(t, err)
+			require.NoError(t, listener.Close())
+			tt.params.targetURL = "http://" + listener.Addr().String()
+			tt.params.enableGRPC = true
+
+			resolver, _ := newTestResolver(t, tt.params)
+			client := newHealthClient(t, resolver.URL)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			_, err = client.Check(ctx, &healthpb.HealthCheckRequest{Service: "cold"})
+			require.Error(t, err)
+			assert.Equal(t, tt.expectedCode, status.Code(err), err.Error())
+		})
+	}
+}
+
+func TestParseGRPCTimeout(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected time.Duration
+		ok       bool
+	}{
+		{value: "100m", expected: 100 * time.Millisecond, ok: true},
+		{value: "5S", expected: 5 * time.Second, ok: true},
+		{value: "1H", expected: time.Hour, ok: true},
+		{value: "10", ok: false},
+		{value: "m", ok: false},
+		{value: "-1S", ok: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			timeout, ok := parseGRPCTimeout(tt.value)
+			assert.Equal(t, tt.ok, ok)
+			assert.Equal(t, tt.expected, timeout)
+		})
+	}
+}
+
+func TestEncodeGRPCMessage(t *testing.T) {
+	assert.Equal(t, "request timeout", encodeGRPCMessage("request timeout"))
+	assert.Equal(t, "100%25 done%0A", encodeGRPCMessage("100% done\n"))
+}
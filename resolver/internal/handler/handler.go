@@ -5,21 +5,45 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/getsentry/sentry-go"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/truefoundry/elasti/resolver/internal/hostmanager"
 	"github.com/truefoundry/elasti/resolver/internal/prom"
+	"github.com/truefoundry/elasti/resolver/internal/serviceconfig"
 	"github.com/truefoundry/elasti/resolver/internal/throttler"
 
+	"github.com/truefoundry/elasti/pkg/k8shelper"
 	"github.com/truefoundry/elasti/pkg/logger"
 	"github.com/truefoundry/elasti/pkg/messages"
+	"github.com/truefoundry/elasti/pkg/tracing"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.34.0"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 )
 
+var tracer = otel.Tracer("github.com/truefoundry/elasti/resolver/internal/handler")
+
+// reasonKey is the attribute of the reason of the error of a request, which is the reason label of its metrics
+const reasonKey = attribute.Key("elasti.reason")
+
+var (
+	// ErrInvalidHost is returned for requests whose host can't be mapped to a service
+	ErrInvalidHost = errors.New("error getting host")
+	// ErrTrafficSwitched is returned for requests of a service whose traffic is switched to its target
+	ErrTrafficSwitched = errors.New("traffic not allowed by resolver")
+)
+
 type (
 	// Handler is the reverse proxy handler
 	Handler struct {
@@ -30,6 +54,20 @@ type (
 		timeout     time.Duration
 		operatorRPC Operator
 		hostManager HostManager
+		enableGRPC  bool
+		// serviceConfig holds how the requests of every service are handled
+		serviceConfig   *serviceconfig.Store
+		bodyMemoryLimit int64
+		bodySpillDir    string
+		bodyBudget      *bodyBudget
+		// k8sUtil reads the templates of warm-up pages, which are cached in warmUpTemplates
+		k8sUtil         *k8shelper.Ops
+		warmUpTemplates sync.Map
+		// retryAttempts is how many times a request is sent again on connection errors, within retryWindow after a scale-up
+		retryAttempts int
+		retryWindow   time.Duration
+		// routes normalise the paths of the requests for the metrics
+		routes *RouteTemplates
 	}
 
 	// Params is the configuration for the handler
@@ -40,17 +78,40 @@ type (
 		HostManager HostManager
 		Throttler   *throttler.Throttler
 		Transport   http.RoundTripper
+		// EnableGRPC makes the errors of gRPC requests gRPC statuses, so gRPC clients can parse them
+		EnableGRPC    bool
+		ServiceConfig *serviceconfig.Store
+		// BodyMemoryLimit is the largest request body kept in memory, larger bodies are spilled to a file in BodySpillDir
+		BodyMemoryLimit int64
+		// BodySpillDir is the directory for the files of spilled request bodies, it defaults to the temporary directory
+		BodySpillDir string
+		// BodyMemoryBudget and BodyDiskBudget bound the bytes of all the request bodies which are kept at the same time,
+		// in memory and on disk. Requests are rejected with 503 once they are used up. 0 is unlimited.
+		BodyMemoryBudget int64
+		BodyDiskBudget   int64
+		K8sUtil          *k8shelper.Ops
+		// RetryAttempts is how many times a request is sent again when the connection to the target is refused or reset,
+		// if the target scaled up less than RetryWindow ago. Retries are disabled with 0.
+		RetryAttempts int
+		RetryWindow   time.Duration
+		// Routes are the route templates the paths of the requests are normalised to, for the route label of the metrics
+		Routes *RouteTemplates
 	}
 
 	// Operator is to communicate with the operator
 	Operator interface {
-		SendIncomingRequestInfo(ns, svc string)
+		// SendIncomingRequestInfo tells the operator about the incoming requests of the service, in the trace of ctx
+		SendIncomingRequestInfo(ctx context.Context, ns, svc string)
+		// LastNotified returns when the operator was last told about the incoming requests of the service
+		LastNotified(ns, svc string) (time.Time, bool)
 	}
 
 	// HostManager is to manage the hosts, and their traffic
 	HostManager interface {
+		// GetHost returns the host of the request, with whether the traffic of its service is allowed
 		GetHost(req *http.Request) (*messages.Host, error)
-		DisableTrafficForHost(service string)
+		// IsTrafficAllowed returns false once the traffic of the service is switched to its target
+		IsTrafficAllowed(namespace, service string) bool
 	}
 )
 
@@ -64,6 +125,16 @@ func NewHandler(hc *Params) *Handler {
 		timeout:     hc.ReqTimeout,
 		operatorRPC: hc.OperatorRPC,
 		hostManager: hc.HostManager,
+		enableGRPC:  hc.EnableGRPC,
+
+		serviceConfig:   hc.ServiceConfig,
+		bodyMemoryLimit: hc.BodyMemoryLimit,
+		bodySpillDir:    hc.BodySpillDir,
+		bodyBudget:      newBodyBudget(hc.BodyMemoryBudget, hc.BodyDiskBudget),
+		k8sUtil:         hc.K8sUtil,
+		retryAttempts:   hc.RetryAttempts,
+		retryWindow:     hc.RetryWindow,
+		routes:          hc.Routes,
 	}
 }
 
@@ -72,67 +143,179 @@ type Response struct {
 }
 
 type QueueStatusResponse struct {
+	// QueueStatus is 1 if the service has queued requests, and 0 otherwise
 	QueueStatus int `json:"queueStatus"`
+	// QueueSize is the number of requests in the queue of the service
+	QueueSize int `json:"queueSize"`
+	// OldestRequestAgeSeconds is how long the oldest request in the queue has been in it
+	OldestRequestAgeSeconds float64 `json:"oldestRequestAgeSeconds"`
 }
 
 func (h *Handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	start := time.Now()
+	// The request continues the trace of the client, if it has one
+	ctx, span := tracer.Start(tracing.Extract(req.Context(), req.Header), "resolver.request",
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(semconv.HTTPRequestMethodKey.String(req.Method)))
+	defer span.End()
+	req = req.WithContext(ctx)
+
 	customWriter := newResponseWriter(w)
 	host, err := h.handleAnyRequest(customWriter, req)
-	var responseStatus, errorMessage string
+	duration := time.Since(start).Seconds()
+	route, reason := h.routes.route(req.URL.Path), requestReason(err)
+	span.SetAttributes(
+		tracing.NamespaceKey.String(host.Namespace),
+		tracing.ServiceKey.String(host.SourceService),
+		semconv.HTTPResponseStatusCode(customWriter.statusCode),
+	)
+	if route != "" {
+		span.SetAttributes(semconv.HTTPRoute(route))
+	}
 	if err != nil {
-		errorMessage = err.Error()
+		span.SetAttributes(reasonKey.String(reason))
+		tracing.RecordError(span, err)
+	}
+	// The labels only have bounded values, the path and the host of the request are kept in the exemplar,
+	// with the trace of the request
+	exemplar := prometheus.Labels{"path": req.URL.Path, "host": host.IncomingHost}
+	if spanContext := span.SpanContext(); spanContext.IsSampled() {
+		exemplar["trace_id"] = spanContext.TraceID().String()
+	}
+	prom.ObserveRequest(prom.RequestObservation{
+		Source:     host.SourceService,
+		Target:     host.TargetService,
+		Namespace:  host.Namespace,
+		Method:     prom.MethodLabel(req.Method),
+		Route:      route,
+		Status:     http.StatusText(customWriter.statusCode),
+		Reason:     reason,
+		SourceHost: host.SourceHost,
+		TargetHost: host.TargetHost,
+	}, duration, exemplar)
+	h.logger.Debug("request served",
+		zap.Int("status", customWriter.statusCode),
+		zap.Int64("bytesWritten", customWriter.bytesWritten),
+		zap.Float64("duration", duration))
+}
+
+// requestReason returns the reason of the error of a request, for the metrics
+func requestReason(err error) string {
+	switch {
+	case err == nil:
+		return prom.ReasonNone
+	case errors.Is(err, hostmanager.ErrUnknownHost):
+		return prom.ReasonUnknownHost
+	case errors.Is(err, ErrInvalidHost):
+		return prom.ReasonInvalidHost
+	case errors.Is(err, ErrTrafficSwitched):
+		return prom.ReasonTrafficSwitched
+	case errors.Is(err, ErrBodyTooLarge):
+		return prom.ReasonBodyTooLarge
+	case errors.Is(err, ErrBodyBudgetExhausted):
+		return prom.ReasonBodyBudgetExhausted
+	case errors.Is(err, ErrInvalidBody):
+		return prom.ReasonInvalidBody
+	default:
+		return throttler.ErrorReason(err)
 	}
-	responseStatus = http.StatusText(customWriter.statusCode)
-	duration := time.Since(start).Seconds()
-	prom.IncomingRequestHistogram.WithLabelValues(
-		host.SourceService,
-		host.TargetService,
-		host.SourceHost,
-		host.TargetHost,
-		host.Namespace,
-		req.Method,
-		req.RequestURI,
-		responseStatus,
-		errorMessage,
-	).Observe(duration)
 }
 
 // handleAnyRequest handles any incoming request
 func (h *Handler) handleAnyRequest(w http.ResponseWriter, req *http.Request) (*messages.Host, error) {
+	isGRPC := h.enableGRPC && isGRPCRequest(req)
 	host, err := h.hostManager.GetHost(req)
-	if err != nil {
-		http.Error(w, "Error getting host", http.StatusInternalServerError)
+	if errors.Is(err, hostmanager.ErrUnknownHost) {
+		// The host is not one of a service managed by an ElastiService, so there is nothing to scale up
+		if isGRPC {
+			writeGRPCError(w, grpcCodeNotFound, "no ElastiService for host")
+		} else {
+			http.Error(w, "no ElastiService for host", http.StatusNotFound)
+		}
+		h.logger.Warn("unknown host", zap.Error(err))
+		return host, fmt.Errorf("%w: %w", ErrInvalidHost, err)
+	} else if err != nil {
+		if isGRPC {
+			writeGRPCError(w, grpcCodeInternal, "error getting host")
+		} else {
+			http.Error(w, "Error getting host", http.StatusInternalServerError)
+		}
 		h.logger.Error("error getting host", zap.Error(err))
-		return host, fmt.Errorf("error getting host: %w", err)
+		return host, fmt.Errorf("%w: %w", ErrInvalidHost, err)
 	}
 	h.logger.Debug("request received", zap.Any("host", logger.MaskMiddle(host.IncomingHost, 4, 4)))
 
 	prom.QueuedRequestGauge.WithLabelValues(host.SourceService, host.Namespace).Inc()
 	defer prom.QueuedRequestGauge.WithLabelValues(host.SourceService, host.Namespace).Dec()
 
-	// This closes the connections, in case the host is scaled up by the controller.
+	// The operator switched the traffic of the service to its target, so this request came on a connection opened before.
+	// The connection is closed, so the client connects to the target.
 	if !host.TrafficAllowed {
 		h.logger.Info("Traffic not allowed", zap.Any("host", logger.MaskMiddle(host.IncomingHost, 4, 4)))
+		if isGRPC {
+			// gRPC clients retry UNAVAILABLE, and HTTP/2 doesn't allow the Connection header
+			writeGRPCError(w, grpcCodeUnavailable, "traffic is switched")
+			return host, ErrTrafficSwitched
+		}
 		w.Header().Set("Connection", "close")
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusForbidden)
 		_, err := w.Write([]byte(`{"error": "traffic is switched"}`))
 		if err != nil {
 			h.logger.Error("Error writing response", zap.Error(err))
-			return host, fmt.Errorf("error writing response: %w", err)
+			return host, fmt.Errorf("%w: error writing response: %w", ErrTrafficSwitched, err)
 		}
-		return host, fmt.Errorf("traffic not allowed by resolver")
+		return host, ErrTrafficSwitched
 	}
 
-	// Inform the controller about the incoming request
-	go h.operatorRPC.SendIncomingRequestInfo(host.Namespace, host.SourceService)
+	// The service may answer with a warm-up response instead of holding the request
+	if h.warmUp(w, req, host) {
+		return host, nil
+	}
+
+	// The body is kept, so the request can be replayed while the target is scaled up. It is only read once the request
+	// has room in the queues, so the requests which are rejected don't use the memory or the disk of the resolver.
+	var body *requestBody
+	defer func() {
+		if body != nil {
+			if err := body.Close(); err != nil {
+				h.logger.Warn("Error closing request body", zap.Error(err))
+			}
+		}
+	}()
+	admitted := func() error {
+		var err error
+		body, err = h.bufferBody(req, host)
+		if err != nil {
+			if !errors.Is(err, ErrBodyTooLarge) && !errors.Is(err, ErrBodyBudgetExhausted) {
+				return fmt.Errorf("%w: %w", ErrInvalidBody, err)
+			}
+			return err
+		}
+		// Inform the controller about the incoming request
+		go h.operatorRPC.SendIncomingRequestInfo(req.Context(), host.Namespace, host.SourceService)
+		return nil
+	}
 
 	// Send request to throttler
-	ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
+	timeout := h.timeout
+	if isGRPC {
+		// The request is not queued longer than the deadline of the gRPC client
+		if grpcTimeout, ok := parseGRPCTimeout(req.Header.Get("Grpc-Timeout")); ok {
+			timeout = min(timeout, grpcTimeout)
+		}
+	}
+	// The request is queued in its trace, but it is not canceled with the request
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(req.Context()), timeout)
 	defer cancel()
-	if tryErr := h.throttler.Try(ctx, host,
+	ctx = throttler.WithPriority(ctx, requestPriority(req, h.serviceConfig.Get(host.Namespace, host.SourceService).Priority))
+	if tryErr := h.throttler.TryAdmitted(ctx, host, admitted,
 		func(count int) error {
+			if body != nil {
+				if err := body.setOn(req); err != nil {
+					return fmt.Errorf("error setting request body: %w", err)
+				}
+			}
 			err := h.ProxyRequest(w, req, host, count)
 			if err != nil {
 				h.logger.Error("Error proxying request", zap.Error(err))
@@ -140,11 +323,22 @@ func (h *Handler) handleAnyRequest(w http.ResponseWriter, req *http.Request) (*m
 				hub.CaptureException(err)
 				return err
 			}
-			h.hostManager.DisableTrafficForHost(host.IncomingHost)
 			return nil
 		}, func() {
-			h.operatorRPC.SendIncomingRequestInfo(host.Namespace, host.SourceService)
+			h.operatorRPC.SendIncomingRequestInfo(ctx, host.Namespace, host.SourceService)
 		}); tryErr != nil {
+		switch {
+		case errors.Is(tryErr, ErrBodyTooLarge):
+			http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+			return host, fmt.Errorf("error buffering request body: %w", tryErr)
+		case errors.Is(tryErr, ErrBodyBudgetExhausted):
+			// The bodies of the other requests use the budget, the client can retry once they are done
+			http.Error(w, "too many request bodies are buffered", http.StatusServiceUnavailable)
+			return host, fmt.Errorf("error buffering request body: %w", tryErr)
+		case errors.Is(tryErr, ErrInvalidBody):
+			http.Error(w, "error reading request body", http.StatusBadRequest)
+			return host, tryErr
+		}
 		// NOTE: Below line throws a CWE, but we identified it as false positive
 		// As we just pass host information like namespace and service name, it is safe to ignore this
 		// See: https://github.com/truefoundry/KubeElasti/pull/177
@@ -155,31 +349,79 @@ func (h *Handler) handleAnyRequest(w http.ResponseWriter, req *http.Request) (*m
 		}
 
 		if errors.Is(tryErr, context.DeadlineExceeded) {
-			http.Error(w, "request timeout", http.StatusRequestTimeout)
+			if isGRPC {
+				writeGRPCError(w, grpcCodeDeadlineExceeded, "request timeout while waiting for the target to be ready")
+			} else {
+				http.Error(w, "request timeout", http.StatusRequestTimeout)
+			}
+			return host, fmt.Errorf("throttler try error: %w", tryErr)
+		}
+		// A full queue is not an error of the resolver, the client can retry later
+		if errors.Is(tryErr, throttler.ErrRequestQueueFull) || errors.Is(tryErr, throttler.ErrRequestShed) {
+			if isGRPC {
+				writeGRPCError(w, grpcCodeUnavailable, "request queue is full")
+			} else {
+				http.Error(w, "request queue is full", http.StatusServiceUnavailable)
+			}
 			return host, fmt.Errorf("throttler try error: %w", tryErr)
 		}
-		w.WriteHeader(http.StatusInternalServerError)
+		if isGRPC {
+			writeGRPCError(w, grpcCodeUnavailable, "target is not available")
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
 		return host, fmt.Errorf("throttler try error: %w", tryErr)
 	}
 	return host, nil
 }
 
 func (h *Handler) ProxyRequest(w http.ResponseWriter, req *http.Request, host *messages.Host, count int) (rErr error) {
+	ctx, span := tracer.Start(req.Context(), "resolver.proxy",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(tracing.TargetServiceKey.String(host.TargetService), attribute.Int("elasti.try_count", count)))
+	defer span.End()
+	req = req.WithContext(ctx)
 	defer func() {
 		if r := recover(); r != nil {
 			rErr = fmt.Errorf("panic in ProxyRequest: %w", r.(error))
 		}
+		if rErr != nil {
+			tracing.RecordError(span, rErr)
+		}
 	}()
-	targetURL, err := url.Parse(host.TargetHost + req.RequestURI)
+	targetHost := host.TargetHost
+	if host.TargetPod != "" {
+		// The per-pod DNS name might still point to the resolver, so we send the request to the pod address
+		address, err := h.throttler.GetPodAddress(host.Namespace, host.TargetService, host.TargetPod)
+		if err != nil {
+			return fmt.Errorf("error getting pod address: %w", err)
+		}
+		if targetHost, err = replaceHostname(targetHost, address); err != nil {
+			return fmt.Errorf("error replacing hostname: %w", err)
+		}
+	}
+	if upstream, ok := throttler.UpstreamTLSFromContext(req.Context()); ok {
+		// The request came through TLS termination, so the target serves TLS on the port of the request
+		var err error
+		if targetHost, err = useHTTPS(targetHost, upstream.Port); err != nil {
+			return fmt.Errorf("error using HTTPS for target: %w", err)
+		}
+	}
+	targetURL, err := url.Parse(targetHost + req.RequestURI)
 	if err != nil {
 		return fmt.Errorf("error parsing target URL: %w", err)
 	}
 
 	proxy := h.NewHeaderPruningReverseProxy(targetURL)
 	proxy.BufferPool = h.bufferPool
-	proxy.Transport = h.transport
+	proxy.Transport = h.retryingTransport(host)
 	proxy.ErrorHandler = func(wErr http.ResponseWriter, reqErr *http.Request, err error) {
 		h.logger.Error("reverse proxy error", zap.Error(err), zap.String("url", reqErr.URL.String()))
+		tracing.RecordError(trace.SpanFromContext(reqErr.Context()), err)
+		if h.enableGRPC && isGRPCRequest(reqErr) {
+			writeGRPCError(wErr, grpcCodeUnavailable, "bad gateway")
+			return
+		}
 		if wErr.Header().Get("Content-Type") == "" {
 			wErr.Header().Set("Content-Type", "text/plain; charset=utf-8")
 			wErr.WriteHeader(http.StatusBadGateway)
@@ -194,6 +436,53 @@ func (h *Handler) ProxyRequest(w http.ResponseWriter, req *http.Request, host *m
 	return nil
 }
 
+// bufferBody keeps the body of the request, with the limits of the service. It returns nil for requests which are
+// streams, like gRPC and protocol upgrades, as their body doesn't end before the response starts.
+// Bodies over the limit are streamed once, unless the service rejects them, which returns ErrBodyTooLarge.
+func (h *Handler) bufferBody(req *http.Request, host *messages.Host) (*requestBody, error) {
+	if isGRPCRequest(req) || req.Header.Get("Upgrade") != "" {
+		return nil, nil
+	}
+	config := h.serviceConfig.Get(host.Namespace, host.SourceService).RequestBody
+	body, err := bufferRequestBody(req, h.bodyMemoryLimit, config.MaxBufferedSize, h.bodySpillDir, h.bodyBudget)
+	if errors.Is(err, ErrBodyTooLarge) {
+		if config.OversizedPolicy == serviceconfig.OversizedBodyReject {
+			_ = body.Close()
+			return nil, err
+		}
+		h.logger.Debug("Request body is too large to be kept, it is streamed once", zap.Int64("maxBufferedSize", config.MaxBufferedSize))
+		return body, nil
+	}
+	return body, err
+}
+
+// replaceHostname replaces the hostname of the URL with the address, and keeps the scheme and the port
+func replaceHostname(rawURL, address string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", fmt.Errorf("error parsing URL: %w", err)
+	}
+	if port := u.Port(); port != "" {
+		u.Host = net.JoinHostPort(address, port)
+	} else if strings.Contains(address, ":") {
+		u.Host = "[" + address + "]"
+	} else {
+		u.Host = address
+	}
+	return u.String(), nil
+}
+
+// useHTTPS makes the URL use HTTPS on the port, and keeps the hostname
+func useHTTPS(rawURL string, port int32) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", fmt.Errorf("error parsing URL: %w", err)
+	}
+	u.Scheme = "https"
+	u.Host = net.JoinHostPort(u.Hostname(), strconv.Itoa(int(port)))
+	return u.String(), nil
+}
+
 // NewHeaderPruningReverseProxy returns a httputil.ReverseProxy that proxies
 // requests to the given targetHost after creating new headers.
 func (h *Handler) NewHeaderPruningReverseProxy(target *url.URL) *httputil.ReverseProxy {
@@ -213,6 +502,9 @@ func (h *Handler) NewHeaderPruningReverseProxy(target *url.URL) *httputil.Revers
 
 			// This ensures the target service sees the original host
 			req.Host = originalHost
+
+			// The target continues the trace of the request
+			tracing.Inject(req.Context(), req.Header)
 		},
 	}
 }
@@ -221,10 +513,13 @@ func (h *Handler) GetQueueStatus(w http.ResponseWriter, r *http.Request) {
 	namespace := r.URL.Query().Get("namespace")
 	service := r.URL.Query().Get("service")
 
-	queueSize := h.throttler.GetQueueSize(namespace, service)
-	response := QueueStatusResponse{}
+	queueStatus := h.throttler.GetQueueStatus(namespace, service)
+	response := QueueStatusResponse{
+		QueueSize:               queueStatus.Size,
+		OldestRequestAgeSeconds: queueStatus.OldestAge.Seconds(),
+	}
 
-	if queueSize > 0 {
+	if queueStatus.Size > 0 {
 		response.QueueStatus = 1
 	} else {
 		response.QueueStatus = 0
@@ -0,0 +1,618 @@
+package handler
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/truefoundry/elasti/pkg/k8shelper"
+	"github.com/truefoundry/elasti/pkg/messages"
+	"github.com/truefoundry/elasti/pkg/tracing"
+	"github.com/truefoundry/elasti/resolver/internal/hostmanager"
+	"github.com/truefoundry/elasti/resolver/internal/serviceconfig"
+	"github.com/truefoundry/elasti/resolver/internal/testutil"
+	"github.com/truefoundry/elasti/resolver/internal/throttler"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	semconv "go.opentelemetry.io/otel/semconv/v1.34.0"
+	"go.uber.org/zap"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"golang.org/x/net/websocket"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+type fakeHostManager struct {
+	targetHost      string
+	trafficDisabled bool
+}
+
+func (hm *fakeHostManager) GetHost(_ *http.Request) (*messages.Host, error) {
+	return &messages.Host{
+		IncomingHost:   "target.namespace.svc.cluster.local",
+		Namespace:      "namespace",
+		SourceService:  "target",
+		TargetService:  "target-pvt",
+		SourceHost:     "http://target.namespace.svc.cluster.local",
+		TargetHost:     hm.targetHost,
+		TrafficAllowed: !hm.trafficDisabled,
+	}, nil
+}
+
+func (hm *fakeHostManager) IsTrafficAllowed(_, _ string) bool {
+	return !hm.trafficDisabled
+}
+
+// warmUpTemplate is the template of the warm-up page in the warm-up ConfigMap of the fake API server
+const warmUpTemplate = `<p>{{.Namespace}}/{{.Service}} back in {{.RetryAfter}}s</p>`
+
+// warmUpConfigMap is the warm-up ConfigMap of the fake API server
+var warmUpConfigMap = &corev1.ConfigMap{
+	ObjectMeta: metav1.ObjectMeta{Name: "warm-up", Namespace: "namespace"},
+	Data:       map[string]string{"page.html": warmUpTemplate},
+}
+
+// newTestOps returns k8shelper.Ops for the private service, which only has a ready endpoint after coldChecks lists,
+// like a target which is scaled up from zero, and the warm-up ConfigMap
+func newTestOps(coldChecks int64) *k8shelper.Ops {
+	return testutil.NewOps(testutil.ReadyAfter(coldChecks), warmUpConfigMap)
+}
+
+type testResolverParams struct {
+	targetURL string
+	// coldChecks is the number of readiness checks for which the target is not ready
+	coldChecks      int64
+	reqTimeout      time.Duration
+	trafficDisabled bool
+	enableGRPC      bool
+	// upstreamTLS is set on the requests, like the TLS termination server does
+	upstreamTLS *throttler.UpstreamTLS
+	// requestBody is how the bodies of the target are kept, it defaults to 1MiB with oversized bodies streamed
+	requestBody     *serviceconfig.RequestBody
+	bodyMemoryLimit int64
+	// bodyMemoryBudget and bodyDiskBudget bound the bytes of all the kept bodies, they are unlimited by default
+	bodyMemoryBudget int64
+	bodyDiskBudget   int64
+	warmUp           serviceconfig.WarmUp
+	retryAttempts    int
+}
+
+// newTestResolver returns a resolver which proxies every request to the target, and accepts HTTP/2 without TLS
+func newTestResolver(t *testing.T, params testResolverParams) (*httptest.Server, *testutil.FakeOperator) {
+	logger := zap.NewNop()
+	operator := &testutil.FakeOperator{}
+	reqTimeout := params.reqTimeout
+	if reqTimeout == 0 {
+		reqTimeout = 5 * time.Second
+	}
+	requestBody := serviceconfig.RequestBody{MaxBufferedSize: 1 << 20, OversizedPolicy: serviceconfig.OversizedBodyStream}
+	if params.requestBody != nil {
+		requestBody = *params.requestBody
+	}
+	k8sUtil := newTestOps(params.coldChecks)
+	h := NewHandler(&Params{
+		Logger:      logger,
+		ReqTimeout:  reqTimeout,
+		OperatorRPC: operator,
+		HostManager: &fakeHostManager{targetHost: params.targetURL, trafficDisabled: params.trafficDisabled},
+		Throttler: throttler.NewThrottler(&throttler.Params{
+			QueueRetryDuration:      10 * time.Millisecond,
+			TrafficReEnableDuration: time.Second,
+			K8sUtil:                 k8sUtil,
+			QueueDepth:              10,
+			MaxConcurrency:          10,
+			InitialCapacity:         10,
+			Logger:                  logger,
+		}),
+		Transport:        throttler.NewProxyAutoTransport(10, 10),
+		EnableGRPC:       params.enableGRPC,
+		ServiceConfig:    serviceconfig.NewStore(logger, serviceconfig.Config{RequestBody: requestBody, WarmUp: params.warmUp}),
+		BodyMemoryLimit:  params.bodyMemoryLimit,
+		BodySpillDir:     t.TempDir(),
+		BodyMemoryBudget: params.bodyMemoryBudget,
+		BodyDiskBudget:   params.bodyDiskBudget,
+		K8sUtil:          k8sUtil,
+		RetryAttempts:    params.retryAttempts,
+		RetryWindow:      time.Minute,
+	})
+	var handler http.Handler = h
+	if params.upstreamTLS != nil {
+		handler = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			h.ServeHTTP(w, req.WithContext(throttler.WithUpstreamTLS(req.Context(), *params.upstreamTLS)))
+		})
+	}
+	resolver := httptest.NewServer(h2c.NewHandler(handler, &http2.Server{}))
+	t.Cleanup(resolver.Close)
+	return resolver, operator
+}
+
+func TestProxyWebSocket(t *testing.T) {
+	exporter := recordSpans(t)
+	echo := httptest.NewServer(websocket.Handler(func(ws *websocket.Conn) {
+		_, _ = io.Copy(ws, ws)
+	}))
+	t.Cleanup(echo.Close)
+	// The target is cold for the first checks, so the upgrade request is queued before it is proxied
+	resolver, operator := newTestResolver(t, testResolverParams{targetURL: echo.URL, coldChecks: 3})
+
+	config, err := websocket.NewConfig("ws"+strings.TrimPrefix(resolver.URL, "http")+"/echo", resolver.URL)
+	require.NoError(t, err)
+	ctx, clientSpan := otel.Tracer("test").Start(context.Background(), "client")
+	tracing.Inject(ctx, config.Header)
+	clientSpan.End()
+	ws, err := websocket.DialConfig(config)
+	require.NoError(t, err)
+
+	for _, message := range []string{"hello", "world"} {
+		require.NoError(t, websocket.Message.Send(ws, message))
+		var reply string
+		require.NoError(t, ws.SetReadDeadline(time.Now().Add(5*time.Second)))
+		require.NoError(t, websocket.Message.Receive(ws, &reply))
+		assert.Equal(t, message, reply)
+	}
+	assert.Positive(t, operator.Requests.Load())
+
+	// The request is recorded with the 101 Switching Protocols the proxy wrote to the hijacked connection,
+	// once the connection is closed
+	require.NoError(t, ws.Close())
+	var statusCode attribute.Value
+	require.Eventually(t, func() bool {
+		for _, span := range exporter.GetSpans() {
+			if span.Name != "resolver.request" || span.SpanContext.TraceID() != clientSpan.SpanContext().TraceID() {
+				continue
+			}
+			for _, attr := range span.Attributes {
+				if attr.Key == semconv.HTTPResponseStatusCodeKey {
+					statusCode = attr.Value
+					return true
+				}
+			}
+		}
+		return false
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, int64(http.StatusSwitchingProtocols), statusCode.AsInt64())
+
+	families, err := prometheus.DefaultGatherer.Gather()
+	require.NoError(t, err)
+	var statuses []string
+	for _, family := range families {
+		if family.GetName() != "elasti_resolver_incoming_requests" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == "status" {
+					statuses = append(statuses, label.GetValue())
+				}
+			}
+		}
+	}
+	assert.Contains(t, statuses, "Switching Protocols")
+	assert.NotContains(t, statuses, "")
+}
+
+func TestProxyHTTPSUpstream(t *testing.T) {
+	target := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_, _ = io.WriteString(w, "served over "+req.Proto+" with TLS "+fmt.Sprint(req.TLS != nil))
+	}))
+	t.Cleanup(target.Close)
+	targetPort, err := strconv.Atoi(target.URL[strings.LastIndex(target.URL, ":")+1:])
+	require.NoError(t, err)
+
+	// The target host is plain HTTP on another port, the upstream TLS makes it HTTPS on the port of the target
+	resolver, _ := newTestResolver(t, testResolverParams{
+		targetURL: "http://127.0.0.1:1",
+		upstreamTLS: &throttler.UpstreamTLS{
+			Port:               int32(targetPort),
+			InsecureSkipVerify: true,
+		},
+	})
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	res, err := client.Get(resolver.URL + "/")
+	require.NoError(t, err)
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "served over HTTP/1.1 with TLS true", string(body))
+}
+
+func TestProxyStreaming(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		first       string
+		second      string
+	}{
+		{
+			name:        "Server-sent events",
+			contentType: "text/event-stream",
+			first:       "data: first\n\n",
+			second:      "data: second\n\n",
+		},
+		{
+			name:        "Chunked response",
+			contentType: "text/plain",
+			first:       "first chunk\n",
+			second:      "second chunk\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			release := make(chan struct{})
+			target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				w.Header().Set("Content-Type", tt.contentType)
+				_, _ = io.WriteString(w, tt.first)
+				w.(http.Flusher).Flush()
+				<-release
+				_, _ = io.WriteString(w, tt.second)
+			}))
+			t.Cleanup(target.Close)
+			resolver, _ := newTestResolver(t, testResolverParams{targetURL: target.URL})
+
+			client := &http.Client{Timeout: 5 * time.Second}
+			res, err := client.Get(resolver.URL + "/stream")
+			require.NoError(t, err)
+			defer res.Body.Close()
+			assert.Equal(t, http.StatusOK, res.StatusCode)
+
+			// The first part must arrive while the target is still writing the response
+			reader := bufio.NewReader(res.Body)
+			firstLine, err := reader.ReadString('\n')
+			require.NoError(t, err)
+			assert.Equal(t, strings.SplitAfter(tt.first, "\n")[0], firstLine)
+
+			close(release)
+			remaining, err := io.ReadAll(reader)
+			require.NoError(t, err)
+			assert.Equal(t, strings.TrimPrefix(tt.first+tt.second, firstLine), string(remaining))
+		})
+	}
+}
+
+func TestProxyRequestBody(t *testing.T) {
+	tests := []struct {
+		name            string
+		body            string
+		bodyMemoryLimit int64
+		policy          string
+		memoryBudget    int64
+		diskBudget      int64
+		expectedStatus  int
+	}{
+		{name: "Kept in memory", body: "small body", bodyMemoryLimit: 1024, policy: serviceconfig.OversizedBodyReject, expectedStatus: http.StatusOK},
+		{name: "Spilled to a file", body: "larger than the memory limit", bodyMemoryLimit: 4, policy: serviceconfig.OversizedBodyReject, expectedStatus: http.StatusOK},
+		{name: "Oversized and rejected", body: strings.Repeat("x", 64), bodyMemoryLimit: 4, policy: serviceconfig.OversizedBodyReject, expectedStatus: http.StatusRequestEntityTooLarge},
+		{name: "Oversized and streamed", body: strings.Repeat("x", 64), bodyMemoryLimit: 4, policy: serviceconfig.OversizedBodyStream, expectedStatus: http.StatusOK},
+		{name: "Over the memory budget", body: "larger than the budget", bodyMemoryLimit: 1024, policy: serviceconfig.OversizedBodyReject, memoryBudget: 8, expectedStatus: http.StatusServiceUnavailable},
+		{name: "Over the disk budget", body: "larger than the budget", bodyMemoryLimit: 4, policy: serviceconfig.OversizedBodyReject, diskBudget: 8, expectedStatus: http.StatusServiceUnavailable},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				_, _ = io.Copy(w, req.Body)
+			}))
+			t.Cleanup(target.Close)
+			// The target is cold for the first checks, so the body is kept while the request is queued
+			resolver, _ := newTestResolver(t, testResolverParams{
+				targetURL:        target.URL,
+				coldChecks:       3,
+				requestBody:      &serviceconfig.RequestBody{MaxBufferedSize: 32, OversizedPolicy: tt.policy},
+				bodyMemoryLimit:  tt.bodyMemoryLimit,
+				bodyMemoryBudget: tt.memoryBudget,
+				bodyDiskBudget:   tt.diskBudget,
+			})
+
+			client := &http.Client{Timeout: 5 * time.Second}
+			res, err := client.Post(resolver.URL+"/", "text/plain", strings.NewReader(tt.body))
+			require.NoError(t, err)
+			defer res.Body.Close()
+			body, err := io.ReadAll(res.Body)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expectedStatus, res.StatusCode)
+			if tt.expectedStatus == http.StatusOK {
+				assert.Equal(t, tt.body, string(body))
+			}
+		})
+	}
+}
+
+// resettingListener resets the first connections it accepts, like a pod which is ready but doesn't accept connections yet
+type resettingListener struct {
+	net.Listener
+	resets atomic.Int64
+}
+
+func (l *resettingListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil || l.resets.Add(-1) < 0 {
+			return conn, err
+		}
+		_ = conn.(*net.TCPConn).SetLinger(0)
+		_ = conn.Close()
+	}
+}
+
+func TestProxyRetry(t *testing.T) {
+	tests := []struct {
+		name           string
+		method         string
+		body           string
+		retryAttempts  int
+		expectedStatus int
+	}{
+		{name: "Idempotent request", method: http.MethodGet, retryAttempts: 3, expectedStatus: http.StatusOK},
+		{name: "Buffered body", method: http.MethodPost, body: "replayed body", retryAttempts: 3, expectedStatus: http.StatusOK},
+		{name: "Too many resets", method: http.MethodGet, retryAttempts: 1, expectedStatus: http.StatusBadGateway},
+		{name: "Retries disabled", method: http.MethodGet, expectedStatus: http.StatusBadGateway},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				_, _ = io.WriteString(w, req.Method+" ")
+				_, _ = io.Copy(w, req.Body)
+			}))
+			listener := &resettingListener{Listener: target.Listener}
+			listener.resets.Store(2)
+			target.Listener = listener
+			target.Start()
+			t.Cleanup(target.Close)
+			// The target is cold for the first checks, so the resets happen right after it scaled up
+			resolver, _ := newTestResolver(t, testResolverParams{targetURL: target.URL, coldChecks: 3, retryAttempts: tt.retryAttempts})
+
+			req, err := http.NewRequest(tt.method, resolver.URL+"/", strings.NewReader(tt.body))
+			require.NoError(t, err)
+			client := &http.Client{Timeout: 5 * time.Second}
+			res, err := client.Do(req)
+			require.NoError(t, err)
+			defer res.Body.Close()
+			body, err := io.ReadAll(res.Body)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expectedStatus, res.StatusCode)
+			if tt.expectedStatus == http.StatusOK {
+				assert.Equal(t, tt.method+" "+tt.body, string(body))
+			}
+		})
+	}
+}
+
+func TestWarmUp(t *testing.T) {
+	tests := []struct {
+		name           string
+		warmUp         serviceconfig.WarmUp
+		header         http.Header
+		expectedStatus int
+		expectedType   string
+		expectedBody   string
+	}{
+		{
+			name:           "Unavailable",
+			warmUp:         serviceconfig.WarmUp{Mode: serviceconfig.WarmUpUnavailable},
+			header:         http.Header{"Accept": {"text/html"}},
+			expectedStatus: http.StatusServiceUnavailable,
+			expectedType:   "application/json",
+			expectedBody:   `{"error": "service is warming up"}`,
+		},
+		{
+			name:           "Page",
+			warmUp:         serviceconfig.WarmUp{Mode: serviceconfig.WarmUpPage},
+			header:         http.Header{"Accept": {"text/html,application/xhtml+xml"}},
+			expectedStatus: http.StatusServiceUnavailable,
+			expectedType:   "text/html; charset=utf-8",
+			expectedBody:   `<meta http-equiv="refresh" content="5">`,
+		},
+		{
+			name:           "Page for an API client",
+			warmUp:         serviceconfig.WarmUp{Mode: serviceconfig.WarmUpPage},
+			header:         http.Header{"Accept": {"application/json"}},
+			expectedStatus: http.StatusServiceUnavailable,
+			expectedType:   "application/json",
+			expectedBody:   `{"error": "service is warming up"}`,
+		},
+		{
+			name:           "Page from a ConfigMap",
+			warmUp:         serviceconfig.WarmUp{Mode: serviceconfig.WarmUpPage, TemplateConfigMap: "warm-up", TemplateKey: "page.html"},
+			header:         http.Header{"Accept": {"text/html"}},
+			expectedStatus: http.StatusServiceUnavailable,
+			expectedType:   "text/html; charset=utf-8",
+			expectedBody:   "<p>namespace/target back in 5s</p>",
+		},
+		{
+			name:           "Held on request",
+			warmUp:         serviceconfig.WarmUp{Mode: serviceconfig.WarmUpUnavailable},
+			header:         http.Header{HoldHeader: {"true"}},
+			expectedStatus: http.StatusOK,
+			expectedType:   "text/plain; charset=utf-8",
+			expectedBody:   "ready",
+		},
+		{
+			name:           "Hold",
+			warmUp:         serviceconfig.WarmUp{Mode: serviceconfig.WarmUpHold},
+			expectedStatus: http.StatusOK,
+			expectedType:   "text/plain; charset=utf-8",
+			expectedBody:   "ready",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				_, _ = io.WriteString(w, "ready")
+			}))
+			t.Cleanup(target.Close)
+			// The target is cold for the first checks, so held requests wait and the others get the warm-up response
+			resolver, operator := newTestResolver(t, testResolverParams{targetURL: target.URL, coldChecks: 3, warmUp: tt.warmUp})
+
+			req, err := http.NewRequest(http.MethodGet, resolver.URL+"/", nil)
+			require.NoError(t, err)
+			req.Header = tt.header
+			client := &http.Client{Timeout: 5 * time.Second}
+			res, err := client.Do(req)
+			require.NoError(t, err)
+			defer res.Body.Close()
+			body, err := io.ReadAll(res.Body)
+			require.NoError(t, err)
+
+			assert.Equal(t, tt.expectedStatus, res.StatusCode)
+			assert.Equal(t, tt.expectedType, res.Header.Get("Content-Type"))
+			assert.Contains(t, string(body), tt.expectedBody)
+			if tt.expectedStatus == http.StatusServiceUnavailable {
+				assert.Equal(t, "5", res.Header.Get("Retry-After"))
+			}
+			assert.Eventually(t, func() bool { return operator.Requests.Load() > 0 }, time.Second, 10*time.Millisecond)
+		})
+	}
+}
+
+func TestGetQueueStatus(t *testing.T) {
+	logger := zap.NewNop()
+	// The target is never ready, so the request stays in the queue
+	newThrottler := throttler.NewThrottler(&throttler.Params{
+		QueueRetryDuration:      10 * time.Millisecond,
+		TrafficReEnableDuration: time.Second,
+		K8sUtil:                 testutil.NewOps(testutil.NotReady),
+		QueueDepth:              10,
+		MaxConcurrency:          10,
+		InitialCapacity:         10,
+		Logger:                  logger,
+	})
+	h := NewHandler(&Params{Logger: logger, Throttler: newThrottler})
+	getQueueStatus := func() QueueStatusResponse {
+		recorder := httptest.NewRecorder()
+		h.GetQueueStatus(recorder, httptest.NewRequest(http.MethodGet, "/queue-status?namespace=namespace&service=target", nil))
+		require.Equal(t, http.StatusOK, recorder.Code)
+		var response QueueStatusResponse
+		require.NoError(t, json.NewDecoder(recorder.Body).Decode(&response))
+		return response
+	}
+	assert.Equal(t, QueueStatusResponse{}, getQueueStatus())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		host := &messages.Host{Namespace: "namespace", SourceService: "target", TargetService: "target-pvt"}
+		_ = newThrottler.Try(ctx, host, func(int) error { return nil }, func() {})
+	}()
+	require.Eventually(t, func() bool { return getQueueStatus().QueueSize == 1 }, time.Second, time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+	response := getQueueStatus()
+	assert.Equal(t, 1, response.QueueStatus)
+	assert.GreaterOrEqual(t, response.OldestRequestAgeSeconds, 0.02)
+
+	cancel()
+	<-done
+	assert.Equal(t, QueueStatusResponse{}, getQueueStatus())
+}
+
+func TestUnknownHost(t *testing.T) {
+	hostManager := hostmanager.NewHostManager(&hostmanager.Params{Logger: zap.NewNop(), HeaderForHost: "Host"})
+	hostManager.SetServices([]hostmanager.ManagedService{{Namespace: "namespace", Service: "target", ElastiService: "target"}})
+	h := NewHandler(&Params{Logger: zap.NewNop(), HostManager: hostManager, EnableGRPC: true})
+
+	recorder := httptest.NewRecorder()
+	h.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "http://other.namespace.svc.cluster.local/", nil))
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+
+	recorder = httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "http://api.example.com/", nil)
+	req.Header.Set("Content-Type", "application/grpc")
+	h.ServeHTTP(recorder, req)
+	assert.Equal(t, "5", recorder.Header().Get("Grpc-Status"))
+}
+
+var (
+	spanExporter     = tracetest.NewInMemoryExporter()
+	spanExporterOnce sync.Once
+)
+
+// recordSpans records the spans in spanExporter. The tracers of the packages are bound to the first global provider,
+// so it is set once.
+func recordSpans(t *testing.T) *tracetest.InMemoryExporter {
+	spanExporterOnce.Do(func() {
+		t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", "")
+		t.Setenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", "")
+		_, err := tracing.Setup(context.Background(), "elasti-resolver")
+		require.NoError(t, err)
+		otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(spanExporter)))
+	})
+	return spanExporter
+}
+
+func TestTracing(t *testing.T) {
+	exporter := recordSpans(t)
+
+	var traceparent atomic.Value
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		traceparent.Store(req.Header.Get("Traceparent"))
+		_, _ = io.WriteString(w, "ok")
+	}))
+	t.Cleanup(target.Close)
+	// The target is cold for the first checks, like a cold start
+	resolver, operator := newTestResolver(t, testResolverParams{targetURL: target.URL, coldChecks: 2})
+
+	// The client starts the trace, which the resolver continues
+	ctx, clientSpan := otel.Tracer("test").Start(context.Background(), "client")
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, resolver.URL+"/users/42", nil)
+	require.NoError(t, err)
+	tracing.Inject(ctx, req.Header)
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	_ = res.Body.Close()
+	clientSpan.End()
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	traceID := clientSpan.SpanContext().TraceID()
+
+	spans := map[string]tracetest.SpanStub{}
+	require.Eventually(t, func() bool {
+		for _, span := range exporter.GetSpans() {
+			if span.SpanContext.TraceID() == traceID {
+				spans[span.Name] = span
+			}
+		}
+		_, ok := spans["resolver.request"]
+		return ok
+	}, 5*time.Second, 10*time.Millisecond)
+
+	request, queue, proxy := spans["resolver.request"], spans["resolver.queue"], spans["resolver.proxy"]
+	assert.Equal(t, clientSpan.SpanContext().SpanID(), request.Parent.SpanID())
+	assert.Equal(t, request.SpanContext.SpanID(), queue.Parent.SpanID())
+	assert.Equal(t, request.SpanContext.SpanID(), proxy.Parent.SpanID())
+	// The queue span ends once the target is ready, before the request is proxied
+	assert.False(t, queue.EndTime.After(proxy.StartTime))
+	var notReady int
+	for _, event := range queue.Events {
+		if event.Name == "target not ready" {
+			notReady++
+		}
+	}
+	assert.Equal(t, 2, notReady)
+
+	// The target and the operator continue the trace
+	assert.Equal(t, fmt.Sprintf("00-%s-%s-01", traceID, proxy.SpanContext.SpanID()), traceparent.Load())
+	require.Eventually(t, func() bool {
+		return operator.TraceID() == traceID
+	}, 5*time.Second, 10*time.Millisecond)
+}
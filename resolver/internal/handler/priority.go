@@ -0,0 +1,40 @@
+package handler
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/truefoundry/elasti/resolver/internal/serviceconfig"
+	"github.com/truefoundry/elasti/resolver/internal/throttler"
+)
+
+// PriorityHeader sets the priority of a queued request, either low, normal, high or critical.
+// It takes precedence over the priority rules of the service, up to the MaxHeaderPriority of the service, and is
+// ignored for services without one, so clients can't move their requests ahead of the others.
+const PriorityHeader = "X-Elasti-Priority"
+
+// requestPriority returns the priority of the request in the queue. It is the priority of the PriorityHeader, capped at
+// the MaxHeaderPriority of the service, or of the rule of the service with the longest matching path prefix, or the
+// default priority of the service.
+func requestPriority(req *http.Request, config serviceconfig.Priority) throttler.Priority {
+	if maxPriority, ok := throttler.ParsePriority(config.MaxHeaderPriority); ok {
+		if priority, ok := throttler.ParsePriority(req.Header.Get(PriorityHeader)); ok {
+			return min(priority, maxPriority)
+		}
+	}
+	priority, ok := throttler.ParsePriority(config.Default)
+	if !ok {
+		priority = throttler.PriorityNormal
+	}
+	longest := -1
+	for _, rule := range config.Rules {
+		if len(rule.PathPrefix) <= longest || !strings.HasPrefix(req.URL.Path, rule.PathPrefix) {
+			continue
+		}
+		if rulePriority, ok := throttler.ParsePriority(rule.Priority); ok {
+			priority = rulePriority
+			longest = len(rule.PathPrefix)
+		}
+	}
+	return priority
+}
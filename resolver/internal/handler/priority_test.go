@@ -0,0 +1,48 @@
+package handler
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/truefoundry/elasti/resolver/internal/serviceconfig"
+	"github.com/truefoundry/elasti/resolver/internal/throttler"
+)
+
+func TestRequestPriority(t *testing.T) {
+	config := serviceconfig.Priority{Default: "low", Rules: []serviceconfig.PriorityRule{
+		{PathPrefix: "/api", Priority: "normal"},
+		{PathPrefix: "/api/health", Priority: "critical"},
+		{PathPrefix: "/batch", Priority: "invalid"},
+	}}
+	// The header is only read for services with a MaxHeaderPriority
+	headerConfig := config
+	headerConfig.MaxHeaderPriority = "high"
+
+	tests := []struct {
+		name     string
+		path     string
+		header   string
+		config   serviceconfig.Priority
+		expected throttler.Priority
+	}{
+		{name: "default", path: "/", config: config, expected: throttler.PriorityLow},
+		{name: "rule", path: "/api/users", config: config, expected: throttler.PriorityNormal},
+		{name: "longest rule", path: "/api/health", config: config, expected: throttler.PriorityCritical},
+		{name: "invalid rule", path: "/batch/jobs", config: config, expected: throttler.PriorityLow},
+		{name: "header", path: "/api/health", header: "Low", config: headerConfig, expected: throttler.PriorityLow},
+		{name: "capped header", path: "/", header: "critical", config: headerConfig, expected: throttler.PriorityHigh},
+		{name: "ignored header", path: "/", header: "high", config: config, expected: throttler.PriorityLow},
+		{name: "invalid header", path: "/api/users", header: "urgent", config: headerConfig, expected: throttler.PriorityNormal},
+		{name: "no config", path: "/", expected: throttler.PriorityNormal},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", tt.path, nil)
+			if tt.header != "" {
+				req.Header.Set(PriorityHeader, tt.header)
+			}
+			assert.Equal(t, tt.expected, requestPriority(req, tt.config))
+		})
+	}
+}
@@ -0,0 +1,115 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.uber.org/zap"
+)
+
+type (
+	// QueuesResponse lists every service with queued requests
+	QueuesResponse struct {
+		Services []ServiceQueue `json:"services"`
+	}
+
+	// ServiceQueue is the queue of a service
+	ServiceQueue struct {
+		Namespace string `json:"namespace"`
+		Service   string `json:"service"`
+		// QueueSize is the number of requests in the queue, which wait for the target or are proxied to it
+		QueueSize int `json:"queueSize"`
+		// OldestRequestAgeSeconds is how long the oldest request in the queue has been in it
+		OldestRequestAgeSeconds float64 `json:"oldestRequestAgeSeconds"`
+		// InFlight is the number of requests in the queue which are proxied to the target
+		InFlight int `json:"inFlight"`
+		// TrafficAllowed is false once the traffic of the service is switched to the target
+		TrafficAllowed bool `json:"trafficAllowed"`
+		// LastOperatorNotification is when the operator was last told about the requests of the service
+		LastOperatorNotification *time.Time `json:"lastOperatorNotification,omitempty"`
+	}
+)
+
+// serviceQueues returns the queues of the services with queued requests
+func (h *Handler) serviceQueues() []ServiceQueue {
+	statuses := h.throttler.GetQueueStatuses()
+	queues := make([]ServiceQueue, 0, len(statuses))
+	for _, status := range statuses {
+		queue := ServiceQueue{
+			Namespace:               status.Namespace,
+			Service:                 status.Service,
+			QueueSize:               status.Size,
+			OldestRequestAgeSeconds: status.OldestAge.Seconds(),
+			InFlight:                status.InFlight,
+			TrafficAllowed:          h.hostManager.IsTrafficAllowed(status.Namespace, status.Service),
+		}
+		if notified, ok := h.operatorRPC.LastNotified(status.Namespace, status.Service); ok {
+			queue.LastOperatorNotification = &notified
+		}
+		queues = append(queues, queue)
+	}
+	return queues
+}
+
+// GetQueues lists every service with queued requests, as JSON
+func (h *Handler) GetQueues(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(QueuesResponse{Services: h.serviceQueues()}); err != nil {
+		h.logger.Error("Failed to encode queues response", zap.Error(err))
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
+
+// QueuesMetricsHandler returns a handler which lists every service with queued requests, as Prometheus metrics.
+// They are collected on every scrape, so services leave the list once their queue is empty.
+func (h *Handler) QueuesMetricsHandler() http.Handler {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(&queuesCollector{handler: h})
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
+
+var (
+	queueSizeDesc = prometheus.NewDesc("elasti_resolver_service_queue_size",
+		"Number of requests in the queue of the service, which wait for the target or are proxied to it", []string{"namespace", "service"}, nil)
+	queueOldestAgeDesc = prometheus.NewDesc("elasti_resolver_service_queue_oldest_request_age_seconds",
+		"How long the oldest request in the queue of the service has been in it", []string{"namespace", "service"}, nil)
+	queueInFlightDesc = prometheus.NewDesc("elasti_resolver_service_queue_in_flight",
+		"Number of requests in the queue of the service which are proxied to the target", []string{"namespace", "service"}, nil)
+	trafficAllowedDesc = prometheus.NewDesc("elasti_resolver_service_traffic_allowed",
+		"1 if the resolver accepts traffic for the service, 0 once the traffic is switched to the target", []string{"namespace", "service"}, nil)
+	lastOperatorNotificationDesc = prometheus.NewDesc("elasti_resolver_service_last_operator_notification_timestamp_seconds",
+		"When the operator was last told about the requests of the service", []string{"namespace", "service"}, nil)
+)
+
+// queuesCollector collects the queues of the services with queued requests
+type queuesCollector struct {
+	handler *Handler
+}
+
+func (c *queuesCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- queueSizeDesc
+	ch <- queueOldestAgeDesc
+	ch <- queueInFlightDesc
+	ch <- trafficAllowedDesc
+	ch <- lastOperatorNotificationDesc
+}
+
+func (c *queuesCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, queue := range c.handler.serviceQueues() {
+		trafficAllowed := 0.0
+		if queue.TrafficAllowed {
+			trafficAllowed = 1
+		}
+		ch <- prometheus.MustNewConstMetric(queueSizeDesc, prometheus.GaugeValue, float64(queue.QueueSize), queue.Namespace, queue.Service)
+		ch <- prometheus.MustNewConstMetric(queueOldestAgeDesc, prometheus.GaugeValue, queue.OldestRequestAgeSeconds, queue.Namespace, queue.Service)
+		ch <- prometheus.MustNewConstMetric(queueInFlightDesc, prometheus.GaugeValue, float64(queue.InFlight), queue.Namespace, queue.Service)
+		ch <- prometheus.MustNewConstMetric(trafficAllowedDesc, prometheus.GaugeValue, trafficAllowed, queue.Namespace, queue.Service)
+		if queue.LastOperatorNotification != nil {
+			ch <- prometheus.MustNewConstMetric(lastOperatorNotificationDesc, prometheus.GaugeValue,
+				float64(queue.LastOperatorNotification.UnixNano())/float64(time.Second), queue.Namespace, queue.Service)
+		}
+	}
+}
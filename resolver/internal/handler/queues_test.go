@@ -0,0 +1,88 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/truefoundry/elasti/pkg/messages"
+	"github.com/truefoundry/elasti/resolver/internal/testutil"
+	"github.com/truefoundry/elasti/resolver/internal/throttler"
+	"go.uber.org/zap"
+)
+
+func TestGetQueues(t *testing.T) {
+	logger := zap.NewNop()
+	// The target is never ready, so the requests stay in the queue
+	newThrottler := throttler.NewThrottler(&throttler.Params{
+		QueueRetryDuration:      10 * time.Millisecond,
+		TrafficReEnableDuration: time.Second,
+		K8sUtil:                 testutil.NewOps(testutil.NotReady),
+		QueueDepth:              10,
+		MaxConcurrency:          10,
+		InitialCapacity:         10,
+		Logger:                  logger,
+	})
+	notified := time.Unix(1700000000, 0).UTC()
+	h := NewHandler(&Params{
+		Logger:      logger,
+		Throttler:   newThrottler,
+		OperatorRPC: &testutil.FakeOperator{LastNotifiedAt: notified},
+		HostManager: &fakeHostManager{trafficDisabled: true},
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{}, 2)
+	for range 2 {
+		go func() {
+			host := &messages.Host{Namespace: "namespace", SourceService: "target", TargetService: "target-pvt"}
+			_ = newThrottler.Try(ctx, host, func(int) error { return nil }, func() {})
+			done <- struct{}{}
+		}()
+	}
+	defer func() {
+		cancel()
+		<-done
+		<-done
+	}()
+	require.Eventually(t, func() bool { return newThrottler.GetQueueSize("namespace", "target") == 2 }, time.Second, time.Millisecond)
+
+	recorder := httptest.NewRecorder()
+	h.GetQueues(recorder, httptest.NewRequest(http.MethodGet, "/queues", nil))
+	require.Equal(t, http.StatusOK, recorder.Code)
+	var response QueuesResponse
+	require.NoError(t, json.NewDecoder(recorder.Body).Decode(&response))
+	require.Len(t, response.Services, 1)
+	queue := response.Services[0]
+	assert.Equal(t, "namespace", queue.Namespace)
+	assert.Equal(t, "target", queue.Service)
+	assert.Equal(t, 2, queue.QueueSize)
+	assert.Positive(t, queue.OldestRequestAgeSeconds)
+	assert.Zero(t, queue.InFlight)
+	assert.False(t, queue.TrafficAllowed)
+	require.NotNil(t, queue.LastOperatorNotification)
+	assert.True(t, notified.Equal(*queue.LastOperatorNotification))
+
+	server := httptest.NewServer(h.QueuesMetricsHandler())
+	t.Cleanup(server.Close)
+	res, err := http.Get(server.URL)
+	require.NoError(t, err)
+	defer res.Body.Close()
+	metrics, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	for _, line := range []string{
+		`elasti_resolver_service_queue_size{namespace="namespace",service="target"} 2`,
+		`elasti_resolver_service_queue_in_flight{namespace="namespace",service="target"} 0`,
+		`elasti_resolver_service_traffic_allowed{namespace="namespace",service="target"} 0`,
+		`elasti_resolver_service_last_operator_notification_timestamp_seconds{namespace="namespace",service="target"} 1.7e+09`,
+		`elasti_resolver_service_queue_oldest_request_age_seconds{namespace="namespace",service="target"} `,
+	} {
+		assert.Contains(t, string(metrics), line)
+	}
+}
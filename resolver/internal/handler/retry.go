@@ -0,0 +1,99 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"syscall"
+	"time"
+
+	"github.com/truefoundry/elasti/pkg/messages"
+	"github.com/truefoundry/elasti/resolver/internal/prom"
+	"go.uber.org/zap"
+)
+
+const (
+	// retryBackoff is the wait before the first retry of a request, it doubles with every retry up to maxRetryBackoff
+	retryBackoff    = 100 * time.Millisecond
+	maxRetryBackoff = 2 * time.Second
+)
+
+// retryTransport sends a request again when the connection to the target is refused or reset. Pods which were
+// just marked ready may not accept connections yet, so the first attempts after a scale-up can fail this way.
+// Only requests which can be sent again are retried: idempotent ones without a body, and the ones with a body which can be replayed.
+type retryTransport struct {
+	next     http.RoundTripper
+	attempts int
+	host     *messages.Host
+	logger   *zap.Logger
+}
+
+// retryingTransport returns the transport for the requests of the host. It only retries requests for targets
+// which scaled up less than the retry window ago, as connection errors past that are not a cold start.
+func (h *Handler) retryingTransport(host *messages.Host) http.RoundTripper {
+	if h.retryAttempts <= 0 || !h.throttler.ScaledUpWithin(host.Namespace, host.TargetService, h.retryWindow) {
+		return h.transport
+	}
+	return &retryTransport{next: h.transport, attempts: h.retryAttempts, host: host, logger: h.logger}
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	backoff := retryBackoff
+	for retry := 1; ; retry++ {
+		res, err := t.next.RoundTrip(req)
+		if err == nil {
+			return res, nil
+		}
+		reason, retryable := connectionErrorReason(err)
+		if !retryable || retry > t.attempts || !canRetry(req) {
+			return nil, err //nolint:wrapcheck // the reverse proxy handles the errors of the transport
+		}
+
+		prom.ProxyRetryCounter.WithLabelValues(t.host.SourceService, t.host.Namespace, reason).Inc()
+		t.logger.Info("Retrying request after connection error", zap.Int("retry", retry), zap.Error(err))
+		select {
+		case <-req.Context().Done():
+			return nil, fmt.Errorf("context done while retrying: %w", req.Context().Err())
+		case <-time.After(backoff):
+		}
+		backoff = min(2*backoff, maxRetryBackoff)
+
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, fmt.Errorf("error replaying request body: %w", err)
+			}
+			req = req.Clone(req.Context())
+			req.Body = body
+		}
+	}
+}
+
+// connectionErrorReason returns the reason for the metrics of a connection error which can be retried
+func connectionErrorReason(err error) (string, bool) {
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return prom.ReasonConnectionRefused, true
+	case errors.Is(err, syscall.ECONNRESET):
+		return prom.ReasonConnectionReset, true
+	default:
+		return "", false
+	}
+}
+
+// canRetry returns true if the request can be sent again: its body was buffered and can be replayed, or it is idempotent
+// and has no body
+func canRetry(req *http.Request) bool {
+	if req.GetBody != nil {
+		return true
+	}
+	if req.Body != nil && req.Body != http.NoBody {
+		return false
+	}
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,83 @@
+package handler
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/truefoundry/elasti/pkg/messages"
+	"go.uber.org/zap"
+)
+
+// failingTransport fails the first requests with err, and then answers with the body it received
+type failingTransport struct {
+	failures int
+	err      error
+	attempts int
+}
+
+func (t *failingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.attempts++
+	if req.Body != nil {
+		defer req.Body.Close()
+	}
+	if t.attempts <= t.failures {
+		return nil, t.err
+	}
+	var body []byte
+	if req.Body != nil {
+		body, _ = io.ReadAll(req.Body)
+	}
+	return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(string(body)))}, nil
+}
+
+func TestRetryTransport(t *testing.T) {
+	refused := fmt.Errorf("dial tcp: %w", syscall.ECONNREFUSED)
+	tests := []struct {
+		name             string
+		method           string
+		body             *requestBody
+		err              error
+		expectedAttempts int
+		expectedErr      bool
+	}{
+		{name: "Idempotent request", method: http.MethodGet, err: refused, expectedAttempts: 3},
+		{name: "Replayable body", method: http.MethodPost, body: &requestBody{memory: []byte("body"), size: 4}, err: refused, expectedAttempts: 3},
+		{name: "Connection reset", method: http.MethodDelete, err: fmt.Errorf("read: %w", syscall.ECONNRESET), expectedAttempts: 3},
+		{name: "Streamed body", method: http.MethodPut, body: &requestBody{rest: io.NopCloser(strings.NewReader("body"))}, err: refused, expectedAttempts: 1, expectedErr: true},
+		{name: "Non-idempotent request", method: http.MethodPost, err: refused, expectedAttempts: 1, expectedErr: true},
+		{name: "Other error", method: http.MethodGet, err: syscall.ETIMEDOUT, expectedAttempts: 1, expectedErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			next := &failingTransport{failures: 2, err: tt.err}
+			transport := &retryTransport{next: next, attempts: 3, host: &messages.Host{Namespace: "namespace", SourceService: "target"}, logger: zap.NewNop()}
+			req := httptest.NewRequest(tt.method, "http://target/", nil)
+			req.Body = nil
+			if tt.body != nil {
+				require.NoError(t, tt.body.setOn(req))
+			}
+
+			res, err := transport.RoundTrip(req)
+			assert.Equal(t, tt.expectedAttempts, next.attempts)
+			if tt.expectedErr {
+				assert.ErrorIs(t, err, tt.err)
+				return
+			}
+			require.NoError(t, err)
+			defer res.Body.Close()
+			body, err := io.ReadAll(res.Body)
+			require.NoError(t, err)
+			if tt.body != nil {
+				assert.Equal(t, string(tt.body.memory), string(body))
+			}
+		})
+	}
+}
@@ -0,0 +1,87 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrInvalidRouteTemplate is returned for route templates which don't start with a slash
+var ErrInvalidRouteTemplate = errors.New("invalid route template")
+
+// otherRoute is the route of the requests which match no template
+const otherRoute = "other"
+
+type (
+	// RouteTemplates normalise the paths of the requests to the route label of the metrics, like /users/{id} for /users/42.
+	// A {name} segment matches any segment, and a trailing * matches the rest of the path.
+	RouteTemplates struct {
+		templates []routeTemplate
+	}
+
+	routeTemplate struct {
+		template string
+		segments []string
+		// prefix is true for templates which end with *, which match the rest of the path
+		prefix bool
+	}
+)
+
+// ParseRouteTemplates parses the route templates, which are matched in order
+func ParseRouteTemplates(templates []string) (*RouteTemplates, error) {
+	routes := &RouteTemplates{templates: make([]routeTemplate, 0, len(templates))}
+	for _, template := range templates {
+		template = strings.TrimSpace(template)
+		if template == "" {
+			continue
+		}
+		if !strings.HasPrefix(template, "/") {
+			return nil, fmt.Errorf("%w %q: it must start with a slash", ErrInvalidRouteTemplate, template)
+		}
+		path, prefix := strings.CutSuffix(template, "*")
+		routes.templates = append(routes.templates, routeTemplate{
+			template: template,
+			segments: strings.Split(strings.Trim(path, "/"), "/"),
+			prefix:   prefix,
+		})
+	}
+	return routes, nil
+}
+
+// route returns the first template which matches the path, or otherRoute. It is empty if there are no templates,
+// so the paths are not part of the metrics.
+func (r *RouteTemplates) route(path string) string {
+	if r == nil || len(r.templates) == 0 {
+		return ""
+	}
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	for _, template := range r.templates {
+		if template.match(segments) {
+			return template.template
+		}
+	}
+	return otherRoute
+}
+
+func (t *routeTemplate) match(segments []string) bool {
+	templateSegments := t.segments
+	if t.prefix && templateSegments[len(templateSegments)-1] == "" {
+		// The template is /prefix/*, whose last segment is empty
+		templateSegments = templateSegments[:len(templateSegments)-1]
+	}
+	if len(segments) < len(templateSegments) || (!t.prefix && len(segments) != len(templateSegments)) {
+		return false
+	}
+	for i, segment := range templateSegments {
+		if strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}") {
+			if segments[i] == "" {
+				return false
+			}
+			continue
+		}
+		if segment != segments[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,62 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/truefoundry/elasti/resolver/internal/hostmanager"
+	"github.com/truefoundry/elasti/resolver/internal/prom"
+	"github.com/truefoundry/elasti/resolver/internal/throttler"
+)
+
+func TestRouteTemplates(t *testing.T) {
+	routes, err := ParseRouteTemplates([]string{"/users/{id}", "/users/{id}/orders/{order}", " /static/* ", "/"})
+	require.NoError(t, err)
+
+	tests := map[string]string{
+		"/users/42":               "/users/{id}",
+		"/users/42/":              "/users/{id}",
+		"/users/42/orders/7":      "/users/{id}/orders/{order}",
+		"/users/42/orders":        otherRoute,
+		"/users":                  otherRoute,
+		"/static":                 "/static/*",
+		"/static/js/app.js":       "/static/*",
+		"/":                       "/",
+		"/random/6f1c2a9e-attack": otherRoute,
+	}
+	for path, expected := range tests {
+		assert.Equal(t, expected, routes.route(path), path)
+	}
+
+	// Paths are not part of the metrics without templates
+	routes, err = ParseRouteTemplates(nil)
+	require.NoError(t, err)
+	assert.Empty(t, routes.route("/users/42"))
+
+	_, err = ParseRouteTemplates([]string{"users/{id}"})
+	assert.ErrorIs(t, err, ErrInvalidRouteTemplate)
+}
+
+func TestRequestReason(t *testing.T) {
+	tests := []struct {
+		err      error
+		expected string
+	}{
+		{nil, prom.ReasonNone},
+		{fmt.Errorf("%w: %w", ErrInvalidHost, hostmanager.ErrUnknownHost), prom.ReasonUnknownHost},
+		{fmt.Errorf("%w: bad host", ErrInvalidHost), prom.ReasonInvalidHost},
+		{ErrTrafficSwitched, prom.ReasonTrafficSwitched},
+		{fmt.Errorf("error buffering request body: %w", ErrBodyTooLarge), prom.ReasonBodyTooLarge},
+		{fmt.Errorf("%w: unexpected EOF", ErrInvalidBody), prom.ReasonInvalidBody},
+		{fmt.Errorf("throttler try error: %w", context.DeadlineExceeded), prom.ReasonTimeout},
+		{fmt.Errorf("throttler try error: %w", throttler.ErrRequestQueueFull), prom.ReasonQueueFull},
+		{fmt.Errorf("throttler try error: %w", throttler.ErrRequestShed), prom.ReasonShed},
+		{fmt.Errorf("some error with a message which changes for every request"), prom.ReasonUpstream},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.expected, requestReason(tt.err), fmt.Sprint(tt.err))
+	}
+}
@@ -0,0 +1,133 @@
+package handler
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/truefoundry/elasti/pkg/messages"
+	"github.com/truefoundry/elasti/resolver/internal/serviceconfig"
+	"go.uber.org/zap"
+)
+
+const (
+	// HoldHeader makes the resolver hold the request until the target is ready, whatever the warm-up mode of the service,
+	// for API clients which would rather wait than retry
+	HoldHeader = "X-Elasti-Hold"
+
+	// defaultRetryAfter is used until a cold start of the target was seen
+	defaultRetryAfter = 5 * time.Second
+	maxRetryAfter     = time.Minute
+	// warmUpTemplateCacheDuration is how long a template is used before it is read again from its ConfigMap
+	warmUpTemplateCacheDuration = time.Minute
+)
+
+var defaultWarmUpTemplate = template.Must(template.New("warmUp").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="{{.RetryAfter}}">
+<title>Warming up</title>
+</head>
+<body>
+<p>{{.Service}} is warming up, this page refreshes in {{.RetryAfter}} seconds.</p>
+</body>
+</html>
+`))
+
+// warmUpPage is the data of the warm-up page template
+type warmUpPage struct {
+	Namespace  string
+	Service    string
+	RetryAfter int
+}
+
+// warmUp answers the request while the target is scaled up, unless the service holds its requests.
+// It returns false if the request is to be held: the target is ready, the client asked to be held, or it is a gRPC request,
+// as gRPC clients have their own deadlines.
+func (h *Handler) warmUp(w http.ResponseWriter, req *http.Request, host *messages.Host) bool {
+	config := h.serviceConfig.Get(host.Namespace, host.SourceService).WarmUp
+	if config.Mode == "" || config.Mode == serviceconfig.WarmUpHold || isGRPCRequest(req) ||
+		strings.EqualFold(req.Header.Get(HoldHeader), "true") {
+		return false
+	}
+	if h.throttler.IsTargetReady(host) {
+		return false
+	}
+	go h.operatorRPC.SendIncomingRequestInfo(req.Context(), host.Namespace, host.SourceService)
+
+	retryAfter := h.retryAfter(host)
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	w.Header().Set("Cache-Control", "no-store")
+	if config.Mode == serviceconfig.WarmUpPage && strings.Contains(req.Header.Get("Accept"), "text/html") {
+		h.writeWarmUpPage(w, host, config, retryAfter)
+		return true
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	if _, err := w.Write([]byte(`{"error": "service is warming up"}`)); err != nil {
+		h.logger.Error("Error writing response", zap.Error(err))
+	}
+	return true
+}
+
+// retryAfter returns the seconds the client should wait before it retries, from how long the last cold start of the target took
+func (h *Handler) retryAfter(host *messages.Host) int {
+	expected, ok := h.throttler.ExpectedReadyIn(host.Namespace, host.TargetService)
+	if !ok {
+		expected = defaultRetryAfter
+	}
+	return int(math.Ceil(min(max(expected, time.Second), maxRetryAfter).Seconds()))
+}
+
+func (h *Handler) writeWarmUpPage(w http.ResponseWriter, host *messages.Host, config serviceconfig.WarmUp, retryAfter int) {
+	page := warmUpPage{Namespace: host.Namespace, Service: host.SourceService, RetryAfter: retryAfter}
+	var body bytes.Buffer
+	tmpl := defaultWarmUpTemplate
+	if config.TemplateConfigMap != "" {
+		custom, err := h.getWarmUpTemplate(host.Namespace, config.TemplateConfigMap, config.TemplateKey)
+		if err != nil {
+			h.logger.Warn("Error getting warm-up template, using the default page", zap.Error(err))
+		} else {
+			tmpl = custom
+		}
+	}
+	if err := tmpl.Execute(&body, page); err != nil {
+		h.logger.Warn("Error executing warm-up template, using the default page", zap.Error(err))
+		body.Reset()
+		_ = defaultWarmUpTemplate.Execute(&body, page)
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	if _, err := w.Write(body.Bytes()); err != nil {
+		h.logger.Error("Error writing response", zap.Error(err))
+	}
+}
+
+// getWarmUpTemplate returns the template of the ConfigMap key, which is cached for a while
+func (h *Handler) getWarmUpTemplate(namespace, configMap, key string) (*template.Template, error) {
+	cacheKey := namespace + "/" + configMap + "/" + key
+	if tmpl, ok := h.warmUpTemplates.Load(cacheKey); ok {
+		return tmpl.(*template.Template), nil
+	}
+	value, err := h.k8sUtil.GetConfigMapValue(namespace, configMap, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get warm-up template: %w", err)
+	}
+	tmpl, err := template.New(cacheKey).Parse(value)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse warm-up template: %w", err)
+	}
+	h.warmUpTemplates.Store(cacheKey, tmpl)
+	// release the memory after sometime
+	time.AfterFunc(warmUpTemplateCacheDuration, func() {
+		h.warmUpTemplates.Delete(cacheKey)
+	})
+	return tmpl, nil
+}
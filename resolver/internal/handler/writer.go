@@ -1,35 +1,105 @@
 package handler
 
 import (
+	"bufio"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
 )
 
+// responseWriter tracks the status code and the number of bytes written to the response,
+// without holding on to the body, so large and streamed responses pass through with flat memory use.
 type responseWriter struct {
 	http.ResponseWriter
-	statusCode int
-	body       []byte
+	statusCode   int
+	bytesWritten int64
 }
 
+var (
+	_ http.Flusher  = (*responseWriter)(nil)
+	_ http.Hijacker = (*responseWriter)(nil)
+	_ io.ReaderFrom = (*responseWriter)(nil)
+)
+
 func newResponseWriter(w http.ResponseWriter) *responseWriter {
 	return &responseWriter{ResponseWriter: w, statusCode: 0}
 }
 
 func (rw *responseWriter) WriteHeader(statusCode int) {
-	rw.statusCode = statusCode
+	// Informational responses like 103 Early Hints are followed by the final status, so we don't record them.
+	// 101 Switching Protocols is the final status of an upgraded connection.
+	if statusCode >= http.StatusOK || statusCode == http.StatusSwitchingProtocols {
+		rw.statusCode = statusCode
+	}
 	rw.ResponseWriter.WriteHeader(statusCode)
 }
 
 func (rw *responseWriter) Write(b []byte) (int, error) {
-	rw.body = append(rw.body, b...)
-	res, err := rw.ResponseWriter.Write(b)
+	if rw.statusCode == 0 {
+		rw.statusCode = http.StatusOK
+	}
+	n, err := rw.ResponseWriter.Write(b)
+	rw.bytesWritten += int64(n)
 	if err != nil {
-		return 0, fmt.Errorf("Write: %w", err)
+		return n, fmt.Errorf("Write: %w", err)
 	}
+	return n, nil
+}
+
+// ReadFrom copies the reader to the response, using the io.ReaderFrom of the underlying writer when it has one,
+// so the copy can skip the intermediate buffer.
+func (rw *responseWriter) ReadFrom(r io.Reader) (int64, error) {
+	if rw.statusCode == 0 {
+		rw.statusCode = http.StatusOK
+	}
+	var n int64
+	var err error
+	if rf, ok := rw.ResponseWriter.(io.ReaderFrom); ok {
+		n, err = rf.ReadFrom(r)
+	} else {
+		// writerOnly hides our ReadFrom from io.Copy, which would call it again
+		n, err = io.Copy(writerOnly{rw.ResponseWriter}, r)
+	}
+	rw.bytesWritten += n
+	if err != nil {
+		return n, fmt.Errorf("ReadFrom: %w", err)
+	}
+	return n, nil
+}
+
+// Flush sends the buffered response to the client, which is needed for server-sent events and chunked streaming
+func (rw *responseWriter) Flush() {
+	_ = rw.FlushError()
+}
+
+// FlushError is like Flush, but returns the error. http.ResponseController prefers it over Flush.
+func (rw *responseWriter) FlushError() error {
+	if err := http.NewResponseController(rw.ResponseWriter).Flush(); err != nil {
+		return fmt.Errorf("Flush: %w", err)
+	}
+	return nil
+}
+
+// Hijack takes over the connection, which the reverse proxy does on protocol upgrades like WebSockets.
+// The proxy writes the 101 Switching Protocols to the hijacked connection without calling WriteHeader, so it is recorded here.
+func (rw *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := http.NewResponseController(rw.ResponseWriter).Hijack()
+	if err != nil {
+		return nil, nil, fmt.Errorf("Hijack: %w", err)
+	}
+	if rw.statusCode == 0 {
+		rw.statusCode = http.StatusSwitchingProtocols
+	}
+	return conn, brw, nil
+}
 
-	return res, nil
+// Unwrap returns the underlying writer, so http.ResponseController can reach it.
+// The reverse proxy uses it to flush streamed responses, and to hijack the connection on protocol upgrades like WebSockets.
+func (rw *responseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
 }
 
-func (rw *responseWriter) Header() http.Header {
-	return rw.ResponseWriter.Header()
+type writerOnly struct {
+	io.Writer
 }
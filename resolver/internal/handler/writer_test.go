@@ -0,0 +1,147 @@
+package handler
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// discardResponseWriter drops the body, so benchmarks only measure the memory used by responseWriter
+type discardResponseWriter struct {
+	header http.Header
+}
+
+func (d *discardResponseWriter) Header() http.Header         { return d.header }
+func (d *discardResponseWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (d *discardResponseWriter) WriteHeader(int)             {}
+
+func TestResponseWriterTracksStatusAndBytes(t *testing.T) {
+	tests := []struct {
+		name           string
+		write          func(rw *responseWriter)
+		expectedStatus int
+		expectedBytes  int64
+	}{
+		{
+			name: "Implicit status on write",
+			write: func(rw *responseWriter) {
+				_, _ = rw.Write([]byte("hello"))
+				_, _ = rw.Write([]byte(" world"))
+			},
+			expectedStatus: http.StatusOK,
+			expectedBytes:  11,
+		},
+		{
+			name: "Informational status is not recorded",
+			write: func(rw *responseWriter) {
+				rw.WriteHeader(http.StatusEarlyHints)
+				rw.WriteHeader(http.StatusNotFound)
+				_, _ = rw.Write([]byte("not found"))
+			},
+			expectedStatus: http.StatusNotFound,
+			expectedBytes:  9,
+		},
+		{
+			name: "ReadFrom",
+			write: func(rw *responseWriter) {
+				_, _ = rw.ReadFrom(strings.NewReader("from a reader"))
+			},
+			expectedStatus: http.StatusOK,
+			expectedBytes:  13,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rw := newResponseWriter(&discardResponseWriter{header: http.Header{}})
+			tt.write(rw)
+			assert.Equal(t, tt.expectedStatus, rw.statusCode)
+			assert.Equal(t, tt.expectedBytes, rw.bytesWritten)
+		})
+	}
+}
+
+func TestResponseWriterFlush(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	rw := newResponseWriter(recorder)
+	_, _ = rw.Write([]byte("data: event\n\n"))
+	rw.Flush()
+	assert.True(t, recorder.Flushed)
+
+	// Writers which can't flush report it, instead of panicking
+	assert.Error(t, newResponseWriter(&discardResponseWriter{header: http.Header{}}).FlushError())
+}
+
+func TestResponseWriterHijack(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		conn, brw, err := newResponseWriter(w).Hijack()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer conn.Close()
+		_, _ = brw.WriteString("HTTP/1.1 200 OK\r\nContent-Length: 8\r\nConnection: close\r\n\r\nhijacked")
+		_ = brw.Flush()
+	}))
+	defer server.Close()
+
+	res, err := http.Get(server.URL)
+	require.NoError(t, err)
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "hijacked", string(body))
+
+	// Writers which can't be hijacked report it
+	_, _, err = newResponseWriter(httptest.NewRecorder()).Hijack()
+	assert.Error(t, err)
+}
+
+func TestResponseWriterDoesNotBuffer(t *testing.T) {
+	rw := newResponseWriter(&discardResponseWriter{header: http.Header{}})
+	chunk := make([]byte, 32*1024)
+	allocs := testing.AllocsPerRun(1000, func() {
+		_, _ = rw.Write(chunk)
+	})
+	assert.Zero(t, allocs)
+}
+
+// BenchmarkResponseWriterLargeResponse writes a 64MiB response per op. B/op stays flat
+// as the response grows, since the body is not kept in memory.
+func BenchmarkResponseWriterLargeResponse(b *testing.B) {
+	const responseSize = 64 << 20
+	chunk := bytes.Repeat([]byte("a"), 32*1024)
+	b.SetBytes(responseSize)
+	b.ReportAllocs()
+	for b.Loop() {
+		rw := newResponseWriter(&discardResponseWriter{header: http.Header{}})
+		for written := 0; written < responseSize; written += len(chunk) {
+			_, _ = rw.Write(chunk)
+		}
+	}
+}
+
+// BenchmarkResponseWriterReadFrom copies a 64MiB response from a reader per op
+func BenchmarkResponseWriterReadFrom(b *testing.B) {
+	const responseSize = 64 << 20
+	b.SetBytes(responseSize)
+	b.ReportAllocs()
+	for b.Loop() {
+		rw := newResponseWriter(&discardResponseWriter{header: http.Header{}})
+		_, _ = rw.ReadFrom(bufio.NewReader(io.LimitReader(zeroReader{}, responseSize)))
+	}
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(b []byte) (int, error) {
+	clear(b)
+	return len(b), nil
+}
@@ -0,0 +1,96 @@
+package hostmanager
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/truefoundry/elasti/pkg/messages"
+	"github.com/truefoundry/elasti/resolver/internal/prom"
+)
+
+const (
+	// DefaultCacheSize is the number of hosts which are cached, when it is not set
+	DefaultCacheSize = 10000
+	// DefaultCacheTTL is how long a host is cached, when it is not set
+	DefaultCacheTTL = 10 * time.Minute
+)
+
+type (
+	// hostCache is an LRU cache of the hosts, keyed by their incoming host and the headers the rules match. Hosts expire
+	// after the TTL, and the least recently used host is evicted once the cache is full. The cached hosts must not be changed.
+	hostCache struct {
+		size    int
+		ttl     time.Duration
+		entries map[string]*list.Element
+		// lru has the entries, the most recently used first
+		lru *list.List
+		mu  sync.Mutex
+	}
+
+	cacheEntry struct {
+		key     string
+		host    *messages.Host
+		expires time.Time
+	}
+)
+
+func newHostCache(size int, ttl time.Duration) *hostCache {
+	if size <= 0 {
+		size = DefaultCacheSize
+	}
+	if ttl <= 0 {
+		ttl = DefaultCacheTTL
+	}
+	return &hostCache{size: size, ttl: ttl, entries: map[string]*list.Element{}, lru: list.New()}
+}
+
+// get returns the host cached with the key, and marks it as recently used
+func (c *hostCache) get(key string) (*messages.Host, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	element, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := element.Value.(*cacheEntry)
+	if time.Now().After(entry.expires) {
+		c.remove(element, "expired")
+		return nil, false
+	}
+	c.lru.MoveToFront(element)
+	return entry.host, true
+}
+
+// store caches the host with the key, and evicts the least recently used host if the cache is full
+func (c *hostCache) store(key string, host *messages.Host) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, ok := c.entries[key]; ok {
+		entry := element.Value.(*cacheEntry)
+		entry.host, entry.expires = host, time.Now().Add(c.ttl)
+		c.lru.MoveToFront(element)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(&cacheEntry{key: key, host: host, expires: time.Now().Add(c.ttl)})
+	if c.lru.Len() > c.size {
+		c.remove(c.lru.Back(), "capacity")
+	}
+	prom.HostCacheSizeGauge.Set(float64(c.lru.Len()))
+}
+
+// clear removes every host
+func (c *hostCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	clear(c.entries)
+	c.lru.Init()
+	prom.HostCacheSizeGauge.Set(0)
+}
+
+func (c *hostCache) remove(element *list.Element, reason string) {
+	delete(c.entries, element.Value.(*cacheEntry).key)
+	c.lru.Remove(element)
+	prom.HostCacheEvictionCounter.WithLabelValues(reason).Inc()
+	prom.HostCacheSizeGauge.Set(float64(c.lru.Len()))
+}
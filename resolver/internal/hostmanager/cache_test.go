@@ -0,0 +1,59 @@
+package hostmanager
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/truefoundry/elasti/pkg/messages"
+	"go.uber.org/zap"
+)
+
+func TestHostCache(t *testing.T) {
+	cache := newHostCache(2, time.Hour)
+	a, b, c := &messages.Host{IncomingHost: "a"}, &messages.Host{IncomingHost: "b"}, &messages.Host{IncomingHost: "c"}
+	cache.store("a", a)
+	cache.store("b", b)
+
+	// a is used, so b is the least recently used host once c is stored
+	host, ok := cache.get("a")
+	require.True(t, ok)
+	assert.Same(t, a, host)
+	cache.store("c", c)
+	_, ok = cache.get("b")
+	assert.False(t, ok)
+	_, ok = cache.get("a")
+	assert.True(t, ok)
+	_, ok = cache.get("c")
+	assert.True(t, ok)
+
+	cache.clear()
+	_, ok = cache.get("a")
+	assert.False(t, ok)
+}
+
+func TestHostCacheTTL(t *testing.T) {
+	cache := newHostCache(10, 10*time.Millisecond)
+	cache.store("a", &messages.Host{IncomingHost: "a"})
+	_, ok := cache.get("a")
+	assert.True(t, ok)
+	time.Sleep(20 * time.Millisecond)
+	_, ok = cache.get("a")
+	assert.False(t, ok)
+}
+
+func TestGetHostEvicts(t *testing.T) {
+	hm := NewHostManager(&Params{Logger: zap.NewNop(), HeaderForHost: "Host", CacheSize: 1})
+	_, err := hm.GetHost(&http.Request{Host: "web.namespace.svc.cluster.local"})
+	require.NoError(t, err)
+
+	// The cache holds a single host, so another host evicts it
+	_, err = hm.GetHost(&http.Request{Host: "api.namespace.svc.cluster.local"})
+	require.NoError(t, err)
+	_, ok := hm.hosts.get("web.namespace.svc.cluster.local")
+	assert.False(t, ok)
+	_, ok = hm.hosts.get("api.namespace.svc.cluster.local")
+	assert.True(t, ok)
+}
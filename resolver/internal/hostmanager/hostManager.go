@@ -1,11 +1,17 @@
 package hostmanager
 
 import (
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
+	"reflect"
 	"regexp"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/truefoundry/elasti/resolver/internal/prom"
@@ -18,121 +24,332 @@ import (
 )
 
 // HostManager is to manage the hosts, and their traffic
-// It is used to process incoming requests and cache the host details in "hosts" map
+// It is used to process incoming requests and cache the host details in "hosts" cache
 // For further requests, the cache is used to get the host details
 type HostManager struct {
-	logger                  *zap.Logger
-	hosts                   sync.Map
-	trafficReEnableDuration time.Duration
-	headerForHost           string
+	logger        *zap.Logger
+	hosts         *hostCache
+	headerForHost string
+	// traffic is the traffic state of every service, the cached hosts don't change with it
+	traffic trafficStates
+
+	// rules map the hosts to their services, before the Kubernetes DNS names. ruleSets are the rules of every source,
+	// which are compiled together in the order of ruleSources.
+	rules    atomic.Pointer[Rules]
+	ruleSets map[string][]Rule
+	rulesMu  sync.Mutex
+
+	// services are the services managed by ElastiServices, hosts of other services are rejected. It is nil until
+	// the ElastiServices are known, so every service is managed until then. clusterIPs are the ClusterIPs of the
+	// managed services, by namespace and name, so requests sent to the ClusterIP of a managed service are mapped to it.
+	// clusterIPsOf looks up the ClusterIPs of the services which become managed.
+	services     atomic.Pointer[managedServices]
+	serviceList  []ManagedService
+	clusterIPs   map[string][]string
+	clusterIPsOf func(namespace, service string) []string
+	servicesMu   sync.Mutex
+}
+
+// Params are the parameters of a HostManager
+type Params struct {
+	Logger *zap.Logger
+	// HeaderForHost is the header with the host of the requests
+	HeaderForHost string
+	// CacheSize and CacheTTL bound the hosts which are cached, they default to DefaultCacheSize and DefaultCacheTTL
+	CacheSize int
+	CacheTTL  time.Duration
+	// ClusterIPs returns the ClusterIPs of a service, like the ones of the Services informer. Only the ClusterIPs of
+	// the managed services are kept, so without it a service only gets its ClusterIPs from SetServiceClusterIPs.
+	ClusterIPs func(namespace, service string) []string
 }
 
 // NewHostManager returns a new HostManager
-func NewHostManager(logger *zap.Logger, trafficReEnableDuration time.Duration, headerForHost string) *HostManager {
+func NewHostManager(params *Params) *HostManager {
 	return &HostManager{
-		logger:                  logger.With(zap.String("component", "hostManager")),
-		hosts:                   sync.Map{},
-		trafficReEnableDuration: trafficReEnableDuration,
-		headerForHost:           headerForHost,
+		logger:        params.Logger.With(zap.String("component", "hostManager")),
+		hosts:         newHostCache(params.CacheSize, params.CacheTTL),
+		headerForHost: params.HeaderForHost,
+		ruleSets:      map[string][]Rule{},
+		clusterIPs:    map[string][]string{},
+		clusterIPsOf:  params.ClusterIPs,
+	}
+}
+
+// SetServices replaces the services managed by ElastiServices. The hosts are mapped again once the services change.
+func (hm *HostManager) SetServices(services []ManagedService) {
+	hm.servicesMu.Lock()
+	defer hm.servicesMu.Unlock()
+	if hm.services.Load() != nil && slices.Equal(hm.serviceList, services) {
+		return
+	}
+	hm.serviceList = services
+	clusterIPs := make(map[string][]string, len(services))
+	for _, service := range services {
+		key := serviceKey(service.Namespace, service.Service)
+		ips := hm.clusterIPs[key]
+		if hm.clusterIPsOf != nil {
+			ips = hm.clusterIPsOf(service.Namespace, service.Service)
+		}
+		if len(ips) > 0 {
+			clusterIPs[key] = ips
+		}
+	}
+	hm.clusterIPs = clusterIPs
+	hm.services.Store(newManagedServices(services, hm.clusterIPs))
+	hm.hosts.clear()
+	hm.logger.Info("Managed services updated", zap.Int("services", len(services)))
+}
+
+// SetServiceClusterIPs sets the ClusterIPs of a service, a deleted service has none. They are only kept for the managed
+// services, and the hosts are mapped again once they change.
+func (hm *HostManager) SetServiceClusterIPs(namespace, service string, clusterIPs []string) {
+	hm.servicesMu.Lock()
+	defer hm.servicesMu.Unlock()
+	services := hm.services.Load()
+	if services == nil {
+		return
+	}
+	if _, ok := services.get(namespace, service); !ok {
+		return
+	}
+	key := serviceKey(namespace, service)
+	if slices.Equal(hm.clusterIPs[key], clusterIPs) {
+		return
+	}
+	if len(clusterIPs) == 0 {
+		delete(hm.clusterIPs, key)
+	} else {
+		hm.clusterIPs[key] = clusterIPs
+	}
+	hm.services.Store(newManagedServices(hm.serviceList, hm.clusterIPs))
+	hm.hosts.clear()
+}
+
+// SetRules replaces the rules of the source. The hosts are mapped again once the rules change.
+// The rules are kept as they were if the new ones are invalid.
+func (hm *HostManager) SetRules(source string, rules []Rule) error {
+	if !slices.Contains(ruleSources, source) {
+		return fmt.Errorf("unknown host rule source %q", source)
+	}
+	hm.rulesMu.Lock()
+	defer hm.rulesMu.Unlock()
+	if reflect.DeepEqual(hm.ruleSets[source], rules) {
+		return nil
+	}
+	var all []Rule
+	for _, s := range ruleSources {
+		if s == source {
+			all = append(all, rules...)
+		} else {
+			all = append(all, hm.ruleSets[s]...)
+		}
+	}
+	compiled, err := CompileRules(all)
+	if err != nil {
+		return err
 	}
+	hm.ruleSets[source] = rules
+	hm.rules.Store(compiled)
+	hm.hosts.clear()
+	hm.logger.Info("Host rules updated", zap.String("source", source), zap.Int("rules", len(rules)))
+	return nil
 }
 
-// GetHost returns the host details for incoming and outgoing requests
+// GetHost returns the host details for incoming and outgoing requests. The cached hosts are never changed, so
+// the host returned is a copy, with whether the traffic of its service is allowed.
 func (hm *HostManager) GetHost(req *http.Request) (*messages.Host, error) {
 	incomingHost := req.Host
 	if values, ok := req.Header[hm.headerForHost]; ok {
 		incomingHost = values[0]
 	}
-	host, ok := hm.hosts.Load(incomingHost)
+	rules := hm.rules.Load()
+	key := rules.cacheKey(req, incomingHost)
+	cached, ok := hm.hosts.get(key)
 	if !ok {
-		sourceService, namespace, err := hm.extractNamespaceAndService(incomingHost)
+		newHost, err := hm.newHost(req, incomingHost, rules)
 		if err != nil {
-			prom.HostExtractionCounter.WithLabelValues("error", incomingHost, hm.headerForHost, err.Error()).Inc()
+			// The incoming host and the error are not used as labels, since anyone can send any host
+			prom.HostExtractionCounter.WithLabelValues("error", "", hm.headerForHost, extractionError(err)).Inc()
 			return &messages.Host{}, err
 		}
-		targetService := utils.GetPrivateServiceName(sourceService)
-		sourceHost := hm.removeTrailingWildcardIfNeeded(incomingHost)
-		sourceHost = hm.removeTrailingPathIfNeeded(sourceHost)
-		sourceHost = hm.addHTTPIfNeeded(sourceHost)
-		targetHost := hm.replaceServiceName(sourceHost, targetService)
-		targetHost = hm.addHTTPIfNeeded(targetHost)
-		newHost := &messages.Host{
-			IncomingHost:   incomingHost,
-			Namespace:      namespace,
-			SourceService:  sourceService,
-			TargetService:  targetService,
-			SourceHost:     sourceHost,
-			TargetHost:     targetHost,
-			TrafficAllowed: true,
+		hm.hosts.store(key, newHost)
+		prom.HostExtractionCounter.WithLabelValues("cache-miss", newHost.SourceService, hm.headerForHost, "").Inc()
+		cached = newHost
+	} else {
+		prom.HostExtractionCounter.WithLabelValues("cache-hit", cached.SourceService, hm.headerForHost, "").Inc()
+	}
+	host := *cached
+	host.TrafficAllowed = hm.traffic.get(host.Namespace, host.SourceService).allowed()
+	return &host, nil
+}
+
+// ServiceForServerName returns the service a TLS server name maps to, from the first host rule which matches it,
+// or from the ClusterIP of a managed service. Rules which match a header never match, as a ClientHello has no headers.
+func (hm *HostManager) ServiceForServerName(serverName string) (namespace, service string, ok bool) {
+	if m, ok := hm.rules.Load().match(&http.Request{Header: http.Header{}}, serverName); ok {
+		return m.namespace, m.service, true
+	}
+	if net.ParseIP(serverName) != nil {
+		if s, ok := hm.services.Load().getByClusterIP(serverName); ok {
+			return s.Namespace, s.Service, true
 		}
-		hm.hosts.Store(incomingHost, newHost)
-		prom.HostExtractionCounter.WithLabelValues("cache-miss", incomingHost, hm.headerForHost, "").Inc()
-		return newHost, nil
-	}
-	prom.HostExtractionCounter.WithLabelValues("cache-hit", incomingHost, hm.headerForHost, "").Inc()
-	return host.(*messages.Host), nil
-}
-
-// DisableTrafficForHost disables the traffic for the host
-func (hm *HostManager) DisableTrafficForHost(hostName string) {
-	if host, ok := hm.hosts.Load(hostName); ok && host.(*messages.Host).TrafficAllowed {
-		host.(*messages.Host).TrafficAllowed = false
-		hm.hosts.Store(hostName, host)
-		hm.logger.Debug("Disabled traffic for host",
-			zap.String("hostName", logger.MaskMiddle(hostName, 4, 4)),
-			zap.Duration("trafficReEnableDuration", hm.trafficReEnableDuration))
-		go time.AfterFunc(hm.trafficReEnableDuration, func() {
-			hm.enableTrafficForHost(hostName)
-		})
-		prom.TrafficSwitchCounter.WithLabelValues(hostName, "disabled").Inc()
-	}
-}
-
-// enableTrafficForHost enables the traffic for the host
-func (hm *HostManager) enableTrafficForHost(hostName string) {
-	if host, ok := hm.hosts.Load(hostName); ok && !host.(*messages.Host).TrafficAllowed {
-		host.(*messages.Host).TrafficAllowed = true
-		hm.hosts.Store(hostName, host)
-		hm.logger.Debug("Enabled traffic for host", zap.Any("hostName", logger.MaskMiddle(hostName, 4, 4)))
-		prom.TrafficSwitchCounter.WithLabelValues(hostName, "enabled").Inc()
-	}
-}
-
-func (hm *HostManager) extractNamespaceAndService(url string) (string, string, error) {
-	// Define regular expression patterns for different Kubernetes internal URL formats
-	patterns := []string{
-		`http://([a-zA-Z0-9-]+)\.([a-zA-Z0-9-]+)\.svc\.cluster\.local:\d+/\*`,
-		`([a-zA-Z0-9-]+)\.([a-zA-Z0-9-]+)\.svc\.cluster\.local:\d+/\*`,
-		`http://([a-zA-Z0-9-]+)\.([a-zA-Z0-9-]+)\.svc\.cluster\.local:\d+`,
-		`([a-zA-Z0-9-]+)\.([a-zA-Z0-9-]+)\.svc\.cluster\.local:\d+`,
-		`http://([a-zA-Z0-9-]+)\.([a-zA-Z0-9-]+)\.svc\.cluster\.local`,
-		`([a-zA-Z0-9-]+)\.([a-zA-Z0-9-]+)\.svc\.cluster\.local`,
-		`http://([a-zA-Z0-9-]+)\.([a-zA-Z0-9-]+)\.svc`,
-		`([a-zA-Z0-9-]+)\.([a-zA-Z0-9-]+)\.svc`,
-		`http://([a-zA-Z0-9-]+)\.([a-zA-Z0-9-]+)`,
-		`([a-zA-Z0-9-]+)\.([a-zA-Z0-9-]+)`,
-		`http://([a-zA-Z0-9-]+)\.svc\.cluster\.local`,
-		`([a-zA-Z0-9-]+)\.svc\.cluster\.local`,
-		`http://([a-zA-Z0-9-]+)\.svc`,
-		`([a-zA-Z0-9-]+)\.svc`,
-		`http://([a-zA-Z0-9-]+)`,
-		`([a-zA-Z0-9-]+)`,
-	}
-	var serviceName, namespace string
-	for _, pattern := range patterns {
-		re := regexp.MustCompile(pattern)
-		matches := re.FindStringSubmatch(url)
-		if len(matches) == 3 {
-			serviceName = matches[1]
-			namespace = matches[2]
-			return serviceName, namespace, nil
-		} else if len(matches) == 2 {
-			serviceName = matches[1]
-			namespace = "default"
-			return serviceName, namespace, fmt.Errorf("namespace not found in URL: %s", logger.MaskMiddle(url, 4, 4))
+	}
+	return "", "", false
+}
+
+// extractionError is the error label of a failed host extraction
+func extractionError(err error) string {
+	if errors.Is(err, ErrUnknownHost) {
+		return prom.ReasonUnknownHost
+	}
+	return prom.ReasonInvalidHost
+}
+
+// newHost builds the host details for an incoming host, and rejects the hosts of services which are not managed
+// by an ElastiService
+func (hm *HostManager) newHost(req *http.Request, incomingHost string, rules *Rules) (*messages.Host, error) {
+	host, err := hm.mapHost(req, incomingHost, rules)
+	if err != nil {
+		return nil, err
+	}
+	service, ok := hm.services.Load().get(host.Namespace, host.SourceService)
+	if !ok {
+		return nil, fmt.Errorf("%w: no ElastiService manages service %s/%s", ErrUnknownHost, host.Namespace, host.SourceService)
+	}
+	hm.logger.Debug("Host mapped to service",
+		zap.String("hostName", logger.MaskMiddle(incomingHost, 4, 4)),
+		zap.String("namespace", service.Namespace),
+		zap.String("service", service.Service),
+		zap.String("elastiService", service.ElastiService))
+	return host, nil
+}
+
+// mapHost builds the host details for an incoming host, from the first rule which matches the request,
+// from the ClusterIP of a managed service, or from the Kubernetes DNS name of the host
+func (hm *HostManager) mapHost(req *http.Request, incomingHost string, rules *Rules) (*messages.Host, error) {
+	sourceHost := hm.removeTrailingWildcardIfNeeded(incomingHost)
+	sourceHost = hm.removeTrailingPathIfNeeded(strings.TrimPrefix(strings.TrimPrefix(sourceHost, "http://"), "https://"))
+	sourceHost = hm.addHTTPIfNeeded(sourceHost)
+	hostname, port := splitHostPort(sourceHost)
+
+	m, ok := rules.match(req, hostname)
+	if !ok && net.ParseIP(hostname) != nil {
+		// Clients which connect to the ClusterIP of a service send it as their host
+		if service, found := hm.services.Load().getByClusterIP(hostname); found {
+			m, ok = ruleMatch{namespace: service.Namespace, service: service.Service}, true
 		}
 	}
-	return "", "", fmt.Errorf("invalid Kubernetes URL: %s", logger.MaskMiddle(url, 4, 4))
+	if ok {
+		targetService := utils.GetPrivateServiceName(m.service)
+		targetHost := "http://" + targetService + "." + m.namespace + ".svc"
+		if m.port != 0 {
+			targetHost += ":" + strconv.Itoa(int(m.port))
+		} else if port != "" {
+			targetHost += ":" + port
+		}
+		return &messages.Host{
+			IncomingHost:  incomingHost,
+			Namespace:     m.namespace,
+			SourceService: m.service,
+			TargetService: targetService,
+			SourceHost:    sourceHost,
+			TargetHost:    targetHost,
+		}, nil
+	}
+
+	// Per-pod DNS names of a headless service point to the resolver too, while the pods are scaled down
+	if pod, sourceService, namespace, ok := hm.extractPodAndService(incomingHost); ok {
+		targetService := utils.GetPrivateServiceName(sourceService)
+		return &messages.Host{
+			IncomingHost:  incomingHost,
+			Namespace:     namespace,
+			SourceService: sourceService,
+			TargetService: targetService,
+			SourceHost:    sourceHost,
+			TargetHost:    hm.replacePodServiceName(sourceHost, targetService),
+			TargetPod:     pod,
+		}, nil
+	}
+
+	sourceService, namespace, err := hm.extractNamespaceAndService(hostname)
+	if err != nil {
+		return nil, err
+	}
+	targetService := utils.GetPrivateServiceName(sourceService)
+	targetHost := hm.replaceServiceName(sourceHost, targetService)
+	targetHost = hm.addHTTPIfNeeded(targetHost)
+	return &messages.Host{
+		IncomingHost:  incomingHost,
+		Namespace:     namespace,
+		SourceService: sourceService,
+		TargetService: targetService,
+		SourceHost:    sourceHost,
+		TargetHost:    targetHost,
+	}, nil
+}
+
+// SetResolverSlice follows the EndpointSlice which points the service to the resolver. The traffic of the service is
+// switched to its target once the operator removes it, and back to the resolver once it is added again.
+func (hm *HostManager) SetResolverSlice(namespace, service string, exists bool) {
+	state := TrafficSwitched
+	if exists {
+		state = TrafficProxying
+	}
+	previous := hm.traffic.set(namespace, service, state)
+	if previous == state || previous.allowed() == state.allowed() {
+		return
+	}
+	enabled := "enabled"
+	if !state.allowed() {
+		enabled = "disabled"
+	}
+	hm.logger.Info("Traffic of service switched",
+		zap.String("namespace", namespace),
+		zap.String("service", service),
+		zap.Stringer("from", previous),
+		zap.Stringer("to", state))
+	prom.TrafficSwitchCounter.WithLabelValues(service, enabled).Inc()
+}
+
+// IsTrafficAllowed returns false once the traffic of the service is switched to its target
+func (hm *HostManager) IsTrafficAllowed(namespace, service string) bool {
+	return hm.traffic.get(namespace, service).allowed()
+}
+
+// podHostPattern matches the per-pod DNS names of a headless service, like web-0.web.ns.svc.cluster.local:8080
+var podHostPattern = regexp.MustCompile(`^(?:https?://)?([a-zA-Z0-9-]+)\.([a-zA-Z0-9-]+)\.([a-zA-Z0-9-]+)\.svc(?:\.cluster\.local)?(?::\d+)?(?:/.*)?$`)
+
+// extractPodAndService returns the pod, service and namespace of a per-pod DNS name
+func (hm *HostManager) extractPodAndService(url string) (string, string, string, bool) {
+	matches := podHostPattern.FindStringSubmatch(url)
+	if len(matches) != 4 {
+		return "", "", "", false
+	}
+	return matches[1], matches[2], matches[3], true
+}
+
+// serviceHostPattern matches the Kubernetes DNS names of a service, like web.ns, web.ns.svc and web.ns.svc.cluster.local
+var serviceHostPattern = regexp.MustCompile(`^([a-z0-9-]+)\.([a-z0-9-]+)(?:\.svc(?:\.[a-z0-9.-]+)?)?$`)
+
+// extractNamespaceAndService returns the service and namespace of the Kubernetes DNS name of a service, without its port.
+// Other hosts, like the ones of an ingress, must be mapped by a rule.
+func (hm *HostManager) extractNamespaceAndService(hostname string) (string, string, error) {
+	matches := serviceHostPattern.FindStringSubmatch(strings.ToLower(hostname))
+	if matches == nil {
+		return "", "", fmt.Errorf("%w: no rule matches host, and it is not the DNS name of a service with its namespace: %s",
+			ErrUnknownHost, logger.MaskMiddle(hostname, 4, 4))
+	}
+	return matches[1], matches[2], nil
+}
+
+// splitHostPort splits the host of a URL like http://web.ns:8080 into its hostname and port, the port is empty if it has none
+func splitHostPort(serviceURL string) (string, string) {
+	host := strings.TrimPrefix(strings.TrimPrefix(serviceURL, "http://"), "https://")
+	if hostname, port, err := net.SplitHostPort(host); err == nil {
+		return hostname, port
+	}
+	// IPv6 addresses without a port are still in brackets
+	return strings.TrimSuffix(strings.TrimPrefix(host, "["), "]"), ""
 }
 
 // addHTTPIfNeeded adds http if not present in the service URL
@@ -158,6 +375,16 @@ func (hm *HostManager) removeTrailingPathIfNeeded(serviceURL string) string {
 	return serviceURL
 }
 
+// replacePodServiceName replaces the service name in a per-pod service URL, which comes after the pod hostname
+func (hm *HostManager) replacePodServiceName(serviceURL, newServiceName string) string {
+	parts := strings.Split(serviceURL, ".")
+	if len(parts) < 4 {
+		return serviceURL
+	}
+	parts[1] = newServiceName
+	return strings.Join(parts, ".")
+}
+
 // replaceServiceName replaces the service name in the service URL
 func (hm *HostManager) replaceServiceName(serviceURL, newServiceName string) string {
 	parts := strings.Split(serviceURL, ".")
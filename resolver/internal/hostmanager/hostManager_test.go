@@ -3,16 +3,17 @@ package hostmanager
 import (
 	"net/http"
 	"testing"
-	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"github.com/truefoundry/elasti/pkg/messages"
+	"github.com/truefoundry/elasti/pkg/utils"
 	"go.uber.org/zap"
 )
 
 func TestGetHost(t *testing.T) {
 	logger, _ := zap.NewDevelopment()
-	hm := NewHostManager(logger, 10*time.Second, "X-Envoy-Decorator-Operation")
+	hm := NewHostManager(&Params{Logger: logger, HeaderForHost: "X-Envoy-Decorator-Operation"})
 
 	tests := []struct {
 		name          string
@@ -39,6 +40,23 @@ func TestGetHost(t *testing.T) {
 			},
 			expectedError: false,
 		},
+		{
+			name: "Per-pod host of a headless service",
+			req: &http.Request{
+				Host: "web-0.web.namespace.svc.cluster.local:8080",
+			},
+			expectedHost: &messages.Host{
+				IncomingHost:   "web-0.web.namespace.svc.cluster.local:8080",
+				Namespace:      "namespace",
+				SourceService:  "web",
+				TargetService:  "elasti-web-pvt-4b5e57f6eb",
+				SourceHost:     "http://web-0.web.namespace.svc.cluster.local:8080",
+				TargetHost:     "http://web-0.elasti-web-pvt-4b5e57f6eb.namespace.svc.cluster.local:8080",
+				TrafficAllowed: true,
+				TargetPod:      "web-0",
+			},
+			expectedError: false,
+		},
 	}
 
 	for _, tt := range tests {
@@ -53,3 +71,44 @@ func TestGetHost(t *testing.T) {
 		})
 	}
 }
+
+func TestGetHostWithRules(t *testing.T) {
+	hm := NewHostManager(&Params{Logger: zap.NewNop(), HeaderForHost: "X-Envoy-Decorator-Operation"})
+
+	// Hosts which are not the DNS name of a service are not guessed
+	_, err := hm.GetHost(&http.Request{Host: "api.example.com"})
+	assert.Error(t, err)
+
+	require.NoError(t, hm.SetRules(RuleSourceElastiServices, []Rule{{Host: "api.example.com", Namespace: "prod", Service: "api", Port: 8080}}))
+	require.NoError(t, hm.SetRules(RuleSourceConfigMap, []Rule{{Header: "X-Tenant", HeaderValue: "beta", Namespace: "beta", Service: "api"}}))
+	host, err := hm.GetHost(&http.Request{Host: "api.example.com"})
+	require.NoError(t, err)
+	targetService := utils.GetPrivateServiceName("api")
+	assert.Equal(t, &messages.Host{
+		IncomingHost:   "api.example.com",
+		Namespace:      "prod",
+		SourceService:  "api",
+		TargetService:  targetService,
+		SourceHost:     "http://api.example.com",
+		TargetHost:     "http://" + targetService + ".prod.svc:8080",
+		TrafficAllowed: true,
+	}, host)
+
+	// The rules of the ConfigMap are matched first, and the host is cached per value of the header they match
+	host, err = hm.GetHost(&http.Request{Host: "api.example.com", Header: http.Header{"X-Tenant": {"beta"}}})
+	require.NoError(t, err)
+	assert.Equal(t, "beta", host.Namespace)
+
+	// Invalid rules keep the previous ones
+	assert.ErrorIs(t, hm.SetRules(RuleSourceConfigMap, []Rule{{Namespace: "beta", Service: "api"}}), ErrInvalidRule)
+	host, err = hm.GetHost(&http.Request{Host: "api.example.com", Header: http.Header{"X-Tenant": {"beta"}}})
+	require.NoError(t, err)
+	assert.Equal(t, "beta", host.Namespace)
+
+	// Hosts are mapped again once the rules change
+	require.NoError(t, hm.SetRules(RuleSourceConfigMap, nil))
+	host, err = hm.GetHost(&http.Request{Host: "api.example.com", Header: http.Header{"X-Tenant": {"beta"}}})
+	require.NoError(t, err)
+	assert.Equal(t, "prod", host.Namespace)
+	assert.True(t, host.TrafficAllowed)
+}
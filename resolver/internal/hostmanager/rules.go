@@ -0,0 +1,189 @@
+package hostmanager
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	// RuleSourceConfigMap are the rules of the host rules ConfigMap, they are matched first
+	RuleSourceConfigMap = "configMap"
+	// RuleSourceElastiServices are the rules derived from the spec.resolver.hosts of the ElastiServices
+	RuleSourceElastiServices = "elastiServices"
+)
+
+// ruleSources are the sources of the rules, in the order they are matched
+var ruleSources = []string{RuleSourceConfigMap, RuleSourceElastiServices}
+
+// ErrInvalidRule is returned for rules which don't match anything, or don't map to a service
+var ErrInvalidRule = errors.New("invalid host rule")
+
+type (
+	// Rule maps the requests it matches to a service. Every condition which is set must match,
+	// and at least one of Host, HostRegex and Header must be set.
+	Rule struct {
+		// Host is the host of the request, without its port, like api.example.com, or a wildcard like *.example.com
+		Host string `json:"host,omitempty"`
+		// HostRegex matches the host of the request, without its port. Namespace and Service can refer to its
+		// submatches, like ${1} or ${service}.
+		HostRegex string `json:"hostRegex,omitempty"`
+		// Header and HeaderValue match the requests with the header, with the value if it is set
+		Header      string `json:"header,omitempty"`
+		HeaderValue string `json:"headerValue,omitempty"`
+
+		Namespace string `json:"namespace"`
+		Service   string `json:"service"`
+		// Port is the port of the service the requests are sent to, it defaults to the port of the host of the request
+		Port int32 `json:"port,omitempty"`
+	}
+
+	// Rules are compiled rules, which are matched in order
+	Rules struct {
+		rules []compiledRule
+		// headers are the headers the rules match, which are part of the cache key of the hosts
+		headers []string
+	}
+
+	compiledRule struct {
+		Rule
+		hostRegex *regexp.Regexp
+	}
+
+	// ruleMatch is the service a request is mapped to by a rule
+	ruleMatch struct {
+		namespace string
+		service   string
+		port      int32
+	}
+)
+
+// CompileRules compiles the rules, it returns an error for the first invalid one
+func CompileRules(rules []Rule) (*Rules, error) {
+	compiled := &Rules{rules: make([]compiledRule, 0, len(rules))}
+	headers := map[string]bool{}
+	for i, rule := range rules {
+		if rule.Host == "" && rule.HostRegex == "" && rule.Header == "" {
+			return nil, fmt.Errorf("%w %d: one of host, hostRegex and header must be set", ErrInvalidRule, i)
+		}
+		if rule.Namespace == "" || rule.Service == "" {
+			return nil, fmt.Errorf("%w %d: namespace and service must be set", ErrInvalidRule, i)
+		}
+		c := compiledRule{Rule: rule}
+		c.Host = strings.ToLower(rule.Host)
+		if rule.HostRegex != "" {
+			hostRegex, err := regexp.Compile(rule.HostRegex)
+			if err != nil {
+				return nil, fmt.Errorf("%w %d: %w", ErrInvalidRule, i, err)
+			}
+			c.hostRegex = hostRegex
+		}
+		if rule.Header != "" {
+			c.Header = http.CanonicalHeaderKey(rule.Header)
+			if !headers[c.Header] {
+				headers[c.Header] = true
+				compiled.headers = append(compiled.headers, c.Header)
+			}
+		}
+		compiled.rules = append(compiled.rules, c)
+	}
+	return compiled, nil
+}
+
+// ParseRules parses YAML rules, like the ones of the host rules ConfigMap
+func ParseRules(data []byte) ([]Rule, error) {
+	var rules []Rule
+	if err := yaml.UnmarshalStrict(data, &rules); err != nil {
+		return nil, fmt.Errorf("error parsing host rules: %w", err)
+	}
+	return rules, nil
+}
+
+// RulesFromElastiServices returns the rules of the spec.resolver.hosts of the ElastiServices
+func RulesFromElastiServices(elastiServices []*unstructured.Unstructured) []Rule {
+	var rules []Rule
+	for _, es := range elastiServices {
+		service, _, _ := unstructured.NestedString(es.Object, "spec", "service")
+		hosts, _, _ := unstructured.NestedSlice(es.Object, "spec", "resolver", "hosts")
+		for _, host := range hosts {
+			fields, ok := host.(map[string]any)
+			if !ok {
+				continue
+			}
+			name, _, _ := unstructured.NestedString(fields, "host")
+			if service == "" || name == "" {
+				continue
+			}
+			port, _, _ := unstructured.NestedInt64(fields, "port")
+			rules = append(rules, Rule{Host: name, Namespace: es.GetNamespace(), Service: service, Port: int32(port)})
+		}
+	}
+	return rules
+}
+
+// match returns the service of the first rule which matches the request to the hostname, which has no port
+func (r *Rules) match(req *http.Request, hostname string) (ruleMatch, bool) {
+	if r == nil {
+		return ruleMatch{}, false
+	}
+	hostname = strings.ToLower(hostname)
+	for _, rule := range r.rules {
+		if m, ok := rule.match(req, hostname); ok {
+			return m, true
+		}
+	}
+	return ruleMatch{}, false
+}
+
+func (r *compiledRule) match(req *http.Request, hostname string) (ruleMatch, bool) {
+	if r.Host != "" && !matchHost(r.Host, hostname) {
+		return ruleMatch{}, false
+	}
+	if r.Header != "" {
+		values, ok := req.Header[r.Header]
+		if !ok || (r.HeaderValue != "" && values[0] != r.HeaderValue) {
+			return ruleMatch{}, false
+		}
+	}
+	m := ruleMatch{namespace: r.Namespace, service: r.Service, port: r.Port}
+	if r.hostRegex != nil {
+		submatches := r.hostRegex.FindStringSubmatchIndex(hostname)
+		if submatches == nil {
+			return ruleMatch{}, false
+		}
+		m.namespace = string(r.hostRegex.ExpandString(nil, r.Namespace, hostname, submatches))
+		m.service = string(r.hostRegex.ExpandString(nil, r.Service, hostname, submatches))
+		if m.namespace == "" || m.service == "" {
+			return ruleMatch{}, false
+		}
+	}
+	return m, true
+}
+
+// matchHost matches the hostname with the host of a rule, which is either exact or a wildcard like *.example.com.
+// A wildcard matches one label or more, but not the domain itself.
+func matchHost(host, hostname string) bool {
+	if suffix, ok := strings.CutPrefix(host, "*"); ok {
+		return strings.HasSuffix(hostname, suffix) && len(hostname) > len(suffix)
+	}
+	return host == hostname
+}
+
+// cacheKey returns the key of the host of the request in the cache, with the values of the headers the rules match
+func (r *Rules) cacheKey(req *http.Request, incomingHost string) string {
+	if r == nil || len(r.headers) == 0 {
+		return incomingHost
+	}
+	var key strings.Builder
+	key.WriteString(incomingHost)
+	for _, header := range r.headers {
+		key.WriteByte(0)
+		key.WriteString(req.Header.Get(header))
+	}
+	return key.String()
+}
@@ -0,0 +1,98 @@
+package hostmanager
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestRulesMatch(t *testing.T) {
+	rules, err := CompileRules([]Rule{
+		{Host: "api.example.com", Namespace: "prod", Service: "api", Port: 8080},
+		{Header: "X-Tenant", HeaderValue: "beta", Host: "*.example.com", Namespace: "beta", Service: "web"},
+		{Host: "*.example.com", Namespace: "prod", Service: "web"},
+		{HostRegex: `^(?P<service>[a-z0-9-]+)\.(?P<namespace>[a-z0-9-]+)\.preview\.dev$`, Namespace: "${namespace}", Service: "${service}"},
+		{Header: "X-Service", Namespace: "default", Service: "by-header"},
+	})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name     string
+		hostname string
+		header   http.Header
+		expected ruleMatch
+		ok       bool
+	}{
+		{name: "Exact host", hostname: "API.example.com", expected: ruleMatch{namespace: "prod", service: "api", port: 8080}, ok: true},
+		{name: "Wildcard", hostname: "www.example.com", expected: ruleMatch{namespace: "prod", service: "web"}, ok: true},
+		{name: "Wildcard doesn't match the domain", hostname: "example.com"},
+		{name: "Header and wildcard", hostname: "www.example.com", header: http.Header{"X-Tenant": {"beta"}}, expected: ruleMatch{namespace: "beta", service: "web"}, ok: true},
+		{name: "Header with another value", hostname: "www.example.com", header: http.Header{"X-Tenant": {"alpha"}}, expected: ruleMatch{namespace: "prod", service: "web"}, ok: true},
+		{name: "Regex", hostname: "shop.team-a.preview.dev", expected: ruleMatch{namespace: "team-a", service: "shop"}, ok: true},
+		{name: "Header only", hostname: "anything", header: http.Header{"X-Service": {""}}, expected: ruleMatch{namespace: "default", service: "by-header"}, ok: true},
+		{name: "No match", hostname: "web.default.svc.cluster.local"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, ok := rules.match(&http.Request{Header: tt.header}, tt.hostname)
+			assert.Equal(t, tt.ok, ok)
+			assert.Equal(t, tt.expected, m)
+		})
+	}
+	assert.Equal(t, []string{"X-Tenant", "X-Service"}, rules.headers)
+}
+
+func TestCompileRulesInvalid(t *testing.T) {
+	for name, rule := range map[string]Rule{
+		"No condition":  {Namespace: "default", Service: "web"},
+		"No service":    {Host: "web.example.com", Namespace: "default"},
+		"Invalid regex": {HostRegex: "(", Namespace: "default", Service: "web"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := CompileRules([]Rule{rule})
+			assert.ErrorIs(t, err, ErrInvalidRule)
+		})
+	}
+}
+
+func TestParseRules(t *testing.T) {
+	rules, err := ParseRules([]byte(`
+- host: api.example.com
+  namespace: prod
+  service: api
+  port: 8080
+- header: X-Tenant
+  headerValue: beta
+  namespace: beta
+  service: web
+`))
+	require.NoError(t, err)
+	assert.Equal(t, []Rule{
+		{Host: "api.example.com", Namespace: "prod", Service: "api", Port: 8080},
+		{Header: "X-Tenant", HeaderValue: "beta", Namespace: "beta", Service: "web"},
+	}, rules)
+
+	_, err = ParseRules([]byte(`- hots: api.example.com`))
+	assert.Error(t, err, "unknown fields are rejected")
+}
+
+func TestRulesFromElastiServices(t *testing.T) {
+	es := &unstructured.Unstructured{Object: map[string]any{
+		"metadata": map[string]any{"name": "api", "namespace": "prod"},
+		"spec": map[string]any{
+			"service": "api",
+			"resolver": map[string]any{"hosts": []any{
+				map[string]any{"host": "api.example.com", "port": int64(8080)},
+				map[string]any{"host": "*.api.example.com"},
+			}},
+		},
+	}}
+
+	assert.Equal(t, []Rule{
+		{Host: "api.example.com", Namespace: "prod", Service: "api", Port: 8080},
+		{Host: "*.api.example.com", Namespace: "prod", Service: "api"},
+	}, RulesFromElastiServices([]*unstructured.Unstructured{es}))
+}
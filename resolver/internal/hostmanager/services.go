@@ -0,0 +1,86 @@
+package hostmanager
+
+import (
+	"cmp"
+	"errors"
+	"slices"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// ErrUnknownHost is returned for hosts which are not mapped to a service managed by an ElastiService
+var ErrUnknownHost = errors.New("unknown host")
+
+type (
+	// ManagedService is a service managed by an ElastiService, the resolver only takes the requests of these services
+	ManagedService struct {
+		Namespace     string
+		Service       string
+		ElastiService string
+	}
+
+	// managedServices is the authoritative map of the services managed by ElastiServices, by their namespace and name,
+	// and by their ClusterIPs
+	managedServices struct {
+		byName      map[string]ManagedService
+		byClusterIP map[string]ManagedService
+	}
+)
+
+// ServicesFromElastiServices returns the services of the ElastiServices, sorted by namespace and service
+func ServicesFromElastiServices(elastiServices []*unstructured.Unstructured) []ManagedService {
+	services := make([]ManagedService, 0, len(elastiServices))
+	for _, es := range elastiServices {
+		service, _, _ := unstructured.NestedString(es.Object, "spec", "service")
+		if service == "" {
+			continue
+		}
+		services = append(services, ManagedService{Namespace: es.GetNamespace(), Service: service, ElastiService: es.GetName()})
+	}
+	slices.SortFunc(services, func(a, b ManagedService) int {
+		return cmp.Or(cmp.Compare(a.Namespace, b.Namespace), cmp.Compare(a.Service, b.Service), cmp.Compare(a.ElastiService, b.ElastiService))
+	})
+	return services
+}
+
+// newManagedServices maps the services by their name, and by the ClusterIPs they have in clusterIPs
+func newManagedServices(services []ManagedService, clusterIPs map[string][]string) *managedServices {
+	managed := &managedServices{
+		byName:      make(map[string]ManagedService, len(services)),
+		byClusterIP: map[string]ManagedService{},
+	}
+	for _, service := range services {
+		key := serviceKey(service.Namespace, service.Service)
+		if _, ok := managed.byName[key]; ok {
+			// Two ElastiServices manage the same service, the first one is kept
+			continue
+		}
+		managed.byName[key] = service
+		for _, ip := range clusterIPs[key] {
+			managed.byClusterIP[ip] = service
+		}
+	}
+	return managed
+}
+
+// get returns the managed service, all services are managed until the services are known
+func (m *managedServices) get(namespace, service string) (ManagedService, bool) {
+	if m == nil {
+		return ManagedService{Namespace: namespace, Service: service}, true
+	}
+	s, ok := m.byName[serviceKey(namespace, service)]
+	return s, ok
+}
+
+// getByClusterIP returns the managed service with the ClusterIP
+func (m *managedServices) getByClusterIP(ip string) (ManagedService, bool) {
+	if m == nil {
+		return ManagedService{}, false
+	}
+	s, ok := m.byClusterIP[ip]
+	return s, ok
+}
+
+func serviceKey(namespace, service string) string {
+	return namespace + "/" + service
+}
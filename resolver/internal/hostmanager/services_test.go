@@ -0,0 +1,110 @@
+package hostmanager
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/truefoundry/elasti/pkg/utils"
+	"go.uber.org/zap"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestServicesFromElastiServices(t *testing.T) {
+	newElastiService := func(namespace, name, service string) *unstructured.Unstructured {
+		return &unstructured.Unstructured{Object: map[string]any{
+			"metadata": map[string]any{"name": name, "namespace": namespace},
+			"spec":     map[string]any{"service": service},
+		}}
+	}
+
+	assert.Equal(t, []ManagedService{
+		{Namespace: "a", Service: "web", ElastiService: "web-es"},
+		{Namespace: "b", Service: "api", ElastiService: "api-es"},
+	}, ServicesFromElastiServices([]*unstructured.Unstructured{
+		newElastiService("b", "api-es", "api"),
+		newElastiService("a", "no-service", ""),
+		newElastiService("a", "web-es", "web"),
+	}))
+}
+
+func TestGetHostWithServices(t *testing.T) {
+	// clusterIPs are the ClusterIPs of every service, like the informer has them
+	clusterIPs := map[string][]string{}
+	hm := NewHostManager(&Params{Logger: zap.NewNop(), HeaderForHost: "Host", ClusterIPs: func(namespace, service string) []string {
+		return clusterIPs[namespace+"/"+service]
+	}})
+	setClusterIPs := func(namespace, service string, ips []string) {
+		clusterIPs[namespace+"/"+service] = ips
+		hm.SetServiceClusterIPs(namespace, service, ips)
+	}
+
+	// Every service is managed until the ElastiServices are known
+	host, err := hm.GetHost(&http.Request{Host: "other.prod.svc.cluster.local"})
+	require.NoError(t, err)
+	assert.Equal(t, "other", host.SourceService)
+
+	hm.SetServices([]ManagedService{{Namespace: "prod", Service: "api", ElastiService: "api"}})
+	_, err = hm.GetHost(&http.Request{Host: "other.prod.svc.cluster.local"})
+	assert.ErrorIs(t, err, ErrUnknownHost)
+	_, err = hm.GetHost(&http.Request{Host: "api.example.com"})
+	assert.ErrorIs(t, err, ErrUnknownHost)
+	host, err = hm.GetHost(&http.Request{Host: "api.prod.svc.cluster.local:8080"})
+	require.NoError(t, err)
+	assert.Equal(t, "api", host.SourceService)
+
+	// Requests sent to the ClusterIP of a managed service are mapped to it
+	_, err = hm.GetHost(&http.Request{Host: "10.0.0.1:8080"})
+	assert.ErrorIs(t, err, ErrUnknownHost)
+	setClusterIPs("prod", "api", []string{"10.0.0.1", "fd00::1"})
+	setClusterIPs("prod", "other", []string{"10.0.0.2"})
+	host, err = hm.GetHost(&http.Request{Host: "10.0.0.1:8080"})
+	require.NoError(t, err)
+	assert.Equal(t, "prod", host.Namespace)
+	assert.Equal(t, "api", host.SourceService)
+	assert.Equal(t, "http://"+utils.GetPrivateServiceName("api")+".prod.svc:8080", host.TargetHost)
+	host, err = hm.GetHost(&http.Request{Host: "[fd00::1]"})
+	require.NoError(t, err)
+	assert.Equal(t, "api", host.SourceService)
+	_, err = hm.GetHost(&http.Request{Host: "10.0.0.2:8080"})
+	assert.ErrorIs(t, err, ErrUnknownHost)
+	assert.Equal(t, map[string][]string{"prod/api": {"10.0.0.1", "fd00::1"}}, hm.clusterIPs)
+
+	// Hosts are mapped again once the services change, with the ClusterIPs of the services which are now managed
+	hm.SetServices([]ManagedService{{Namespace: "prod", Service: "other", ElastiService: "other"}})
+	_, err = hm.GetHost(&http.Request{Host: "10.0.0.1:8080"})
+	assert.ErrorIs(t, err, ErrUnknownHost)
+	host, err = hm.GetHost(&http.Request{Host: "10.0.0.2:8080"})
+	require.NoError(t, err)
+	assert.Equal(t, "other", host.SourceService)
+	assert.Equal(t, map[string][]string{"prod/other": {"10.0.0.2"}}, hm.clusterIPs)
+	setClusterIPs("prod", "other", nil)
+	_, err = hm.GetHost(&http.Request{Host: "10.0.0.2:8080"})
+	assert.ErrorIs(t, err, ErrUnknownHost)
+}
+
+func TestServiceForServerName(t *testing.T) {
+	hm := NewHostManager(&Params{Logger: zap.NewNop(), HeaderForHost: "Host"})
+	hm.SetServices([]ManagedService{{Namespace: "prod", Service: "api", ElastiService: "api"}})
+	hm.SetServiceClusterIPs("prod", "api", []string{"10.0.0.1"})
+	require.NoError(t, hm.SetRules(RuleSourceConfigMap, []Rule{
+		{Host: "*.example.com", Namespace: "prod", Service: "api"},
+		{Header: "X-Tenant", Namespace: "beta", Service: "api"},
+	}))
+
+	namespace, service, ok := hm.ServiceForServerName("api.example.com")
+	require.True(t, ok)
+	assert.Equal(t, "prod", namespace)
+	assert.Equal(t, "api", service)
+	namespace, service, ok = hm.ServiceForServerName("10.0.0.1")
+	require.True(t, ok)
+	assert.Equal(t, "prod", namespace)
+	assert.Equal(t, "api", service)
+
+	// Rules which match a header, and ClusterIPs of other services, don't map server names
+	_, _, ok = hm.ServiceForServerName("api.other.com")
+	assert.False(t, ok)
+	_, _, ok = hm.ServiceForServerName("10.0.0.2")
+	assert.False(t, ok)
+}
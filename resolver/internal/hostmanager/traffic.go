@@ -0,0 +1,56 @@
+package hostmanager
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// TrafficState is where the traffic of a service goes, which follows the EndpointSlice the operator points to the resolver
+type TrafficState int32
+
+const (
+	// TrafficUnknown is the state of the services whose EndpointSlice to the resolver was never seen, their requests are proxied
+	TrafficUnknown TrafficState = iota
+	// TrafficProxying is the state of the services with an EndpointSlice to the resolver, their requests are proxied
+	TrafficProxying
+	// TrafficSwitched is the state of the services whose EndpointSlice to the resolver was removed by the operator, so
+	// their traffic goes to the target. Requests which still reach the resolver, on connections opened before, are
+	// refused and their connection is closed, so clients connect to the target.
+	TrafficSwitched
+)
+
+func (s TrafficState) String() string {
+	switch s {
+	case TrafficProxying:
+		return "proxying"
+	case TrafficSwitched:
+		return "switched"
+	default:
+		return "unknown"
+	}
+}
+
+// allowed returns true if the requests of a service in this state are proxied
+func (s TrafficState) allowed() bool {
+	return s != TrafficSwitched
+}
+
+// trafficStates are the traffic states of the services, by namespace and name. A state is only changed atomically,
+// so it can be read while requests are served.
+type trafficStates struct {
+	states sync.Map
+}
+
+// get returns the traffic state of the service
+func (t *trafficStates) get(namespace, service string) TrafficState {
+	if state, ok := t.states.Load(serviceKey(namespace, service)); ok {
+		return TrafficState(state.(*atomic.Int32).Load())
+	}
+	return TrafficUnknown
+}
+
+// set changes the traffic state of the service, and returns the previous one
+func (t *trafficStates) set(namespace, service string, state TrafficState) TrafficState {
+	value, _ := t.states.LoadOrStore(serviceKey(namespace, service), &atomic.Int32{})
+	return TrafficState(value.(*atomic.Int32).Swap(int32(state)))
+}
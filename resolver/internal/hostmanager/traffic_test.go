@@ -0,0 +1,70 @@
+package hostmanager
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestSetResolverSlice(t *testing.T) {
+	hm := NewHostManager(&Params{Logger: zap.NewNop(), HeaderForHost: "Host"})
+	getHost := func(incomingHost string) bool {
+		host, err := hm.GetHost(&http.Request{Host: incomingHost})
+		require.NoError(t, err)
+		return host.TrafficAllowed
+	}
+
+	// The traffic is allowed until the EndpointSlice to the resolver is seen, and while it exists
+	assert.True(t, getHost("service.namespace.svc"))
+	hm.SetResolverSlice("namespace", "service", true)
+	assert.True(t, getHost("service.namespace.svc"))
+	assert.True(t, hm.IsTrafficAllowed("namespace", "service"))
+
+	// Every host of the service is switched once the operator removes it
+	hm.SetResolverSlice("namespace", "service", false)
+	assert.False(t, getHost("service.namespace.svc"))
+	assert.False(t, getHost("service.namespace.svc.cluster.local:8080"))
+	assert.False(t, hm.IsTrafficAllowed("namespace", "service"))
+	assert.True(t, getHost("other.namespace.svc"))
+
+	// And back once the service is switched to the resolver again
+	hm.SetResolverSlice("namespace", "service", true)
+	assert.True(t, getHost("service.namespace.svc"))
+}
+
+func TestTrafficSwitchConcurrent(t *testing.T) {
+	hm := NewHostManager(&Params{Logger: zap.NewNop(), HeaderForHost: "Host"})
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 1000 {
+				host, err := hm.GetHost(&http.Request{Host: "service.namespace.svc"})
+				assert.NoError(t, err)
+				_ = host.TrafficAllowed
+				_ = hm.IsTrafficAllowed("namespace", "service")
+			}
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := range 1000 {
+			hm.SetResolverSlice("namespace", "service", i%2 == 0)
+		}
+	}()
+	wg.Wait()
+
+	// The hosts handed out before are not changed by a switch
+	hm.SetResolverSlice("namespace", "service", true)
+	host, err := hm.GetHost(&http.Request{Host: "service.namespace.svc"})
+	require.NoError(t, err)
+	assert.True(t, host.TrafficAllowed)
+	hm.SetResolverSlice("namespace", "service", false)
+	assert.True(t, host.TrafficAllowed)
+}
@@ -2,6 +2,7 @@ package operator
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"io"
 	"net"
@@ -13,11 +14,18 @@ import (
 
 	"github.com/truefoundry/elasti/pkg/config"
 	"github.com/truefoundry/elasti/pkg/messages"
+	"github.com/truefoundry/elasti/pkg/tracing"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.34.0"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 
 	"sync"
 )
 
+var tracer = otel.Tracer("github.com/truefoundry/elasti/resolver/internal/operator")
+
 // Client is to communicate with the operator
 type Client struct {
 	logger *zap.Logger
@@ -31,6 +39,8 @@ type Client struct {
 	incomingRequestEndpoint string
 	// client is the http client
 	client http.Client
+	// lastNotified has when the operator was last told about the incoming requests of a service, keyed by namespace and service
+	lastNotified sync.Map
 }
 
 // NewOperatorClient returns a new OperatorClient
@@ -48,8 +58,9 @@ func NewOperatorClient(logger *zap.Logger, retryDuration time.Duration) *Client
 	}
 }
 
-// SendIncomingRequestInfo send request details like service name to the operator
-func (o *Client) SendIncomingRequestInfo(ns, svc string) {
+// SendIncomingRequestInfo send request details like service name to the operator. The operator continues the trace
+// of ctx, but the request is not canceled with ctx, since it is often sent after the incoming request is done.
+func (o *Client) SendIncomingRequestInfo(ctx context.Context, ns, svc string) {
 	lock, taken := o.getMutexForServiceRPC(svc)
 	if taken {
 		return
@@ -58,6 +69,10 @@ func (o *Client) SendIncomingRequestInfo(ns, svc string) {
 	defer time.AfterFunc(o.retryDuration, func() {
 		o.releaseMutexForServiceRPC(svc)
 	})
+	ctx, span := tracer.Start(context.WithoutCancel(ctx), "resolver.operator_rpc",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(tracing.NamespaceKey.String(ns), tracing.ServiceKey.String(svc)))
+	defer span.End()
 
 	requestBody := messages.RequestCount{
 		Count:     1,
@@ -66,41 +81,57 @@ func (o *Client) SendIncomingRequestInfo(ns, svc string) {
 	}
 	jsonData, err := json.Marshal(requestBody)
 	if err != nil {
-		prom.OperatorRPCCounter.WithLabelValues(err.Error()).Inc()
+		prom.OperatorRPCCounter.WithLabelValues("marshal_error").Inc()
+		tracing.RecordError(span, err)
 		o.logger.Error("Error marshalling request body for operatorRPC", zap.Error(err))
 		return
 	}
 	url := o.operatorURL + o.incomingRequestEndpoint
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(jsonData))
 	if err != nil {
-		prom.OperatorRPCCounter.WithLabelValues(err.Error()).Inc()
+		prom.OperatorRPCCounter.WithLabelValues("request_error").Inc()
+		tracing.RecordError(span, err)
 		o.logger.Error("Error creating request", zap.Error(err))
 		return
 	}
 	req.Header.Set("Content-Type", "application/json")
+	tracing.Inject(ctx, req.Header)
 	//nolint:bodyclose
 	resp, err := o.client.Do(req)
 	if err != nil {
-		prom.OperatorRPCCounter.WithLabelValues(err.Error()).Inc()
+		prom.OperatorRPCCounter.WithLabelValues("send_error").Inc()
+		tracing.RecordError(span, err)
 		o.logger.Error("Error sending request", zap.Error(err))
 		return
 	}
 	defer func(Body io.ReadCloser) {
 		err := Body.Close()
 		if err != nil {
-			prom.OperatorRPCCounter.WithLabelValues(err.Error()).Inc()
+			prom.OperatorRPCCounter.WithLabelValues("close_error").Inc()
 			o.logger.Error("Error closing body", zap.Error(err))
 		}
 	}(resp.Body)
+	span.SetAttributes(semconv.HTTPResponseStatusCode(resp.StatusCode))
 	if resp.StatusCode != http.StatusOK {
 		prom.OperatorRPCCounter.WithLabelValues(strconv.Itoa(resp.StatusCode)).Inc()
 		o.logger.Error("Request failed with status code", zap.Int("status_code", resp.StatusCode))
+		span.SetStatus(codes.Error, resp.Status)
 		return
 	}
 	prom.OperatorRPCCounter.WithLabelValues("").Inc()
+	o.lastNotified.Store(ns+"/"+svc, time.Now())
 	o.logger.Info("Request sent to controller", zap.Int("statusCode", resp.StatusCode), zap.Any("body", resp.Body))
 }
 
+// LastNotified returns when the operator was last told about the incoming requests of the service
+func (o *Client) LastNotified(ns, svc string) (time.Time, bool) {
+	notified, ok := o.lastNotified.Load(ns + "/" + svc)
+	if !ok {
+		return time.Time{}, false
+	}
+	return notified.(time.Time), true
+}
+
 func (o *Client) releaseMutexForServiceRPC(service string) {
 	lock, loaded := o.serviceRPCLocks.Load(service)
 	if !loaded {
@@ -0,0 +1,64 @@
+package operator
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/truefoundry/elasti/pkg/messages"
+	"github.com/truefoundry/elasti/pkg/tracing"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+type operatorRequest struct {
+	body        messages.RequestCount
+	traceparent string
+}
+
+func TestSendIncomingRequestInfo(t *testing.T) {
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", "")
+	t.Setenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", "")
+	_, err := tracing.Setup(context.Background(), "elasti-resolver")
+	require.NoError(t, err)
+
+	received := make(chan operatorRequest, 2)
+	operator := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var body messages.RequestCount
+		assert.NoError(t, json.NewDecoder(req.Body).Decode(&body))
+		received <- operatorRequest{body: body, traceparent: req.Header.Get("Traceparent")}
+	}))
+	t.Cleanup(operator.Close)
+	client := &Client{
+		logger:                  zap.NewNop(),
+		retryDuration:           time.Minute,
+		operatorURL:             operator.URL,
+		incomingRequestEndpoint: "/informer/incoming-request",
+	}
+
+	// The incoming request is done, but the operator is still told about it, in its trace
+	spanContext := trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    trace.TraceID{1},
+		SpanID:     trace.SpanID{2},
+		TraceFlags: trace.FlagsSampled,
+	})
+	ctx, cancel := context.WithCancel(trace.ContextWithSpanContext(context.Background(), spanContext))
+	cancel()
+	client.SendIncomingRequestInfo(ctx, "namespace", "target")
+
+	require.Len(t, received, 1)
+	request := <-received
+	assert.Equal(t, messages.RequestCount{Count: 1, Svc: "target", Namespace: "namespace"}, request.body)
+	assert.Equal(t, "00-"+spanContext.TraceID().String()+"-"+spanContext.SpanID().String()+"-01", request.traceparent)
+	_, notified := client.LastNotified("namespace", "target")
+	assert.True(t, notified)
+
+	// The operator is not told again within the retry duration
+	client.SendIncomingRequestInfo(context.Background(), "namespace", "target")
+	assert.Empty(t, received)
+}
@@ -19,6 +19,21 @@ var (
 		},
 	)
 
+	HostCacheSizeGauge = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "elasti_resolver_host_cache_size",
+			Help: "Gauge for the hosts in the cache of the resolver",
+		},
+	)
+
+	HostCacheEvictionCounter = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "elasti_resolver_host_cache_eviction_count",
+			Help: "Counter for hosts evicted from the cache of the resolver, because it was full or they expired",
+		},
+		[]string{"reason"},
+	)
+
 	QueuedRequestGauge = promauto.NewGaugeVec(
 		prometheus.GaugeOpts{
 			Name: "elasti_resolver_queued_count",
@@ -30,21 +45,62 @@ var (
 		},
 	)
 
-	IncomingRequestHistogram = promauto.NewHistogramVec(
-		prometheus.HistogramOpts{
-			Name:    "elasti_resolver_incoming_requests",
-			Help:    "Histogram of response latency (seconds) for every request resolved",
-			Buckets: []float64{0.1, 0.5, 1, 2, 5, 10},
+	QueueRejectedCounter = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "elasti_resolver_queue_rejected_count",
+			Help: "Counter for requests rejected because the queue of their service, or the global queue, was full",
 		},
-		[]string{"source",
-			"target",
-			"sourceHost",
-			"targetHost",
-			"namespace",
-			"method",
-			"requestURI",
-			"status",
-			"error"},
+		[]string{"source", "namespace", "limit"},
+	)
+
+	QueueShedCounter = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "elasti_resolver_queue_shed_count",
+			Help: "Counter for queued requests shed from a full queue, for requests with a higher priority",
+		},
+		[]string{"source", "namespace", "priority"},
+	)
+
+	ProxyRetryCounter = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "elasti_resolver_proxy_retry_count",
+			Help: "Counter for proxied requests which were sent again, after the connection to the target failed right after it scaled up",
+		},
+		[]string{"source", "namespace", "reason"},
+	)
+
+	QueueActiveGauge = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "elasti_resolver_queue_active_count",
+			Help: "Gauge for queued requests which hold a concurrency slot",
+		},
+		[]string{"source", "namespace"},
+	)
+
+	QueueLimitGauge = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "elasti_resolver_queue_limit",
+			Help: "Gauge for the queue depth and concurrency limits of every service",
+		},
+		[]string{"source", "namespace", "limit"},
+	)
+
+	BufferedBodyBytesGauge = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "elasti_resolver_buffered_body_bytes",
+			Help: "Gauge for the bytes of the request bodies which are kept to replay the requests",
+		},
+		// storage is memory or disk
+		[]string{"storage"},
+	)
+
+	TCPConnectionCounter = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "elasti_resolver_tcp_connection_count",
+			Help: "Counter for TCP connections proxied by the resolver",
+		},
+		// error is success, or one of the reasons
+		[]string{"source", "namespace", "error"},
 	)
 
 	TrafficSwitchCounter = promauto.NewCounterVec(
@@ -60,6 +116,7 @@ var (
 			Name: "elasti_resolver_operator_rpc_count",
 			Help: "Counter for operator RPC",
 		},
+		// error is empty on success, the status code of the operator, or the step of the request which failed
 		[]string{"error"},
 	)
 )
@@ -0,0 +1,188 @@
+package prom
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"sync/atomic"
+	"unicode/utf8"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Reasons are the values of the error labels. They are a fixed set, so errors don't add series for every message.
+const (
+	ReasonNone                = ""
+	ReasonUnknownHost         = "unknown_host"
+	ReasonInvalidHost         = "invalid_host"
+	ReasonTrafficSwitched     = "traffic_switched"
+	ReasonBodyTooLarge        = "body_too_large"
+	ReasonInvalidBody         = "invalid_body"
+	ReasonBodyBudgetExhausted = "body_budget_exhausted"
+	ReasonTimeout             = "timeout"
+	ReasonCanceled            = "canceled"
+	ReasonQueueFull           = "queue_full"
+	ReasonShed                = "shed"
+	ReasonConnectionRefused   = "connection_refused"
+	ReasonConnectionReset     = "connection_reset"
+	ReasonUpstream            = "upstream_error"
+)
+
+// ErrUnknownRequestLabel is returned for request labels which are not in RequestLabels
+var ErrUnknownRequestLabel = errors.New("unknown request metric label")
+
+var (
+	// RequestLabels are the labels the incoming requests can be observed with. sourceHost and targetHost have a series
+	// for every host clients send, so they are not in DefaultRequestLabels.
+	RequestLabels = []string{"source", "target", "namespace", "method", "route", "status", "reason", "sourceHost", "targetHost"}
+	// DefaultRequestLabels are the labels the incoming requests are observed with, unless others are set
+	DefaultRequestLabels = []string{"source", "target", "namespace", "method", "route", "status", "reason"}
+)
+
+type (
+	// RequestHistogram is the histogram of the latency of the incoming requests, with a configurable set of labels
+	RequestHistogram struct {
+		vec    *prometheus.HistogramVec
+		labels []string
+	}
+
+	// RequestObservation is an incoming request, each field is the value of the label with the same name
+	RequestObservation struct {
+		Source     string
+		Target     string
+		Namespace  string
+		Method     string
+		Route      string
+		Status     string
+		Reason     string
+		SourceHost string
+		TargetHost string
+	}
+)
+
+// incomingRequests is the histogram of the incoming requests, which is replaced by SetRequestLabels. It is collected
+// through requestsCollector, since a registry doesn't accept a metric again with other labels.
+var incomingRequests atomic.Pointer[RequestHistogram]
+
+func init() {
+	histogram, err := NewRequestHistogram(DefaultRequestLabels)
+	if err != nil {
+		panic(err)
+	}
+	incomingRequests.Store(histogram)
+	prometheus.MustRegister(requestsCollector{})
+}
+
+// requestsCollector collects the current histogram of the incoming requests. It describes no metric, so the registry
+// doesn't check the labels of the histogram.
+type requestsCollector struct{}
+
+func (requestsCollector) Describe(chan<- *prometheus.Desc) {}
+
+func (requestsCollector) Collect(ch chan<- prometheus.Metric) {
+	incomingRequests.Load().vec.Collect(ch)
+}
+
+// NewRequestHistogram returns a histogram of the incoming requests, with the labels, which must be in RequestLabels
+func NewRequestHistogram(labels []string) (*RequestHistogram, error) {
+	for _, label := range labels {
+		if !slices.Contains(RequestLabels, label) {
+			return nil, fmt.Errorf("%w: %q", ErrUnknownRequestLabel, label)
+		}
+	}
+	return &RequestHistogram{
+		vec: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "elasti_resolver_incoming_requests",
+				Help:    "Histogram of response latency (seconds) for every request resolved",
+				Buckets: []float64{0.1, 0.5, 1, 2, 5, 10},
+			},
+			labels,
+		),
+		labels: slices.Clone(labels),
+	}, nil
+}
+
+// SetRequestLabels replaces the histogram of the incoming requests with one with the labels.
+// It is meant to be called once, before requests are served.
+func SetRequestLabels(labels []string) error {
+	histogram, err := NewRequestHistogram(labels)
+	if err != nil {
+		return err
+	}
+	incomingRequests.Store(histogram)
+	return nil
+}
+
+// ObserveRequest observes the latency of an incoming request. The exemplar has the details which would add too many
+// series as labels, it is cut to the length Prometheus allows.
+func ObserveRequest(request RequestObservation, seconds float64, exemplar prometheus.Labels) {
+	histogram := incomingRequests.Load()
+	values := make([]string, len(histogram.labels))
+	for i, label := range histogram.labels {
+		values[i] = request.label(label)
+	}
+	observer := histogram.vec.WithLabelValues(values...)
+	if exemplarObserver, ok := observer.(prometheus.ExemplarObserver); ok && len(exemplar) > 0 {
+		exemplarObserver.ObserveWithExemplar(seconds, truncateExemplar(exemplar))
+		return
+	}
+	observer.Observe(seconds)
+}
+
+func (r RequestObservation) label(name string) string {
+	switch name {
+	case "source":
+		return r.Source
+	case "target":
+		return r.Target
+	case "namespace":
+		return r.Namespace
+	case "method":
+		return r.Method
+	case "route":
+		return r.Route
+	case "status":
+		return r.Status
+	case "reason":
+		return r.Reason
+	case "sourceHost":
+		return r.SourceHost
+	case "targetHost":
+		return r.TargetHost
+	default:
+		return ""
+	}
+}
+
+// MethodLabel returns the method as a label, methods which are not standard are "other", since clients can send any
+func MethodLabel(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodConnect, http.MethodOptions, http.MethodTrace:
+		return method
+	default:
+		return "other"
+	}
+}
+
+// truncateExemplar cuts the values of the exemplar, so its names and values fit in prometheus.ExemplarMaxRunes
+func truncateExemplar(exemplar prometheus.Labels) prometheus.Labels {
+	names := 0
+	for name := range exemplar {
+		names += utf8.RuneCountInString(name)
+	}
+	if len(exemplar) == 0 || names >= prometheus.ExemplarMaxRunes {
+		return nil
+	}
+	perValue := (prometheus.ExemplarMaxRunes - names) / len(exemplar)
+	truncated := make(prometheus.Labels, len(exemplar))
+	for name, value := range exemplar {
+		if utf8.RuneCountInString(value) > perValue {
+			value = string([]rune(value)[:perValue])
+		}
+		truncated[name] = value
+	}
+	return truncated
+}
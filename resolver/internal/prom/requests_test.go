@@ -0,0 +1,51 @@
+package prom
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSetRequestLabels(t *testing.T) {
+	t.Cleanup(func() { require.NoError(t, SetRequestLabels(DefaultRequestLabels)) })
+	assert.ErrorIs(t, SetRequestLabels([]string{"namespace", "requestURI"}), ErrUnknownRequestLabel)
+
+	require.NoError(t, SetRequestLabels([]string{"namespace", "reason"}))
+	ObserveRequest(RequestObservation{Namespace: "prod", Reason: ReasonTimeout, SourceHost: "api.example.com"}, 1,
+		prometheus.Labels{"path": "/users/42", "host": "api.example.com"})
+
+	families, err := prometheus.DefaultGatherer.Gather()
+	require.NoError(t, err)
+	var labels map[string]string
+	for _, family := range families {
+		if family.GetName() != "elasti_resolver_incoming_requests" {
+			continue
+		}
+		require.Len(t, family.GetMetric(), 1)
+		labels = map[string]string{}
+		for _, label := range family.GetMetric()[0].GetLabel() {
+			labels[label.GetName()] = label.GetValue()
+		}
+	}
+	assert.Equal(t, map[string]string{"namespace": "prod", "reason": ReasonTimeout}, labels)
+}
+
+func TestTruncateExemplar(t *testing.T) {
+	exemplar := truncateExemplar(prometheus.Labels{"path": "/" + strings.Repeat("a", 200), "host": "api.example.com"})
+	runes := 0
+	for name, value := range exemplar {
+		runes += utf8.RuneCountInString(name) + utf8.RuneCountInString(value)
+	}
+	assert.LessOrEqual(t, runes, prometheus.ExemplarMaxRunes)
+	assert.Equal(t, "api.example.com", exemplar["host"])
+	assert.True(t, strings.HasPrefix(exemplar["path"], "/aaa"))
+}
+
+func TestMethodLabel(t *testing.T) {
+	assert.Equal(t, "GET", MethodLabel("GET"))
+	assert.Equal(t, "other", MethodLabel("BREW"))
+}
@@ -0,0 +1,190 @@
+package serviceconfig
+
+import (
+	"fmt"
+	"sync"
+
+	"go.uber.org/zap"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+const (
+	// OversizedBodyReject rejects requests with bodies larger than the limit, with 413 Request Entity Too Large
+	OversizedBodyReject = "reject"
+	// OversizedBodyStream sends bodies larger than the limit once, without keeping them, so the request can't be replayed
+	OversizedBodyStream = "stream"
+
+	// WarmUpHold holds the requests until the target is ready
+	WarmUpHold = "hold"
+	// WarmUpPage answers browsers with a page which refreshes until the target is ready, and other clients like WarmUpUnavailable
+	WarmUpPage = "page"
+	// WarmUpUnavailable answers with 503 Service Unavailable, with a Retry-After from the cold start time of the target
+	WarmUpUnavailable = "unavailable"
+)
+
+type (
+	// Config is how the resolver handles the requests of a service. It comes from the spec.resolver of
+	// the ElastiService of the service, and every field which is not set there falls back to the defaults of the resolver.
+	Config struct {
+		RequestBody RequestBody
+		WarmUp      WarmUp
+		Queue       Queue
+		Priority    Priority
+	}
+
+	// RequestBody is how the resolver keeps request bodies, so queued requests can be replayed
+	RequestBody struct {
+		// MaxBufferedSize is the largest body, in bytes, which is kept to replay the request
+		MaxBufferedSize int64
+		// OversizedPolicy is what is done with bodies larger than MaxBufferedSize, either OversizedBodyReject or OversizedBodyStream
+		OversizedPolicy string
+	}
+
+	// WarmUp is what the resolver answers while the target is scaled up from zero
+	WarmUp struct {
+		// Mode is either WarmUpHold, WarmUpPage or WarmUpUnavailable
+		Mode string
+		// TemplateConfigMap and TemplateKey select the HTML template of the page, the default page is used if they are not set
+		TemplateConfigMap string
+		TemplateKey       string
+	}
+
+	// Queue is the limits of the requests of a service which wait for the target, on top of the global limits of the resolver
+	Queue struct {
+		// Depth is the number of requests which wait for a concurrency slot
+		Depth int
+		// MaxConcurrency is the number of requests which check the target, or are proxied to it, at the same time
+		MaxConcurrency int
+	}
+
+	// Priority sets the priority of the queued requests of a service
+	Priority struct {
+		// Default is the priority of the requests which match no rule
+		Default string
+		// MaxHeaderPriority is the highest priority clients can set with a header, which is ignored when it is empty
+		MaxHeaderPriority string
+		// Rules set the priority of the requests by their path
+		Rules []PriorityRule
+	}
+
+	// PriorityRule sets the priority of the requests whose path starts with PathPrefix
+	PriorityRule struct {
+		PathPrefix string
+		Priority   string
+	}
+
+	// Store holds the Config of every service with an ElastiService
+	Store struct {
+		logger   *zap.Logger
+		defaults Config
+
+		mu sync.RWMutex
+		// configs are keyed by namespace and service
+		configs map[string]Config
+	}
+)
+
+// NewStore returns a Store, which returns the defaults for every service until Apply is called
+func NewStore(logger *zap.Logger, defaults Config) *Store {
+	return &Store{
+		logger:   logger.With(zap.String("component", "serviceConfig")),
+		defaults: defaults,
+		configs:  map[string]Config{},
+	}
+}
+
+// Get returns the Config of the service
+func (s *Store) Get(namespace, service string) Config {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if config, ok := s.configs[namespace+"/"+service]; ok {
+		return config
+	}
+	return s.defaults
+}
+
+// Has returns whether an ElastiService manages the service, so it has its own Config
+func (s *Store) Has(namespace, service string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, ok := s.configs[namespace+"/"+service]
+	return ok
+}
+
+// Apply replaces the configs with the ones of the ElastiServices
+func (s *Store) Apply(elastiServices []*unstructured.Unstructured) {
+	configs := make(map[string]Config, len(elastiServices))
+	for _, es := range elastiServices {
+		service, _, _ := unstructured.NestedString(es.Object, "spec", "service")
+		if service == "" {
+			continue
+		}
+		configs[es.GetNamespace()+"/"+service] = s.configFromElastiService(es)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.configs = configs
+}
+
+func (s *Store) configFromElastiService(es *unstructured.Unstructured) Config {
+	config := s.defaults
+	if maxBufferedSize, ok, _ := unstructured.NestedFieldNoCopy(es.Object, "spec", "resolver", "requestBody", "maxBufferedSize"); ok {
+		if size, err := parseQuantity(maxBufferedSize); err != nil {
+			s.logger.Warn("Invalid maxBufferedSize, using the default",
+				zap.String("elastiService", es.GetNamespace()+"/"+es.GetName()), zap.Error(err))
+		} else {
+			config.RequestBody.MaxBufferedSize = size
+		}
+	}
+	if policy, _, _ := unstructured.NestedString(es.Object, "spec", "resolver", "requestBody", "oversizedPolicy"); policy != "" {
+		config.RequestBody.OversizedPolicy = policy
+	}
+	if mode, _, _ := unstructured.NestedString(es.Object, "spec", "resolver", "warmUp", "mode"); mode != "" {
+		config.WarmUp.Mode = mode
+	}
+	if depth, ok, _ := unstructured.NestedInt64(es.Object, "spec", "resolver", "queue", "depth"); ok {
+		config.Queue.Depth = int(depth)
+	}
+	if maxConcurrency, ok, _ := unstructured.NestedInt64(es.Object, "spec", "resolver", "queue", "maxConcurrency"); ok {
+		config.Queue.MaxConcurrency = int(maxConcurrency)
+	}
+	if priority, _, _ := unstructured.NestedString(es.Object, "spec", "resolver", "priority", "default"); priority != "" {
+		config.Priority.Default = priority
+	}
+	config.Priority.MaxHeaderPriority, _, _ = unstructured.NestedString(es.Object, "spec", "resolver", "priority", "maxHeaderPriority")
+	rules, _, _ := unstructured.NestedSlice(es.Object, "spec", "resolver", "priority", "rules")
+	for _, rule := range rules {
+		fields, ok := rule.(map[string]any)
+		if !ok {
+			continue
+		}
+		pathPrefix, _, _ := unstructured.NestedString(fields, "pathPrefix")
+		priority, _, _ := unstructured.NestedString(fields, "priority")
+		if pathPrefix == "" || priority == "" {
+			continue
+		}
+		config.Priority.Rules = append(config.Priority.Rules, PriorityRule{PathPrefix: pathPrefix, Priority: priority})
+	}
+	config.WarmUp.TemplateConfigMap, _, _ = unstructured.NestedString(es.Object, "spec", "resolver", "warmUp", "template", "name")
+	config.WarmUp.TemplateKey, _, _ = unstructured.NestedString(es.Object, "spec", "resolver", "warmUp", "template", "key")
+	return config
+}
+
+// parseQuantity parses a resource.Quantity of the unstructured object, which is either a string like "10Mi" or a number
+func parseQuantity(value any) (int64, error) {
+	switch v := value.(type) {
+	case int64:
+		return v, nil
+	case float64:
+		return int64(v), nil
+	case string:
+		quantity, err := resource.ParseQuantity(v)
+		if err != nil {
+			return 0, fmt.Errorf("invalid quantity %q: %w", v, err)
+		}
+		return quantity.Value(), nil
+	default:
+		return 0, fmt.Errorf("invalid quantity type %T", value)
+	}
+}
@@ -0,0 +1,86 @@
+package serviceconfig
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func newElastiService(name string, spec map[string]any) *unstructured.Unstructured {
+	return &unstructured.Unstructured{Object: map[string]any{
+		"metadata": map[string]any{"name": name, "namespace": "default"},
+		"spec":     spec,
+	}}
+}
+
+func TestStore(t *testing.T) {
+	defaults := Config{
+		RequestBody: RequestBody{MaxBufferedSize: 1024, OversizedPolicy: OversizedBodyStream},
+		WarmUp:      WarmUp{Mode: WarmUpHold},
+		Queue:       Queue{Depth: 100, MaxConcurrency: 10},
+		Priority:    Priority{Default: "normal"},
+	}
+	store := NewStore(zap.NewNop(), defaults)
+	store.Apply([]*unstructured.Unstructured{
+		newElastiService("upload", map[string]any{
+			"service": "upload",
+			"resolver": map[string]any{"requestBody": map[string]any{
+				"maxBufferedSize": "1Mi",
+				"oversizedPolicy": OversizedBodyReject,
+			}, "warmUp": map[string]any{
+				"mode":     WarmUpPage,
+				"template": map[string]any{"name": "warm-up", "key": "page.html"},
+			}},
+		}),
+		newElastiService("api", map[string]any{
+			"service": "api",
+			"resolver": map[string]any{
+				"requestBody": map[string]any{"maxBufferedSize": int64(2048)},
+				"queue":       map[string]any{"depth": int64(5), "maxConcurrency": int64(2)},
+				"priority": map[string]any{"default": "low", "maxHeaderPriority": "high", "rules": []any{
+					map[string]any{"pathPrefix": "/healthz", "priority": "critical"},
+					map[string]any{"pathPrefix": "/batch"},
+				}},
+			},
+		}),
+		newElastiService("invalid", map[string]any{
+			"service":  "invalid",
+			"resolver": map[string]any{"requestBody": map[string]any{"maxBufferedSize": "lots"}},
+		}),
+	})
+
+	tests := []struct {
+		service  string
+		expected Config
+	}{
+		{service: "upload", expected: Config{
+			RequestBody: RequestBody{MaxBufferedSize: 1 << 20, OversizedPolicy: OversizedBodyReject},
+			WarmUp:      WarmUp{Mode: WarmUpPage, TemplateConfigMap: "warm-up", TemplateKey: "page.html"},
+			Queue:       Queue{Depth: 100, MaxConcurrency: 10},
+			Priority:    Priority{Default: "normal"},
+		}},
+		{service: "api", expected: Config{
+			RequestBody: RequestBody{MaxBufferedSize: 2048, OversizedPolicy: OversizedBodyStream},
+			WarmUp:      WarmUp{Mode: WarmUpHold},
+			Queue:       Queue{Depth: 5, MaxConcurrency: 2},
+			Priority:    Priority{Default: "low", MaxHeaderPriority: "high", Rules: []PriorityRule{{PathPrefix: "/healthz", Priority: "critical"}}},
+		}},
+		{service: "invalid", expected: defaults},
+		{service: "unknown", expected: defaults},
+	}
+	for _, tt := range tests {
+		t.Run(tt.service, func(t *testing.T) {
+			assert.Equal(t, tt.expected, store.Get("default", tt.service))
+		})
+	}
+
+	assert.True(t, store.Has("default", "invalid"))
+	assert.False(t, store.Has("default", "unknown"))
+
+	// Services are back to the defaults once their ElastiService is gone
+	store.Apply(nil)
+	assert.Equal(t, defaults, store.Get("default", "upload"))
+	assert.False(t, store.Has("default", "upload"))
+}
@@ -0,0 +1,314 @@
+package tcpproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/truefoundry/elasti/pkg/config"
+	"github.com/truefoundry/elasti/pkg/logger"
+	"github.com/truefoundry/elasti/pkg/tracing"
+	"github.com/truefoundry/elasti/pkg/utils"
+	"github.com/truefoundry/elasti/pkg/values"
+	"github.com/truefoundry/elasti/resolver/internal/prom"
+	"github.com/truefoundry/elasti/resolver/internal/throttler"
+	"go.opentelemetry.io/otel"
+	semconv "go.opentelemetry.io/otel/semconv/v1.34.0"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+var tracer = otel.Tracer("github.com/truefoundry/elasti/resolver/internal/tcpproxy")
+
+// dialTimeout is the timeout to connect to the private service, once it has a ready endpoint
+const dialTimeout = 10 * time.Second
+
+type (
+	// Proxy accepts raw TCP connections for the TCP ports of ElastiServices, holds them while the target
+	// is scaled up, and then splices them to the private service.
+	// Every TCP port gets its own listener, since nothing in a raw TCP connection tells which service it is for.
+	Proxy struct {
+		logger      *zap.Logger
+		throttler   *throttler.Throttler
+		operatorRPC Operator
+		timeout     time.Duration
+		// targetAddress returns the address of the private service for a port
+		targetAddress func(port Port) string
+
+		mu        sync.Mutex
+		listeners map[int32]*listener
+	}
+
+	// Params is the configuration for the proxy
+	Params struct {
+		Logger *zap.Logger
+		// ReqTimeout is how long a connection waits for the target to be ready
+		ReqTimeout  time.Duration
+		OperatorRPC Operator
+		Throttler   *throttler.Throttler
+		// TargetAddress returns the address to splice the connections of a port to,
+		// it defaults to the cluster DNS name of the private service
+		TargetAddress func(port Port) string
+	}
+
+	// Operator is to communicate with the operator
+	Operator interface {
+		SendIncomingRequestInfo(ctx context.Context, ns, svc string)
+	}
+
+	// Port is a port of a service, which the resolver proxies as raw TCP
+	Port struct {
+		Namespace    string
+		Service      string
+		Port         int32
+		ResolverPort int32
+	}
+
+	listener struct {
+		net.Listener
+		// port can change while the listener is open, when the ElastiService moves the resolver port to another service port
+		port atomic.Pointer[Port]
+	}
+)
+
+// NewProxy returns a new Proxy, which doesn't listen on any port until Apply is called
+func NewProxy(params *Params) *Proxy {
+	targetAddress := params.TargetAddress
+	if targetAddress == nil {
+		targetAddress = privateServiceAddress
+	}
+	return &Proxy{
+		logger:        params.Logger.With(zap.String("component", "tcpProxy")),
+		throttler:     params.Throttler,
+		operatorRPC:   params.OperatorRPC,
+		timeout:       params.ReqTimeout,
+		targetAddress: targetAddress,
+		listeners:     map[int32]*listener{},
+	}
+}
+
+// privateServiceAddress returns the cluster DNS name of the private service, with the port
+func privateServiceAddress(port Port) string {
+	host := utils.GetPrivateServiceName(port.Service) + "." + port.Namespace + ".svc." + config.GetKubernetesClusterDomain()
+	return net.JoinHostPort(host, strconv.Itoa(int(port.Port)))
+}
+
+// reasonResolverPortConflict is the reason of the ServiceSupported condition, when the operator found the
+// resolverPort of a TCP port is a port the resolver already uses, or is used by an older ElastiService
+const reasonResolverPortConflict = "ResolverPortConflict"
+
+// PortsFromElastiServices returns the TCP ports of the ElastiServices.
+// The ports of the ElastiServices the operator rejected for a resolver port conflict are skipped.
+func PortsFromElastiServices(elastiServices []*unstructured.Unstructured) []Port {
+	var ports []Port
+	for _, es := range elastiServices {
+		if hasResolverPortConflict(es) {
+			continue
+		}
+		service, _, _ := unstructured.NestedString(es.Object, "spec", "service")
+		tcpPorts, _, _ := unstructured.NestedSlice(es.Object, "spec", "tcpPorts")
+		for _, tcpPort := range tcpPorts {
+			fields, ok := tcpPort.(map[string]any)
+			if !ok {
+				continue
+			}
+			port, _, _ := unstructured.NestedInt64(fields, "port")
+			resolverPort, _, _ := unstructured.NestedInt64(fields, "resolverPort")
+			if service == "" || port == 0 || resolverPort == 0 {
+				continue
+			}
+			ports = append(ports, Port{
+				Namespace:    es.GetNamespace(),
+				Service:      service,
+				Port:         int32(port),
+				ResolverPort: int32(resolverPort),
+			})
+		}
+	}
+	return ports
+}
+
+// hasResolverPortConflict returns true if the ServiceSupported condition of the ElastiService reports a resolver port conflict
+func hasResolverPortConflict(es *unstructured.Unstructured) bool {
+	conditions, _, _ := unstructured.NestedSlice(es.Object, "status", "conditions")
+	for _, condition := range conditions {
+		fields, ok := condition.(map[string]any)
+		if !ok || fields["type"] != "ServiceSupported" {
+			continue
+		}
+		return fields["status"] == "False" && fields["reason"] == reasonResolverPortConflict
+	}
+	return false
+}
+
+// Apply opens a listener for every port, and closes the listeners of the ports which are gone.
+// Ports which failed to listen are retried on the next Apply. The connections which are already open are not closed.
+func (p *Proxy) Apply(ports []Port) {
+	// The operator rejects the ElastiServices with a resolver port conflict, but until it did, the ports are sorted,
+	// so the same port wins every time two ElastiServices use the same resolver port
+	ports = append([]Port(nil), ports...)
+	sort.Slice(ports, func(i, j int) bool {
+		if ports[i].Namespace != ports[j].Namespace {
+			return ports[i].Namespace < ports[j].Namespace
+		}
+		if ports[i].Service != ports[j].Service {
+			return ports[i].Service < ports[j].Service
+		}
+		return ports[i].Port < ports[j].Port
+	})
+	desired := make(map[int32]Port, len(ports))
+	for _, port := range ports {
+		if existing, ok := desired[port.ResolverPort]; ok {
+			p.logger.Error("Resolver port is used by more than one service, ignoring it",
+				zap.Int32("resolverPort", port.ResolverPort),
+				zap.String("service", port.Namespace+"/"+port.Service),
+				zap.String("usedBy", existing.Namespace+"/"+existing.Service))
+			continue
+		}
+		desired[port.ResolverPort] = port
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for resolverPort, l := range p.listeners {
+		if _, ok := desired[resolverPort]; !ok {
+			if err := l.Close(); err != nil {
+				p.logger.Warn("Failed to close TCP listener", zap.Int32("resolverPort", resolverPort), zap.Error(err))
+			}
+			delete(p.listeners, resolverPort)
+			p.logger.Info("Stopped listening for TCP connections", zap.Int32("resolverPort", resolverPort))
+		}
+	}
+	for resolverPort, port := range desired {
+		if l, ok := p.listeners[resolverPort]; ok {
+			l.port.Store(&port)
+			continue
+		}
+		netListener, err := net.Listen("tcp", fmt.Sprintf(":%d", resolverPort))
+		if err != nil {
+			p.logger.Error("Failed to listen for TCP connections", zap.Int32("resolverPort", resolverPort), zap.Error(err))
+			continue
+		}
+		l := &listener{Listener: netListener}
+		l.port.Store(&port)
+		p.listeners[resolverPort] = l
+		go p.serve(l)
+		p.logger.Info("Listening for TCP connections",
+			zap.Int32("resolverPort", resolverPort),
+			zap.String("service", logger.MaskMiddle(port.Service, 3, 3)),
+			zap.Int32("port", port.Port))
+	}
+}
+
+// Close closes all the listeners
+func (p *Proxy) Close() {
+	p.Apply(nil)
+}
+
+func (p *Proxy) serve(l *listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			p.logger.Error("Failed to accept TCP connection", zap.Error(err))
+			continue
+		}
+		go p.HandleConn(conn, *l.port.Load())
+	}
+}
+
+// HandleConn holds the connection until the private service has a ready endpoint, and then splices it to the private service.
+// It closes the connection once it is done.
+func (p *Proxy) HandleConn(conn net.Conn, port Port) {
+	defer conn.Close()
+	ctx, span := tracer.Start(context.Background(), "resolver.tcp_connection",
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			tracing.NamespaceKey.String(port.Namespace),
+			tracing.ServiceKey.String(port.Service),
+			semconv.ServerPort(int(port.Port)),
+		))
+	defer span.End()
+	err := p.proxyConn(ctx, conn, port)
+	errorLabel := values.Success
+	if err != nil {
+		errorLabel = throttler.ErrorReason(err)
+		tracing.RecordError(span, err)
+		p.logger.Error("Error proxying TCP connection", zap.String("service", logger.MaskMiddle(port.Service, 3, 3)), zap.Error(err))
+	}
+	prom.TCPConnectionCounter.WithLabelValues(port.Service, port.Namespace, errorLabel).Inc()
+}
+
+func (p *Proxy) proxyConn(ctx context.Context, conn net.Conn, port Port) error {
+	start := time.Now()
+	// Inform the controller about the incoming connection
+	go p.operatorRPC.SendIncomingRequestInfo(ctx, port.Namespace, port.Service)
+
+	ctx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+	prom.QueuedRequestGauge.WithLabelValues(port.Service, port.Namespace).Inc()
+	err := p.throttler.WaitForServiceReady(ctx, port.Namespace, port.Service, utils.GetPrivateServiceName(port.Service), func() {
+		p.operatorRPC.SendIncomingRequestInfo(ctx, port.Namespace, port.Service)
+	})
+	prom.QueuedRequestGauge.WithLabelValues(port.Service, port.Namespace).Dec()
+	if err != nil {
+		return fmt.Errorf("failed to wait for the target: %w", err)
+	}
+
+	dialer := &net.Dialer{Timeout: dialTimeout}
+	upstream, err := dialer.DialContext(ctx, "tcp", p.targetAddress(port))
+	if err != nil {
+		return fmt.Errorf("failed to connect to the target: %w", err)
+	}
+	defer upstream.Close()
+
+	sent, received := splice(conn, upstream)
+	p.logger.Debug("TCP connection closed",
+		zap.Int64("bytesSent", sent),
+		zap.Int64("bytesReceived", received),
+		zap.Duration("duration", time.Since(start)))
+	return nil
+}
+
+// splice copies the data in both directions, until both sides are done. When one side stops sending,
+// only the write half of the other side is closed, so protocols which half-close the connection keep working.
+// It returns the bytes sent to the upstream, and the bytes received from it.
+func splice(client, upstream net.Conn) (int64, int64) {
+	var sent int64
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		sent = copyAndCloseWrite(upstream, client)
+	}()
+	received := copyAndCloseWrite(client, upstream)
+	wg.Wait()
+	return sent, received
+}
+
+// copyAndCloseWrite copies src to dst, and closes the write half of dst once src is done.
+// On errors, like a reset connection, both connections are closed, so the copy in the other direction doesn't hang.
+func copyAndCloseWrite(dst, src net.Conn) int64 {
+	n, err := io.Copy(dst, src)
+	if err != nil {
+		_ = dst.Close()
+		_ = src.Close()
+		return n
+	}
+	if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+		_ = cw.CloseWrite()
+	} else {
+		_ = dst.Close()
+	}
+	return n
+}
@@ -0,0 +1,166 @@
+package tcpproxy
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/truefoundry/elasti/resolver/internal/testutil"
+	"github.com/truefoundry/elasti/resolver/internal/throttler"
+	"go.uber.org/zap"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// newEchoTarget starts a TCP server which echoes everything it receives, and closes the connection when the client is done sending
+func newEchoTarget(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = listener.Close()
+	})
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// freePort returns a port nothing listens on
+func freePort(t *testing.T) int32 {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	return int32(listener.Addr().(*net.TCPAddr).Port)
+}
+
+func newTestProxy(t *testing.T, targetAddress string, coldChecks int64, reqTimeout time.Duration) (*Proxy, *testutil.FakeOperator) {
+	logger := zap.NewNop()
+	operator := &testutil.FakeOperator{}
+	proxy := NewProxy(&Params{
+		Logger:      logger,
+		ReqTimeout:  reqTimeout,
+		OperatorRPC: operator,
+		Throttler: throttler.NewThrottler(&throttler.Params{
+			QueueRetryDuration:      10 * time.Millisecond,
+			TrafficReEnableDuration: time.Second,
+			K8sUtil:                 testutil.NewOps(testutil.ReadyAfter(coldChecks)),
+			QueueDepth:              10,
+			MaxConcurrency:          10,
+			InitialCapacity:         10,
+			Logger:                  logger,
+		}),
+		TargetAddress: func(Port) string { return targetAddress },
+	})
+	t.Cleanup(proxy.Close)
+	return proxy, operator
+}
+
+func dialResolver(t *testing.T, resolverPort int32) *net.TCPConn {
+	conn, err := net.DialTimeout("tcp", fmt.Sprintf("127.0.0.1:%d", resolverPort), time.Second)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+	require.NoError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+	return conn.(*net.TCPConn)
+}
+
+func TestProxyTCP(t *testing.T) {
+	// The target is cold for the first checks, so the connection is held before it is spliced
+	proxy, operator := newTestProxy(t, newEchoTarget(t), 3, 5*time.Second)
+	resolverPort := freePort(t)
+	proxy.Apply([]Port{{Namespace: "namespace", Service: "target", Port: 6379, ResolverPort: resolverPort}})
+
+	conn := dialResolver(t, resolverPort)
+	_, err := conn.Write([]byte("PING\r\n"))
+	require.NoError(t, err)
+	reply := make([]byte, len("PING\r\n"))
+	_, err = io.ReadFull(conn, reply)
+	require.NoError(t, err)
+	assert.Equal(t, "PING\r\n", string(reply))
+
+	// Half-closing the connection is forwarded, so the target sees the end of the data and closes its side
+	_, err = conn.Write([]byte("QUIT\r\n"))
+	require.NoError(t, err)
+	require.NoError(t, conn.CloseWrite())
+	remaining, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Equal(t, "QUIT\r\n", string(remaining))
+	assert.Positive(t, operator.Requests.Load())
+}
+
+func TestProxyTCPTimeout(t *testing.T) {
+	proxy, _ := newTestProxy(t, newEchoTarget(t), 1<<30, 100*time.Millisecond)
+	resolverPort := freePort(t)
+	proxy.Apply([]Port{{Namespace: "namespace", Service: "target", Port: 6379, ResolverPort: resolverPort}})
+
+	// The connection is closed without data, once the target is not ready in time
+	conn := dialResolver(t, resolverPort)
+	data, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Empty(t, data)
+}
+
+func TestApply(t *testing.T) {
+	proxy, _ := newTestProxy(t, newEchoTarget(t), 0, 5*time.Second)
+	resolverPort := freePort(t)
+
+	// The same resolver port is used twice, the port of the first service in order wins
+	proxy.Apply([]Port{
+		{Namespace: "namespace", Service: "redis", Port: 6379, ResolverPort: resolverPort},
+		{Namespace: "namespace", Service: "postgres", Port: 5432, ResolverPort: resolverPort},
+	})
+	require.Contains(t, proxy.listeners, resolverPort)
+	assert.Equal(t, "postgres", proxy.listeners[resolverPort].port.Load().Service)
+	dialResolver(t, resolverPort)
+
+	// Once the port is gone, the resolver stops listening on it
+	proxy.Apply(nil)
+	assert.Empty(t, proxy.listeners)
+	_, err := net.DialTimeout("tcp", fmt.Sprintf("127.0.0.1:%d", resolverPort), time.Second)
+	assert.Error(t, err)
+}
+
+func TestPortsFromElastiServices(t *testing.T) {
+	es := &unstructured.Unstructured{Object: map[string]any{
+		"metadata": map[string]any{"name": "redis", "namespace": "cache"},
+		"spec": map[string]any{
+			"service": "redis",
+			"tcpPorts": []any{
+				map[string]any{"port": int64(6379), "resolverPort": int64(16379)},
+				map[string]any{"port": int64(26379)},
+			},
+		},
+	}}
+	httpOnly := &unstructured.Unstructured{Object: map[string]any{
+		"metadata": map[string]any{"name": "web", "namespace": "default"},
+		"spec":     map[string]any{"service": "web"},
+	}}
+
+	conflicting := &unstructured.Unstructured{Object: map[string]any{
+		"metadata": map[string]any{"name": "other-redis", "namespace": "default"},
+		"spec": map[string]any{
+			"service":  "other-redis",
+			"tcpPorts": []any{map[string]any{"port": int64(6379), "resolverPort": int64(16379)}},
+		},
+		"status": map[string]any{
+			"conditions": []any{map[string]any{"type": "ServiceSupported", "status": "False", "reason": "ResolverPortConflict"}},
+		},
+	}}
+
+	assert.Equal(t, []Port{
+		{Namespace: "cache", Service: "redis", Port: 6379, ResolverPort: 16379},
+	}, PortsFromElastiServices([]*unstructured.Unstructured{es, httpOnly, conflicting}))
+}
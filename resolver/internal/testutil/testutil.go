@@ -0,0 +1,86 @@
+// Package testutil has the fakes shared by the tests of the resolver packages
+package testutil
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/truefoundry/elasti/pkg/k8shelper"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/utils/ptr"
+)
+
+// FakeOperator counts the requests the operator is told about
+type FakeOperator struct {
+	Requests atomic.Int64
+	// LastNotifiedAt is returned by LastNotified, for every service
+	LastNotifiedAt time.Time
+	traceID        atomic.Value
+}
+
+func (o *FakeOperator) SendIncomingRequestInfo(ctx context.Context, _, _ string) {
+	o.Requests.Add(1)
+	o.traceID.Store(trace.SpanContextFromContext(ctx).TraceID())
+}
+
+func (o *FakeOperator) LastNotified(_, _ string) (time.Time, bool) {
+	return o.LastNotifiedAt, !o.LastNotifiedAt.IsZero()
+}
+
+// TraceID returns the trace of the last request the operator was told about
+func (o *FakeOperator) TraceID() trace.TraceID {
+	traceID, _ := o.traceID.Load().(trace.TraceID)
+	return traceID
+}
+
+// Readiness returns whether the private service has a ready endpoint, it is called for every list of its EndpointSlices
+type Readiness func() bool
+
+// Ready is the readiness of a private service which is always ready
+func Ready() bool { return true }
+
+// NotReady is the readiness of a private service which is never ready
+func NotReady() bool { return false }
+
+// ReadyAfter is the readiness of a private service which only has a ready endpoint after coldChecks lists,
+// like a target which is scaled up from zero
+func ReadyAfter(coldChecks int64) Readiness {
+	var checks atomic.Int64
+	return func() bool {
+		return checks.Add(1) > coldChecks
+	}
+}
+
+// NewOps returns k8shelper.Ops backed by a fake clientset with the given objects, like ConfigMaps and Secrets.
+// Every list of EndpointSlices returns a single EndpointSlice with one endpoint, with the given readiness.
+func NewOps(readiness Readiness, objs ...runtime.Object) *k8shelper.Ops {
+	kClient := fake.NewClientset(objs...)
+	kClient.PrependReactor("list", "endpointslices", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		// The fake clientset filters the list by the label selector, so the EndpointSlice gets the labels it selects
+		labels := map[string]string{}
+		if requirements, ok := action.(k8stesting.ListAction).GetListRestrictions().Labels.Requirements(); ok {
+			for _, requirement := range requirements {
+				if value, ok := requirement.Values().PopAny(); ok {
+					labels[requirement.Key()] = value
+				}
+			}
+		}
+		return true, &discoveryv1.EndpointSliceList{Items: []discoveryv1.EndpointSlice{{
+			ObjectMeta:  metav1.ObjectMeta{Name: "target-pvt-abc", Labels: labels},
+			AddressType: discoveryv1.AddressTypeIPv4,
+			Endpoints: []discoveryv1.Endpoint{{
+				Addresses:  []string{"10.0.0.1"},
+				Conditions: discoveryv1.EndpointConditions{Ready: ptr.To(readiness())},
+			}},
+		}}}, nil
+	})
+	return k8shelper.NewOpsWithClients(zap.NewNop(), kClient, dynamicfake.NewSimpleDynamicClient(runtime.NewScheme()))
+}
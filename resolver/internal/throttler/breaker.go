@@ -1,8 +1,10 @@
 package throttler
 
 import (
+	"container/list"
 	"context"
 	"errors"
+	"sync"
 	"sync/atomic"
 
 	"go.uber.org/zap"
@@ -12,7 +14,9 @@ type BreakerParams struct {
 	QueueDepth      int
 	MaxConcurrency  int
 	InitialCapacity int
-	Logger          *zap.Logger
+	// Fair shares the concurrency round-robin between the keys of the calls, instead of in the order they arrive
+	Fair   bool
+	Logger *zap.Logger
 }
 
 // Breaker enforces a concurrency limit on the execution of a function.
@@ -23,18 +27,45 @@ type Breaker struct {
 	totalSlots     int64
 	maxConcurrency uint16
 	sem            *semaphore
+	fairSem        *fairSemaphore
+	// tickets are the queue slots of the requests which entered the queue, by priority, in the order they entered it
+	tickets   [numPriorities]*list.List
+	ticketsMu sync.Mutex
 }
 
 func NewBreaker(params BreakerParams) *Breaker {
-	return &Breaker{
+	b := &Breaker{
 		maxConcurrency: uint16(params.MaxConcurrency), //nolint: gosec
 		totalSlots:     int64(params.QueueDepth + params.MaxConcurrency),
 		logger:         params.Logger,
-		sem:            newSemaphore(params.MaxConcurrency, params.InitialCapacity),
 	}
+	for i := range b.tickets {
+		b.tickets[i] = list.New()
+	}
+	if params.Fair {
+		// Like the semaphore, the capacity is the initial one
+		b.fairSem = newFairSemaphore(params.InitialCapacity)
+	} else {
+		b.sem = newSemaphore(params.MaxConcurrency, params.InitialCapacity)
+	}
+	return b
 }
 
-var ErrRequestQueueFull = errors.New("request queue is full! This request is dropped")
+var (
+	ErrRequestQueueFull = errors.New("request queue is full! This request is dropped")
+	// ErrRequestShed is returned for a queued request which was shed from the full queue, for a request with a higher priority
+	ErrRequestShed = errors.New("request was shed from the full queue for a request with a higher priority")
+)
+
+// queueTicket is the queue slot of a request. Requests which wait for the target can be shed from a full queue,
+// to make room for requests with a higher priority, but the ones which are active can't.
+type queueTicket struct {
+	priority Priority
+	onShed   func()
+	element  *list.Element
+	active   bool
+	shed     bool
+}
 
 // Maybe conditionally executes thunk based on the Breaker concurrency
 // and queue parameters.
@@ -48,7 +79,7 @@ func (b *Breaker) Maybe(ctx context.Context, thunk func()) error {
 
 	defer b.releaseInFlightSlot()
 
-	if err := b.sem.acquire(ctx); err != nil {
+	if err := b.acquire(ctx, "", PriorityNormal); err != nil {
 		return err
 	}
 
@@ -56,12 +87,83 @@ func (b *Breaker) Maybe(ctx context.Context, thunk func()) error {
 	// It's safe to ignore the error returned by release since we
 	// make sure the semaphore is only manipulated here and acquire
 	// + release calls are equally paired.
-	defer b.sem.release()
+	defer b.release()
 
 	thunk()
 	return nil
 }
 
+// enter takes a queue slot for a request with the priority, which is held until leave is called. When the queue is full,
+// the newest waiting request with the lowest priority below it is shed: its onShed is called, and its slot is handed over.
+func (b *Breaker) enter(priority Priority, onShed func()) (*queueTicket, error) {
+	b.ticketsMu.Lock()
+	defer b.ticketsMu.Unlock()
+	if !b.tryAcquireInFlightSlot() && !b.shedBelow(priority) {
+		return nil, ErrRequestQueueFull
+	}
+	ticket := &queueTicket{priority: priority, onShed: onShed}
+	ticket.element = b.tickets[priority].PushBack(ticket)
+	return ticket, nil
+}
+
+// shedBelow sheds the newest waiting request with the lowest priority below the priority, it returns false if there is none.
+// It must be called with ticketsMu held.
+func (b *Breaker) shedBelow(priority Priority) bool {
+	for p := PriorityLow; p < priority; p++ {
+		for element := b.tickets[p].Back(); element != nil; element = element.Prev() {
+			victim := element.Value.(*queueTicket)
+			if victim.active {
+				continue
+			}
+			b.tickets[p].Remove(element)
+			victim.shed = true
+			victim.onShed()
+			return true
+		}
+	}
+	return false
+}
+
+// leave releases the queue slot of a request, unless it was shed and handed over
+func (b *Breaker) leave(ticket *queueTicket) {
+	b.ticketsMu.Lock()
+	defer b.ticketsMu.Unlock()
+	if ticket.shed {
+		return
+	}
+	b.tickets[ticket.priority].Remove(ticket.element)
+	b.releaseInFlightSlot()
+}
+
+// activate marks the request as active, so it can't be shed, or as waiting again. It returns false if it was already shed.
+func (b *Breaker) activate(ticket *queueTicket, active bool) bool {
+	b.ticketsMu.Lock()
+	defer b.ticketsMu.Unlock()
+	if ticket.shed {
+		return false
+	}
+	ticket.active = active
+	return true
+}
+
+// acquire acquires a concurrency slot for a call with the key, like the service of a request.
+// The concurrency of a fair Breaker goes to the highest priority first, and is shared round-robin between the keys.
+func (b *Breaker) acquire(ctx context.Context, key string, priority Priority) error {
+	if b.fairSem != nil {
+		return b.fairSem.acquire(ctx, key, priority)
+	}
+	return b.sem.acquire(ctx)
+}
+
+// release releases a concurrency slot
+func (b *Breaker) release() {
+	if b.fairSem != nil {
+		b.fairSem.release()
+		return
+	}
+	b.sem.release()
+}
+
 func (b *Breaker) tryAcquireInFlightSlot() bool {
 	// We can't just use an atomic increment as we need to check if we're
 	// "allowed" to increment first. Since a Load and a CompareAndSwap are
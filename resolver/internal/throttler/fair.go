@@ -0,0 +1,137 @@
+package throttler
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"sync"
+)
+
+// fairSemaphore is a semaphore which hands the released capacity to the waiting acquirers with the highest priority.
+// Within a priority, it is handed round-robin to the keys with waiting acquirers, so a key with many waiting acquirers
+// doesn't starve the others. Acquirers of the same key and priority are served in order.
+type fairSemaphore struct {
+	mu       sync.Mutex
+	capacity int
+	in       int
+	levels   [numPriorities]fairLevel
+	// numWaiting is the number of waiting acquirers of all the levels
+	numWaiting int
+}
+
+// fairLevel has the waiting acquirers of a priority. Keys are served in the order of keys, starting at next.
+type fairLevel struct {
+	waiters map[string]*list.List
+	keys    []string
+	next    int
+}
+
+type fairWaiter struct {
+	ready   chan struct{}
+	granted bool
+}
+
+func newFairSemaphore(capacity int) *fairSemaphore {
+	s := &fairSemaphore{capacity: capacity}
+	for i := range s.levels {
+		s.levels[i].waiters = map[string]*list.List{}
+	}
+	return s
+}
+
+// acquire acquires capacity from the semaphore for the key
+func (s *fairSemaphore) acquire(ctx context.Context, key string, priority Priority) error {
+	s.mu.Lock()
+	if s.in < s.capacity && s.numWaiting == 0 {
+		s.in++
+		s.mu.Unlock()
+		return nil
+	}
+	level := &s.levels[priority]
+	waiters, ok := level.waiters[key]
+	if !ok {
+		waiters = list.New()
+		level.waiters[key] = waiters
+		level.keys = append(level.keys, key)
+	}
+	waiter := &fairWaiter{ready: make(chan struct{})}
+	element := waiters.PushBack(waiter)
+	s.numWaiting++
+	s.mu.Unlock()
+
+	select {
+	case <-waiter.ready:
+		return nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if waiter.granted {
+			// The capacity was handed over while the context was done, so it is passed on
+			s.handOver()
+		} else {
+			level.remove(key, waiters, element)
+			s.numWaiting--
+		}
+		return fmt.Errorf("acquire: %w", ctx.Err())
+	}
+}
+
+// release releases capacity in the semaphore, handing it to the next waiting acquirer
+func (s *fairSemaphore) release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.in == 0 {
+		panic("release and acquire are not paired")
+	}
+	s.handOver()
+}
+
+// handOver hands the capacity of a done acquirer to the next waiting acquirer of the highest priority, or frees it.
+// It must be called with mu held.
+func (s *fairSemaphore) handOver() {
+	for i := len(s.levels) - 1; i >= 0; i-- {
+		if s.levels[i].handOver() {
+			s.numWaiting--
+			return
+		}
+	}
+	s.in--
+}
+
+// handOver hands the capacity to the first waiting acquirer of the next key, it returns false if there is none
+func (l *fairLevel) handOver() bool {
+	if len(l.keys) == 0 {
+		return false
+	}
+	l.next %= len(l.keys)
+	key := l.keys[l.next]
+	waiters := l.waiters[key]
+	element := waiters.Front()
+	waiter := element.Value.(*fairWaiter)
+	waiter.granted = true
+	close(waiter.ready)
+	l.remove(key, waiters, element)
+	// The next key is at the same index, if this key has no waiting acquirers left
+	if _, ok := l.waiters[key]; ok {
+		l.next++
+	}
+	return true
+}
+
+// remove removes a waiting acquirer, and its key once it has none left
+func (l *fairLevel) remove(key string, waiters *list.List, element *list.Element) {
+	waiters.Remove(element)
+	if waiters.Len() > 0 {
+		return
+	}
+	delete(l.waiters, key)
+	for i, k := range l.keys {
+		if k == key {
+			l.keys = append(l.keys[:i], l.keys[i+1:]...)
+			if i < l.next {
+				l.next--
+			}
+			return
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package throttler
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// waiting returns the number of waiting acquirers of the semaphore
+func (s *fairSemaphore) waiting() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.numWaiting
+}
+
+func TestFairSemaphore(t *testing.T) {
+	sem := newFairSemaphore(1)
+	require.NoError(t, sem.acquire(context.Background(), "noisy", PriorityNormal))
+
+	// The noisy service queues many requests before the quiet one queues its own
+	acquired := make(chan string, 4)
+	for i, key := range []string{"noisy", "noisy", "noisy", "quiet"} {
+		go func() {
+			if err := sem.acquire(context.Background(), key, PriorityNormal); err == nil {
+				acquired <- key
+			}
+		}()
+		require.Eventually(t, func() bool { return sem.waiting() == i+1 }, time.Second, time.Millisecond)
+	}
+
+	// The quiet service gets the second slot, instead of waiting for all the requests of the noisy one
+	var order []string
+	for range 4 {
+		sem.release()
+		order = append(order, <-acquired)
+	}
+	assert.Equal(t, []string{"noisy", "quiet", "noisy", "noisy"}, order)
+	sem.release()
+	assert.Zero(t, sem.in)
+}
+
+func TestFairSemaphoreContextDone(t *testing.T) {
+	sem := newFairSemaphore(1)
+	require.NoError(t, sem.acquire(context.Background(), "a", PriorityNormal))
+
+	// A request which is done waiting leaves the queue, and doesn't take the released capacity
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, sem.acquire(ctx, "b", PriorityNormal), context.DeadlineExceeded)
+	assert.Zero(t, sem.waiting())
+	assert.Empty(t, sem.levels[PriorityNormal].keys)
+
+	sem.release()
+	require.NoError(t, sem.acquire(context.Background(), "b", PriorityNormal))
+	sem.release()
+	assert.Zero(t, sem.in)
+}
+
+func TestFairSemaphorePriority(t *testing.T) {
+	sem := newFairSemaphore(1)
+	require.NoError(t, sem.acquire(context.Background(), "a", PriorityNormal))
+
+	// Requests with a higher priority get the capacity first, whenever they arrived
+	acquired := make(chan Priority, 3)
+	for i, priority := range []Priority{PriorityLow, PriorityNormal, PriorityCritical} {
+		go func() {
+			if err := sem.acquire(context.Background(), "a", priority); err == nil {
+				acquired <- priority
+			}
+		}()
+		require.Eventually(t, func() bool { return sem.waiting() == i+1 }, time.Second, time.Millisecond)
+	}
+
+	var order []Priority
+	for range 3 {
+		sem.release()
+		order = append(order, <-acquired)
+	}
+	assert.Equal(t, []Priority{PriorityCritical, PriorityNormal, PriorityLow}, order)
+	sem.release()
+	assert.Zero(t, sem.in)
+}
@@ -0,0 +1,54 @@
+package throttler
+
+import (
+	"context"
+	"strings"
+)
+
+// Priority is the priority of a queued request. Requests with a higher priority get concurrency slots first,
+// and requests with a lower priority are shed first when the queue is full.
+type Priority int
+
+const (
+	PriorityLow Priority = iota
+	PriorityNormal
+	PriorityHigh
+	PriorityCritical
+
+	numPriorities = int(PriorityCritical) + 1
+)
+
+var priorityNames = [numPriorities]string{"low", "normal", "high", "critical"}
+
+// String returns the name of the priority, like "normal"
+func (p Priority) String() string {
+	if p < PriorityLow || p > PriorityCritical {
+		return "unknown"
+	}
+	return priorityNames[p]
+}
+
+// ParsePriority returns the priority with the name, which is case insensitive
+func ParsePriority(name string) (Priority, bool) {
+	for p, priorityName := range priorityNames {
+		if strings.EqualFold(name, priorityName) {
+			return Priority(p), true
+		}
+	}
+	return PriorityNormal, false
+}
+
+type priorityKey struct{}
+
+// WithPriority returns a context which makes the requests tried with it queued with the priority
+func WithPriority(ctx context.Context, priority Priority) context.Context {
+	return context.WithValue(ctx, priorityKey{}, priority)
+}
+
+// PriorityFromContext returns the priority of the context, which is PriorityNormal if it was not set
+func PriorityFromContext(ctx context.Context) Priority {
+	if priority, ok := ctx.Value(priorityKey{}).(Priority); ok {
+		return priority
+	}
+	return PriorityNormal
+}
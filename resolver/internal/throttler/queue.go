@@ -0,0 +1,138 @@
+package throttler
+
+import (
+	"cmp"
+	"container/list"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type (
+	// queueCounters count the requests in the queue of every service. The counter of a service is removed once its
+	// queue is empty, so services which are gone don't keep one.
+	queueCounters struct {
+		// counters are keyed by namespace and service
+		counters sync.Map
+	}
+
+	// queueCounter counts the requests in the queue of a service. Its size is -1 once it was removed, so requests
+	// which loaded it before that create a new one instead.
+	queueCounter struct {
+		namespace string
+		service   string
+		size      atomic.Int64
+		// proxying is the number of requests in the queue which are proxied to the target
+		proxying atomic.Int64
+		// enqueued has when the requests in the queue entered it, the oldest first
+		enqueued   *list.List
+		enqueuedMu sync.Mutex
+	}
+
+	// queueEntry is a request in the queue of a service, until leave is called
+	queueEntry struct {
+		queues  *queueCounters
+		key     string
+		counter *queueCounter
+		element *list.Element
+	}
+
+	// QueueStatus is the queue of a service
+	QueueStatus struct {
+		Namespace string
+		Service   string
+		// Size is the number of requests in the queue, which wait for the target or are proxied to it
+		Size int
+		// OldestAge is how long the oldest request in the queue has been in it
+		OldestAge time.Duration
+		// InFlight is the number of requests in the queue which are proxied to the target
+		InFlight int
+	}
+)
+
+// enter adds a request to the queue of the service
+func (q *queueCounters) enter(namespace, service string) *queueEntry {
+	key := namespace + "/" + service
+	for {
+		value, _ := q.counters.LoadOrStore(key, &queueCounter{namespace: namespace, service: service, enqueued: list.New()})
+		counter := value.(*queueCounter)
+		if !counter.tryIncrement() {
+			// The counter was removed after it was loaded, a new one is stored on the next try
+			q.counters.CompareAndDelete(key, counter)
+			continue
+		}
+		counter.enqueuedMu.Lock()
+		element := counter.enqueued.PushBack(time.Now())
+		counter.enqueuedMu.Unlock()
+		return &queueEntry{queues: q, key: key, counter: counter, element: element}
+	}
+}
+
+// leave removes the request from the queue, and the counter of the service once its queue is empty
+func (e *queueEntry) leave() {
+	e.counter.enqueuedMu.Lock()
+	e.counter.enqueued.Remove(e.element)
+	e.counter.enqueuedMu.Unlock()
+	if e.counter.size.Add(-1) == 0 && e.counter.size.CompareAndSwap(0, -1) {
+		e.queues.counters.CompareAndDelete(e.key, e.counter)
+	}
+}
+
+// proxy counts the request as proxied to the target while proxy runs
+func (e *queueEntry) proxy(proxy func()) {
+	e.counter.proxying.Add(1)
+	defer e.counter.proxying.Add(-1)
+	proxy()
+}
+
+// status returns the queue of the service
+func (q *queueCounters) status(namespace, service string) QueueStatus {
+	value, ok := q.counters.Load(namespace + "/" + service)
+	if !ok {
+		return QueueStatus{Namespace: namespace, Service: service}
+	}
+	return value.(*queueCounter).status()
+}
+
+// all returns the queues of the services with requests in them, sorted by namespace and service
+func (q *queueCounters) all() []QueueStatus {
+	var statuses []QueueStatus
+	q.counters.Range(func(_, value any) bool {
+		if status := value.(*queueCounter).status(); status.Size > 0 {
+			statuses = append(statuses, status)
+		}
+		return true
+	})
+	slices.SortFunc(statuses, func(a, b QueueStatus) int {
+		return cmp.Or(cmp.Compare(a.Namespace, b.Namespace), cmp.Compare(a.Service, b.Service))
+	})
+	return statuses
+}
+
+func (c *queueCounter) tryIncrement() bool {
+	for {
+		size := c.size.Load()
+		if size < 0 {
+			return false
+		}
+		if c.size.CompareAndSwap(size, size+1) {
+			return true
+		}
+	}
+}
+
+func (c *queueCounter) status() QueueStatus {
+	status := QueueStatus{
+		Namespace: c.namespace,
+		Service:   c.service,
+		Size:      max(int(c.size.Load()), 0),
+		InFlight:  int(c.proxying.Load()),
+	}
+	c.enqueuedMu.Lock()
+	defer c.enqueuedMu.Unlock()
+	if oldest := c.enqueued.Front(); oldest != nil {
+		status.OldestAge = time.Since(oldest.Value.(time.Time))
+	}
+	return status
+}
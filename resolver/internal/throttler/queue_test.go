@@ -0,0 +1,99 @@
+package throttler
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQueueCounters(t *testing.T) {
+	var queues queueCounters
+
+	// The oldest request stays the oldest until it leaves
+	first := queues.enter("namespace", "target")
+	time.Sleep(20 * time.Millisecond)
+	second := queues.enter("namespace", "target")
+	status := queues.status("namespace", "target")
+	assert.Equal(t, 2, status.Size)
+	assert.GreaterOrEqual(t, status.OldestAge, 20*time.Millisecond)
+
+	first.leave()
+	status = queues.status("namespace", "target")
+	assert.Equal(t, 1, status.Size)
+	assert.Less(t, status.OldestAge, 20*time.Millisecond)
+
+	// The counter is removed once the queue is empty
+	second.leave()
+	assert.Equal(t, QueueStatus{Namespace: "namespace", Service: "target"}, queues.status("namespace", "target"))
+	_, ok := queues.counters.Load("namespace/target")
+	assert.False(t, ok)
+}
+
+func TestQueueCountersConcurrent(t *testing.T) {
+	var queues queueCounters
+	const goroutines, iterations = 32, 500
+
+	// A request which stays in the queue, while the others enter and leave it
+	held := queues.enter("namespace", "held")
+	var wg sync.WaitGroup
+	for i := range goroutines {
+		service := []string{"held", "idle"}[i%2]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range iterations {
+				entry := queues.enter("namespace", service)
+				_ = queues.status("namespace", service)
+				entry.leave()
+			}
+		}()
+	}
+
+	// No update is lost, so the queue is never seen smaller than the held request
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	for waiting := true; waiting; {
+		select {
+		case <-done:
+			waiting = false
+		default:
+			require.GreaterOrEqual(t, queues.status("namespace", "held").Size, 1)
+		}
+	}
+
+	assert.Equal(t, 1, queues.status("namespace", "held").Size)
+	assert.Zero(t, queues.status("namespace", "idle").Size)
+	_, ok := queues.counters.Load("namespace/idle")
+	assert.False(t, ok, "the counter of an idle service is removed")
+	held.leave()
+	_, ok = queues.counters.Load("namespace/held")
+	assert.False(t, ok)
+}
+
+func TestQueueCountersAll(t *testing.T) {
+	var queues queueCounters
+	web := queues.enter("default", "web")
+	api := queues.enter("default", "api")
+	defer api.leave()
+	queues.enter("other", "idle").leave()
+
+	// Only the services with queued requests are listed, with the requests which are proxied
+	web.proxy(func() {
+		statuses := queues.all()
+		require.Len(t, statuses, 2)
+		assert.Equal(t, "api", statuses[0].Service)
+		assert.Zero(t, statuses[0].InFlight)
+		assert.Equal(t, "web", statuses[1].Service)
+		assert.Equal(t, 1, statuses[1].Size)
+		assert.Equal(t, 1, statuses[1].InFlight)
+	})
+	assert.Zero(t, queues.status("default", "web").InFlight)
+	web.leave()
+	assert.Len(t, queues.all(), 1)
+}
@@ -0,0 +1,31 @@
+package throttler
+
+import (
+	"context"
+	"errors"
+	"syscall"
+
+	"github.com/truefoundry/elasti/resolver/internal/prom"
+)
+
+// ErrorReason returns the reason of an error of Try, or of a connection to the target, for the error labels of the metrics
+func ErrorReason(err error) string {
+	switch {
+	case err == nil:
+		return prom.ReasonNone
+	case errors.Is(err, ErrRequestQueueFull):
+		return prom.ReasonQueueFull
+	case errors.Is(err, ErrRequestShed):
+		return prom.ReasonShed
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, ErrTimeoutDialing):
+		return prom.ReasonTimeout
+	case errors.Is(err, context.Canceled):
+		return prom.ReasonCanceled
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return prom.ReasonConnectionRefused
+	case errors.Is(err, syscall.ECONNRESET):
+		return prom.ReasonConnectionReset
+	default:
+		return prom.ReasonUpstream
+	}
+}
@@ -2,15 +2,30 @@ package throttler
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"sync"
 	"time"
 
 	"github.com/truefoundry/elasti/pkg/k8shelper"
 	"github.com/truefoundry/elasti/pkg/messages"
+	"github.com/truefoundry/elasti/pkg/tracing"
+	"github.com/truefoundry/elasti/resolver/internal/prom"
+	"github.com/truefoundry/elasti/resolver/internal/serviceconfig"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 )
 
+var tracer = otel.Tracer("github.com/truefoundry/elasti/resolver/internal/throttler")
+
+// Attributes of the spans of the queue
+const (
+	priorityAttribute = attribute.Key("elasti.priority")
+	tryCountAttribute = attribute.Key("elasti.try_count")
+)
+
 type (
 	Throttler struct {
 		logger                  *zap.Logger
@@ -19,7 +34,30 @@ type (
 		retryDuration           time.Duration
 		TrafficReEnableDuration time.Duration
 		serviceReadyMap         sync.Map
-		queueSizeMap            sync.Map
+		podAddressMap           sync.Map
+		queues                  queueCounters
+		// coldSinceMap has when a service was first seen not ready, and coldStartMap how long it took to be ready since then
+		coldSinceMap sync.Map
+		coldStartMap sync.Map
+		// scaledUpMap has when a service turned ready after it was seen cold
+		scaledUpMap sync.Map
+		// serviceConfig has the queue limits of every service, which have their own breakers on top of the global one
+		serviceConfig   *serviceconfig.Store
+		serviceBreakers map[string]*serviceBreaker
+		breakersMu      sync.Mutex
+		// watchedReadiness has the readiness of the private services from the EndpointSlice informer, and readyChans
+		// are closed once their service turns ready, to wake the requests which wait for it
+		watchedReadiness sync.Map
+		readyChans       map[string]chan struct{}
+		readyMu          sync.Mutex
+	}
+
+	// serviceBreaker is the breaker of a service, with the limits it was created with
+	serviceBreaker struct {
+		*Breaker
+		namespace string
+		service   string
+		limits    serviceconfig.Queue
 	}
 
 	Params struct {
@@ -30,6 +68,8 @@ type (
 		MaxConcurrency          int
 		InitialCapacity         int
 		Logger                  *zap.Logger
+		// ServiceConfig gives the queue limits of every service, only the global limits apply without it
+		ServiceConfig *serviceconfig.Store
 	}
 )
 
@@ -38,6 +78,7 @@ func NewThrottler(param *Params) *Throttler {
 		QueueDepth:      param.QueueDepth,
 		MaxConcurrency:  param.MaxConcurrency,
 		InitialCapacity: param.InitialCapacity,
+		Fair:            true,
 		Logger:          param.Logger,
 	})
 
@@ -47,45 +88,108 @@ func NewThrottler(param *Params) *Throttler {
 		k8sUtil:                 param.K8sUtil,
 		TrafficReEnableDuration: param.TrafficReEnableDuration,
 		retryDuration:           param.QueueRetryDuration,
+		serviceConfig:           param.ServiceConfig,
+		serviceBreakers:         map[string]*serviceBreaker{},
+		readyChans:              map[string]chan struct{}{},
 	}
 }
 
 func (t *Throttler) Try(ctx context.Context, host *messages.Host, resolve func(int) error, tryErrCallback func()) error {
+	return t.TryAdmitted(ctx, host, nil, resolve, tryErrCallback)
+}
+
+// TryAdmitted is like Try, and calls admitted once the request has its slots in the queues, before it waits for the target.
+// An error of admitted is returned wrapped, and the request leaves the queues. This way, work like reading the body of the
+// request is only done for the requests the queues have room for.
+func (t *Throttler) TryAdmitted(ctx context.Context, host *messages.Host, admitted func() error, resolve func(int) error, tryErrCallback func()) error {
 	reenqueue := true
 	tryCount := 1
 	var tryErr error
 
-	t.incrementQueueSize(host.Namespace, host.SourceService)
-	defer t.decrementQueueSize(host.Namespace, host.SourceService)
+	queued := t.queues.enter(host.Namespace, host.SourceService)
+	defer queued.leave()
+
+	// The span of the queue ends once the target is ready, so the wait and the proxying are apart in the trace
+	priority := PriorityFromContext(ctx)
+	ctx, span := tracer.Start(ctx, "resolver.queue", trace.WithAttributes(
+		tracing.NamespaceKey.String(host.Namespace),
+		tracing.ServiceKey.String(host.SourceService),
+		tracing.TargetServiceKey.String(host.TargetService),
+		priorityAttribute.String(priority.String()),
+	))
+	defer span.End()
+
+	// The request stops waiting once it is shed from the queue
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	var shedOnce sync.Once
+	onShed := func() {
+		shedOnce.Do(func() {
+			prom.QueueShedCounter.WithLabelValues(host.SourceService, host.Namespace, priority.String()).Inc()
+			cancel(ErrRequestShed)
+		})
+	}
+
+	slots, breakErr := t.enterQueue(host.Namespace, host.SourceService, priority, onShed)
+	if breakErr != nil {
+		tracing.RecordError(span, breakErr)
+		return fmt.Errorf("breaker error: %w", breakErr)
+	}
+	defer slots.leave()
+	if admitted != nil {
+		if err := admitted(); err != nil {
+			tracing.RecordError(span, err)
+			return fmt.Errorf("admission error: %w", err)
+		}
+	}
 
 	for reenqueue {
 		tryErr = nil
-		breakErr := t.breaker.Maybe(ctx, func() {
-			if isPodActive, err := t.checkIfServiceReady(host.Namespace, host.TargetService); err != nil {
+		// The notification is taken before the check, so a target which turns ready right after it is not missed
+		ready := t.readyNotification(host.Namespace, host.TargetService)
+		breakErr := t.withConcurrencySlot(ctx, host.Namespace, host.SourceService, slots, func() {
+			if isPodActive, err := t.checkIfTargetReady(host); err != nil {
 				tryErr = err
 				go tryErrCallback()
 			} else if isPodActive {
-				if res := resolve(tryCount); res != nil {
-					tryErr = fmt.Errorf("resolve error: %w", res)
-				}
+				span.SetAttributes(tryCountAttribute.Int(tryCount))
+				span.End()
+				queued.proxy(func() {
+					if res := resolve(tryCount); res != nil {
+						tryErr = fmt.Errorf("resolve error: %w", res)
+					}
+				})
 				// We don't reenqueue if the POD is active, but request failed to resolve
 				reenqueue = false
 			}
-
-			select {
-			case <-ctx.Done():
-				tryErr = fmt.Errorf("context done error: %w", ctx.Err())
-				reenqueue = false
-			default:
-				if reenqueue {
-					tryCount++
-					time.Sleep(t.retryDuration)
-				}
-			}
 		})
 		if breakErr != nil {
+			if errors.Is(context.Cause(ctx), ErrRequestShed) {
+				breakErr = ErrRequestShed
+			}
+			tracing.RecordError(span, breakErr)
 			return fmt.Errorf("breaker error: %w", breakErr)
 		}
+
+		// Once the request is resolved, the context is not checked anymore, since long-lived
+		// requests like WebSockets and server-sent events often outlive it
+		if !reenqueue {
+			break
+		}
+		// The request waits without its concurrency slot, until the target turns ready, or the next check in case
+		// the notification was missed
+		span.AddEvent("target not ready", trace.WithAttributes(tryCountAttribute.Int(tryCount)))
+		select {
+		case <-ctx.Done():
+			tryErr = fmt.Errorf("context done error: %w", context.Cause(ctx))
+			tracing.RecordError(span, tryErr)
+			reenqueue = false
+		case <-ready:
+			span.AddEvent("endpoints ready")
+			tryCount++
+		case <-time.After(t.retryDuration):
+			tryCount++
+		}
 	}
 	if tryErr != nil {
 		return fmt.Errorf("thunk error: %w", tryErr)
@@ -93,19 +197,255 @@ func (t *Throttler) Try(ctx context.Context, host *messages.Host, resolve func(i
 	return nil
 }
 
+// queueSlots are the slots of a request in the queue of its service, and in the global queue
+type queueSlots struct {
+	serviceBreaker *Breaker
+	service        *queueTicket
+	globalBreaker  *Breaker
+	global         *queueTicket
+}
+
+// enterQueue takes a queue slot of the service, and of the global queue, which are held until leave is called.
+// A full queue sheds a waiting request with a lower priority to make room, or rejects the request.
+func (t *Throttler) enterQueue(namespace, service string, priority Priority, onShed func()) (*queueSlots, error) {
+	slots := &queueSlots{serviceBreaker: t.getServiceBreaker(namespace, service), globalBreaker: t.breaker}
+	if slots.serviceBreaker != nil {
+		ticket, err := slots.serviceBreaker.enter(priority, onShed)
+		if err != nil {
+			prom.QueueRejectedCounter.WithLabelValues(service, namespace, "service").Inc()
+			return nil, err
+		}
+		slots.service = ticket
+	}
+	ticket, err := t.breaker.enter(priority, onShed)
+	if err != nil {
+		slots.leave()
+		prom.QueueRejectedCounter.WithLabelValues(service, namespace, "global").Inc()
+		return nil, err
+	}
+	slots.global = ticket
+	return slots, nil
+}
+
+// leave releases the queue slots
+func (s *queueSlots) leave() {
+	if s.global != nil {
+		s.globalBreaker.leave(s.global)
+	}
+	if s.service != nil {
+		s.serviceBreaker.leave(s.service)
+	}
+}
+
+// activate marks the request as active in both queues, so it can't be shed, or as waiting again.
+// It returns false if the request was already shed.
+func (s *queueSlots) activate(active bool) bool {
+	if s.service != nil && !s.serviceBreaker.activate(s.service, active) {
+		return false
+	}
+	return s.globalBreaker.activate(s.global, active)
+}
+
+// withConcurrencySlot runs thunk with a concurrency slot of the service, and of the global queue. The slots go to the requests
+// with the highest priority first, and the global concurrency is shared round-robin between the services, so a service with
+// many queued requests doesn't starve the others.
+func (t *Throttler) withConcurrencySlot(ctx context.Context, namespace, service string, slots *queueSlots, thunk func()) error {
+	priority := slots.global.priority
+	if slots.serviceBreaker != nil {
+		if err := slots.serviceBreaker.acquire(ctx, "", priority); err != nil {
+			return err
+		}
+		defer slots.serviceBreaker.release()
+	}
+	if err := t.breaker.acquire(ctx, namespace+"/"+service, priority); err != nil {
+		return err
+	}
+	defer t.breaker.release()
+
+	if !slots.activate(true) {
+		return ErrRequestShed
+	}
+	defer slots.activate(false)
+
+	prom.QueueActiveGauge.WithLabelValues(service, namespace).Inc()
+	defer prom.QueueActiveGauge.WithLabelValues(service, namespace).Dec()
+	thunk()
+	return nil
+}
+
+// getServiceBreaker returns the breaker of the service, which is replaced once its limits change.
+// Requests which are already queued stay in the old breaker until they are done. Services which no ElastiService
+// manages, or all of them until the ElastiServices are listed, only have the global limits, so a Host header can't
+// add a breaker.
+func (t *Throttler) getServiceBreaker(namespace, service string) *Breaker {
+	if t.serviceConfig == nil || !t.serviceConfig.Has(namespace, service) {
+		return nil
+	}
+	limits := t.serviceConfig.Get(namespace, service).Queue
+	key := fmt.Sprintf("%s/%s", namespace, service)
+
+	t.breakersMu.Lock()
+	defer t.breakersMu.Unlock()
+	if b, ok := t.serviceBreakers[key]; ok && b.limits == limits {
+		return b.Breaker
+	}
+	b := &serviceBreaker{
+		Breaker: NewBreaker(BreakerParams{
+			QueueDepth:      limits.Depth,
+			MaxConcurrency:  limits.MaxConcurrency,
+			InitialCapacity: limits.MaxConcurrency,
+			Fair:            true,
+			Logger:          t.logger,
+		}),
+		namespace: namespace,
+		service:   service,
+		limits:    limits,
+	}
+	t.serviceBreakers[key] = b
+	prom.QueueLimitGauge.WithLabelValues(service, namespace, "depth").Set(float64(limits.Depth))
+	prom.QueueLimitGauge.WithLabelValues(service, namespace, "concurrency").Set(float64(limits.MaxConcurrency))
+	return b.Breaker
+}
+
+// PruneServiceBreakers drops the breakers, and their limit metrics, of the services which are no longer managed by an
+// ElastiService. It is called once the ElastiServices are applied to the service config. Requests which are already
+// queued keep their breaker until they are done.
+func (t *Throttler) PruneServiceBreakers() {
+	if t.serviceConfig == nil {
+		return
+	}
+	t.breakersMu.Lock()
+	defer t.breakersMu.Unlock()
+	for key, b := range t.serviceBreakers {
+		if t.serviceConfig.Has(b.namespace, b.service) {
+			continue
+		}
+		delete(t.serviceBreakers, key)
+		prom.QueueLimitGauge.DeleteLabelValues(b.service, b.namespace, "depth")
+		prom.QueueLimitGauge.DeleteLabelValues(b.service, b.namespace, "concurrency")
+	}
+}
+
+// WaitForServiceReady waits until the target service has a ready endpoint, calling notReadyCallback every time it is not ready.
+// It is used for TCP connections, which are not limited by the breaker, since they are long-lived and would hold a slot
+// for as long as they are open. They are still counted in the queue size of the source service while they wait.
+func (t *Throttler) WaitForServiceReady(ctx context.Context, namespace, sourceService, targetService string, notReadyCallback func()) error {
+	queued := t.queues.enter(namespace, sourceService)
+	defer queued.leave()
+	_, span := tracer.Start(ctx, "resolver.queue", trace.WithAttributes(
+		tracing.NamespaceKey.String(namespace),
+		tracing.ServiceKey.String(sourceService),
+		tracing.TargetServiceKey.String(targetService),
+	))
+	defer span.End()
+
+	for tryCount := 1; ; tryCount++ {
+		ready := t.readyNotification(namespace, targetService)
+		if isReady, err := t.checkIfServiceReady(namespace, targetService); err == nil && isReady {
+			span.SetAttributes(tryCountAttribute.Int(tryCount))
+			return nil
+		}
+		go notReadyCallback()
+		span.AddEvent("target not ready", trace.WithAttributes(tryCountAttribute.Int(tryCount)))
+		select {
+		case <-ctx.Done():
+			err := fmt.Errorf("context done error: %w", ctx.Err())
+			tracing.RecordError(span, err)
+			return err
+		case <-ready:
+			span.AddEvent("endpoints ready")
+		case <-time.After(t.retryDuration):
+		}
+	}
+}
+
+// SetServiceReadiness sets the readiness of a private service, from the EndpointSlice informer.
+// The requests which wait for the service are woken up once it turns ready.
+func (t *Throttler) SetServiceReadiness(namespace, service string, ready bool) {
+	key := fmt.Sprintf("%s/%s", namespace, service)
+	t.watchedReadiness.Store(key, ready)
+	if !ready {
+		t.serviceReadyMap.Delete(key)
+		return
+	}
+	t.readyMu.Lock()
+	defer t.readyMu.Unlock()
+	if ch, ok := t.readyChans[key]; ok {
+		close(ch)
+		delete(t.readyChans, key)
+	}
+}
+
+// readyNotification returns a channel which is closed once the service turns ready
+func (t *Throttler) readyNotification(namespace, service string) <-chan struct{} {
+	key := fmt.Sprintf("%s/%s", namespace, service)
+	t.readyMu.Lock()
+	defer t.readyMu.Unlock()
+	ch, ok := t.readyChans[key]
+	if !ok {
+		ch = make(chan struct{})
+		t.readyChans[key] = ch
+	}
+	return ch
+}
+
+// IsTargetReady returns true if the target of the request is ready, without waiting for it
+func (t *Throttler) IsTargetReady(host *messages.Host) bool {
+	ready, err := t.checkIfTargetReady(host)
+	return err == nil && ready
+}
+
+// ExpectedReadyIn returns how long the service is expected to take to be ready, from how long its last cold start took.
+// It returns false if no cold start was seen yet, or the service is not cold.
+func (t *Throttler) ExpectedReadyIn(namespace, service string) (time.Duration, bool) {
+	key := fmt.Sprintf("%s/%s", namespace, service)
+	coldSince, ok := t.coldSinceMap.Load(key)
+	if !ok {
+		return 0, false
+	}
+	coldStart, ok := t.coldStartMap.Load(key)
+	if !ok {
+		return 0, false
+	}
+	return max(coldStart.(time.Duration)-time.Since(coldSince.(time.Time)), 0), true
+}
+
+// ScaledUpWithin returns true if the service turned ready after a cold start less than d ago. Its pods may
+// not accept connections yet at that point, even if they are ready.
+func (t *Throttler) ScaledUpWithin(namespace, service string, d time.Duration) bool {
+	scaledUp, ok := t.scaledUpMap.Load(fmt.Sprintf("%s/%s", namespace, service))
+	return ok && time.Since(scaledUp.(time.Time)) < d
+}
+
+// checkIfTargetReady checks if the pod the request is for is ready, or any pod of the service if the request is not for a pod
+func (t *Throttler) checkIfTargetReady(host *messages.Host) (bool, error) {
+	if host.TargetPod == "" {
+		return t.checkIfServiceReady(host.Namespace, host.TargetService)
+	}
+	if _, err := t.GetPodAddress(host.Namespace, host.TargetService, host.TargetPod); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
 func (t *Throttler) checkIfServiceReady(namespace, service string) (bool, error) {
 	key := fmt.Sprintf("%s/%s", namespace, service)
 	if ready, ok := t.serviceReadyMap.Load(key); ok {
 		return ready.(bool), nil
 	}
 
-	isPodActive, err := t.k8sUtil.CheckIfServiceEndpointSliceActive(namespace, service)
+	isPodActive, err := t.isServiceActive(namespace, service)
 	if err != nil {
 		return false, fmt.Errorf("unable to get target active endpoints: %w", err)
 	}
 	if !isPodActive {
+		t.coldSinceMap.LoadOrStore(key, time.Now())
 		return false, fmt.Errorf("no active endpoints found for namespace: %v service: %v", namespace, service)
 	}
+	if coldSince, ok := t.coldSinceMap.LoadAndDelete(key); ok {
+		t.coldStartMap.Store(key, time.Since(coldSince.(time.Time)))
+		t.scaledUpMap.Store(key, time.Now())
+	}
 
 	t.serviceReadyMap.Store(key, true)
 	// release the memory after sometime
@@ -115,20 +455,51 @@ func (t *Throttler) checkIfServiceReady(namespace, service string) (bool, error)
 	return true, nil
 }
 
-func (t *Throttler) GetQueueSize(namespace, service string) int {
-	key := fmt.Sprintf("%s/%s", namespace, service)
-	if size, ok := t.queueSizeMap.Load(key); ok {
-		return size.(int)
+// isServiceActive returns true if the service has a ready endpoint. It comes from the EndpointSlice informer
+// for the services it knows about, and from the API server for the others.
+func (t *Throttler) isServiceActive(namespace, service string) (bool, error) {
+	if ready, ok := t.watchedReadiness.Load(fmt.Sprintf("%s/%s", namespace, service)); ok {
+		return ready.(bool), nil
 	}
-	return 0
+	active, err := t.k8sUtil.CheckIfServiceEndpointSliceActive(namespace, service)
+	if err != nil {
+		return false, fmt.Errorf("check endpoint slices: %w", err)
+	}
+	return active, nil
 }
 
-func (t *Throttler) incrementQueueSize(namespace, service string) {
-	key := fmt.Sprintf("%s/%s", namespace, service)
-	t.queueSizeMap.Store(key, t.GetQueueSize(namespace, service)+1)
+// GetPodAddress returns the address of a ready pod behind the service, for requests to the per-pod DNS name of a headless service.
+// Those names point to the resolver until it switches to serve mode, so the request has to be sent to the pod address directly.
+func (t *Throttler) GetPodAddress(namespace, service, pod string) (string, error) {
+	key := fmt.Sprintf("%s/%s/%s", namespace, service, pod)
+	if address, ok := t.podAddressMap.Load(key); ok {
+		return address.(string), nil
+	}
+
+	address, err := t.k8sUtil.GetReadyEndpointAddressForPod(namespace, service, pod)
+	if err != nil {
+		return "", fmt.Errorf("unable to get ready endpoint for namespace: %v service: %v pod: %v: %w", namespace, service, pod, err)
+	}
+
+	t.podAddressMap.Store(key, address)
+	// release the memory after sometime
+	time.AfterFunc(t.TrafficReEnableDuration, func() {
+		t.podAddressMap.Delete(key)
+	})
+	return address, nil
 }
 
-func (t *Throttler) decrementQueueSize(namespace, service string) {
-	key := fmt.Sprintf("%s/%s", namespace, service)
-	t.queueSizeMap.Store(key, t.GetQueueSize(namespace, service)-1)
+// GetQueueSize returns the number of requests in the queue of the service
+func (t *Throttler) GetQueueSize(namespace, service string) int {
+	return t.queues.status(namespace, service).Size
+}
+
+// GetQueueStatus returns the queue of the service
+func (t *Throttler) GetQueueStatus(namespace, service string) QueueStatus {
+	return t.queues.status(namespace, service)
+}
+
+// GetQueueStatuses returns the queues of the services with requests in them, sorted by namespace and service
+func (t *Throttler) GetQueueStatuses() []QueueStatus {
+	return t.queues.all()
 }
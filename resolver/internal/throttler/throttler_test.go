@@ -0,0 +1,240 @@
+package throttler
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/truefoundry/elasti/pkg/messages"
+	"github.com/truefoundry/elasti/resolver/internal/prom"
+	"github.com/truefoundry/elasti/resolver/internal/serviceconfig"
+	"github.com/truefoundry/elasti/resolver/internal/testutil"
+	"go.uber.org/zap"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestExpectedReadyIn(t *testing.T) {
+	var ready atomic.Bool
+	logger := zap.NewNop()
+	throttler := NewThrottler(&Params{
+		QueueRetryDuration:      10 * time.Millisecond,
+		TrafficReEnableDuration: 10 * time.Millisecond,
+		K8sUtil:                 testutil.NewOps(ready.Load),
+		QueueDepth:              10,
+		MaxConcurrency:          10,
+		InitialCapacity:         10,
+		Logger:                  logger,
+	})
+
+	// Nothing is expected until a cold start was seen
+	_, _ = throttler.checkIfServiceReady("namespace", "target-pvt")
+	_, ok := throttler.ExpectedReadyIn("namespace", "target-pvt")
+	assert.False(t, ok)
+
+	// The first cold start takes a while
+	time.Sleep(200 * time.Millisecond)
+	ready.Store(true)
+	_, err := throttler.checkIfServiceReady("namespace", "target-pvt")
+	assert.NoError(t, err)
+	_, ok = throttler.ExpectedReadyIn("namespace", "target-pvt")
+	assert.False(t, ok, "nothing is expected while the service is ready")
+	assert.True(t, throttler.ScaledUpWithin("namespace", "target-pvt", time.Second))
+	assert.False(t, throttler.ScaledUpWithin("namespace", "target-pvt", 0))
+
+	// The next one is expected to take as long, from when it started
+	ready.Store(false)
+	assert.Eventually(t, func() bool {
+		_, err := throttler.checkIfServiceReady("namespace", "target-pvt")
+		return err != nil
+	}, time.Second, 10*time.Millisecond)
+	expected, ok := throttler.ExpectedReadyIn("namespace", "target-pvt")
+	assert.True(t, ok)
+	assert.InDelta(t, 200*time.Millisecond, expected, float64(100*time.Millisecond))
+}
+
+func TestServiceQueueLimits(t *testing.T) {
+	logger := zap.NewNop()
+	serviceConfig := newServiceConfig(serviceconfig.Queue{Depth: 0, MaxConcurrency: 1}, "noisy", "quiet")
+	throttler := NewThrottler(&Params{
+		QueueRetryDuration:      10 * time.Millisecond,
+		TrafficReEnableDuration: time.Second,
+		K8sUtil:                 testutil.NewOps(testutil.Ready),
+		QueueDepth:              10,
+		MaxConcurrency:          10,
+		InitialCapacity:         10,
+		Logger:                  logger,
+		ServiceConfig:           serviceConfig,
+	})
+	host := func(service string) *messages.Host {
+		return &messages.Host{Namespace: "namespace", SourceService: service, TargetService: service + "-pvt"}
+	}
+
+	// The noisy service holds its only slot, so its next request is rejected
+	release := make(chan struct{})
+	running := make(chan struct{})
+	go func() {
+		_ = throttler.Try(context.Background(), host("noisy"), func(int) error {
+			close(running)
+			<-release
+			return nil
+		}, func() {})
+	}()
+	<-running
+	defer close(release)
+	err := throttler.Try(context.Background(), host("noisy"), func(int) error { return nil }, func() {})
+	assert.ErrorIs(t, err, ErrRequestQueueFull)
+
+	// A request which doesn't enter the queue is never admitted, so its body is not read
+	admitted := false
+	err = throttler.TryAdmitted(context.Background(), host("noisy"), func() error {
+		admitted = true
+		return nil
+	}, func(int) error { return nil }, func() {})
+	assert.ErrorIs(t, err, ErrRequestQueueFull)
+	assert.False(t, admitted)
+
+	// The other services still have room in the global queue, and a request which fails its admission leaves it
+	errAdmission := errors.New("admission")
+	err = throttler.TryAdmitted(context.Background(), host("quiet"), func() error { return errAdmission }, func(int) error { return nil }, func() {})
+	assert.ErrorIs(t, err, errAdmission)
+	assert.NoError(t, throttler.Try(context.Background(), host("quiet"), func(int) error { return nil }, func() {}))
+}
+
+// newServiceConfig returns a service config with the queue limits, for the services of ElastiServices in namespace
+func newServiceConfig(queue serviceconfig.Queue, services ...string) *serviceconfig.Store {
+	store := serviceconfig.NewStore(zap.NewNop(), serviceconfig.Config{Queue: queue})
+	elastiServices := make([]*unstructured.Unstructured, 0, len(services))
+	for _, service := range services {
+		elastiServices = append(elastiServices, &unstructured.Unstructured{Object: map[string]any{
+			"metadata": map[string]any{"name": service, "namespace": "namespace"},
+			"spec":     map[string]any{"service": service},
+		}})
+	}
+	store.Apply(elastiServices)
+	return store
+}
+
+func TestPruneServiceBreakers(t *testing.T) {
+	throttler := newColdThrottler(1)
+	serviceConfig := newServiceConfig(serviceconfig.Queue{Depth: 1, MaxConcurrency: 1}, "target")
+	throttler.serviceConfig = serviceConfig
+
+	// Only the services of ElastiServices have a breaker
+	require.NotNil(t, throttler.getServiceBreaker("namespace", "target"))
+	assert.Nil(t, throttler.getServiceBreaker("namespace", "unknown"))
+
+	// The breaker and its limit metrics are dropped once the ElastiService is gone
+	serviceConfig.Apply(nil)
+	throttler.PruneServiceBreakers()
+	assert.Empty(t, throttler.serviceBreakers)
+	assert.Nil(t, throttler.getServiceBreaker("namespace", "target"))
+	assert.False(t, prom.QueueLimitGauge.DeleteLabelValues("target", "namespace", "depth"))
+}
+
+// newColdThrottler returns a throttler for a target which the API server never sees ready, with a retry duration
+// longer than the tests, so requests only move on when they are notified
+func newColdThrottler(initialCapacity int) *Throttler {
+	logger := zap.NewNop()
+	return NewThrottler(&Params{
+		QueueRetryDuration:      time.Minute,
+		TrafficReEnableDuration: time.Second,
+		K8sUtil:                 testutil.NewOps(testutil.NotReady),
+		QueueDepth:              10,
+		MaxConcurrency:          initialCapacity,
+		InitialCapacity:         initialCapacity,
+		Logger:                  logger,
+	})
+}
+
+func TestTryWakesOnReadiness(t *testing.T) {
+	throttler := newColdThrottler(1)
+	host := &messages.Host{Namespace: "namespace", SourceService: "target", TargetService: "target-pvt"}
+
+	// Both requests wait for the target, without holding the only concurrency slot
+	resolved := make(chan int, 2)
+	for range 2 {
+		go func() {
+			_ = throttler.Try(context.Background(), host, func(count int) error {
+				resolved <- count
+				return nil
+			}, func() {})
+		}()
+	}
+	assert.Eventually(t, func() bool { return throttler.GetQueueSize("namespace", "target") == 2 }, time.Second, time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	assert.Empty(t, resolved)
+
+	// They are resolved as soon as the target turns ready, instead of at the next check
+	throttler.SetServiceReadiness("namespace", "target-pvt", true)
+	for range 2 {
+		select {
+		case count := <-resolved:
+			assert.Equal(t, 2, count)
+		case <-time.After(time.Second):
+			t.Fatal("request was not resolved once the target turned ready")
+		}
+	}
+
+	// Once the target is not ready anymore, requests wait again
+	throttler.SetServiceReadiness("namespace", "target-pvt", false)
+	assert.False(t, throttler.IsTargetReady(host))
+}
+
+// waitingTickets returns the number of requests in the queue of the breaker which wait for the target
+func waitingTickets(b *Breaker) int {
+	b.ticketsMu.Lock()
+	defer b.ticketsMu.Unlock()
+	waiting := 0
+	for _, tickets := range b.tickets {
+		for element := tickets.Front(); element != nil; element = element.Next() {
+			if !element.Value.(*queueTicket).active {
+				waiting++
+			}
+		}
+	}
+	return waiting
+}
+
+func TestTryShedsLowestPriority(t *testing.T) {
+	throttler := newColdThrottler(1)
+	throttler.serviceConfig = newServiceConfig(serviceconfig.Queue{Depth: 1, MaxConcurrency: 1}, "target")
+	host := &messages.Host{Namespace: "namespace", SourceService: "target", TargetService: "target-pvt"}
+	try := func(priority Priority) <-chan error {
+		done := make(chan error, 1)
+		go func() {
+			done <- throttler.Try(WithPriority(context.Background(), priority), host, func(int) error { return nil }, func() {})
+		}()
+		return done
+	}
+
+	// Two low priority requests fill the queue of the service, and wait for the target
+	oldest := try(PriorityLow)
+	require.Eventually(t, func() bool { return waitingTickets(throttler.getServiceBreaker("namespace", "target")) == 1 }, time.Second, time.Millisecond)
+	newest := try(PriorityLow)
+	require.Eventually(t, func() bool { return waitingTickets(throttler.getServiceBreaker("namespace", "target")) == 2 }, time.Second, time.Millisecond)
+
+	// A request with the same priority is rejected, but a higher one sheds the newest low priority request
+	assert.ErrorIs(t, <-try(PriorityLow), ErrRequestQueueFull)
+	high := try(PriorityHigh)
+	select {
+	case err := <-newest:
+		assert.ErrorIs(t, err, ErrRequestShed)
+	case <-time.After(time.Second):
+		t.Fatal("low priority request was not shed")
+	}
+
+	// The remaining requests are resolved once the target is ready
+	throttler.SetServiceReadiness("namespace", "target-pvt", true)
+	for _, done := range []<-chan error{oldest, high} {
+		select {
+		case err := <-done:
+			assert.NoError(t, err)
+		case <-time.After(time.Second):
+			t.Fatal("request was not resolved once the target turned ready")
+		}
+	}
+}
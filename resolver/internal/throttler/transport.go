@@ -33,12 +33,39 @@ var backOffTemplate = wait.Backoff{
 	Steps:    15,
 }
 
+// UpstreamTLS is how the resolver connects to a target which serves HTTPS
+type UpstreamTLS struct {
+	// Port of the target which serves HTTPS
+	Port int32
+	// ServerName is verified against the certificate of the target, it is the name the client asked for,
+	// since the certificate is not issued for the private service
+	ServerName string
+	// InsecureSkipVerify skips the verification of the certificate of the target
+	InsecureSkipVerify bool
+}
+
+type upstreamTLSKey struct{}
+
+// WithUpstreamTLS returns a context which makes the requests proxied with it use HTTPS to the target
+func WithUpstreamTLS(ctx context.Context, upstream UpstreamTLS) context.Context {
+	return context.WithValue(ctx, upstreamTLSKey{}, upstream)
+}
+
+// UpstreamTLSFromContext returns the UpstreamTLS of the context, if the requests proxied with it use HTTPS
+func UpstreamTLSFromContext(ctx context.Context) (UpstreamTLS, bool) {
+	upstream, ok := ctx.Value(upstreamTLSKey{}).(UpstreamTLS)
+	return upstream, ok
+}
+
 func NewProxyAutoTransport(maxIdleProxyConns, maxIdleProxyConnsPerHost int) http.RoundTripper {
 	v1 := newHTTPTransport(false /*disable keep-alives*/, true /*disable auto-compression*/, maxIdleProxyConns, maxIdleProxyConnsPerHost)
 	v2 := newH2CTransport(true)
+	https := newHTTPSTransport(true /*disable auto-compression*/, maxIdleProxyConns, maxIdleProxyConnsPerHost)
 	return RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
 		t := v1
-		if r.ProtoMajor == 2 {
+		if r.URL.Scheme == "https" {
+			t = https
+		} else if r.ProtoMajor == 2 {
 			t = v2
 		}
 		return t.RoundTrip(r)
@@ -56,6 +83,40 @@ func newHTTPTransport(disableKeepAlives, disableCompression bool, maxIdle, maxId
 	return transport
 }
 
+// newHTTPSTransport returns a transport for targets which serve HTTPS. It negotiates HTTP/2 with ALPN, so gRPC works too.
+// The certificate is verified with the UpstreamTLS of the request context, as the server name differs per service.
+func newHTTPSTransport(disableCompression bool, maxIdle, maxIdlePerHost int) http.RoundTripper {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConns = maxIdle
+	transport.MaxIdleConnsPerHost = maxIdlePerHost
+	transport.ForceAttemptHTTP2 = true
+	transport.DisableCompression = disableCompression
+	transport.DialTLSContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+		upstream, _ := UpstreamTLSFromContext(ctx)
+		serverName := upstream.ServerName
+		if serverName == "" {
+			serverName, _, _ = net.SplitHostPort(address)
+		}
+		conn, err := DialWithBackOff(ctx, network, address)
+		if err != nil {
+			return nil, err
+		}
+		tlsConn := tls.Client(conn, &tls.Config{
+			ServerName: serverName,
+			// #nosec G402 -- only when the ElastiService asks for it, for targets with self-signed certificates
+			InsecureSkipVerify: upstream.InsecureSkipVerify,
+			NextProtos:         []string{http2.NextProtoTLS, "http/1.1"},
+			MinVersion:         tls.VersionTLS12,
+		})
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			_ = conn.Close()
+			return nil, fmt.Errorf("TLS handshake with %s: %w", address, err)
+		}
+		return tlsConn, nil
+	}
+	return transport
+}
+
 func newH2CTransport(disableCompression bool) http.RoundTripper {
 	return &http2.Transport{
 		AllowHTTP:          true,
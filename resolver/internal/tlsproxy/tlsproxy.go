@@ -0,0 +1,326 @@
+package tlsproxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/truefoundry/elasti/pkg/k8shelper"
+	"github.com/truefoundry/elasti/pkg/logger"
+	"github.com/truefoundry/elasti/resolver/internal/hostmanager"
+	"github.com/truefoundry/elasti/resolver/internal/tcpproxy"
+	"github.com/truefoundry/elasti/resolver/internal/throttler"
+	"go.uber.org/zap"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+const (
+	// ModePassthrough splices the TLS connection to the private service, without decrypting it
+	ModePassthrough = "passthrough"
+	// ModeTerminate decrypts the TLS connection, and proxies its requests to the private service over HTTPS
+	ModeTerminate = "terminate"
+
+	// clientHelloTimeout is how long a client has to send its ClientHello
+	clientHelloTimeout = 10 * time.Second
+	// certificateCacheDuration is how long a certificate is used before it is read again from its Secret,
+	// so renewed certificates are picked up
+	certificateCacheDuration = time.Minute
+)
+
+var (
+	// ErrNoServerName is returned for TLS connections without SNI, as the service can't be found without it
+	ErrNoServerName = errors.New("client did not send a server name")
+	// ErrUnknownServerName is returned when no ElastiService has a TLS port for the server name
+	ErrUnknownServerName = errors.New("no TLS port for server name")
+
+	errClientHelloRead = errors.New("client hello read")
+)
+
+type (
+	// Proxy handles the TLS ports of ElastiServices. All of them share the TLS passthrough and termination ports
+	// of the resolver, and the service of a connection is found from its SNI, like redis.cache.svc.cluster.local.
+	Proxy struct {
+		logger      *zap.Logger
+		tcpProxy    *tcpproxy.Proxy
+		k8sUtil     *k8shelper.Ops
+		hostManager *hostmanager.HostManager
+
+		mu sync.RWMutex
+		// ports are keyed by mode, namespace and service
+		ports        map[string]Port
+		certificates sync.Map
+	}
+
+	// Params is the configuration for the proxy
+	Params struct {
+		Logger *zap.Logger
+		// TCPProxy holds the passthrough connections until the target is ready, and splices them
+		TCPProxy *tcpproxy.Proxy
+		K8sUtil  *k8shelper.Ops
+		// HostManager maps the server names which are not Kubernetes DNS names, from the host rules and the ClusterIPs
+		// of the managed services. It is optional.
+		HostManager *hostmanager.HostManager
+	}
+
+	// Port is a port of a service which serves TLS
+	Port struct {
+		Namespace          string
+		Service            string
+		Port               int32
+		Mode               string
+		SecretName         string
+		InsecureSkipVerify bool
+	}
+)
+
+// NewProxy returns a new Proxy
+func NewProxy(params *Params) *Proxy {
+	return &Proxy{
+		logger:      params.Logger.With(zap.String("component", "tlsProxy")),
+		tcpProxy:    params.TCPProxy,
+		k8sUtil:     params.K8sUtil,
+		hostManager: params.HostManager,
+		ports:       map[string]Port{},
+	}
+}
+
+func portKey(mode, namespace, service string) string {
+	return mode + "/" + namespace + "/" + service
+}
+
+// PortsFromElastiServices returns the TLS ports of the ElastiServices
+func PortsFromElastiServices(elastiServices []*unstructured.Unstructured) []Port {
+	var ports []Port
+	for _, es := range elastiServices {
+		service, _, _ := unstructured.NestedString(es.Object, "spec", "service")
+		tlsPorts, _, _ := unstructured.NestedSlice(es.Object, "spec", "tlsPorts")
+		for _, tlsPort := range tlsPorts {
+			fields, ok := tlsPort.(map[string]any)
+			if !ok {
+				continue
+			}
+			port, _, _ := unstructured.NestedInt64(fields, "port")
+			if service == "" || port == 0 {
+				continue
+			}
+			mode, _, _ := unstructured.NestedString(fields, "mode")
+			if mode == "" {
+				mode = ModePassthrough
+			}
+			secretName, _, _ := unstructured.NestedString(fields, "secretName")
+			insecureSkipVerify, _, _ := unstructured.NestedBool(fields, "insecureSkipVerify")
+			ports = append(ports, Port{
+				Namespace:          es.GetNamespace(),
+				Service:            service,
+				Port:               int32(port),
+				Mode:               mode,
+				SecretName:         secretName,
+				InsecureSkipVerify: insecureSkipVerify,
+			})
+		}
+	}
+	return ports
+}
+
+// Apply replaces the TLS ports the proxy knows about
+func (p *Proxy) Apply(ports []Port) {
+	byKey := make(map[string]Port, len(ports))
+	for _, port := range ports {
+		byKey[portKey(port.Mode, port.Namespace, port.Service)] = port
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.ports = byKey
+}
+
+// portForServerName returns the TLS port of the service the server name points to. Like the hosts of HTTP requests,
+// the server name is mapped by the host rules, then by the ClusterIP of a managed service, and then as a
+// Kubernetes DNS name, like redis.cache.svc.cluster.local.
+func (p *Proxy) portForServerName(serverName, mode string) (Port, error) {
+	if serverName == "" {
+		return Port{}, ErrNoServerName
+	}
+	name := strings.ToLower(strings.TrimSuffix(serverName, "."))
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.hostManager != nil {
+		if namespace, service, ok := p.hostManager.ServiceForServerName(name); ok {
+			if port, ok := p.ports[portKey(mode, namespace, service)]; ok {
+				return port, nil
+			}
+		}
+	}
+	labels := strings.Split(name, ".")
+	if len(labels) >= 2 && (len(labels) == 2 || labels[2] == "svc") {
+		if port, ok := p.ports[portKey(mode, labels[1], labels[0])]; ok {
+			return port, nil
+		}
+	}
+	return Port{}, fmt.Errorf("%w: %s", ErrUnknownServerName, logger.MaskMiddle(serverName, 4, 4))
+}
+
+// ServePassthrough accepts TLS connections, reads the SNI of their ClientHello to find the service,
+// and hands them to the TCP proxy, which splices them to the private service once it is ready.
+// It returns once the listener is closed.
+func (p *Proxy) ServePassthrough(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			p.logger.Error("Failed to accept TLS connection", zap.Error(err))
+			continue
+		}
+		go p.handlePassthrough(conn)
+	}
+}
+
+func (p *Proxy) handlePassthrough(conn net.Conn) {
+	_ = conn.SetReadDeadline(time.Now().Add(clientHelloTimeout))
+	serverName, peeked, err := peekServerName(conn)
+	if err != nil {
+		p.logger.Error("Failed to read TLS ClientHello", zap.Error(err))
+		_ = conn.Close()
+		return
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+
+	port, err := p.portForServerName(serverName, ModePassthrough)
+	if err != nil {
+		p.logger.Error("Failed to find the service of TLS connection", zap.Error(err))
+		_ = conn.Close()
+		return
+	}
+	// The ClientHello was read from the connection, so it is replayed to the target before the rest of the connection
+	p.tcpProxy.HandleConn(&prefixConn{Conn: conn, reader: io.MultiReader(bytes.NewReader(peeked), conn)}, tcpproxy.Port{
+		Namespace: port.Namespace,
+		Service:   port.Service,
+		Port:      port.Port,
+	})
+}
+
+// TLSConfig returns the TLS config of the termination server, which picks the certificate of the service from the SNI
+func (p *Proxy) TLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			port, err := p.portForServerName(hello.ServerName, ModeTerminate)
+			if err != nil {
+				return nil, err
+			}
+			return p.getCertificate(port.Namespace, port.SecretName)
+		},
+	}
+}
+
+// getCertificate returns the certificate of the Secret, which is cached for a while
+func (p *Proxy) getCertificate(namespace, secretName string) (*tls.Certificate, error) {
+	key := namespace + "/" + secretName
+	if cert, ok := p.certificates.Load(key); ok {
+		return cert.(*tls.Certificate), nil
+	}
+	cert, err := p.k8sUtil.GetTLSCertificate(namespace, secretName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get certificate: %w", err)
+	}
+	p.certificates.Store(key, cert)
+	// release the memory after sometime
+	time.AfterFunc(certificateCacheDuration, func() {
+		p.certificates.Delete(key)
+	})
+	return cert, nil
+}
+
+// WithUpstreamTLS wraps the handler of the termination server, so the requests are proxied to the private service over HTTPS,
+// on the port of the service the client connected to
+func (p *Proxy) WithUpstreamTLS(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.TLS == nil {
+			next.ServeHTTP(w, req)
+			return
+		}
+		port, err := p.portForServerName(req.TLS.ServerName, ModeTerminate)
+		if err != nil {
+			p.logger.Error("Failed to find the service of TLS request", zap.Error(err))
+			http.Error(w, "Unknown server name", http.StatusMisdirectedRequest)
+			return
+		}
+		next.ServeHTTP(w, req.WithContext(throttler.WithUpstreamTLS(req.Context(), throttler.UpstreamTLS{
+			Port:               port.Port,
+			ServerName:         req.TLS.ServerName,
+			InsecureSkipVerify: port.InsecureSkipVerify,
+		})))
+	})
+}
+
+// peekServerName reads the ClientHello of the connection, and returns its server name with the bytes read,
+// so they can be replayed to the target
+func peekServerName(conn net.Conn) (string, []byte, error) {
+	var peeked bytes.Buffer
+	var serverName string
+	// The handshake is stopped once the ClientHello is parsed, so nothing is written to the connection
+	err := tls.Server(readOnlyConn{reader: io.TeeReader(conn, &peeked)}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName = hello.ServerName
+			return nil, errClientHelloRead
+		},
+	}).Handshake()
+	if !errors.Is(err, errClientHelloRead) {
+		return "", nil, fmt.Errorf("failed to parse ClientHello: %w", err)
+	}
+	return serverName, peeked.Bytes(), nil
+}
+
+// readOnlyConn is a connection which can only be read, for parsing the ClientHello without answering it
+type readOnlyConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (c readOnlyConn) Read(b []byte) (int, error) {
+	n, err := c.reader.Read(b)
+	if err != nil {
+		return n, fmt.Errorf("Read: %w", err)
+	}
+	return n, nil
+}
+func (readOnlyConn) Write([]byte) (int, error)        { return 0, io.ErrClosedPipe }
+func (readOnlyConn) Close() error                     { return nil }
+func (readOnlyConn) LocalAddr() net.Addr              { return nil }
+func (readOnlyConn) RemoteAddr() net.Addr             { return nil }
+func (readOnlyConn) SetDeadline(time.Time) error      { return nil }
+func (readOnlyConn) SetReadDeadline(time.Time) error  { return nil }
+func (readOnlyConn) SetWriteDeadline(time.Time) error { return nil }
+
+// prefixConn reads from reader before the connection, to replay the bytes which were read to find the service
+type prefixConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (c *prefixConn) Read(b []byte) (int, error) {
+	n, err := c.reader.Read(b)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return n, fmt.Errorf("Read: %w", err)
+	}
+	return n, err //nolint:wrapcheck // io.EOF must not be wrapped, io.Copy compares it
+}
+
+// CloseWrite closes the write half of the connection, so the splice can forward half-closes
+func (c *prefixConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		if err := cw.CloseWrite(); err != nil {
+			return fmt.Errorf("CloseWrite: %w", err)
+		}
+		return nil
+	}
+	return c.Close()
+}
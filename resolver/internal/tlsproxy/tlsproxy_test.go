@@ -0,0 +1,265 @@
+package tlsproxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/truefoundry/elasti/resolver/internal/hostmanager"
+	"github.com/truefoundry/elasti/resolver/internal/tcpproxy"
+	"github.com/truefoundry/elasti/resolver/internal/testutil"
+	"github.com/truefoundry/elasti/resolver/internal/throttler"
+	"go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+const serverName = "target.namespace.svc.cluster.local"
+
+// newCertificate returns a self-signed certificate for the DNS name, with its PEM encoding
+func newCertificate(t *testing.T, dnsName string) (tls.Certificate, []byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: dnsName},
+		DNSNames:     []string{dnsName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	require.NoError(t, err)
+	return cert, certPEM, keyPEM
+}
+
+// newTLSSecret returns the TLS Secret of the service
+func newTLSSecret(certPEM, keyPEM []byte) *corev1.Secret {
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "target-tls", Namespace: "namespace"},
+		Type:       corev1.SecretTypeTLS,
+		Data:       map[string][]byte{corev1.TLSCertKey: certPEM, corev1.TLSPrivateKeyKey: keyPEM},
+	}
+}
+
+// newTLSEchoTarget starts a TLS server which echoes everything it receives
+func newTLSEchoTarget(t *testing.T, cert tls.Certificate) string {
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = listener.Close()
+	})
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func newTestProxy(t *testing.T, targetAddress string, certPEM, keyPEM []byte) (*Proxy, *testutil.FakeOperator) {
+	logger := zap.NewNop()
+	k8sUtil := testutil.NewOps(testutil.Ready, newTLSSecret(certPEM, keyPEM))
+	operator := &testutil.FakeOperator{}
+	proxy := NewProxy(&Params{
+		Logger:  logger,
+		K8sUtil: k8sUtil,
+		TCPProxy: tcpproxy.NewProxy(&tcpproxy.Params{
+			Logger:      logger,
+			ReqTimeout:  5 * time.Second,
+			OperatorRPC: operator,
+			Throttler: throttler.NewThrottler(&throttler.Params{
+				QueueRetryDuration:      10 * time.Millisecond,
+				TrafficReEnableDuration: time.Second,
+				K8sUtil:                 k8sUtil,
+				QueueDepth:              10,
+				MaxConcurrency:          10,
+				InitialCapacity:         10,
+				Logger:                  logger,
+			}),
+			TargetAddress: func(tcpproxy.Port) string { return targetAddress },
+		}),
+	})
+	proxy.Apply([]Port{
+		{Namespace: "namespace", Service: "target", Port: 443, Mode: ModePassthrough},
+		{Namespace: "namespace", Service: "target", Port: 8443, Mode: ModeTerminate, SecretName: "target-tls", InsecureSkipVerify: true},
+	})
+	return proxy, operator
+}
+
+func TestPassthrough(t *testing.T) {
+	cert, certPEM, keyPEM := newCertificate(t, serverName)
+	proxy, operator := newTestProxy(t, newTLSEchoTarget(t, cert), certPEM, keyPEM)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = listener.Close()
+	})
+	go func() {
+		_ = proxy.ServePassthrough(listener)
+	}()
+
+	// The client verifies the certificate of the target, so the connection is not decrypted on the way
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(certPEM)
+	conn, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{ServerName: serverName, RootCAs: roots, MinVersion: tls.VersionTLS12})
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+
+	_, err = conn.Write([]byte("hello"))
+	require.NoError(t, err)
+	reply := make([]byte, len("hello"))
+	_, err = io.ReadFull(conn, reply)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(reply))
+	assert.Positive(t, operator.Requests.Load())
+}
+
+func TestPassthroughUnknownServerName(t *testing.T) {
+	cert, certPEM, keyPEM := newCertificate(t, serverName)
+	proxy, _ := newTestProxy(t, newTLSEchoTarget(t, cert), certPEM, keyPEM)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = listener.Close()
+	})
+	go func() {
+		_ = proxy.ServePassthrough(listener)
+	}()
+
+	// The connection is closed, as no ElastiService has a TLS port for the server name
+	_, err = tls.Dial("tcp", listener.Addr().String(), &tls.Config{ServerName: "other.namespace.svc", InsecureSkipVerify: true}) // #nosec G402
+	assert.Error(t, err)
+}
+
+func TestTermination(t *testing.T) {
+	_, certPEM, keyPEM := newCertificate(t, serverName)
+	proxy, _ := newTestProxy(t, "", certPEM, keyPEM)
+	server := httptest.NewUnstartedServer(proxy.WithUpstreamTLS(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		upstream, ok := throttler.UpstreamTLSFromContext(req.Context())
+		if !ok {
+			http.Error(w, "no upstream TLS", http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintf(w, "%d %s %t", upstream.Port, upstream.ServerName, upstream.InsecureSkipVerify)
+	})))
+	server.TLS = proxy.TLSConfig()
+	server.StartTLS()
+	t.Cleanup(server.Close)
+
+	// The certificate of the Secret is served for the server name of the service
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(certPEM)
+	client := &http.Client{
+		Timeout:   5 * time.Second,
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{ServerName: serverName, RootCAs: roots, MinVersion: tls.VersionTLS12}},
+	}
+	res, err := client.Get(server.URL)
+	require.NoError(t, err)
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "8443 "+serverName+" true", string(body))
+}
+
+func TestPortForServerName(t *testing.T) {
+	proxy := NewProxy(&Params{Logger: zap.NewNop()})
+	proxy.Apply([]Port{{Namespace: "namespace", Service: "target", Port: 443, Mode: ModePassthrough}})
+
+	tests := []struct {
+		serverName  string
+		mode        string
+		expectedErr error
+	}{
+		{serverName: "target.namespace.svc.cluster.local", mode: ModePassthrough},
+		{serverName: "target.namespace.svc.cluster.local.", mode: ModePassthrough},
+		{serverName: "Target.Namespace.svc", mode: ModePassthrough},
+		{serverName: "target.namespace", mode: ModePassthrough},
+		{serverName: "target.namespace.svc", mode: ModeTerminate, expectedErr: ErrUnknownServerName},
+		{serverName: "target.namespace.example.com", mode: ModePassthrough, expectedErr: ErrUnknownServerName},
+		{serverName: "target", mode: ModePassthrough, expectedErr: ErrUnknownServerName},
+		{serverName: "", mode: ModePassthrough, expectedErr: ErrNoServerName},
+	}
+	for _, tt := range tests {
+		t.Run(tt.serverName, func(t *testing.T) {
+			port, err := proxy.portForServerName(tt.serverName, tt.mode)
+			if tt.expectedErr != nil {
+				assert.ErrorIs(t, err, tt.expectedErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, int32(443), port.Port)
+		})
+	}
+}
+
+func TestPortForServerNameFallback(t *testing.T) {
+	hostManager := hostmanager.NewHostManager(&hostmanager.Params{Logger: zap.NewNop(), HeaderForHost: "Host"})
+	hostManager.SetServices([]hostmanager.ManagedService{{Namespace: "namespace", Service: "target", ElastiService: "target"}})
+	hostManager.SetServiceClusterIPs("namespace", "target", []string{"10.0.0.1"})
+	require.NoError(t, hostManager.SetRules(hostmanager.RuleSourceConfigMap, []hostmanager.Rule{
+		{Host: "api.example.com", Namespace: "namespace", Service: "target"},
+		{Host: "other.example.com", Namespace: "namespace", Service: "other"},
+	}))
+	proxy := NewProxy(&Params{Logger: zap.NewNop(), HostManager: hostManager})
+	proxy.Apply([]Port{{Namespace: "namespace", Service: "target", Port: 443, Mode: ModePassthrough}})
+
+	for _, serverName := range []string{"api.example.com", "API.example.com.", "10.0.0.1", "target.namespace.svc"} {
+		port, err := proxy.portForServerName(serverName, ModePassthrough)
+		require.NoError(t, err, serverName)
+		assert.Equal(t, int32(443), port.Port)
+	}
+	// The service of the rule has no TLS port
+	_, err := proxy.portForServerName("other.example.com", ModePassthrough)
+	assert.ErrorIs(t, err, ErrUnknownServerName)
+	_, err = proxy.portForServerName("10.0.0.2", ModePassthrough)
+	assert.ErrorIs(t, err, ErrUnknownServerName)
+}
+
+func TestPortsFromElastiServices(t *testing.T) {
+	es := &unstructured.Unstructured{Object: map[string]any{
+		"metadata": map[string]any{"name": "web", "namespace": "default"},
+		"spec": map[string]any{
+			"service": "web",
+			"tlsPorts": []any{
+				map[string]any{"port": int64(443)},
+				map[string]any{"port": int64(8443), "mode": "terminate", "secretName": "web-tls", "insecureSkipVerify": true},
+			},
+		},
+	}}
+
+	assert.Equal(t, []Port{
+		{Namespace: "default", Service: "web", Port: 443, Mode: ModePassthrough},
+		{Namespace: "default", Service: "web", Port: 8443, Mode: ModeTerminate, SecretName: "web-tls", InsecureSkipVerify: true},
+	}, PortsFromElastiServices([]*unstructured.Unstructured{es}))
+}